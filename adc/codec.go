@@ -21,6 +21,11 @@ var (
 	unescaper = strings.NewReplacer(`\s`, " ", `\n`, "\n", `\\`, `\`)
 )
 
+// Escape escapes a string to be used as an ADC parameter value.
+func Escape(s string) string {
+	return escaper.Replace(s)
+}
+
 func escape(s string) []byte {
 	return []byte(escaper.Replace(s))
 }
@@ -6,6 +6,7 @@ import (
 
 	"github.com/direct-connect/go-dcpp/adc"
 	"github.com/direct-connect/go-dcpp/adc/types"
+	"github.com/direct-connect/go-dcpp/tiger"
 )
 
 var casesDecode = []struct {
@@ -66,6 +67,21 @@ var casesDecode = []struct {
 			Features: adc.ExtFeatures{{'N', 'A', 'T', '0'}, {'A', 'D', 'C', '0'}, {'S', 'E', 'G', 'A'}},
 		},
 	},
+	{
+		"sup add",
+		`ADBASE ADTIGR`,
+		&adc.Supported{Features: adc.ModFeatures{adc.FeaBASE: true, adc.FeaTIGR: true}},
+	},
+	{
+		"sup remove",
+		`RMBZIP`,
+		&adc.Supported{Features: adc.ModFeatures{adc.FeaBZIP: false}},
+	},
+	{
+		"sup mixed",
+		`ADTS00 RMUCMD ADPING`,
+		&adc.Supported{Features: adc.ModFeatures{adc.FeaTS: true, adc.FeaUCMD: false, adc.FeaPING: true}},
+	},
 	{
 		"search res",
 		`TOtok FNfilepath SI1234567 SL3`,
@@ -101,6 +117,65 @@ var casesDecode = []struct {
 		`some\stext PMAAAB`,
 		&adc.ChatMessage{Text: "some text", PM: sidp("AAAB")},
 	},
+	{
+		"quit",
+		`AAAB`,
+		&adc.Disconnect{ID: types.SIDFromString("AAAB")},
+	},
+	{
+		"kick",
+		`AAAB IDAAAC MSflood\sin\schat`,
+		&adc.Disconnect{ID: types.SIDFromString("AAAB"), By: sidp("AAAC"), Message: "flood in chat"},
+	},
+	{
+		"redirect",
+		`AAAB MShub\srestart TL30 RDadcs://example.org:411`,
+		&adc.Disconnect{ID: types.SIDFromString("AAAB"), Message: "hub restart", TimeLeft: 30, Redirect: "adcs://example.org:411"},
+	},
+	{
+		"user command",
+		`Moderation/Kick\suser TTHMSG\s!kick\s%[userNI]\n CT2 RM1`,
+		&adc.UserCommand{
+			Path: "Moderation/Kick user", Command: "HMSG !kick %[userNI]\n",
+			Category: adc.CategoryUser, Remove: true,
+		},
+	},
+	{
+		"status",
+		`222 nick\staken`,
+		&adc.Status{Sev: adc.Fatal, Code: adc.CodeNickTaken, Msg: "nick taken"},
+	},
+	{
+		"status params",
+		`125 access\sdenied FCBSCH`,
+		&adc.Status{
+			Sev: adc.Recoverable, Code: adc.CodeAccessDenied, Msg: "access denied",
+			Params: []adc.StatusParam{{Name: "FC", Value: "BSCH"}},
+		},
+	},
+	{
+		"status trailing space",
+		`000 msg `,
+		&adc.Status{Sev: adc.Success, Code: adc.CodeGeneric, Msg: "msg"},
+	},
+	{
+		"status double space",
+		`125 access\sdenied  FCBSCH`,
+		&adc.Status{
+			Sev: adc.Recoverable, Code: adc.CodeAccessDenied, Msg: "access denied",
+			Params: []adc.StatusParam{{Name: "FC", Value: "BSCH"}},
+		},
+	},
+	{
+		"get password",
+		`MFRGGZDF`,
+		&adc.GetPassword{Salt: []byte("abcde")},
+	},
+	{
+		"password",
+		`LWPNACQDBZRYXW3VHJVCJ64QBZNGHOHHHZWCLNQ`,
+		&adc.Password{Hash: tiger.MustParseBase32(`LWPNACQDBZRYXW3VHJVCJ64QBZNGHOHHHZWCLNQ`)},
+	},
 }
 
 func sidp(s string) *types.SID {
@@ -173,6 +248,22 @@ var casesEncode = []struct {
 		adc.RevConnectRequest{Proto: `ADC/1.0`, Token: `12345678`},
 		`ADC/1.0 12345678`,
 	},
+	{
+		adc.Disconnect{ID: types.SIDFromString("AAAB"), Message: "flood in chat"},
+		`AAAB MSflood\sin\schat`,
+	},
+	{
+		adc.UserCommand{Path: "Moderation/Kick", Command: "HMSG !kick %[userNI]\n", Category: adc.CategoryUser},
+		`Moderation/Kick TTHMSG\s!kick\s%[userNI]\n CT2`,
+	},
+	{
+		adc.NewStatus(adc.Fatal, adc.CodeTempBanned, "banned", adc.StatusParam{Name: "TL", Value: "600"}),
+		`232 banned TL600`,
+	},
+	{
+		adc.Supported{Features: adc.ModFeatures{adc.FeaTS: true, adc.FeaUCMD: false, adc.FeaPING: true, adc.FeaBZIP: false}},
+		`RMBZIP RMUCMD ADPING ADTS00`,
+	},
 }
 
 func TestEncode(t *testing.T) {
@@ -185,3 +276,43 @@ func TestEncode(t *testing.T) {
 		}
 	}
 }
+
+func TestModFeaturesSetFrom(t *testing.T) {
+	cur := adc.ModFeatures{adc.FeaBASE: true, adc.FeaTIGR: true, adc.FeaUCMD: true}
+	for _, c := range []struct {
+		name  string
+		delta adc.ModFeatures
+		exp   adc.ModFeatures
+	}{
+		{
+			"add",
+			adc.ModFeatures{adc.FeaTS: true, adc.FeaBASE: true},
+			adc.ModFeatures{adc.FeaBASE: true, adc.FeaTIGR: true, adc.FeaUCMD: true, adc.FeaTS: true},
+		},
+		{
+			"remove",
+			adc.ModFeatures{adc.FeaUCMD: false, adc.FeaBZIP: false},
+			adc.ModFeatures{adc.FeaBASE: true, adc.FeaTIGR: true},
+		},
+		{
+			"mixed",
+			adc.ModFeatures{adc.FeaUCMD: false, adc.FeaPING: true},
+			adc.ModFeatures{adc.FeaBASE: true, adc.FeaTIGR: true, adc.FeaPING: true},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got := cur.SetFrom(c.delta)
+			if !reflect.DeepEqual(got, c.exp) {
+				t.Fatalf("unexpected features: %v", got.List())
+			}
+			for f, add := range c.delta {
+				if got.IsSet(f) != add {
+					t.Fatalf("unexpected state of %s", f)
+				}
+			}
+		})
+	}
+	if len(cur) != 3 {
+		t.Fatal("original set was modified")
+	}
+}
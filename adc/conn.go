@@ -3,6 +3,7 @@ package adc
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +27,11 @@ type Route interface {
 
 // Dial connects to a specified address.
 func Dial(addr string) (*Conn, error) {
+	return DialContext(context.Background(), addr)
+}
+
+// DialContext is like Dial, but aborts the connection and the TLS handshake when the context is done.
+func DialContext(ctx context.Context, addr string) (*Conn, error) {
 	secure := false
 	if i := strings.Index(addr, "://"); i >= 0 {
 		proto := addr[:i+3]
@@ -38,7 +45,8 @@ func Dial(addr string) (*Conn, error) {
 			return nil, fmt.Errorf("unsupported protocol: %q", proto)
 		}
 	}
-	conn, err := net.Dial("tcp", addr)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -46,7 +54,8 @@ func Dial(addr string) (*Conn, error) {
 		sconn := tls.Client(conn, &tls.Config{
 			InsecureSkipVerify: true,
 		})
-		if err = sconn.Handshake(); err != nil {
+		if err = sconn.HandshakeContext(ctx); err != nil {
+			conn.Close()
 			return nil, fmt.Errorf("TLS handshake failed: %v", err)
 		}
 		conn = sconn
@@ -57,7 +66,8 @@ func Dial(addr string) (*Conn, error) {
 // NewConn runs an ADC protocol over a specified connection.
 func NewConn(conn net.Conn) (*Conn, error) {
 	c := &Conn{
-		conn: conn,
+		conn:   conn,
+		closed: make(chan struct{}),
 	}
 	c.write.w = bufio.NewWriter(conn)
 	c.read.r = bufio.NewReader(conn)
@@ -66,7 +76,15 @@ func NewConn(conn net.Conn) (*Conn, error) {
 
 // Conn is an ADC protocol connection.
 type Conn struct {
-	closed chan struct{}
+	// accessed atomically; must be first for 64 bit alignment
+	stats struct {
+		in, out         uint64
+		lastIn, lastOut int64 // unix nanoseconds
+	}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	keepAlive sync.Once
 
 	// bin should be acquired as RLock on commands read/write
 	// and as Lock when switching to binary mode.
@@ -92,56 +110,98 @@ func (c *Conn) RemoteAddr() net.Addr {
 
 // Close closes the connection.
 func (c *Conn) Close() error {
-	if c.closed != nil {
-		select {
-		case <-c.closed:
-		default:
-			close(c.closed)
-		}
-	}
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
 	return c.conn.Close()
 }
 
 // KeepAlive starts sending keep-alive messages on the connection.
 func (c *Conn) KeepAlive(interval time.Duration) {
-	if c.closed != nil {
-		// already enabled
-		return
-	}
-	c.closed = make(chan struct{})
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-c.closed:
-				return
-			case <-ticker.C:
-			}
-			// empty packet serves as keep-alive for ADC
-			err := c.writeRawPacket(nil)
-			if err == nil {
-				err = c.Flush()
-			}
-			if err != nil {
-				_ = c.Close()
-				return
-			}
+	c.keepAlive.Do(func() {
+		go c.keepAliveLoop(interval)
+	})
+}
+
+func (c *Conn) keepAliveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		// empty packet serves as keep-alive for ADC
+		err := c.writeRawPacket(nil)
+		if err == nil {
+			err = c.Flush()
+		}
+		if err != nil {
+			_ = c.Close()
+			return
 		}
-	}()
+	}
+}
+
+// Ping sends a keep-alive message and flushes the buffer. It fails if the write
+// is not completed within a given timeout, which usually means that the connection is dead.
+func (c *Conn) Ping(timeout time.Duration) error {
+	// make sure connection is not in binary mode
+	c.bin.RLock()
+	defer c.bin.RUnlock()
+
+	c.write.Lock()
+	defer c.write.Unlock()
+
+	if err := c.write.err; err != nil {
+		return err
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer c.conn.SetWriteDeadline(time.Time{})
+
+	// empty packet serves as keep-alive for ADC
+	err := c.write.w.WriteByte(0x0a)
+	if err == nil {
+		err = c.write.w.Flush()
+	}
+	if err != nil {
+		c.write.err = err
+	}
+	return err
 }
 
 // ReadPacket reads and decodes a single ADC command.
 func (c *Conn) ReadPacket(deadline time.Time) (Packet, error) {
-	p, err := c.readPacket(deadline)
+	p, err := c.readPacket(deadline, nil)
 	if err != nil {
 		return nil, err
 	}
 	return DecodePacket(p)
 }
 
+// ReadPacketCtx is the same as ReadPacket, but aborts the read when the context is cancelled
+// or its deadline is exceeded.
+//
+// If the read is aborted, ctx.Err() is returned and the connection cannot be read anymore.
+func (c *Conn) ReadPacketCtx(ctx context.Context) (Packet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// the deadline is not set on the connection directly, so the error is always the one from the context
+	p, err := c.readPacket(time.Time{}, ctx.Done())
+	if err != nil {
+		if err2 := ctx.Err(); err2 != nil {
+			return nil, err2
+		}
+		return nil, err
+	}
+	return DecodePacket(p)
+}
+
 // readPacket reads a single ADC packet (separated by 0x0a byte) without decoding it.
-func (c *Conn) readPacket(deadline time.Time) ([]byte, error) {
+// If the cancel channel is closed, the read is interrupted.
+func (c *Conn) readPacket(deadline time.Time, cancel <-chan struct{}) ([]byte, error) {
 	// make sure connection is not in binary mode
 	c.bin.RLock()
 	defer c.bin.RUnlock()
@@ -153,10 +213,28 @@ func (c *Conn) readPacket(deadline time.Time) ([]byte, error) {
 		return nil, err
 	}
 
-	if !deadline.IsZero() {
+	if !deadline.IsZero() || cancel != nil {
 		c.conn.SetReadDeadline(deadline)
 		defer c.conn.SetReadDeadline(time.Time{})
 	}
+	if cancel != nil {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			select {
+			case <-cancel:
+				// unblock the read
+				c.conn.SetReadDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+		// must run before resetting the deadline
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
 	for {
 		s, err := c.read.r.ReadBytes(byte(0x0a))
 		if err == io.EOF {
@@ -176,6 +254,8 @@ func (c *Conn) readPacket(deadline time.Time) ([]byte, error) {
 			if Debug {
 				log.Println("<-", string(s))
 			}
+			atomic.AddUint64(&c.stats.in, 1)
+			atomic.StoreInt64(&c.stats.lastIn, time.Now().UnixNano())
 			return s, nil
 		}
 		// clients may send message containing only 0x0a byte
@@ -334,8 +414,75 @@ func (c *Conn) writeRawPacket(s []byte) error {
 	err = c.write.w.WriteByte(0x0a)
 	if err != nil {
 		c.write.err = err
+		return err
 	}
-	return err
+	c.countWrite()
+	return nil
+}
+
+func (c *Conn) countWrite() {
+	atomic.AddUint64(&c.stats.out, 1)
+	atomic.StoreInt64(&c.stats.lastOut, time.Now().UnixNano())
+}
+
+// ConnStats are packet counters of the connection. Keep-alive messages are not counted.
+type ConnStats struct {
+	PacketsIn  uint64
+	PacketsOut uint64
+	// LastIn and LastOut are times of the last packet read and written. Zero if there was none.
+	LastIn  time.Time
+	LastOut time.Time
+}
+
+// Stats returns packet counters of the connection. Packets are counted as written once they are buffered.
+func (c *Conn) Stats() ConnStats {
+	st := ConnStats{
+		PacketsIn:  atomic.LoadUint64(&c.stats.in),
+		PacketsOut: atomic.LoadUint64(&c.stats.out),
+	}
+	if t := atomic.LoadInt64(&c.stats.lastIn); t != 0 {
+		st.LastIn = time.Unix(0, t)
+	}
+	if t := atomic.LoadInt64(&c.stats.lastOut); t != 0 {
+		st.LastOut = time.Unix(0, t)
+	}
+	return st
+}
+
+// WriteBinary writes a packet followed by raw binary data, for example SND and the file content.
+// No other packets can be written in between.
+func (c *Conn) WriteBinary(p Packet, data []byte) error {
+	s, err := p.MarshalPacket()
+	if err != nil {
+		return err
+	}
+	// make sure connection is not in binary mode
+	c.bin.RLock()
+	defer c.bin.RUnlock()
+
+	c.write.Lock()
+	defer c.write.Unlock()
+
+	if err := c.write.err; err != nil {
+		return err
+	}
+	if Debug {
+		log.Println("->", string(s))
+		log.Printf("-> [binary data: %d bytes]", len(data))
+	}
+	_, err = c.write.w.Write(s)
+	if err == nil {
+		err = c.write.w.WriteByte(0x0a)
+	}
+	if err == nil {
+		_, err = c.write.w.Write(data)
+	}
+	if err != nil {
+		c.write.err = err
+		return err
+	}
+	c.countWrite()
+	return nil
 }
 
 // Flush the underlying buffer. Should be called after each WritePacket batch.
@@ -0,0 +1,53 @@
+package adc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadPacketCtx(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	conn, err := NewConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		_, _ = c1.Write([]byte("HSUP ADBASE\n"))
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err = conn.ReadPacketCtx(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = conn.ReadPacketCtx(ctx)
+	if err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dt := time.Since(start); dt > time.Second {
+		t.Fatalf("read was not cancelled in time: %v", dt)
+	}
+}
+
+func TestReadPacketCtxDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	conn, err := NewConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = conn.ReadPacketCtx(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
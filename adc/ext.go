@@ -19,8 +19,9 @@ var (
 	extZLIG = Feature{'Z', 'L', 'I', 'G'} // Compressed communication (Get)
 	extPING = Feature{'P', 'I', 'N', 'G'} // Pinger extension (additional info about hub)
 	FeaSEGA = Feature{'S', 'E', 'G', 'A'} // Grouping of file extensions in search
-	extUCMD = Feature{'U', 'C', 'M', 'D'} // User commands
+	FeaUCMD = Feature{'U', 'C', 'M', 'D'} // User commands
 	FeaADCS = Feature{'A', 'D', 'C', 'S'} // ADC over TLS for C-H
+	FeaHBRI = Feature{'H', 'B', 'R', 'I'} // Validation of the address of the second IP family
 
 	FeaADC0 = Feature{'A', 'D', 'C', '0'} // ADC over TLS for C-C
 	extNAT0 = Feature{'N', 'A', 'T', '0'} // NAT traversal for C-C
@@ -0,0 +1,16 @@
+package adc
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+)
+
+// KeyprintPrefix is the prefix of SHA256 keyprints, the only kind of keyprints defined by ADC.
+const KeyprintPrefix = "SHA256/"
+
+// Keyprint returns an ADC keyprint of the DER-encoded TLS certificate, as used in the "kp" parameter
+// of ADCS addresses and in the KP field of the user info.
+func Keyprint(der []byte) string {
+	h := sha256.Sum256(der)
+	return KeyprintPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(h[:])
+}
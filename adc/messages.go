@@ -2,10 +2,13 @@ package adc
 
 import (
 	"bytes"
+	"encoding/base32"
 	"fmt"
 	"os"
 	"reflect"
 	"strconv"
+
+	"github.com/direct-connect/go-dcpp/tiger"
 )
 
 var (
@@ -16,9 +19,12 @@ func init() {
 	RegisterMessage(Supported{})
 	RegisterMessage(Status{})
 	RegisterMessage(SIDAssign{})
+	RegisterMessage(GetPassword{})
+	RegisterMessage(Password{})
 	RegisterMessage(User{})
 	RegisterMessage(RevConnectRequest{})
 	RegisterMessage(ConnectRequest{})
+	RegisterMessage(HybridBridge{})
 	RegisterMessage(GetInfoRequest{})
 	RegisterMessage(GetRequest{})
 	RegisterMessage(GetResponse{})
@@ -26,6 +32,7 @@ func init() {
 	RegisterMessage(SearchResult{})
 	RegisterMessage(ChatMessage{})
 	RegisterMessage(Disconnect{})
+	RegisterMessage(UserCommand{})
 }
 
 type Message interface {
@@ -116,10 +123,70 @@ var (
 	_ Unmarshaler = (*Status)(nil)
 )
 
+// Status codes. The first digit is a category of the error, the second one is a specific error.
+const (
+	CodeGeneric = 0
+
+	CodeHubGeneric  = 10
+	CodeHubFull     = 11
+	CodeHubDisabled = 12
+
+	CodeLoginGeneric    = 20
+	CodeNickInvalid     = 21
+	CodeNickTaken       = 22
+	CodeInvalidPassword = 23
+	CodeCIDTaken        = 24
+	CodeAccessDenied    = 25 // FC is set to the offending command
+	CodeRegisteredOnly  = 26
+	CodeInvalidPID      = 27
+
+	CodeBanGeneric = 30
+	CodePermBanned = 31
+	CodeTempBanned = 32 // TL is set to the number of seconds left
+
+	CodeProtocolGeneric  = 40
+	CodeTransferProtocol = 41 // PR is set to the protocol, TO to the token
+	CodeDirectConnFailed = 42
+	CodeInfoInvalid      = 43 // FM or FB is set to the missing or invalid field
+	CodeInvalidState     = 44 // FC is set to the offending command
+	CodeFeatureMissing   = 45 // FC is set to the missing feature
+	CodeInvalidIP        = 46 // I4 or I6 is set to the correct IP
+	CodeNoHashOverlap    = 47
+
+	CodeTransferGeneric  = 50
+	CodeFileNotAvailable = 51
+	CodePartNotAvailable = 52
+	CodeSlotsFull        = 53
+	CodeNoHashSupport    = 54
+)
+
 type Status struct {
 	Sev  Severity
 	Code int
 	Msg  string
+	// Params are additional named parameters that clarify the error.
+	Params []StatusParam
+}
+
+// StatusParam is a named parameter of the status message.
+type StatusParam struct {
+	Name  string // two-letter name, e.g. FC
+	Value string
+}
+
+// NewStatus creates a status message with a given severity, code and optional parameters.
+func NewStatus(sev Severity, code int, msg string, params ...StatusParam) Status {
+	return Status{Sev: sev, Code: code, Msg: msg, Params: params}
+}
+
+// Param returns a value of the named parameter.
+func (st Status) Param(name string) (string, bool) {
+	for _, p := range st.Params {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+	return "", false
 }
 
 func (Status) Cmd() MsgType {
@@ -134,7 +201,7 @@ func (st Status) Recoverable() bool {
 }
 func (st Status) Err() error {
 	if !st.Ok() {
-		if st.Code == 51 {
+		if st.Code == CodeFileNotAvailable {
 			return os.ErrNotExist
 		}
 		return Error{st}
@@ -142,7 +209,7 @@ func (st Status) Err() error {
 	return nil
 }
 func (st *Status) UnmarshalAdc(s []byte) error {
-	sub := bytes.SplitN(s, []byte(" "), 2)
+	sub := bytes.Split(s, []byte(" "))
 	code, err := strconv.Atoi(string(sub[0]))
 	if err != nil {
 		return fmt.Errorf("wrong status code: %v", err)
@@ -150,14 +217,37 @@ func (st *Status) UnmarshalAdc(s []byte) error {
 	st.Code = code % 100
 	st.Sev = Severity(code / 100)
 	st.Msg = ""
-	if len(sub) > 1 {
-		st.Msg = unescape(sub[1])
+	st.Params = nil
+	if len(sub) < 2 {
+		return nil
+	}
+	st.Msg = unescape(sub[1])
+	for _, p := range sub[2:] {
+		if len(p) == 0 {
+			// trailing or repeated spaces
+			continue
+		}
+		if len(p) < 2 {
+			return fmt.Errorf("invalid status parameter: %q", p)
+		}
+		st.Params = append(st.Params, StatusParam{
+			Name: string(p[:2]), Value: unescape(p[2:]),
+		})
 	}
 	return nil
 }
 func (st Status) MarshalAdc() ([]byte, error) {
-	s := fmt.Sprintf("%d%02d %s", int(st.Sev), st.Code, escape(st.Msg))
-	return []byte(s), nil
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "%d%02d %s", int(st.Sev), st.Code, escape(st.Msg))
+	for _, p := range st.Params {
+		if len(p.Name) != 2 {
+			return nil, fmt.Errorf("invalid status parameter name: %q", p.Name)
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(p.Name)
+		buf.Write(escape(p.Value))
+	}
+	return buf.Bytes(), nil
 }
 
 var (
@@ -182,6 +272,71 @@ func (m *SIDAssign) UnmarshalAdc(data []byte) error {
 	return m.SID.UnmarshalAdc(data)
 }
 
+var (
+	_ Message     = GetPassword{}
+	_ Marshaler   = GetPassword{}
+	_ Unmarshaler = (*GetPassword)(nil)
+)
+
+// saltEncoding is the encoding of the random data sent in GetPassword.
+var saltEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GetPassword is sent by the hub to request the password of a registered user.
+// The client must reply with Password.
+type GetPassword struct {
+	// Salt is a random data that the client hashes together with the password.
+	// Should be at least 24 bytes long.
+	Salt []byte
+}
+
+func (GetPassword) Cmd() MsgType {
+	return MsgType{'G', 'P', 'A'}
+}
+
+func (m GetPassword) MarshalAdc() ([]byte, error) {
+	return []byte(saltEncoding.EncodeToString(m.Salt)), nil
+}
+
+func (m *GetPassword) UnmarshalAdc(data []byte) error {
+	salt, err := saltEncoding.DecodeString(string(data))
+	if err != nil {
+		return fmt.Errorf("invalid password salt: %v", err)
+	}
+	m.Salt = salt
+	return nil
+}
+
+var (
+	_ Message     = Password{}
+	_ Marshaler   = Password{}
+	_ Unmarshaler = (*Password)(nil)
+)
+
+// Password is a reply to GetPassword. See HashPassword.
+type Password struct {
+	Hash tiger.Hash
+}
+
+func (Password) Cmd() MsgType {
+	return MsgType{'P', 'A', 'S'}
+}
+
+func (m Password) MarshalAdc() ([]byte, error) {
+	return m.Hash.MarshalAdc()
+}
+
+func (m *Password) UnmarshalAdc(data []byte) error {
+	return m.Hash.UnmarshalAdc(data)
+}
+
+// HashPassword returns the hash of the password and the salt sent by the hub in GetPassword.
+func HashPassword(pass string, salt []byte) tiger.Hash {
+	buf := make([]byte, 0, len(pass)+len(salt))
+	buf = append(buf, pass...)
+	buf = append(buf, salt...)
+	return tiger.HashBytes(buf)
+}
+
 var _ Message = User{}
 
 type User struct {
@@ -300,6 +455,23 @@ func (ConnectRequest) Cmd() MsgType {
 	return MsgType{'C', 'T', 'M'}
 }
 
+var _ Message = HybridBridge{}
+
+// HybridBridge is used by the HBRI extension to validate the address of the second IP family.
+// The hub sends it to the client with its own address of that family. The client connects
+// to this address and sends the message back with the same token and its own address.
+type HybridBridge struct {
+	Ip4   string `adc:"I4"`
+	Port4 int    `adc:"P4"`
+	Ip6   string `adc:"I6"`
+	Port6 int    `adc:"P6"`
+	Token string `adc:"TO"`
+}
+
+func (HybridBridge) Cmd() MsgType {
+	return MsgType{'T', 'C', 'P'}
+}
+
 var _ Message = GetInfoRequest{}
 
 type GetInfoRequest struct {
@@ -389,6 +561,7 @@ var (
 type ChatMessage struct {
 	Text String `adc:"#"`
 	PM   *SID   `adc:"PM"`
+	TS   int64  `adc:"TS"` // Unix timestamp (TS00 extension)
 }
 
 func (ChatMessage) Cmd() MsgType {
@@ -396,25 +569,39 @@ func (ChatMessage) Cmd() MsgType {
 }
 
 var (
-	_ Message     = Disconnect{}
-	_ Marshaler   = Disconnect{}
-	_ Unmarshaler = (*Disconnect)(nil)
+	_ Message = Disconnect{}
 )
 
 type Disconnect struct {
-	ID SID
+	ID SID `adc:"#"`
+	// By is a SID of the user that initiated the disconnect (e.g. kicked the user).
+	By      *SID   `adc:"ID"`
+	Message string `adc:"MS"`
+	// TimeLeft is the number of seconds the client should wait before reconnecting. -1 means forever.
+	TimeLeft int `adc:"TL"`
+	// Redirect is the address of the hub the client should connect to instead.
+	Redirect string `adc:"RD"`
 }
 
 func (Disconnect) Cmd() MsgType {
 	return MsgType{'Q', 'U', 'I'}
 }
 
-func (m Disconnect) MarshalAdc() ([]byte, error) {
-	return m.ID.MarshalAdc()
+var _ Message = UserCommand{}
+
+// UserCommand is a context menu command sent by the hub (UCMD extension).
+type UserCommand struct {
+	// Path is a menu path of the command, separated by '/'.
+	Path        String   `adc:"#"`
+	Command     string   `adc:"TT"` // raw ADC command sent by the client, with parameter substitutions
+	Category    Category `adc:"CT"`
+	Remove      BoolInt  `adc:"RM"`
+	Constrained BoolInt  `adc:"CO"`
+	Separator   BoolInt  `adc:"SP"`
 }
 
-func (m *Disconnect) UnmarshalAdc(data []byte) error {
-	return m.ID.UnmarshalAdc(data)
+func (UserCommand) Cmd() MsgType {
+	return MsgType{'C', 'M', 'D'}
 }
 
 var _ Message = HubInfo{}
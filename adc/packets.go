@@ -27,6 +27,11 @@ type Packet interface {
 	MarshalPacket() ([]byte, error)
 }
 
+// FourCC returns a four-letter code of the packet, e.g. BMSG.
+func FourCC(p Packet) string {
+	return string(p.kind()) + p.Message().Type.String()
+}
+
 type BasePacket struct {
 	Name MsgType
 	Data []byte
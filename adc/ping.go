@@ -0,0 +1,120 @@
+package adc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PingInfo is the information about the hub returned by Ping.
+type PingInfo struct {
+	HubInfo
+	// Ext is a sorted list of features supported by the hub.
+	Ext []string
+}
+
+// Ping fetches the information about the hub using the PING extension.
+//
+// The hub should support PING and send the hub info before the pinger identifies itself.
+// The ping is aborted when the context is done.
+func Ping(ctx context.Context, addr string) (*PingInfo, error) {
+	c, err := DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblock the reads
+			_ = c.Close()
+		case <-stop:
+		}
+	}()
+	info, err := PingConn(ctx, c)
+	if err != nil {
+		if err2 := ctx.Err(); err2 != nil {
+			return nil, err2
+		}
+		return nil, err
+	}
+	return info, nil
+}
+
+// PingConn is like Ping, but uses an existing connection. The connection is not closed.
+func PingConn(ctx context.Context, c *Conn) (*PingInfo, error) {
+	err := c.WriteHubMsg(Supported{
+		Features: ModFeatures{
+			FeaBASE: true,
+			FeaBAS0: true,
+			FeaTIGR: true,
+			FeaPING: true,
+		},
+	})
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return PingReply(ctx, c)
+}
+
+// PingReply reads the hub reply to the pinger SUP message that was already sent on the connection.
+// The message must enable BASE, TIGR and PING features. This allows to continue the ping on the
+// connection used to detect the protocol. The connection is not closed.
+func PingReply(ctx context.Context, c *Conn) (*PingInfo, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second * 10)
+	}
+
+	msg, err := c.ReadInfoMsg(deadline)
+	if err != nil {
+		return nil, err
+	}
+	sup, ok := msg.(Supported)
+	if !ok {
+		return nil, fmt.Errorf("expected SUP command, got: %#v", msg)
+	} else if !sup.Features.IsSet(FeaPING) {
+		return nil, errors.New("hub does not support PING")
+	}
+	info := &PingInfo{Ext: sup.Features.List()}
+
+	msg, err = c.ReadInfoMsg(deadline)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok = msg.(SIDAssign); !ok {
+		return nil, fmt.Errorf("expected SID command, got: %#v", msg)
+	}
+
+	for {
+		p, err := c.ReadPacket(deadline)
+		if err != nil {
+			return nil, err
+		}
+		ip, ok := p.(*InfoPacket)
+		if !ok {
+			return nil, fmt.Errorf("expected hub info, got: %#v", p)
+		}
+		switch ip.Name {
+		case (Status{}).Cmd():
+			var st Status
+			if err = Unmarshal(ip.Data, &st); err != nil {
+				return nil, err
+			} else if !st.Ok() {
+				return nil, st.Err()
+			}
+		case (HubInfo{}).Cmd():
+			if err = Unmarshal(ip.Data, &info.HubInfo); err != nil {
+				return nil, err
+			}
+			return info, nil
+		}
+	}
+}
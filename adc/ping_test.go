@@ -0,0 +1,53 @@
+package adc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPingCancel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// accept connections, but never reply
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	addr := l.Addr().String()
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
+		_, err := Ping(ctx, addr)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if dt := time.Since(start); dt > time.Second {
+			t.Fatalf("ping was not cancelled in time: %v", dt)
+		}
+	})
+	t.Run("silent hub", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		_, err := Ping(ctx, addr)
+		if err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if dt := time.Since(start); dt > time.Second {
+			t.Fatalf("ping was not cancelled in time: %v", dt)
+		}
+	})
+}
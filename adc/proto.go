@@ -3,6 +3,7 @@ package adc
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -80,6 +81,8 @@ func (f Feature) MarshalAdc() ([]byte, error) {
 	return f[:], nil
 }
 
+// ModFeatures is a set of features, or a change of the set sent in the SUP message.
+// Added features (AD) are true, removed ones (RM) are false.
 type ModFeatures map[Feature]bool
 
 func (f ModFeatures) Clone() ModFeatures {
@@ -120,38 +123,41 @@ func (f *ModFeatures) UnmarshalAdc(s []byte) error {
 	}
 	return nil
 }
+
+// MarshalAdc encodes removed features first, same as they are applied by UnmarshalAdc.
+// Features are sorted, so the encoding is stable.
 func (f ModFeatures) MarshalAdc() ([]byte, error) {
-	buf := bytes.NewBuffer(nil)
-	first := true
+	var rm, add []string
 	for fea, st := range f {
-		if !first {
-			buf.WriteRune(' ')
-		} else {
-			first = false
-		}
 		if st {
-			buf.WriteString("AD")
+			add = append(add, "AD"+fea.String())
 		} else {
-			buf.WriteString("RM")
+			rm = append(rm, "RM"+fea.String())
 		}
-		buf.WriteString(fea.String())
 	}
-	return buf.Bytes(), nil
+	sort.Strings(rm)
+	sort.Strings(add)
+	return []byte(strings.Join(append(rm, add...), " ")), nil
 }
+
+// IsSet checks if the feature is added. Removed features are not set.
 func (f ModFeatures) IsSet(s Feature) bool {
-	if f == nil {
-		return false
-	}
-	_, ok := f[s]
-	return ok
+	return f[s]
 }
+
+// SetFrom applies the change of features to the set and returns a new set.
+// Removed features are deleted from the set, thus it only contains added ones.
 func (f ModFeatures) SetFrom(fp ModFeatures) ModFeatures {
 	if f == nil && fp == nil {
 		return nil
 	}
 	fi := f.Clone()
 	for name, add := range fp {
-		fi[name] = add
+		if add {
+			fi[name] = true
+		} else {
+			delete(fi, name)
+		}
 	}
 	return fi
 }
@@ -169,6 +175,18 @@ func (f ModFeatures) Intersect(fp ModFeatures) ModFeatures {
 	}
 	return fi
 }
+
+// List returns a sorted list of enabled features.
+func (f ModFeatures) List() []string {
+	list := make([]string, 0, len(f))
+	for name, add := range f {
+		if add {
+			list = append(list, name.String())
+		}
+	}
+	sort.Strings(list)
+	return list
+}
 func (f ModFeatures) Join() string {
 	var arr []string
 	for name, add := range f {
@@ -195,6 +213,11 @@ func (f ExtFeatures) Has(s Feature) bool {
 	return false
 }
 func (f *ExtFeatures) UnmarshalAdc(s []byte) error {
+	if len(s) == 0 {
+		// users without extensions, e.g. passive users or bots
+		*f = nil
+		return nil
+	}
 	sub := bytes.Split(s, []byte(","))
 	arr := make(ExtFeatures, 0, len(sub))
 	for _, s := range sub {
@@ -257,6 +280,18 @@ const (
 	UserTypeHidden     UserType = 0x40
 )
 
+// Category is a context of a user command (UCMD extension).
+type Category int
+
+func (c Category) Is(c2 Category) bool { return c&c2 != 0 }
+
+const (
+	CategoryHub      Category = 0x01
+	CategoryUser     Category = 0x02
+	CategorySearch   Category = 0x04
+	CategoryFileList Category = 0x08
+)
+
 type AwayType int
 
 const (
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+const (
+	keyTypeRSA   = "rsa"
+	keyTypeECDSA = "ecdsa"
+)
+
+const (
+	// defaultCertValidity is a validity period of self-signed certificates.
+	defaultCertValidity = 365 * 24 * time.Hour
+	// certBackdate is subtracted from NotBefore to tolerate clock skew on the client side.
+	certBackdate = time.Hour
+	// certRenewBefore is how long before the expiration the certificate is renewed.
+	certRenewBefore = 7 * 24 * time.Hour
+	// certRetryInterval is a delay before the next renewal attempt, if the previous one failed.
+	certRetryInterval = time.Hour
+)
+
+// renewCert replaces the hub certificate with the one returned by a given function.
+// It returns false if the new certificate is the same as the current one.
+func renewCert(h *hub.Hub, fnc func() (*tls.Certificate, string, error)) (bool, error) {
+	cert, kp, err := fnc()
+	if err != nil {
+		return false, err
+	}
+	var old string
+	if cur := h.Certificate(); cur != nil {
+		old = keyPrint(cur)
+	}
+	if kp == old {
+		return false, nil
+	}
+	if err = h.SetCertificate(cert); err != nil {
+		return false, err
+	}
+	log.Printf(`
+
+[ TLS certificate renewed ]
+old keyprint: %s
+new keyprint: %s
+
+`, old, kp)
+	return true, nil
+}
+
+// certRenewDelay returns how long to wait before renewing the certificate.
+func certRenewDelay(cert *tls.Certificate, now time.Time) time.Duration {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return 0
+	}
+	before := certRenewBefore
+	if life := leaf.NotAfter.Sub(leaf.NotBefore); before > life/4 {
+		// short-lived certificate
+		before = life / 4
+	}
+	if d := leaf.NotAfter.Add(-before).Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// autoRenewCert renews the hub certificate before it expires. It never returns.
+func autoRenewCert(h *hub.Hub, fnc func() (*tls.Certificate, string, error)) {
+	for {
+		time.Sleep(certRenewDelay(h.Certificate(), time.Now()))
+		ok, err := renewCert(h, fnc)
+		if err != nil {
+			log.Println("cannot renew cert:", err)
+		}
+		if !ok {
+			// try again later; the cert file might be replaced by then
+			time.Sleep(certRetryInterval)
+		}
+	}
+}
+
+// keyPrint returns an ADC keyprint of the certificate.
+func keyPrint(cert *tls.Certificate) string {
+	return adc.Keyprint(cert.Certificate[0])
+}
+
+// loadCertFile loads a TLS certificate and a key from PEM files.
+func loadCertFile(certFile, keyFile string) (*tls.Certificate, string, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Println("loaded cert from", certFile)
+	return &cert, keyPrint(&cert), nil
+}
+
+// generateKey creates a new private key of a given type (RSA 2048 or ECDSA P-256)
+// and encodes it to PEM.
+func generateKey(keyType string) (crypto.Signer, []byte, error) {
+	switch keyType {
+	case "", keyTypeRSA:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyPEM := pem.EncodeToMemory(&pem.Block{
+			Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+		return key, keyPEM, nil
+	case keyTypeECDSA:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyPEM := pem.EncodeToMemory(&pem.Block{
+			Type: "EC PRIVATE KEY", Bytes: der,
+		})
+		return key, keyPEM, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported key type: %q", keyType)
+}
+
+// generateCert creates a self-signed TLS certificate for a given host.
+// The key type is either "rsa" or "ecdsa". The certificate is valid for a given duration.
+func generateCert(host, keyType string, validity time.Duration) (*tls.Certificate, string, error) {
+	// generate a new key-pair
+	rootKey, rootKeyPEM, err := generateKey(keyType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rootCertTmpl, err := CertTemplate(validity)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, ok := rootKey.(*ecdsa.PrivateKey); ok {
+		rootCertTmpl.SignatureAlgorithm = x509.ECDSAWithSHA256
+	}
+	// describe what the certificate will be used for
+	rootCertTmpl.IsCA = true
+	rootCertTmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	rootCertTmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if ip := net.ParseIP(host); ip != nil {
+		rootCertTmpl.IPAddresses = []net.IP{ip}
+	} else {
+		rootCertTmpl.DNSNames = []string{host}
+	}
+
+	_, rootCertPEM, err := CreateCert(rootCertTmpl, rootCertTmpl, rootKey.Public(), rootKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating cert: %v", err)
+	}
+
+	// Create a TLS cert using the private key and certificate
+	rootTLSCert, err := tls.X509KeyPair(rootCertPEM, rootKeyPEM)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Println("generated cert for", host)
+	return &rootTLSCert, keyPrint(&rootTLSCert), nil
+}
+
+// helper function to create a cert template with a serial number and other required fields
+func CertTemplate(validity time.Duration) (*x509.Certificate, error) {
+	// generate a random serial number (a real cert authority would have some logic behind this)
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, errors.New("failed to generate serial number: " + err.Error())
+	}
+
+	now := time.Now()
+	tmpl := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"Go Hub"}},
+		SignatureAlgorithm:    x509.SHA256WithRSA,
+		NotBefore:             now.Add(-certBackdate),
+		NotAfter:              now.Add(validity),
+		BasicConstraintsValid: true,
+	}
+	return &tmpl, nil
+}
+
+func CreateCert(template, parent *x509.Certificate, pub interface{}, parentPriv interface{}) (
+	cert *x509.Certificate, certPEM []byte, err error) {
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentPriv)
+	if err != nil {
+		return
+	}
+	// parse the resulting certificate so we can use it again
+	cert, err = x509.ParseCertificate(certDER)
+	if err != nil {
+		return
+	}
+	// PEM encode the certificate (this is a standard TLS encoding)
+	b := pem.Block{Type: "CERTIFICATE", Bytes: certDER}
+	certPEM = pem.EncodeToMemory(&b)
+	return
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base32"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+func TestGenerateCert(t *testing.T) {
+	for _, c := range []struct {
+		keyType string
+		check   func(pub interface{}) bool
+	}{
+		{keyTypeRSA, func(pub interface{}) bool { _, ok := pub.(*rsa.PublicKey); return ok }},
+		{keyTypeECDSA, func(pub interface{}) bool { _, ok := pub.(*ecdsa.PublicKey); return ok }},
+	} {
+		t.Run(c.keyType, func(t *testing.T) {
+			cert, kp, err := generateCert("127.0.0.1", c.keyType, defaultCertValidity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			} else if !c.check(leaf.PublicKey) {
+				t.Fatalf("unexpected key type: %T", leaf.PublicKey)
+			}
+
+			// make sure the cert can be used for a handshake and the keyprint matches the one seen by the client
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			srv := tls.Server(c1, &tls.Config{Certificates: []tls.Certificate{*cert}})
+			go srv.Handshake()
+			cli := tls.Client(c2, &tls.Config{InsecureSkipVerify: true})
+			if err = cli.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			h := sha256.Sum256(cli.ConnectionState().PeerCertificates[0].Raw)
+			exp := "SHA256/" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(h[:])
+			if kp != exp {
+				t.Fatalf("unexpected keyprint: %q vs %q", kp, exp)
+			}
+		})
+	}
+}
+
+func TestCertValidity(t *testing.T) {
+	const validity = 30 * 24 * time.Hour
+	start := time.Now().Truncate(time.Second)
+	cert, _, err := generateCert("127.0.0.1", keyTypeECDSA, validity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := time.Now()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.NotBefore.Before(start.Add(-certBackdate)) || leaf.NotBefore.After(end.Add(-certBackdate)) {
+		t.Fatalf("unexpected NotBefore: %v", leaf.NotBefore)
+	}
+	if leaf.NotAfter.Before(start.Add(validity)) || leaf.NotAfter.After(end.Add(validity)) {
+		t.Fatalf("unexpected NotAfter: %v", leaf.NotAfter)
+	}
+}
+
+func TestCertRenew(t *testing.T) {
+	cert, kp, err := generateCert("127.0.0.1", keyTypeECDSA, defaultCertValidity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := certRenewDelay(cert, time.Now())
+	if exp := defaultCertValidity - certRenewBefore; d > exp || d < exp-time.Minute {
+		t.Fatalf("unexpected renew delay: %v", d)
+	}
+
+	h := hub.New(hub.Config{
+		Name: "test",
+		TLS:  &tls.Config{Certificates: []tls.Certificate{*cert}},
+	})
+
+	// same certificate is not replaced
+	ok, err := renewCert(h, func() (*tls.Certificate, string, error) {
+		return cert, kp, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("same cert should not be renewed")
+	}
+
+	cert2, kp2, err := generateCert("127.0.0.1", keyTypeECDSA, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = renewCert(h, func() (*tls.Certificate, string, error) {
+		return cert2, kp2, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("cert was not renewed")
+	}
+	if h.Certificate() != cert2 {
+		t.Fatal("unexpected cert")
+	}
+	// short-lived cert that expires soon should be renewed immediately
+	if d = certRenewDelay(cert2, time.Now()); d != 0 {
+		t.Fatalf("unexpected renew delay: %v", d)
+	}
+}
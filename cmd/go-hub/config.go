@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/hub"
+	"github.com/direct-connect/go-dcpp/tiger"
+)
+
+// ClientRule bans the client application or its outdated versions.
+type ClientRule struct {
+	Name       string `json:"name"`
+	MinVersion string `json:"min_version"`
+}
+
+// UserRule is a requirement on the share, slots and hubs of users, with an optional message for users
+// that violate it.
+type UserRule struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Config is a configuration file of the hub.
+type Config struct {
+	Name         string   `json:"name"`
+	Desc         string   `json:"desc"`
+	Topic        string   `json:"topic"`
+	MOTD         string   `json:"motd"`
+	MaxUsers     int      `json:"max_users"`
+	QueueSize    int      `json:"queue_size"`
+	LoginTimeout Duration `json:"login_timeout"`
+	// Maintenance puts the hub into the maintenance mode: new logins are refused with this message.
+	Maintenance string `json:"maintenance"`
+	// LoginDeadline limits the total time of the ADC login. Default is twice the login_timeout.
+	LoginDeadline Duration `json:"login_deadline"`
+	// ChatHistory is the number of chat messages replayed to users after login.
+	// Negative value disables the history.
+	ChatHistory       int  `json:"chat_history"`
+	HistoryBeforeMOTD bool `json:"history_before_motd"`
+	// ChatTimestamps adds the server time to main chat messages.
+	ChatTimestamps bool `json:"chat_timestamps"`
+	// MaxChatLength truncates main chat messages to a given number of characters. Zero means no limit.
+	MaxChatLength int `json:"max_chat_length"`
+	// ResyncInterval enables periodic resending of join and leave notifications missed by clients.
+	ResyncInterval Duration `json:"resync_interval"`
+	// QuietPresence sends join and leave notifications only to operators.
+	QuietPresence bool `json:"quiet_presence"`
+	// RequiredFeatures is a list of ADC features (e.g. "UCMD") clients must support to log in.
+	RequiredFeatures []string `json:"required_features"`
+	// HBRIAddr4 and HBRIAddr6 are public IPv4 and IPv6 addresses of the hub (ip:port) that ADC clients
+	// connect to for validating their address of the second IP family (HBRI).
+	HBRIAddr4 string `json:"hbri_addr4"`
+	HBRIAddr6 string `json:"hbri_addr6"`
+	// HBRIStrict refuses connection requests from users with unverified addresses.
+	HBRIStrict bool `json:"hbri_strict"`
+	// HideIPs hides IP addresses of users from everyone except operators.
+	HideIPs bool `json:"hide_ips"`
+	// InfoFields is a list of ADC user info fields (e.g. "SS") forwarded to regular users. All fields are forwarded if empty.
+	InfoFields []string `json:"info_fields"`
+	// ReplaceOnReconnect lets reconnecting users replace their dead connections instead of being refused.
+	ReplaceOnReconnect bool `json:"replace_on_reconnect"`
+	// BotName is a nick of the hub bot. The bot is disabled if it's empty.
+	BotName string `json:"bot_name"`
+	// BotCID is a base32 CID of the hub bot. It's derived from the name if not set.
+	BotCID string `json:"bot_cid"`
+	// BridgeCIDHash is a hash that derives CIDs of NMDC and IRC users for ADC clients from their nicks:
+	// "tiger" (default), "sha256" or "sha512".
+	BridgeCIDHash string `json:"bridge_cid_hash"`
+	// MaxSearchResults limits the number of results relayed for a single search. Negative value disables the limit.
+	MaxSearchResults int `json:"max_search_results"`
+	// SearchResultRate limits the number of search results a single user can send per second.
+	SearchResultRate int `json:"search_result_rate"`
+	// PeerBandwidth and HubBandwidth limit the traffic of each connection and of the whole hub,
+	// in bytes per second. Zero means no limit.
+	PeerBandwidth int64 `json:"peer_bandwidth"`
+	HubBandwidth  int64 `json:"hub_bandwidth"`
+	// MinShare is a minimal share size in bytes.
+	MinShare       uint64  `json:"min_share"`
+	MinSlots       int     `json:"min_slots"`
+	MinSlotsPerHub float64 `json:"min_slots_per_hub"`
+	// Rules is a list of additional requirements on users, e.g. "slots >= share / 50GB".
+	Rules []UserRule `json:"rules"`
+	// ReconnectLimit is the number of connections allowed from one IP, or logins with one CID,
+	// during the reconnect_window (1 minute by default). Zero means no limit.
+	ReconnectLimit  int      `json:"reconnect_limit"`
+	ReconnectWindow Duration `json:"reconnect_window"`
+	// ReconnectCooldown is the time during which users that were kicked or redirected cannot log in again.
+	ReconnectCooldown Duration `json:"reconnect_cooldown"`
+	// SpoofTolerance is the number of ADC packets with a wrong SID dropped before the client is disconnected.
+	SpoofTolerance int `json:"spoof_tolerance"`
+	// JoinDelay delays announcing new users, so users that reconnect quickly are never shown to others.
+	JoinDelay Duration `json:"join_delay"`
+	// ReverseDNS resolves host names of users after login.
+	ReverseDNS bool `json:"reverse_dns"`
+	// NMDCEncoding is the charset of legacy NMDC clients that do not use UTF-8. Default is windows-1252.
+	NMDCEncoding string `json:"nmdc_encoding"`
+	// AllowedClients is a list of client applications allowed on the hub. All clients are allowed if it's empty.
+	AllowedClients []string `json:"allowed_clients"`
+	// BannedClients is a list of banned clients, optionally only the versions below min_version.
+	BannedClients []ClientRule `json:"banned_clients"`
+	// TrustedProxies is a list of IPs or CIDR networks of load balancers that send the PROXY protocol header.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Listen is a list of addresses to listen on.
+	Listen []string `json:"listen"`
+	// Sign is a host or IP to sign a self-signed TLS certificate for.
+	// Ignored if a certificate is set.
+	Sign string `json:"sign"`
+	// KeyType is a type of the key for a self-signed certificate: "rsa" (default) or "ecdsa".
+	KeyType string `json:"key_type"`
+	// CertValidity is a validity period of a self-signed certificate.
+	CertValidity Duration `json:"cert_validity"`
+	// Cert and Key are paths to PEM-encoded TLS certificate and key.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// TLSMinVersion is a minimal TLS version: "1.0", "1.1", "1.2" or "1.3".
+	// TLS 1.2 is used if not set.
+	TLSMinVersion string `json:"tls_min_version"`
+	// OpCerts maps keyprints of TLS client certificates ("SHA256/<base32>", same as the ADC KP field)
+	// to nicks of operators. Such operators login without a password, and their nicks require the certificate.
+	OpCerts map[string]string `json:"op_certs"`
+	// TLSCiphers is a list of cipher suite names for TLS 1.2 and below, as defined in crypto/tls.
+	// Go defaults are used if the list is empty. TLS 1.3 suites are not configurable.
+	TLSCiphers []string `json:"tls_ciphers"`
+	// Files maps the names of files that ADC clients can download from the hub to paths on disk.
+	Files map[string]string `json:"files"`
+	// MaxFileSize is the size limit of served files in bytes.
+	MaxFileSize int64 `json:"max_file_size"`
+	// Links is a list of ADC URLs of other hubs to relay the main chat with.
+	Links []string `json:"links"`
+	// BrowserPage shows a page with the hub address to browsers that open the hub port.
+	BrowserPage bool `json:"browser_page"`
+	// Metrics is an address to serve Prometheus metrics on. Metrics are disabled if it's empty.
+	Metrics string `json:"metrics"`
+	// WebSocket is an address to serve the hub stats and ADC over WebSocket on. Disabled if it's empty.
+	WebSocket string `json:"websocket"`
+	// Accounts is a path to the file with registered users.
+	// ADC clients can only use registered nicks if the account has an ADC password set, see hub.FileAccounts.
+	Accounts string `json:"accounts"`
+	// IPBans is a path to the file with banned IPs and networks.
+	IPBans string `json:"ip_bans"`
+	// AuditLog is a path to the file where moderation actions are appended as JSON lines.
+	AuditLog string `json:"audit_log"`
+	// ChatLog is a path to the file where main chat messages are appended as JSON lines.
+	ChatLog string `json:"chat_log"`
+	// SIDWarnUsage is a fraction of the ADC SID space that triggers a warning in the log. Default is 0.9.
+	SIDWarnUsage float64 `json:"sid_warn_usage"`
+	// CaptureDir is a directory where the raw traffic of connections is written for debugging.
+	// Only clients from capture_ips are captured, or all clients if the list is empty.
+	CaptureDir   string   `json:"capture_dir"`
+	CaptureIPs   []string `json:"capture_ips"`
+	CaptureLimit int64    `json:"capture_limit"`
+}
+
+// Duration is a time.Duration that is encoded as a string in JSON (e.g. "5s").
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration should be a string: %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// DefaultConfig returns a configuration used when no config file is given.
+func DefaultConfig() Config {
+	return Config{
+		Name:   "GoTestHub",
+		Desc:   "Hybrid hub",
+		MOTD:   "Welcome!",
+		Listen: []string{":1411"},
+		Sign:   "127.0.0.1",
+
+		CertValidity:  Duration(defaultCertValidity),
+		TLSMinVersion: "1.2",
+	}
+}
+
+// LoadConfig reads a config file and applies it on top of the current config.
+// Unknown keys in the file are reported as errors.
+func (c *Config) LoadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(c); err != nil {
+		return fmt.Errorf("cannot parse config %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks the config values.
+func (c *Config) Validate() error {
+	switch {
+	case c.Name == "":
+		return errors.New("hub name must be set")
+	case c.MaxUsers < 0:
+		return fmt.Errorf("invalid max_users: %d", c.MaxUsers)
+	case c.QueueSize < 0:
+		return fmt.Errorf("invalid queue_size: %d", c.QueueSize)
+	case c.MinSlots < 0:
+		return fmt.Errorf("invalid min_slots: %d", c.MinSlots)
+	case c.MinSlotsPerHub < 0:
+		return fmt.Errorf("invalid min_slots_per_hub: %v", c.MinSlotsPerHub)
+	case c.MaxChatLength < 0:
+		return fmt.Errorf("invalid max_chat_length: %d", c.MaxChatLength)
+	case c.SearchResultRate < 0:
+		return fmt.Errorf("invalid search_result_rate: %d", c.SearchResultRate)
+	case c.PeerBandwidth < 0:
+		return fmt.Errorf("invalid peer_bandwidth: %d", c.PeerBandwidth)
+	case c.HubBandwidth < 0:
+		return fmt.Errorf("invalid hub_bandwidth: %d", c.HubBandwidth)
+	case c.LoginTimeout < 0:
+		return fmt.Errorf("invalid login_timeout: %v", time.Duration(c.LoginTimeout))
+	case c.LoginDeadline < 0:
+		return fmt.Errorf("invalid login_deadline: %v", time.Duration(c.LoginDeadline))
+	case c.ReconnectLimit < 0:
+		return fmt.Errorf("invalid reconnect_limit: %d", c.ReconnectLimit)
+	case c.ReconnectWindow < 0:
+		return fmt.Errorf("invalid reconnect_window: %v", time.Duration(c.ReconnectWindow))
+	case c.ReconnectCooldown < 0:
+		return fmt.Errorf("invalid reconnect_cooldown: %v", time.Duration(c.ReconnectCooldown))
+	case c.SpoofTolerance < 0:
+		return fmt.Errorf("invalid spoof_tolerance: %d", c.SpoofTolerance)
+	case c.ResyncInterval < 0:
+		return fmt.Errorf("invalid resync_interval: %v", time.Duration(c.ResyncInterval))
+	case c.JoinDelay < 0:
+		return fmt.Errorf("invalid join_delay: %v", time.Duration(c.JoinDelay))
+	case c.SIDWarnUsage < 0 || c.SIDWarnUsage > 1:
+		return fmt.Errorf("invalid sid_warn_usage: %v", c.SIDWarnUsage)
+	case c.CaptureLimit < 0:
+		return fmt.Errorf("invalid capture_limit: %d", c.CaptureLimit)
+	case len(c.Listen) == 0:
+		return errors.New("at least one listen address must be set")
+	case (c.Cert == "") != (c.Key == ""):
+		return errors.New("both cert and key should be set")
+	case c.Cert == "" && c.Sign == "":
+		return errors.New("either cert or sign host must be set")
+	}
+	switch c.KeyType {
+	case "", keyTypeRSA, keyTypeECDSA:
+	default:
+		return fmt.Errorf("invalid key_type: %q", c.KeyType)
+	}
+	if time.Duration(c.CertValidity) < time.Hour {
+		return fmt.Errorf("invalid cert_validity: %v", time.Duration(c.CertValidity))
+	}
+	if c.NMDCEncoding != "" {
+		if _, err := htmlindex.Get(c.NMDCEncoding); err != nil {
+			return fmt.Errorf("invalid nmdc_encoding: %q", c.NMDCEncoding)
+		}
+	}
+	for kp, name := range c.OpCerts {
+		if !strings.HasPrefix(kp, adc.KeyprintPrefix) || name == "" {
+			return fmt.Errorf("invalid op_certs entry: %q: %q", kp, name)
+		}
+	}
+	for _, name := range c.InfoFields {
+		if len(name) != 2 || strings.ToUpper(name) != name {
+			return fmt.Errorf("invalid info_fields entry: %q", name)
+		}
+	}
+	for _, r := range c.BannedClients {
+		if r.Name == "" {
+			return errors.New("client name must be set in banned_clients")
+		}
+	}
+	if _, err := c.bridgeCID(); err != nil {
+		return err
+	}
+	if _, err := c.botCID(); err != nil {
+		return err
+	}
+	if _, err := c.trustedProxies(); err != nil {
+		return err
+	}
+	if _, err := c.captureIPs(); err != nil {
+		return err
+	}
+	if _, err := c.requiredFeatures(); err != nil {
+		return err
+	}
+	if _, err := c.userRules(); err != nil {
+		return err
+	}
+	if c.HBRIAddr4 != "" && !validHBRIAddr(c.HBRIAddr4, false) {
+		return fmt.Errorf("invalid hbri_addr4: %q", c.HBRIAddr4)
+	}
+	if c.HBRIAddr6 != "" && !validHBRIAddr(c.HBRIAddr6, true) {
+		return fmt.Errorf("invalid hbri_addr6: %q", c.HBRIAddr6)
+	}
+	if _, err := tlsVersion(c.TLSMinVersion); err != nil {
+		return err
+	}
+	if _, err := tlsCiphers(c.TLSCiphers); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TLSConfig returns a TLS config that serves a given certificate.
+// Session tickets are enabled, so clients can resume sessions on reconnect.
+func (c *Config) TLSConfig(cert tls.Certificate) (*tls.Config, error) {
+	ver, err := tlsVersion(c.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	ciphers, err := tlsCiphers(c.TLSCiphers)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               ver,
+		CipherSuites:             ciphers,
+		PreferServerCipherSuites: len(ciphers) != 0,
+	}, nil
+}
+
+func (c *Config) botCID() (adc.CID, error) {
+	var cid adc.CID
+	if c.BotCID == "" {
+		return cid, nil
+	}
+	if err := cid.FromBase32(c.BotCID); err != nil {
+		return cid, fmt.Errorf("invalid bot_cid: %v", err)
+	}
+	return cid, nil
+}
+
+// bridgeCIDHashes are hashes allowed in the bridge_cid_hash option.
+var bridgeCIDHashes = map[string]func() hash.Hash{
+	"tiger":  tiger.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// bridgeCID returns a function that derives CIDs of bridged users, or nil for the hub default.
+func (c *Config) bridgeCID() (func(name string) adc.CID, error) {
+	if c.BridgeCIDHash == "" {
+		return nil, nil
+	}
+	newHash, ok := bridgeCIDHashes[c.BridgeCIDHash]
+	if !ok {
+		return nil, fmt.Errorf("invalid bridge_cid_hash: %q", c.BridgeCIDHash)
+	}
+	return hub.HashBridgeCID(newHash), nil
+}
+
+// validHBRIAddr checks that the address is an ip:port pair of a given IP family.
+func validHBRIAddr(addr string, ip6 bool) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.To4() == nil) == ip6
+}
+
+// requiredFeatures parses the required_features list.
+func (c *Config) requiredFeatures() ([]adc.Feature, error) {
+	var list []adc.Feature
+	for _, s := range c.RequiredFeatures {
+		var f adc.Feature
+		if err := f.UnmarshalAdc([]byte(s)); err != nil {
+			return nil, fmt.Errorf("invalid required_features: %q", s)
+		}
+		list = append(list, f)
+	}
+	return list, nil
+}
+
+// userRules parses the rules list.
+func (c *Config) userRules() ([]*hub.UserRule, error) {
+	var list []*hub.UserRule
+	for _, r := range c.Rules {
+		rule, err := hub.ParseUserRule(r.Rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rules: %v", err)
+		}
+		rule.Message = r.Message
+		list = append(list, rule)
+	}
+	return list, nil
+}
+
+// trustedProxies parses the trusted_proxies list. Single IPs are converted to networks with one address.
+func (c *Config) trustedProxies() ([]*net.IPNet, error) {
+	return parseNets("trusted_proxies", c.TrustedProxies)
+}
+
+// captureIPs parses the capture_ips list, same as trustedProxies.
+func (c *Config) captureIPs() ([]*net.IPNet, error) {
+	return parseNets("capture_ips", c.CaptureIPs)
+}
+
+// parseNets parses a list of IPs or CIDR networks from the config option with a given name.
+func parseNets(name string, nets []string) ([]*net.IPNet, error) {
+	var list []*net.IPNet
+	for _, s := range nets {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", name, s)
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+func tlsVersion(s string) (uint16, error) {
+	switch s {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid tls_min_version: %q", s)
+}
+
+// tlsCiphers converts cipher suite names to IDs. Only suites considered secure by crypto/tls are allowed.
+func tlsCiphers(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	byName := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		byName[cs.Name] = cs.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
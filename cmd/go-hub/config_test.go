@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	dir, err := ioutil.TempDir("", "go-hub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "hub.json")
+	if err = ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{
+	"name": "Test",
+	"max_users": 10,
+	"login_timeout": "3s",
+	"listen": [":1411", ":1412"]
+}`)
+	conf := DefaultConfig()
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Name != "Test" || conf.Desc != "Hybrid hub" || conf.MaxUsers != 10 ||
+		time.Duration(conf.LoginTimeout) != 3*time.Second || len(conf.Listen) != 2 {
+		t.Fatalf("unexpected config: %+v", conf)
+	}
+}
+
+func TestLoadConfigUnknown(t *testing.T) {
+	path := writeConfig(t, `{"name": "Test", "max_user": 10}`)
+	conf := DefaultConfig()
+	err := conf.LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), `"max_user"`) {
+		t.Fatalf("expected an error for unknown key, got: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Cert = "hub.crt"
+	if err := conf.Validate(); err == nil {
+		t.Fatal("expected an error for cert without a key")
+	}
+}
+
+func TestConfigTrustedProxies(t *testing.T) {
+	conf := DefaultConfig()
+	conf.TrustedProxies = []string{"10.0.0.1", "192.168.0.0/16", "2001:db8::/32"}
+	list, err := conf.trustedProxies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, n := range list {
+		out = append(out, n.String())
+	}
+	if strings.Join(out, " ") != "10.0.0.1/32 192.168.0.0/16 2001:db8::/32" {
+		t.Fatalf("unexpected networks: %v", out)
+	}
+	conf.TrustedProxies = []string{"10.0.0.0/33"}
+	if err = conf.Validate(); err == nil {
+		t.Fatal("expected an error for invalid network")
+	}
+}
+
+func TestConfigTLS(t *testing.T) {
+	conf := DefaultConfig()
+	tc, err := conf.TLSConfig(tls.Certificate{})
+	if err != nil {
+		t.Fatal(err)
+	} else if tc.MinVersion != tls.VersionTLS12 || tc.CipherSuites != nil {
+		t.Fatalf("unexpected defaults: %v %v", tc.MinVersion, tc.CipherSuites)
+	}
+
+	conf.TLSMinVersion = "1.3"
+	conf.TLSCiphers = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	tc, err = conf.TLSConfig(tls.Certificate{})
+	if err != nil {
+		t.Fatal(err)
+	} else if tc.MinVersion != tls.VersionTLS13 || len(tc.CipherSuites) != 1 ||
+		tc.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("unexpected config: %v %v", tc.MinVersion, tc.CipherSuites)
+	}
+
+	conf.TLSCiphers = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	if err = conf.Validate(); err == nil {
+		t.Fatal("expected an error for insecure cipher")
+	}
+	conf.TLSCiphers = nil
+	conf.TLSMinVersion = "2.0"
+	if err = conf.Validate(); err == nil {
+		t.Fatal("expected an error for invalid version")
+	}
+}
@@ -1,65 +1,261 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/base32"
-	"encoding/pem"
-	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math/big"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/direct-connect/go-dcpp/hub"
 )
 
 var (
-	f_host  = flag.String("host", ":1411", "host to listen on")
-	f_sign  = flag.String("sign", "127.0.0.1", "host or IP to sign TLS certs for")
-	f_name  = flag.String("name", "GoTestHub", "hub name")
-	f_desc  = flag.String("desc", "Hybrid hub", "hub description")
-	f_pprof = flag.Bool("pprof", false, "run pprof")
+	f_config = flag.String("config", "", "path to a JSON config file")
+	f_host   = flag.String("host", ":1411", "host to listen on, or unix:<path> for a Unix socket")
+	f_sign   = flag.String("sign", "127.0.0.1", "host or IP to sign TLS certs for")
+	f_keyt   = flag.String("keytype", keyTypeRSA, "type of the key for a self-signed TLS cert (rsa or ecdsa)")
+	f_valid  = flag.Duration("validity", defaultCertValidity, "validity period of a self-signed TLS cert")
+	f_name   = flag.String("name", "GoTestHub", "hub name")
+	f_desc   = flag.String("desc", "Hybrid hub", "hub description")
+	f_motd   = flag.String("motd", "Welcome!", "message of the day")
+	f_pprof  = flag.Bool("pprof", false, "run pprof")
 )
 
 func main() {
+	flag.Parse()
 	if *f_pprof {
 		go http.ListenAndServe(":6060", nil)
 	}
-	flag.Parse()
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
+// loadConfig reads the config file (if any) and overrides its values with flags set explicitly.
+func loadConfig() (*Config, error) {
+	conf := DefaultConfig()
+	if *f_config != "" {
+		if err := conf.LoadConfig(*f_config); err != nil {
+			return nil, err
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			conf.Listen = []string{*f_host}
+		case "sign":
+			conf.Sign = *f_sign
+		case "keytype":
+			conf.KeyType = *f_keyt
+		case "validity":
+			conf.CertValidity = Duration(*f_valid)
+		case "name":
+			conf.Name = *f_name
+		case "desc":
+			conf.Desc = *f_desc
+		case "motd":
+			conf.MOTD = *f_motd
+		}
+	})
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return &conf, nil
+}
+
 func run() error {
-	cert, kp, err := loadCert()
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	getCert := func() (*tls.Certificate, string, error) {
+		if conf.Cert != "" {
+			return loadCertFile(conf.Cert, conf.Key)
+		}
+		return generateCert(conf.Sign, conf.KeyType, time.Duration(conf.CertValidity))
+	}
+	cert, kp, err := getCert()
+	if err != nil {
+		return err
+	}
+	tlsConf, err := conf.TLSConfig(*cert)
 	if err != nil {
 		return err
 	}
 
-	conf := &tls.Config{
-		Certificates: []tls.Certificate{*cert},
+	var accounts *hub.FileAccounts
+	if conf.Accounts != "" {
+		accounts, err = hub.OpenFileAccounts(conf.Accounts)
+		if err != nil {
+			return fmt.Errorf("cannot load accounts: %v", err)
+		}
 	}
-	h := hub.NewHub(hub.Info{
-		Name: *f_name,
-		Desc: *f_desc,
-	}, conf)
 
-	_, port, _ := net.SplitHostPort(*f_host)
-	addr := *f_sign + ":" + port
-	log.Println("listening on", *f_host)
-	log.Printf(`
+	var bans *hub.IPBans
+	if conf.IPBans != "" {
+		bans, err = hub.OpenIPBans(conf.IPBans)
+		if err != nil {
+			return fmt.Errorf("cannot load ip bans: %v", err)
+		}
+	}
+
+	var auditLog hub.AuditLogger
+	if conf.AuditLog != "" {
+		f, err := os.OpenFile(conf.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("cannot open audit log: %v", err)
+		}
+		defer f.Close()
+		auditLog = hub.NewJSONAuditLog(f)
+	}
+
+	var chatLog hub.ChatSink
+	if conf.ChatLog != "" {
+		f, err := os.OpenFile(conf.ChatLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("cannot open chat log: %v", err)
+		}
+		defer f.Close()
+		chatLog = hub.NewJSONChatLog(f)
+	}
+
+	botCID, err := conf.botCID()
+	if err != nil {
+		return err
+	}
+	bridgeCID, err := conf.bridgeCID()
+	if err != nil {
+		return err
+	}
+	proxies, err := conf.trustedProxies()
+	if err != nil {
+		return err
+	}
+	captureIPs, err := conf.captureIPs()
+	if err != nil {
+		return err
+	}
+	features, err := conf.requiredFeatures()
+	if err != nil {
+		return err
+	}
+	rules, err := conf.userRules()
+	if err != nil {
+		return err
+	}
+	var bannedClients []hub.ClientRule
+	for _, r := range conf.BannedClients {
+		bannedClients = append(bannedClients, hub.ClientRule{Name: r.Name, MinVersion: r.MinVersion})
+	}
+
+	h := hub.New(hub.Config{
+		Name:               conf.Name,
+		Desc:               conf.Desc,
+		Topic:              conf.Topic,
+		MOTD:               conf.MOTD,
+		ChatHistory:        conf.ChatHistory,
+		HistoryBeforeMOTD:  conf.HistoryBeforeMOTD,
+		ChatTimestamps:     conf.ChatTimestamps,
+		ChatFilters:        []hub.ChatFilter{hub.ChatSanitizer{MaxLength: conf.MaxChatLength}},
+		MaxUsers:           conf.MaxUsers,
+		QueueSize:          conf.QueueSize,
+		ReplaceOnReconnect: conf.ReplaceOnReconnect,
+		RequiredFeatures:   features,
+		HBRIAddr4:          conf.HBRIAddr4,
+		HBRIAddr6:          conf.HBRIAddr6,
+		HBRIStrict:         conf.HBRIStrict,
+		ResyncInterval:     time.Duration(conf.ResyncInterval),
+		QuietPresence:      conf.QuietPresence,
+		HideIPs:            conf.HideIPs,
+		InfoFields:         conf.InfoFields,
+		TrustedProxies:     proxies,
+		BotName:            conf.BotName,
+		BotCID:             botCID,
+		BridgeCID:          bridgeCID,
+		MaxSearchResults:   conf.MaxSearchResults,
+		SearchResultRate:   conf.SearchResultRate,
+		PeerBandwidth:      conf.PeerBandwidth,
+		HubBandwidth:       conf.HubBandwidth,
+		LoginTimeout:       time.Duration(conf.LoginTimeout),
+		LoginDeadline:      time.Duration(conf.LoginDeadline),
+		MinShare:           conf.MinShare,
+		MinSlots:           conf.MinSlots,
+		MinSlotsPerHub:     conf.MinSlotsPerHub,
+		Rules:              rules,
+		NMDCEncoding:       conf.NMDCEncoding,
+		ReconnectLimit:     conf.ReconnectLimit,
+		ReconnectWindow:    time.Duration(conf.ReconnectWindow),
+		ReconnectCooldown:  time.Duration(conf.ReconnectCooldown),
+		SpoofTolerance:     conf.SpoofTolerance,
+		JoinDelay:          time.Duration(conf.JoinDelay),
+		ReverseDNS:         conf.ReverseDNS,
+		AllowedClients:     conf.AllowedClients,
+		BannedClients:      bannedClients,
+		BrowserPage:        conf.BrowserPage,
+		Files:              conf.Files,
+		MaxFileSize:        conf.MaxFileSize,
+		TLS:                tlsConf,
+		OpCerts:            conf.OpCerts,
+		AuditLog:           auditLog,
+		ChatSink:           chatLog,
+		SIDWarnUsage:       conf.SIDWarnUsage,
+		CaptureDir:         conf.CaptureDir,
+		CaptureIPs:         captureIPs,
+		CaptureLimit:       conf.CaptureLimit,
+		Accounts:           accounts,
+		IPBans:             bans,
+	})
+	if conf.Maintenance != "" {
+		h.SetMaintenance(true, conf.Maintenance)
+	}
+
+	for _, addr := range conf.Links {
+		addr := addr
+		go func() {
+			if err := h.Link(addr); err != nil {
+				log.Printf("cannot link %s: %v", addr, err)
+			}
+		}()
+	}
+
+	go autoRenewCert(h, getCert)
+	cur := *conf
+	go reloadOnSignal(h, accounts, bans, &cur)
+
+	errc := make(chan error, 3)
+	if conf.Metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", hub.PrometheusHandler(h))
+		log.Printf("serving metrics on http://%s/metrics", conf.Metrics)
+		go func() {
+			errc <- http.ListenAndServe(conf.Metrics, mux)
+		}()
+	}
+	if conf.WebSocket != "" {
+		log.Printf("serving stats and WebSocket clients on http://%s", conf.WebSocket)
+		go func() {
+			errc <- http.ListenAndServe(conf.WebSocket, h)
+		}()
+	}
+	for _, host := range conf.Listen {
+		if strings.HasPrefix(host, "unix:") {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(host)
+		if conf.Sign != "" {
+			host = conf.Sign
+		}
+		addr := net.JoinHostPort(host, port)
+		log.Printf(`
 
 [ Hub URIs ]
 adcs://%s?kp=%s
@@ -75,96 +271,36 @@ irc://%s/hub
 https://%s
 
 `,
-		addr, kp,
-		addr,
-		addr,
-		addr,
-
-		addr,
-		addr,
-
-		addr,
-	)
-	return h.ListenAndServe(*f_host)
-}
-
-func loadCert() (*tls.Certificate, string, error) {
-	// generate a new key-pair
-	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, "", err
-	}
-
-	rootCertTmpl, err := CertTemplate()
-	if err != nil {
-		return nil, "", err
-	}
-	// describe what the certificate will be used for
-	rootCertTmpl.IsCA = true
-	rootCertTmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
-	rootCertTmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
-	if ip := net.ParseIP(*f_sign); ip != nil {
-		rootCertTmpl.IPAddresses = []net.IP{ip}
-	} else {
-		rootCertTmpl.DNSNames = []string{*f_sign}
-	}
+			addr, kp,
+			addr,
+			addr,
+			addr,
 
-	_, rootCertPEM, err := CreateCert(rootCertTmpl, rootCertTmpl, &rootKey.PublicKey, rootKey)
-	if err != nil {
-		log.Fatalf("error creating cert: %v", err)
-	}
+			addr,
+			addr,
 
-	// PEM encode the private key
-	rootKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rootKey),
-	})
-
-	h := sha256.Sum256(rootCertPEM)
-	kp := "SHA256/" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(h[:])
-
-	// Create a TLS cert using the private key and certificate
-	rootTLSCert, err := tls.X509KeyPair(rootCertPEM, rootKeyPEM)
-	if err != nil {
-		return nil, "", err
+			addr,
+		)
 	}
-	log.Println("generated cert for", *f_sign)
-	return &rootTLSCert, kp, nil
-}
-
-// helper function to create a cert template with a serial number and other required fields
-func CertTemplate() (*x509.Certificate, error) {
-	// generate a random serial number (a real cert authority would have some logic behind this)
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		return nil, errors.New("failed to generate serial number: " + err.Error())
+	for _, host := range conf.Listen {
+		log.Println("listening on", host)
 	}
-
-	tmpl := x509.Certificate{
-		SerialNumber:          serialNumber,
-		Subject:               pkix.Name{Organization: []string{"Go Hub"}},
-		SignatureAlgorithm:    x509.SHA256WithRSA,
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(time.Hour * 24 * 356),
-		BasicConstraintsValid: true,
+	go func() {
+		errc <- h.ListenAndServeAll(conf.Listen)
+	}()
+	go stopOnSignal(h)
+	err = <-errc
+	if err == hub.ErrListenerClosed {
+		err = nil
 	}
-	return &tmpl, nil
+	return err
 }
 
-func CreateCert(template, parent *x509.Certificate, pub interface{}, parentPriv interface{}) (
-	cert *x509.Certificate, certPEM []byte, err error) {
-
-	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentPriv)
-	if err != nil {
-		return
-	}
-	// parse the resulting certificate so we can use it again
-	cert, err = x509.ParseCertificate(certDER)
-	if err != nil {
-		return
-	}
-	// PEM encode the certificate (this is a standard TLS encoding)
-	b := pem.Block{Type: "CERTIFICATE", Bytes: certDER}
-	certPEM = pem.EncodeToMemory(&b)
-	return
+// stopOnSignal closes the listeners on SIGINT or SIGTERM, so Unix socket files are removed.
+func stopOnSignal(h *hub.Hub) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	<-ch
+	log.Println("stopping")
+	_ = h.StopListening()
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+// reloadOnSignal reloads the config file each time SIGHUP is received.
+// Accounts and IP bans are re-read from their files, if set.
+func reloadOnSignal(h *hub.Hub, accounts *hub.FileAccounts, bans *hub.IPBans, conf *Config) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		log.Println("reloading config")
+		nconf, err := loadConfig()
+		if err != nil {
+			log.Println("reload failed:", err)
+			continue
+		}
+		for _, s := range applyConfig(h, conf, nconf) {
+			log.Println("reload:", s)
+		}
+		if conf.Cert != "" {
+			// certificate paths require a restart, but the files can be replaced
+			_, err = renewCert(h, func() (*tls.Certificate, string, error) {
+				return loadCertFile(conf.Cert, conf.Key)
+			})
+			if err != nil {
+				log.Println("reload: cannot load cert:", err)
+			}
+		}
+		if accounts != nil {
+			if err = accounts.Reload(); err != nil {
+				log.Println("reload: cannot load accounts:", err)
+			} else {
+				log.Println("reload: accounts reloaded")
+			}
+		}
+		if bans != nil {
+			if err = bans.Reload(); err != nil {
+				log.Println("reload: cannot load ip bans:", err)
+			} else {
+				log.Println("reload: ip bans reloaded")
+			}
+		}
+	}
+}
+
+// applyConfig applies hot-reloadable settings from the new config to a running hub.
+// Settings that require a restart are reported and reset to the old values in the new config,
+// so the config always reflects the running state. It returns a list of changes.
+func applyConfig(h *hub.Hub, old, conf *Config) []string {
+	var changes []string
+	if conf.Name != old.Name {
+		h.SetName(conf.Name)
+		changes = append(changes, fmt.Sprintf("name: %q -> %q", old.Name, conf.Name))
+	}
+	if conf.Desc != old.Desc {
+		h.SetDesc(conf.Desc)
+		changes = append(changes, "desc changed")
+	}
+	if conf.MOTD != old.MOTD {
+		h.SetMOTD(conf.MOTD)
+		changes = append(changes, "motd changed")
+	}
+	if conf.Topic != old.Topic {
+		h.SetTopic(conf.Topic)
+		changes = append(changes, "topic changed")
+	}
+	if conf.MaxUsers != old.MaxUsers {
+		h.SetMaxUsers(conf.MaxUsers)
+		changes = append(changes, fmt.Sprintf("max_users: %d -> %d", old.MaxUsers, conf.MaxUsers))
+	}
+	if conf.Maintenance != old.Maintenance {
+		h.SetMaintenance(conf.Maintenance != "", conf.Maintenance)
+		if conf.Maintenance != "" {
+			changes = append(changes, "maintenance mode enabled")
+		} else {
+			changes = append(changes, "maintenance mode lifted")
+		}
+	}
+	if conf.LoginTimeout != old.LoginTimeout {
+		h.SetLoginTimeout(time.Duration(conf.LoginTimeout))
+		changes = append(changes, fmt.Sprintf("login_timeout: %v -> %v",
+			time.Duration(old.LoginTimeout), time.Duration(conf.LoginTimeout)))
+	}
+	if conf.LoginDeadline != old.LoginDeadline {
+		h.SetLoginDeadline(time.Duration(conf.LoginDeadline))
+		changes = append(changes, fmt.Sprintf("login_deadline: %v -> %v",
+			time.Duration(old.LoginDeadline), time.Duration(conf.LoginDeadline)))
+	}
+	if conf.MinShare != old.MinShare || conf.MinSlots != old.MinSlots || conf.MinSlotsPerHub != old.MinSlotsPerHub {
+		h.SetUserLimits(conf.MinShare, conf.MinSlots, conf.MinSlotsPerHub)
+		changes = append(changes, fmt.Sprintf("user limits: share %d, slots %d, slots per hub %v",
+			conf.MinShare, conf.MinSlots, conf.MinSlotsPerHub))
+	}
+	if conf.PeerBandwidth != old.PeerBandwidth || conf.HubBandwidth != old.HubBandwidth {
+		h.SetBandwidth(conf.PeerBandwidth, conf.HubBandwidth)
+		changes = append(changes, fmt.Sprintf("bandwidth: peer %d, hub %d", conf.PeerBandwidth, conf.HubBandwidth))
+	}
+	if conf.MaxSearchResults != old.MaxSearchResults || conf.SearchResultRate != old.SearchResultRate {
+		h.SetSearchLimits(conf.MaxSearchResults, conf.SearchResultRate)
+		changes = append(changes, fmt.Sprintf("search limits: results %d, rate %d",
+			conf.MaxSearchResults, conf.SearchResultRate))
+	}
+	if conf.ReconnectLimit != old.ReconnectLimit || conf.ReconnectWindow != old.ReconnectWindow ||
+		conf.ReconnectCooldown != old.ReconnectCooldown {
+		h.SetReconnectLimits(conf.ReconnectLimit, time.Duration(conf.ReconnectWindow), time.Duration(conf.ReconnectCooldown))
+		changes = append(changes, fmt.Sprintf("reconnect limits: %d per %v, cooldown %v", conf.ReconnectLimit,
+			time.Duration(conf.ReconnectWindow), time.Duration(conf.ReconnectCooldown)))
+	}
+
+	restart := func(name string, changed bool) {
+		if changed {
+			changes = append(changes, name+" changed, restart is required to apply it")
+		}
+	}
+	restart("chat history", conf.ChatHistory != old.ChatHistory || conf.HistoryBeforeMOTD != old.HistoryBeforeMOTD)
+	restart("chat timestamps", conf.ChatTimestamps != old.ChatTimestamps)
+	restart("max chat length", conf.MaxChatLength != old.MaxChatLength)
+	restart("queue size", conf.QueueSize != old.QueueSize)
+	restart("replace on reconnect", conf.ReplaceOnReconnect != old.ReplaceOnReconnect)
+	restart("hide ips", conf.HideIPs != old.HideIPs)
+	restart("info fields", !reflect.DeepEqual(conf.InfoFields, old.InfoFields))
+	restart("resync interval", conf.ResyncInterval != old.ResyncInterval)
+	restart("quiet presence", conf.QuietPresence != old.QuietPresence)
+	restart("required features", !reflect.DeepEqual(conf.RequiredFeatures, old.RequiredFeatures))
+	restart("hbri", conf.HBRIAddr4 != old.HBRIAddr4 || conf.HBRIAddr6 != old.HBRIAddr6 || conf.HBRIStrict != old.HBRIStrict)
+	restart("bot", conf.BotName != old.BotName || conf.BotCID != old.BotCID)
+	restart("bridge cid hash", conf.BridgeCIDHash != old.BridgeCIDHash)
+	restart("nmdc encoding", conf.NMDCEncoding != old.NMDCEncoding)
+	restart("spoof tolerance", conf.SpoofTolerance != old.SpoofTolerance)
+	restart("join delay", conf.JoinDelay != old.JoinDelay)
+	restart("reverse dns", conf.ReverseDNS != old.ReverseDNS)
+	restart("user rules", !reflect.DeepEqual(conf.Rules, old.Rules))
+	restart("client rules", !reflect.DeepEqual(conf.AllowedClients, old.AllowedClients) ||
+		!reflect.DeepEqual(conf.BannedClients, old.BannedClients))
+	restart("trusted proxies", !reflect.DeepEqual(conf.TrustedProxies, old.TrustedProxies))
+	restart("listen", !reflect.DeepEqual(conf.Listen, old.Listen))
+	restart("sign", conf.Sign != old.Sign || conf.KeyType != old.KeyType || conf.CertValidity != old.CertValidity)
+	restart("cert", conf.Cert != old.Cert || conf.Key != old.Key)
+	restart("accounts", conf.Accounts != old.Accounts)
+	restart("ip bans", conf.IPBans != old.IPBans)
+	restart("audit log", conf.AuditLog != old.AuditLog)
+	restart("chat log", conf.ChatLog != old.ChatLog)
+	restart("sid warn usage", conf.SIDWarnUsage != old.SIDWarnUsage)
+	restart("capture", conf.CaptureDir != old.CaptureDir || !reflect.DeepEqual(conf.CaptureIPs, old.CaptureIPs) ||
+		conf.CaptureLimit != old.CaptureLimit)
+	restart("metrics", conf.Metrics != old.Metrics)
+	restart("websocket", conf.WebSocket != old.WebSocket)
+	restart("links", !reflect.DeepEqual(conf.Links, old.Links))
+	restart("browser page", conf.BrowserPage != old.BrowserPage)
+	restart("files", !reflect.DeepEqual(conf.Files, old.Files) || conf.MaxFileSize != old.MaxFileSize)
+	restart("op certs", !reflect.DeepEqual(conf.OpCerts, old.OpCerts))
+	restart("tls", conf.TLSMinVersion != old.TLSMinVersion || !reflect.DeepEqual(conf.TLSCiphers, old.TLSCiphers))
+	conf.ChatHistory, conf.HistoryBeforeMOTD = old.ChatHistory, old.HistoryBeforeMOTD
+	conf.ChatTimestamps = old.ChatTimestamps
+	conf.MaxChatLength = old.MaxChatLength
+	conf.QueueSize = old.QueueSize
+	conf.ReplaceOnReconnect = old.ReplaceOnReconnect
+	conf.HideIPs = old.HideIPs
+	conf.InfoFields = old.InfoFields
+	conf.RequiredFeatures = old.RequiredFeatures
+	conf.HBRIAddr4, conf.HBRIAddr6, conf.HBRIStrict = old.HBRIAddr4, old.HBRIAddr6, old.HBRIStrict
+	conf.ResyncInterval = old.ResyncInterval
+	conf.QuietPresence = old.QuietPresence
+	conf.BotName, conf.BotCID = old.BotName, old.BotCID
+	conf.BridgeCIDHash = old.BridgeCIDHash
+	conf.NMDCEncoding = old.NMDCEncoding
+	conf.SpoofTolerance = old.SpoofTolerance
+	conf.JoinDelay = old.JoinDelay
+	conf.ReverseDNS = old.ReverseDNS
+	conf.Rules = old.Rules
+	conf.AllowedClients, conf.BannedClients = old.AllowedClients, old.BannedClients
+	conf.TrustedProxies = old.TrustedProxies
+	conf.Listen, conf.Sign = old.Listen, old.Sign
+	conf.KeyType, conf.CertValidity = old.KeyType, old.CertValidity
+	conf.Cert, conf.Key = old.Cert, old.Key
+	conf.Accounts = old.Accounts
+	conf.IPBans = old.IPBans
+	conf.AuditLog = old.AuditLog
+	conf.ChatLog = old.ChatLog
+	conf.SIDWarnUsage = old.SIDWarnUsage
+	conf.CaptureDir, conf.CaptureIPs, conf.CaptureLimit = old.CaptureDir, old.CaptureIPs, old.CaptureLimit
+	conf.Metrics = old.Metrics
+	conf.WebSocket = old.WebSocket
+	conf.Links = old.Links
+	conf.BrowserPage = old.BrowserPage
+	conf.Files, conf.MaxFileSize = old.Files, old.MaxFileSize
+	conf.OpCerts = old.OpCerts
+	conf.TLSMinVersion, conf.TLSCiphers = old.TLSMinVersion, old.TLSCiphers
+
+	*old = *conf
+	return changes
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+func TestApplyConfig(t *testing.T) {
+	old := DefaultConfig()
+	h := hub.New(hub.Config{Name: old.Name, MOTD: old.MOTD})
+
+	conf := old
+	conf.MOTD = "new motd"
+	conf.MaxUsers = 10
+	conf.Listen = []string{":1412"}
+	changes := applyConfig(h, &old, &conf)
+	if len(changes) != 3 {
+		t.Fatalf("unexpected changes: %q", changes)
+	}
+	if old.MOTD != "new motd" || old.MaxUsers != 10 {
+		t.Fatalf("settings were not applied: %+v", old)
+	}
+	if len(old.Listen) != 1 || old.Listen[0] != ":1411" {
+		t.Fatalf("listen address should not change: %q", old.Listen)
+	}
+
+	// nothing changed
+	conf = old
+	if changes = applyConfig(h, &old, &conf); len(changes) != 0 {
+		t.Fatalf("unexpected changes: %q", changes)
+	}
+
+	conf.Maintenance = "back soon"
+	if changes = applyConfig(h, &old, &conf); len(changes) != 1 {
+		t.Fatalf("unexpected changes: %q", changes)
+	}
+	if on, msg := h.Maintenance(); !on || msg != "back soon" {
+		t.Fatalf("maintenance was not applied: %v %q", on, msg)
+	}
+	conf = old
+	conf.Maintenance = ""
+	applyConfig(h, &old, &conf)
+	if on, _ := h.Maintenance(); on {
+		t.Fatal("maintenance was not lifted")
+	}
+}
+
+func TestApplyConfigLimits(t *testing.T) {
+	old := DefaultConfig()
+	h := hub.New(hub.Config{Name: old.Name})
+
+	conf := old
+	conf.PeerBandwidth, conf.HubBandwidth = 1000, 10000
+	conf.MaxSearchResults, conf.SearchResultRate = 20, 5
+	conf.ReconnectLimit = 3
+	conf.ReconnectWindow = Duration(time.Minute)
+	conf.ReconnectCooldown = Duration(time.Second)
+	changes := applyConfig(h, &old, &conf)
+	if len(changes) != 3 {
+		t.Fatalf("unexpected changes: %q", changes)
+	}
+	hc := h.Config()
+	if hc.PeerBandwidth != 1000 || hc.HubBandwidth != 10000 {
+		t.Fatalf("bandwidth was not applied: %d %d", hc.PeerBandwidth, hc.HubBandwidth)
+	}
+	if hc.MaxSearchResults != 20 || hc.SearchResultRate != 5 {
+		t.Fatalf("search limits were not applied: %d %d", hc.MaxSearchResults, hc.SearchResultRate)
+	}
+	if hc.ReconnectLimit != 3 || hc.ReconnectWindow != time.Minute || hc.ReconnectCooldown != time.Second {
+		t.Fatalf("reconnect limits were not applied: %d %v %v", hc.ReconnectLimit, hc.ReconnectWindow, hc.ReconnectCooldown)
+	}
+	if old.PeerBandwidth != 1000 || old.MaxSearchResults != 20 || old.ReconnectLimit != 3 {
+		t.Fatalf("config does not reflect the running state: %+v", old)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	dc "github.com/direct-connect/go-dcpp"
+)
+
+// options are the command line settings of the pinger.
+type options struct {
+	timeout     time.Duration
+	concurrency int
+	json        bool
+	addrs       []string
+}
+
+// parseArgs parses the flags and the hub addresses. Addresses are read from stdin, one per line,
+// if none are given or if one of them is "-". Empty lines and lines starting with '#' are skipped.
+func parseArgs(args []string, stdin io.Reader, stderr io.Writer) (*options, error) {
+	fs := flag.NewFlagSet("go-ping", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: go-ping [flags] [address ...]")
+		fmt.Fprintln(stderr, "Addresses are read from stdin if none are given, or if one of them is \"-\".")
+		fs.PrintDefaults()
+	}
+	opts := &options{}
+	fs.DurationVar(&opts.timeout, "timeout", 10*time.Second, "timeout of a single ping")
+	fs.IntVar(&opts.concurrency, "c", 8, "number of hubs to ping concurrently")
+	fs.BoolVar(&opts.json, "json", false, "print results as JSON lines instead of a table")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if opts.timeout <= 0 {
+		return nil, fmt.Errorf("invalid timeout: %v", opts.timeout)
+	}
+	if opts.concurrency <= 0 {
+		return nil, fmt.Errorf("invalid concurrency: %d", opts.concurrency)
+	}
+	addrs := fs.Args()
+	if len(addrs) == 0 {
+		addrs = []string{"-"}
+	}
+	for _, a := range addrs {
+		if a != "-" {
+			opts.addrs = append(opts.addrs, a)
+			continue
+		}
+		sc := bufio.NewScanner(stdin)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			opts.addrs = append(opts.addrs, line)
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("cannot read addresses: %v", err)
+		}
+		// stdin is consumed
+		stdin = strings.NewReader("")
+	}
+	if len(opts.addrs) == 0 {
+		return nil, errors.New("no hub addresses")
+	}
+	return opts, nil
+}
+
+// result is the outcome of a single ping.
+type result struct {
+	Addr  string      `json:"addr"`
+	Error string      `json:"error,omitempty"`
+	Hub   *dc.HubInfo `json:"hub,omitempty"`
+}
+
+// pingAll pings the hubs concurrently and returns the results in the order of addresses.
+func pingAll(opts *options) []result {
+	out := make([]result, len(opts.addrs))
+	sem := make(chan struct{}, opts.concurrency)
+	var wg sync.WaitGroup
+	for i, addr := range opts.addrs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, addr string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+			defer cancel()
+			out[i].Addr = addr
+			info, err := dc.Ping(ctx, addr)
+			if err != nil {
+				out[i].Error = err.Error()
+				return
+			}
+			out[i].Hub = info
+		}(i, addr)
+	}
+	wg.Wait()
+	return out
+}
+
+func printJSON(w io.Writer, results []result) error {
+	enc := json.NewEncoder(w)
+	for _, r := range results {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printTable(w io.Writer, results []result) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tNAME\tUSERS\tSHARE\tSOFTWARE")
+	for _, r := range results {
+		if r.Hub == nil {
+			fmt.Fprintf(tw, "%s\terror: %s\t\t\t\n", r.Addr, r.Error)
+			continue
+		}
+		soft := ""
+		if s := r.Hub.Server; s != nil {
+			soft = strings.TrimSpace(s.Name + " " + s.Vers)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", r.Addr, r.Hub.Name, r.Hub.UserCount, formatSize(r.Hub.Share), soft)
+	}
+	return tw.Flush()
+}
+
+// formatSize formats the size in bytes with a binary unit, for example "1.5 GiB".
+func formatSize(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return strconv.FormatUint(n, 10) + " B"
+	}
+	v, i := float64(n)/1024, 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64) + " " + units[i:i+1] + "iB"
+}
+
+func main() {
+	opts, err := parseArgs(os.Args[1:], os.Stdin, os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	results := pingAll(opts)
+	if opts.json {
+		err = printJSON(os.Stdout, results)
+	} else {
+		err = printTable(os.Stdout, results)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			os.Exit(1)
+		}
+	}
+}
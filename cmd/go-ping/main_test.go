@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArgs(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		args  []string
+		stdin string
+		exp   *options
+	}{
+		{
+			name: "defaults",
+			args: []string{"adc://example.com:411"},
+			exp:  &options{timeout: 10 * time.Second, concurrency: 8, addrs: []string{"adc://example.com:411"}},
+		},
+		{
+			name: "flags",
+			args: []string{"-timeout", "3s", "-c", "2", "-json", "a.com", "b.com"},
+			exp:  &options{timeout: 3 * time.Second, concurrency: 2, json: true, addrs: []string{"a.com", "b.com"}},
+		},
+		{
+			name:  "stdin",
+			stdin: "a.com\n\n# comment\n  b.com  \n",
+			exp:   &options{timeout: 10 * time.Second, concurrency: 8, addrs: []string{"a.com", "b.com"}},
+		},
+		{
+			name:  "mixed",
+			args:  []string{"a.com", "-", "c.com"},
+			stdin: "b.com\n",
+			exp:   &options{timeout: 10 * time.Second, concurrency: 8, addrs: []string{"a.com", "b.com", "c.com"}},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opts, err := parseArgs(c.args, strings.NewReader(c.stdin), ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(opts, c.exp) {
+				t.Fatalf("unexpected options: %+v", opts)
+			}
+		})
+	}
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-c", "0", "a.com"},
+		{"-timeout", "-1s", "a.com"},
+		{"-unknown", "a.com"},
+	} {
+		if _, err := parseArgs(args, strings.NewReader(""), ioutil.Discard); err == nil {
+			t.Fatalf("expected an error for %q", args)
+		}
+	}
+}
@@ -2,6 +2,7 @@ module github.com/direct-connect/go-dcpp
 
 require (
 	github.com/go-irc/irc v2.1.0+incompatible
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 	golang.org/x/net v0.0.0-20190110200230-915654e7eabc
-	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/text v0.3.0
 )
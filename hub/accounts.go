@@ -0,0 +1,201 @@
+package hub
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/tiger"
+)
+
+// Account is a registered user account.
+type Account struct {
+	Name string
+	Op   bool
+}
+
+// Accounts is a store of registered user accounts.
+type Accounts interface {
+	// Account returns an account registered for a given nick.
+	// It returns false if the nick is not registered.
+	Account(name string) (Account, bool)
+	// CheckPassword checks if the password matches the one of the registered account.
+	CheckPassword(name, pass string) bool
+}
+
+// ADCAccounts is an optional interface for Accounts that allows ADC users to log in with a password.
+//
+// ADC clients never send the password itself, only the hash of the password and the random salt
+// sent by the hub. Thus, the password must be known to the hub, and cannot be checked against
+// a one-way hash used by CheckPassword.
+type ADCAccounts interface {
+	Accounts
+	// CheckADCPassword checks if the hash sent by the ADC client matches the password of the registered
+	// account and a given salt. See adc.HashPassword.
+	CheckADCPassword(name string, salt []byte, hash tiger.Hash) bool
+}
+
+var _ ADCAccounts = (*FileAccounts)(nil)
+
+// fileAccount is an account entry stored in the file.
+type fileAccount struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+	Op   bool   `json:"op,omitempty"`
+	// ADCPass is a plain password used for ADC logins, see ADCAccounts.
+	ADCPass string `json:"adc_pass,omitempty"`
+}
+
+// FileAccounts is an accounts store backed by a JSON file.
+// Passwords are stored as bcrypt hashes. ADC passwords are optional and stored in plain text,
+// see SetADCPassword.
+type FileAccounts struct {
+	path string
+
+	mu       sync.RWMutex
+	accounts map[string]fileAccount
+}
+
+// OpenFileAccounts loads accounts from a given file. The file is created on the first write, if it doesn't exist.
+func OpenFileAccounts(path string) (*FileAccounts, error) {
+	a := &FileAccounts{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads accounts from the file.
+func (a *FileAccounts) Reload() error {
+	data, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		data, err = nil, nil
+	} else if err != nil {
+		return err
+	}
+	var list []fileAccount
+	if len(data) != 0 {
+		if err = json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+	}
+	accounts := make(map[string]fileAccount, len(list))
+	for _, acc := range list {
+		if acc.Name == "" || acc.Hash == "" {
+			return errors.New("invalid account entry: name and hash must be set")
+		}
+		accounts[acc.Name] = acc
+	}
+	a.mu.Lock()
+	a.accounts = accounts
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *FileAccounts) Account(name string) (Account, bool) {
+	a.mu.RLock()
+	acc, ok := a.accounts[name]
+	a.mu.RUnlock()
+	if !ok {
+		return Account{}, false
+	}
+	return Account{Name: acc.Name, Op: acc.Op}, true
+}
+
+func (a *FileAccounts) CheckPassword(name, pass string) bool {
+	a.mu.RLock()
+	acc, ok := a.accounts[name]
+	a.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(acc.Hash), []byte(pass)) == nil
+}
+
+func (a *FileAccounts) CheckADCPassword(name string, salt []byte, hash tiger.Hash) bool {
+	a.mu.RLock()
+	acc, ok := a.accounts[name]
+	a.mu.RUnlock()
+	if !ok || acc.ADCPass == "" {
+		return false
+	}
+	exp := adc.HashPassword(acc.ADCPass, salt)
+	return subtle.ConstantTimeCompare(exp[:], hash[:]) == 1
+}
+
+// SetAccount adds or updates the account and writes all accounts to the file.
+// The ADC password of an existing account is kept.
+func (a *FileAccounts) SetAccount(name, pass string, op bool) error {
+	if name == "" {
+		return errors.New("name must be set")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	accounts := make(map[string]fileAccount, len(a.accounts)+1)
+	for k, v := range a.accounts {
+		accounts[k] = v
+	}
+	accounts[name] = fileAccount{Name: name, Hash: string(hash), Op: op, ADCPass: a.accounts[name].ADCPass}
+	if err = a.write(accounts); err != nil {
+		return err
+	}
+	a.accounts = accounts
+	return nil
+}
+
+// SetADCPassword sets the password that a registered user can use to log in with ADC clients,
+// and writes all accounts to the file. Empty password disables ADC logins for the account.
+//
+// The password is stored in plain text, since ADC clients only send the hash of it. It's better
+// to use a different password than the one set by SetAccount.
+func (a *FileAccounts) SetADCPassword(name, pass string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	acc, ok := a.accounts[name]
+	if !ok {
+		return errors.New("account is not registered")
+	}
+	accounts := make(map[string]fileAccount, len(a.accounts))
+	for k, v := range a.accounts {
+		accounts[k] = v
+	}
+	acc.ADCPass = pass
+	accounts[name] = acc
+	if err := a.write(accounts); err != nil {
+		return err
+	}
+	a.accounts = accounts
+	return nil
+}
+
+// write saves the accounts to the file. Write lock must be held.
+func (a *FileAccounts) write(accounts map[string]fileAccount) error {
+	list := make([]fileAccount, 0, len(accounts))
+	for _, acc := range accounts {
+		list = append(list, acc)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so the file is never left in a partial state
+	tmp := a.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
@@ -0,0 +1,251 @@
+package hub
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-irc/irc"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+func newTestAccounts(t testing.TB) *FileAccounts {
+	dir, err := ioutil.TempDir("", "go-dcpp-accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	acc, err := OpenFileAccounts(filepath.Join(dir, "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acc
+}
+
+func TestFileAccounts(t *testing.T) {
+	acc := newTestAccounts(t)
+	if err := acc.SetAccount("bob", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.SetAccount("alice", "pass", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, ok := acc.Account("bob"); !ok || a.Name != "bob" || a.Op {
+		t.Fatalf("unexpected account: %v, %v", a, ok)
+	}
+	if a, ok := acc.Account("alice"); !ok || !a.Op {
+		t.Fatalf("unexpected account: %v, %v", a, ok)
+	}
+	if _, ok := acc.Account("carol"); ok {
+		t.Fatal("unexpected account")
+	}
+	if !acc.CheckPassword("bob", "secret") {
+		t.Fatal("password should match")
+	}
+	if acc.CheckPassword("bob", "pass") || acc.CheckPassword("carol", "") {
+		t.Fatal("password should not match")
+	}
+
+	data, err := ioutil.ReadFile(acc.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(data); !strings.Contains(s, `"alice"`) {
+		t.Fatalf("accounts are not saved:\n%s", s)
+	} else if strings.Contains(s, "secret") || strings.Contains(s, `"pass"`) {
+		t.Fatalf("plain passwords are stored:\n%s", s)
+	}
+
+	// update the file from a second store and reload the first one
+	acc2, err := OpenFileAccounts(acc.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = acc2.SetAccount("bob", "secret2", true); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := acc.Account("bob"); a.Op {
+		t.Fatal("account changed before reload")
+	}
+	if err = acc.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := acc.Account("bob"); !a.Op {
+		t.Fatal("account was not reloaded")
+	}
+	if !acc.CheckPassword("bob", "secret2") || !acc.CheckPassword("alice", "pass") {
+		t.Fatal("password should match")
+	}
+}
+
+// readNMDC skips messages until the one with a given command is received.
+func readNMDC(t testing.TB, c *nmdc.Conn, cmd string) nmdc.Message {
+	deadline := time.Now().Add(testTimeout)
+	for {
+		m, err := c.ReadMsg(deadline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Cmd() == cmd {
+			return m
+		}
+	}
+}
+
+func TestNMDCLoginPassword(t *testing.T) {
+	acc := newTestAccounts(t)
+	if err := acc.SetAccount("bob", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Name: "test", Accounts: acc})
+
+	login := func(pass string) *nmdc.Conn {
+		c, err := nmdc.NewConn(dialPipe(t, h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.SendClientHandshake(time.Now().Add(testTimeout), "bob", nmdc.FeaNoHello, nmdc.FeaNoGetINFO)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readNMDC(t, c, "GetPass")
+		err = c.WriteMsg(&nmdc.MyPass{String: nmdc.String(pass)})
+		if err == nil {
+			err = c.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := login("wrong")
+	readNMDC(t, c, "BadPass")
+
+	c = login("secret")
+	readNMDC(t, c, "Hello")
+	if m := readNMDC(t, c, "LogedIn").(*nmdc.LogedIn); m.Name != "bob" {
+		t.Fatalf("unexpected name: %q", m.Name)
+	}
+	err := c.SendClientInfo(time.Now(), &nmdc.MyInfo{
+		Name: "bob", Client: "test", Version: "1.0", Mode: nmdc.UserModeActive,
+		Flag: nmdc.FlagStatusNormal, Conn: "LAN(T3)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := c.ReadMsg(time.Time{}); err != nil {
+				return
+			}
+		}
+	}()
+	if p := waitPeer(t, h, "bob"); !p.User().Op {
+		t.Fatal("expected an operator")
+	}
+}
+
+func TestIRCLoginPassword(t *testing.T) {
+	acc := newTestAccounts(t)
+	if err := acc.SetAccount("bob", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Name: "test", Accounts: acc})
+
+	c := irc.NewConn(dialPipe(t, h))
+	for _, m := range []*irc.Message{
+		{Command: "PASS", Params: []string{"wrong"}},
+		{Command: "NICK", Params: []string{"bob"}},
+		{Command: "USER", Params: []string{"bob", "0", "*", "bob"}},
+	} {
+		if err := c.WriteMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	} else if m.Command != "464" {
+		t.Fatalf("unexpected reply: %v", m)
+	}
+}
+
+func TestADCLoginPassword(t *testing.T) {
+	acc := newTestAccounts(t)
+	if err := acc.SetAccount("bob", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.SetAccount("carol", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.SetADCPassword("bob", "adc-secret"); err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Name: "test", Accounts: acc})
+
+	login := func(name, pass string) *testADC {
+		c := dialADC(t, h)
+		c.handshake()
+		c.identify(adc.User{Name: name})
+		c.password(pass)
+		return c
+	}
+	for _, c := range []struct {
+		name, nick, pass string
+	}{
+		{name: "wrong", nick: "bob", pass: "secret"},
+		{name: "no ADC password", nick: "carol", pass: "secret"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cl := login(c.nick, c.pass)
+			if st, ok := cl.expectInfo().(adc.Status); !ok || st.Sev != adc.Fatal || st.Code != adc.CodeInvalidPassword {
+				t.Fatalf("unexpected status: %#v", st)
+			}
+		})
+	}
+
+	c := login("bob", "adc-secret")
+	c.expectUser(c.sid)
+	if p := waitPeer(t, h, "bob"); !p.User().Op {
+		t.Fatal("expected an operator")
+	}
+	// unregistered nicks are allowed
+	loginADC(t, h, "alice")
+}
+
+func TestFileAccountsADCPassword(t *testing.T) {
+	acc := newTestAccounts(t)
+	if err := acc.SetADCPassword("bob", "secret"); err == nil {
+		t.Fatal("expected an error for unregistered nick")
+	}
+	if err := acc.SetAccount("bob", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("salt")
+	if acc.CheckADCPassword("bob", salt, adc.HashPassword("secret", salt)) {
+		t.Fatal("ADC password is not set")
+	}
+	if err := acc.SetADCPassword("bob", "adc"); err != nil {
+		t.Fatal(err)
+	}
+	// the password is kept when the account is updated
+	if err := acc.SetAccount("bob", "secret2", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !acc.CheckADCPassword("bob", salt, adc.HashPassword("adc", salt)) {
+		t.Fatal("password should match")
+	}
+	if acc.CheckADCPassword("bob", []byte("other"), adc.HashPassword("adc", salt)) {
+		t.Fatal("password should not match with a different salt")
+	}
+}
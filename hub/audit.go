@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// AuditAction is a type of the moderation event.
+type AuditAction string
+
+const (
+	// AuditKick is recorded when the user is kicked from the hub.
+	AuditKick = AuditAction("kick")
+	// AuditRedirect is recorded when the user is redirected to another hub. The Redirect field is set
+	// to the address of that hub.
+	AuditRedirect = AuditAction("redirect")
+	// AuditLoginReject is recorded when the hub refuses the login, for example
+	// because the nick is taken, the password is wrong or the user doesn't meet the limits.
+	AuditLoginReject = AuditAction("login_reject")
+	// AuditBan is recorded when an IP or a network is banned. The IP field is set to the network.
+	AuditBan = AuditAction("ban")
+)
+
+// AuditEvent is a record of the moderation action.
+type AuditEvent struct {
+	Time   time.Time   `json:"time"`
+	Action AuditAction `json:"action"`
+	// Actor is the name of the user that performed the action. Empty if it was done by the hub.
+	Actor  string `json:"actor,omitempty"`
+	Nick   string `json:"nick,omitempty"`
+	CID    string `json:"cid,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Redirect is the address the user was redirected to.
+	Redirect string `json:"redirect,omitempty"`
+}
+
+// AuditLogger records moderation actions. It is called synchronously and must be safe for concurrent use.
+type AuditLogger interface {
+	Audit(e AuditEvent)
+}
+
+// NewJSONAuditLog creates an audit logger that writes events to w as JSON lines.
+func NewJSONAuditLog(w io.Writer) AuditLogger {
+	return &jsonAuditLog{enc: json.NewEncoder(w)}
+}
+
+type jsonAuditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (l *jsonAuditLog) Audit(e AuditEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		log.Println("audit log:", err)
+	}
+}
+
+// audit fills the time and the address of the event and sends it to the audit logger, if it's set.
+func (h *Hub) audit(e AuditEvent, addr net.Addr) {
+	logger := h.config().AuditLog
+	if logger == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = h.now().UTC()
+	}
+	if addr != nil {
+		if ip := remoteIP(addr); ip != nil {
+			e.IP = ip.String()
+		}
+	}
+	logger.Audit(e)
+}
+
+// auditLoginReject records the login refused by the hub.
+func (h *Hub) auditLoginReject(addr net.Addr, nick string, reason error) {
+	h.audit(AuditEvent{Action: AuditLoginReject, Nick: nick, Reason: reason.Error()}, addr)
+}
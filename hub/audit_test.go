@@ -0,0 +1,155 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+type testAuditLog struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (l *testAuditLog) Audit(e AuditEvent) {
+	l.mu.Lock()
+	l.events = append(l.events, e)
+	l.mu.Unlock()
+}
+
+// expect waits for the audit event and checks that no other events were recorded.
+func (l *testAuditLog) expect(t testing.TB, action AuditAction, nick string) AuditEvent {
+	deadline := time.Now().Add(testTimeout)
+	for {
+		l.mu.Lock()
+		n := len(l.events)
+		l.mu.Unlock()
+		if n != 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("no audit events")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// make sure the event is not recorded twice
+	time.Sleep(50 * time.Millisecond)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) != 1 {
+		t.Fatalf("expected one event, got: %#v", l.events)
+	}
+	e := l.events[0]
+	l.events = nil
+	if e.Action != action || e.Nick != nick || e.Time.IsZero() || e.Reason == "" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	return e
+}
+
+func TestAuditKick(t *testing.T) {
+	audit := &testAuditLog{}
+	h := New(Config{Name: "test", AuditLog: audit})
+
+	bob := loginADC(t, h, "bob")
+	if err := h.byName("bob").Kick("spam"); err != nil {
+		t.Fatal(err)
+	}
+	e := audit.expect(t, AuditKick, "bob")
+	if e.CID != bob.pid.Hash().String() || e.Reason != "spam" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	loginNMDCFrom(t, h, addr, nmdc.MyInfo{Name: "alice"})
+	if err := h.byName("alice").Kick("flood"); err != nil {
+		t.Fatal(err)
+	}
+	e = audit.expect(t, AuditKick, "alice")
+	if e.IP != "10.0.0.1" || e.Reason != "flood" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+func TestAuditRedirect(t *testing.T) {
+	audit := &testAuditLog{}
+	h := New(Config{Name: "test", AuditLog: audit})
+
+	loginADC(t, h, "bob")
+	if err := h.Redirect(h.byName("bob"), "adcs://example.org:411", "hub restart"); err != nil {
+		t.Fatal(err)
+	}
+	e := audit.expect(t, AuditRedirect, "bob")
+	if e.Redirect != "adcs://example.org:411" || e.Reason != "hub restart" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if st := h.Stats(); st.Kicks != 0 {
+		t.Fatalf("redirect is counted as a kick: %d", st.Kicks)
+	}
+}
+
+func TestAuditLoginReject(t *testing.T) {
+	audit := &testAuditLog{}
+	h := New(Config{Name: "test", MaxUsers: 1, AuditLog: audit})
+
+	loginADC(t, h, "bob")
+
+	c := dialADC(t, h)
+	c.handshake()
+	c.identify(adc.User{Name: "bob"})
+	if st, ok := c.expectInfo().(adc.Status); !ok || st.Code != adc.CodeNickTaken {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+	e := audit.expect(t, AuditLoginReject, "bob")
+	if e.CID != c.pid.Hash().String() {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	conn, err := nmdc.NewConn(dialPipe(t, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(testTimeout)
+	_, err = conn.SendClientHandshake(deadline, "alice", nmdc.FeaNoHello, nmdc.FeaNoGetINFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var full nmdc.HubIsFull
+	if err = conn.ReadMsgTo(deadline, &full); err != nil {
+		t.Fatal(err)
+	}
+	audit.expect(t, AuditLoginReject, "alice")
+}
+
+func TestJSONAuditLog(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	h := New(Config{Name: "test", AuditLog: NewJSONAuditLog(buf)})
+
+	h.audit(AuditEvent{Action: AuditKick, Actor: "op", Nick: "bob", Reason: "spam"}, nil)
+	h.auditLoginReject(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, "alice", errNickTaken)
+
+	var events []AuditEvent
+	sc := bufio.NewScanner(buf)
+	for sc.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if e := events[0]; e.Action != AuditKick || e.Actor != "op" || e.Nick != "bob" || e.Time.IsZero() {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if e := events[1]; e.Action != AuditLoginReject || e.IP != "10.0.0.1" || e.Reason != errNickTaken.Error() {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
@@ -0,0 +1,148 @@
+package hub
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// bandwidthBurst is the amount of time the bandwidth limiter can save up for bursts.
+const bandwidthBurst = time.Second / 4
+
+// rateLimiter is a token bucket that limits the number of bytes per second.
+//
+// Callers may take more tokens than available, in which case they are blocked
+// until the debt is paid off. Thus, writers are slowed down instead of losing data.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a limiter for a given number of bytes per second.
+// It returns nil if the rate is not positive, which means no limit.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate) * bandwidthBurst.Seconds()
+	return &rateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// setRate changes the number of bytes per second. Zero or negative rate disables the limit.
+func (l *rateLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	l.rate = float64(rate)
+	l.burst = float64(rate) * bandwidthBurst.Seconds()
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.mu.Unlock()
+}
+
+// wait takes n bytes from the bucket and blocks until the limit allows to send them.
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// meter counts the bytes transferred in total and during the last second.
+type meter struct {
+	mu    sync.Mutex
+	total uint64
+	sec   int64  // current second
+	cur   uint64 // bytes in the current second
+	prev  uint64 // bytes in the previous second
+}
+
+func (m *meter) add(n int) {
+	if n <= 0 {
+		return
+	}
+	sec := time.Now().Unix()
+	m.mu.Lock()
+	m.advance(sec)
+	m.cur += uint64(n)
+	m.total += uint64(n)
+	m.mu.Unlock()
+}
+
+// advance starts a new one-second window, if necessary. Lock must be held.
+func (m *meter) advance(sec int64) {
+	switch sec {
+	case m.sec:
+		return
+	case m.sec + 1:
+		m.prev = m.cur
+	default:
+		m.prev = 0
+	}
+	m.sec, m.cur = sec, 0
+}
+
+// stats returns the total number of bytes and the number of bytes transferred during the last second.
+func (m *meter) stats() (total, rate uint64) {
+	sec := time.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(sec)
+	return m.total, m.prev
+}
+
+// limitedConn throttles and accounts the traffic of the connection.
+// Both per-connection and hub-wide limiters are optional.
+type limitedConn struct {
+	net.Conn
+	h *Hub
+
+	rd, wr *rateLimiter
+}
+
+// limitConn wraps the connection with the bandwidth limits and accounting of the hub.
+func (h *Hub) limitConn(conn net.Conn) net.Conn {
+	conf := h.config()
+	return &limitedConn{
+		Conn: conn, h: h,
+		rd: newRateLimiter(conf.PeerBandwidth),
+		wr: newRateLimiter(conf.PeerBandwidth),
+	}
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.h.traffic.recv.add(n)
+	c.rd.wait(n)
+	c.h.traffic.rd.wait(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	c.wr.wait(len(p))
+	c.h.traffic.wr.wait(len(p))
+	n, err := c.Conn.Write(p)
+	c.h.traffic.sent.add(n)
+	return n, err
+}
@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerBandwidth(t *testing.T) {
+	const rate = 256 << 10
+	h := New(Config{Name: "test", PeerBandwidth: rate})
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	conn := h.limitConn(c2)
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, c1)
+	}()
+
+	buf := make([]byte, 4096)
+	const size = rate / 2
+	start := time.Now()
+	for n := 0; n < size; n += len(buf) {
+		if _, err := conn.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = conn.Close()
+	dt := time.Since(start)
+
+	// the first part is sent without waiting, since the limiter allows bursts
+	exp := time.Duration(float64(size)/rate*float64(time.Second)) - bandwidthBurst
+	if dt < exp*8/10 || dt > exp*12/10 {
+		t.Fatalf("unexpected duration: %v, expected %v", dt, exp)
+	}
+	st := h.Stats()
+	if st.BytesSent != size {
+		t.Fatalf("unexpected traffic: %d", st.BytesSent)
+	}
+}
+
+func TestSetHubBandwidth(t *testing.T) {
+	const rate = 256 << 10
+	h := New(Config{Name: "test"})
+	h.SetBandwidth(0, rate)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	conn := h.limitConn(c2)
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, c1)
+	}()
+
+	buf := make([]byte, 4096)
+	const size = rate / 2
+	start := time.Now()
+	for n := 0; n < size; n += len(buf) {
+		if _, err := conn.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dt := time.Since(start)
+	exp := time.Duration(float64(size)/rate*float64(time.Second)) - bandwidthBurst
+	if dt < exp*8/10 || dt > exp*12/10 {
+		t.Fatalf("unexpected duration: %v, expected %v", dt, exp)
+	}
+
+	// the limit is lifted for existing connections as well
+	h.SetBandwidth(0, 0)
+	start = time.Now()
+	for n := 0; n < size; n += len(buf) {
+		if _, err := conn.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = conn.Close()
+	if dt = time.Since(start); dt > exp {
+		t.Fatalf("the limit was not lifted: %v", dt)
+	}
+}
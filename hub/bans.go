@@ -0,0 +1,264 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// banPruneInterval is the period of removing expired bans.
+const banPruneInterval = time.Minute
+
+// IPBan bans an IP address or a network.
+type IPBan struct {
+	// Net is the banned network in CIDR notation, for example "10.0.0.0/24". Single IPs are stored
+	// as networks with one address, for example "10.0.0.1/32".
+	Net string `json:"net"`
+	// Expires is the time when the ban ends. Zero means the ban is permanent.
+	Expires time.Time `json:"expires,omitempty"`
+
+	sub *net.IPNet
+}
+
+func (b IPBan) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && !now.Before(b.Expires)
+}
+
+// IPBans is a list of IP bans. Bans are kept in memory, or in a JSON file if the list is opened
+// with OpenIPBans.
+type IPBans struct {
+	path string
+
+	mu   sync.RWMutex
+	bans []IPBan
+}
+
+// OpenIPBans loads bans from a given file and removes the expired ones.
+// The file is created on the first write, if it doesn't exist.
+func OpenIPBans(path string) (*IPBans, error) {
+	b := &IPBans{path: path}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload re-reads bans from the file and removes the expired ones.
+// It does nothing if the bans are kept in memory.
+func (b *IPBans) Reload() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		data, err = nil, nil
+	} else if err != nil {
+		return err
+	}
+	var list []IPBan
+	if len(data) != 0 {
+		if err = json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+	}
+	for i := range list {
+		if list[i].sub, err = parseIPNet(list[i].Net); err != nil {
+			return err
+		}
+		list[i].Net = list[i].sub.String()
+	}
+	b.mu.Lock()
+	b.bans = list
+	b.mu.Unlock()
+	return b.prune(time.Now())
+}
+
+// List returns all bans, including the expired ones that were not removed yet.
+func (b *IPBans) List() []IPBan {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]IPBan(nil), b.bans...)
+}
+
+// add bans the network until a given time, or permanently if the time is zero.
+// The existing ban of the same network is replaced.
+func (b *IPBans) add(sub *net.IPNet, expires time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ban := IPBan{Net: sub.String(), Expires: expires, sub: sub}
+	list := make([]IPBan, 0, len(b.bans)+1)
+	for _, v := range b.bans {
+		if v.Net != ban.Net {
+			list = append(list, v)
+		}
+	}
+	list = append(list, ban)
+	if err := b.write(list); err != nil {
+		return err
+	}
+	b.bans = list
+	return nil
+}
+
+// remove lifts the ban of the network. It returns false if the network is not banned.
+func (b *IPBans) remove(sub *net.IPNet) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.filter(func(v IPBan) bool {
+		return v.Net != sub.String()
+	})
+}
+
+// prune removes expired bans.
+func (b *IPBans) prune(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.filter(func(v IPBan) bool {
+		return !v.expired(now)
+	})
+	return err
+}
+
+// filter keeps bans that match the function, and saves the list if it changed.
+// It returns true if any bans were removed. Write lock must be held.
+func (b *IPBans) filter(keep func(v IPBan) bool) (bool, error) {
+	list := make([]IPBan, 0, len(b.bans))
+	for _, v := range b.bans {
+		if keep(v) {
+			list = append(list, v)
+		}
+	}
+	if len(list) == len(b.bans) {
+		return false, nil
+	}
+	if err := b.write(list); err != nil {
+		return false, err
+	}
+	b.bans = list
+	return true, nil
+}
+
+// match returns an active ban that covers a given IP.
+func (b *IPBans) match(now time.Time, ip net.IP) (IPBan, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, v := range b.bans {
+		if v.sub.Contains(ip) && !v.expired(now) {
+			return v, true
+		}
+	}
+	return IPBan{}, false
+}
+
+// write saves the bans to the file, if it's set. Write lock must be held.
+func (b *IPBans) write(list []IPBan) error {
+	if b.path == "" {
+		return nil
+	}
+	list = append([]IPBan(nil), list...)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Net < list[j].Net
+	})
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so the file is never left in a partial state
+	tmp := b.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// BanIP bans the IP address or the network for a given duration. Zero duration makes the ban permanent.
+// The network is either a CIDR, for example "10.0.0.0/24" or "2001:db8::/32", or a single IP address.
+// Connections from banned addresses are refused before the handshake. Users that are already
+// on the hub are not affected, see KickByIP.
+func (h *Hub) BanIP(cidr string, d time.Duration) error {
+	sub, err := parseIPNet(cidr)
+	if err != nil {
+		return err
+	} else if d < 0 {
+		return fmt.Errorf("invalid ban duration: %v", d)
+	}
+	var expires time.Time
+	if d > 0 {
+		expires = h.now().Add(d).UTC()
+	}
+	if err = h.bans.add(sub, expires); err != nil {
+		return err
+	}
+	if d > 0 {
+		h.startPruneBans()
+	}
+	e := AuditEvent{Action: AuditBan, IP: sub.String()}
+	if d > 0 {
+		e.Reason = "banned for " + d.String()
+	}
+	h.audit(e, nil)
+	return nil
+}
+
+// UnbanIP lifts the ban of the IP address or the network. It returns false if there is no such ban.
+// Bans of other networks that contain the address are not affected.
+func (h *Hub) UnbanIP(cidr string) (bool, error) {
+	sub, err := parseIPNet(cidr)
+	if err != nil {
+		return false, err
+	}
+	return h.bans.remove(sub)
+}
+
+// BannedIPs returns all active IP bans.
+func (h *Hub) BannedIPs() []IPBan {
+	now := h.now()
+	var out []IPBan
+	for _, b := range h.bans.List() {
+		if !b.expired(now) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// checkBan refuses the connection from the banned IP.
+func (h *Hub) checkBan(conn net.Conn) error {
+	ip := remoteIP(conn.RemoteAddr())
+	if ip == nil {
+		return nil
+	}
+	b, ok := h.bans.match(h.now(), ip)
+	if !ok {
+		return nil
+	} else if b.Expires.IsZero() {
+		return errBanned
+	}
+	return fmt.Errorf("%v until %s", errBanned, b.Expires.UTC().Format(time.RFC1123))
+}
+
+// startPruneBans starts removing expired bans in the background, unless it's already started.
+// The hub only needs it if the bans are configured or expiring bans were added, so hubs without
+// any bans don't keep the goroutine.
+func (h *Hub) startPruneBans() {
+	h.pruneBans.Do(func() {
+		go h.pruneBansLoop()
+	})
+}
+
+// pruneBansLoop periodically removes expired bans.
+func (h *Hub) pruneBansLoop() {
+	ticker := time.NewTicker(banPruneInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := h.bans.prune(h.now()); err != nil {
+			log.Println("cannot remove expired bans:", err)
+		}
+	}
+}
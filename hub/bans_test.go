@@ -0,0 +1,192 @@
+package hub
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+func TestBanIPMatch(t *testing.T) {
+	h := newTestHub(t)
+	for _, s := range []string{"10.0.0.0/24", "2001:db8::/32", "192.168.1.1", "10.0.0.0/24"} {
+		if err := h.BanIP(s, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(h.BannedIPs()); n != 3 {
+		t.Fatalf("unexpected number of bans: %d", n)
+	}
+	for _, c := range []struct {
+		ip     string
+		banned bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.255", true},
+		{"10.0.1.1", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::ffff:10.0.0.1", true},
+	} {
+		if _, ok := h.bans.match(time.Now(), net.ParseIP(c.ip)); ok != c.banned {
+			t.Errorf("%s: expected banned=%v", c.ip, c.banned)
+		}
+	}
+	for _, s := range []string{"", "10.0.0.0/33", "10.0.0"} {
+		if err := h.BanIP(s, 0); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+
+	if ok, err := h.UnbanIP("10.0.0.5/24"); err != nil || !ok {
+		t.Fatalf("unban failed: %v, %v", ok, err)
+	}
+	if ok, _ := h.UnbanIP("10.0.0.0/24"); ok {
+		t.Fatal("network is already unbanned")
+	}
+	if _, ok := h.bans.match(time.Now(), net.ParseIP("10.0.0.1")); ok {
+		t.Fatal("ban was not lifted")
+	}
+}
+
+func TestBanIPExpiry(t *testing.T) {
+	clock := newTestClock()
+	h := newHub(Config{Name: "test"}, clock.Now)
+	if err := h.BanIP("10.0.0.0/8", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 1234}
+	c := dialADCFrom(t, h, addr)
+	err := c.conn.WriteHubMsg(adc.Supported{Features: adc.ModFeatures{adc.FeaBASE: true, adc.FeaTIGR: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.conn.Flush()
+	st, ok := c.expectInfo().(adc.Status)
+	if !ok || st.Sev != adc.Fatal || !strings.HasPrefix(st.Msg, errBanned.Error()+" until ") {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+
+	clock.Advance(time.Hour)
+	if bans := h.BannedIPs(); len(bans) != 0 {
+		t.Fatalf("unexpected bans: %v", bans)
+	}
+	c = dialADCFrom(t, h, addr)
+	c.handshake()
+	c.identify(adc.User{Name: "bob"})
+	c.expectUser(c.sid)
+
+	if err = h.bans.prune(clock.Now()); err != nil {
+		t.Fatal(err)
+	} else if n := len(h.bans.List()); n != 0 {
+		t.Fatalf("expired bans were not removed: %d", n)
+	}
+}
+
+func TestBanIPPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	bans, err := OpenIPBans(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Name: "test", IPBans: bans})
+	if err = h.BanIP("10.0.0.0/24", 0); err != nil {
+		t.Fatal(err)
+	} else if err = h.BanIP("2001:db8::1", time.Hour); err != nil {
+		t.Fatal(err)
+	} else if err = h.BanIP("10.0.1.0/24", time.Hour); err != nil {
+		t.Fatal(err)
+	} else if _, err = h.UnbanIP("10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	// the ban expires before the restart
+	old := newHub(Config{Name: "test", IPBans: bans}, newTestClock().Now)
+	if err = old.BanIP("10.0.2.0/24", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	bans, err = OpenIPBans(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := bans.List()
+	if len(list) != 2 {
+		t.Fatalf("unexpected bans: %v", list)
+	}
+	byNet := make(map[string]IPBan)
+	for _, b := range list {
+		byNet[b.Net] = b
+	}
+	if b, ok := byNet["10.0.0.0/24"]; !ok || !b.Expires.IsZero() {
+		t.Fatalf("unexpected ban: %#v", b)
+	}
+	if b, ok := byNet["2001:db8::1/128"]; !ok || time.Until(b.Expires) <= 0 {
+		t.Fatalf("unexpected ban: %#v", b)
+	}
+	h = New(Config{Name: "test", IPBans: bans})
+	if err = h.checkBan(&addrConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7")}}); err != errBanned {
+		t.Fatalf("expected the ban to be restored, got: %v", err)
+	}
+}
+
+func TestBanIPReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	bans, err := OpenIPBans(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Name: "test", IPBans: bans})
+	if err = h.BanIP("10.0.0.0/24", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is edited by hand
+	data := []byte(`[{"net": "10.0.1.0/24"}, {"net": "10.0.2.1", "expires": "2000-01-01T00:00:00Z"}]`)
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = bans.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if list := bans.List(); len(list) != 1 || list[0].Net != "10.0.1.0/24" {
+		t.Fatalf("unexpected bans: %v", list)
+	}
+	if err = h.checkBan(&addrConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7")}}); err != nil {
+		t.Fatalf("the ban should be lifted, got: %v", err)
+	}
+	if err = h.checkBan(&addrConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.1.7")}}); err != errBanned {
+		t.Fatalf("expected the ban to be loaded, got: %v", err)
+	}
+
+	// invalid file keeps the current bans
+	if err = ioutil.WriteFile(path, []byte(`[{"net": "bad"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = bans.Reload(); err == nil {
+		t.Fatal("expected an error")
+	} else if n := len(bans.List()); n != 1 {
+		t.Fatalf("bans should not change: %d", n)
+	}
+}
+
+func TestPruneBansLazy(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		h := New(Config{Name: "test"})
+		// permanent bans never expire
+		if err := h.BanIP("10.0.0.1", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("hubs without expiring bans started %d goroutines", n-before)
+	}
+}
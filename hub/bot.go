@@ -0,0 +1,111 @@
+package hub
+
+import (
+	"net"
+	"strings"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/tiger"
+)
+
+var (
+	_ Peer     = (*botPeer)(nil)
+	_ net.Addr = botAddr{}
+)
+
+// botPeer is a virtual user that represents the hub itself.
+// It sends hub messages and runs commands sent to it in private messages.
+type botPeer struct {
+	BasePeer
+	name string
+	cid  adc.CID
+}
+
+// botAddr is a fake address of the hub bot.
+type botAddr struct{}
+
+func (botAddr) Network() string { return "hub" }
+func (botAddr) String() string  { return "hub" }
+
+// initBot registers the hub bot, if it's enabled in the config.
+func (h *Hub) initBot() {
+	conf := h.config()
+	if conf.BotName == "" {
+		return
+	}
+	cid := conf.BotCID
+	if cid.IsZero() {
+		// keep the CID stable across restarts
+		cid = adc.CID(tiger.HashBytes([]byte("bot\x00" + conf.BotName)))
+	}
+	h.bot = &botPeer{
+		BasePeer: BasePeer{
+			hub:     h,
+			addr:    botAddr{},
+			sid:     h.nextSID(),
+			created: h.created,
+			op:      true,
+		},
+		name: conf.BotName,
+		cid:  cid,
+	}
+	h.peers.byName[h.bot.name] = h.bot
+	h.peers.bySID[h.bot.sid] = h.bot
+}
+
+func (b *botPeer) Name() string {
+	return b.name
+}
+
+func (b *botPeer) User() User {
+	conf := b.hub.config()
+	return User{Name: b.name, App: conf.Soft, Op: true}
+}
+
+// adcInfo returns the bot info for ADC clients.
+func (b *botPeer) adcInfo() adc.User {
+	conf := b.hub.config()
+	return adc.User{
+		Name:        b.name,
+		Id:          b.cid,
+		Application: conf.Soft.Name,
+		Version:     conf.Soft.Vers,
+		Type:        adc.UserTypeHub,
+	}
+}
+
+func (b *botPeer) Features() []string { return nil }
+
+func (b *botPeer) Close() error { return nil }
+
+func (b *botPeer) Kick(reason string) error { return errBotKick }
+
+func (b *botPeer) SendError(sev Severity, code int, text string) error { return nil }
+
+func (b *botPeer) PeersJoin(peers []Peer) error { return nil }
+
+func (b *botPeer) PeersLeave(peers []Peer, reason string) error { return nil }
+
+func (b *botPeer) ChatMsg(from Peer, text string) error { return nil }
+
+// PrivateMsg runs the hub command sent to the bot. The command prefix is optional.
+func (b *botPeer) PrivateMsg(from Peer, text string) error {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, cmdPrefix) {
+		text = cmdPrefix + text
+	}
+	if b.hub.chatCommand(from, text) {
+		return nil
+	}
+	return from.PrivateMsg(b, "Unknown command: "+text)
+}
+
+func (b *botPeer) HubChatMsg(text string) error { return nil }
+
+func (b *botPeer) ConnectTo(peer Peer, addr string, token string, secure bool) error {
+	return errBotConnect
+}
+
+func (b *botPeer) RevConnectTo(peer Peer, token string, secure bool) error {
+	return errBotConnect
+}
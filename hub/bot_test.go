@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+func TestHubBot(t *testing.T) {
+	h := New(Config{Name: "test", BotName: "Hub", MOTD: "hello"})
+	h.RegisterCommand(Command{
+		Name: "ping",
+		Func: func(p Peer, args string) error {
+			return p.HubChatMsg("pong")
+		},
+	})
+	bot := h.byName("Hub")
+	if bot == nil {
+		t.Fatal("bot is not registered")
+	}
+
+	bob := dialADC(t, h)
+	bob.handshake()
+	bob.identify(adc.User{Name: "bob"})
+	if u := bob.expectUser(bot.SID()); u.Name != "Hub" || !u.Type.Is(adc.UserTypeHub) {
+		t.Fatalf("unexpected bot info: %+v", u)
+	}
+	bob.expectUser(bob.sid)
+	waitPeer(t, h, "bob")
+	expectBot := func(name, text string) {
+		t.Helper()
+		p := bob.expect(name)
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(p.Message().Data, &m); err != nil {
+			t.Fatal(err)
+		}
+		var from adc.SID
+		switch p := p.(type) {
+		case *adc.BroadcastPacket:
+			from = p.ID
+		case *adc.DirectPacket:
+			from = p.ID
+		}
+		if from != bot.SID() || string(m.Text) != text {
+			t.Fatalf("unexpected message from %v: %q", from, m.Text)
+		}
+	}
+	expectBot("MSG", "hello")
+
+	alice := loginNMDC(t, h, "alice")
+	if m := alice.expect("").(*nmdc.ChatMessage); m.Name != "Hub" || m.Text != "hello" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	if m := alice.expect("MyINFO").(*nmdc.MyInfo); m.Name != "Hub" && m.Name != "bob" {
+		t.Fatalf("unexpected user: %+v", m)
+	}
+	if n := h.UserCount(); n != 2 || len(h.ListUsers()) != 2 {
+		t.Fatalf("bot should not be counted: %d users", n)
+	}
+
+	// commands can be sent to the bot in private
+	for _, text := range []string{"ping", "!ping"} {
+		err := bob.conn.WriteDirect(bob.sid, bot.SID(), &adc.ChatMessage{Text: adc.String(text), PM: &bob.sid})
+		if err == nil {
+			err = bob.conn.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectBot("MSG", "pong")
+	}
+	err := bob.conn.WriteDirect(bob.sid, bot.SID(), &adc.ChatMessage{Text: "foo", PM: &bob.sid})
+	if err == nil {
+		err = bob.conn.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBot("MSG", "Unknown command: !foo")
+
+	if err = bot.Kick("test"); err == nil {
+		t.Fatal("bot should not be kicked")
+	}
+}
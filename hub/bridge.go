@@ -0,0 +1,71 @@
+package hub
+
+import (
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/tiger"
+)
+
+// defaultBridgeCID derives CIDs of bridged users, if Config.BridgeCID is not set.
+var defaultBridgeCID = HashBridgeCID(tiger.New)
+
+// HashBridgeCID returns a function that derives CIDs of users bridged from other protocols
+// (NMDC, IRC) to ADC, see Config.BridgeCID.
+//
+// The CID is a hash of "user\x00" followed by the nick, truncated to the CID size. Since nicks
+// are unique on the hub, users get distinct CIDs, and the CID of the user stays the same across
+// reconnects. The hash must be at least as long as the CID.
+func HashBridgeCID(newHash func() hash.Hash) func(name string) adc.CID {
+	if n := newHash().Size(); n < len(adc.CID{}) {
+		panic(fmt.Errorf("hash is too short for a CID: %d bytes", n))
+	}
+	return func(name string) adc.CID {
+		h := newHash()
+		_, _ = h.Write([]byte("user\x00" + name))
+		var cid adc.CID
+		copy(cid[:], h.Sum(nil))
+		return cid
+	}
+}
+
+// adcNick returns the nick of the bridged user shown to ADC clients.
+//
+// ADC doesn't allow spaces and control characters in nicks (code points below 33), while NMDC clients
+// may use them. Such characters are replaced with underscores, and invalid UTF-8 sequences with U+FFFD.
+// Bridged users can still be found by the nick shown to ADC clients, see Hub.Lookup.
+func adcNick(name string) string {
+	name = strings.ToValidUTF8(name, "\uFFFD")
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// bindADCName maps the nick shown to ADC clients back to the bridged peer, if it's different from
+// the real one. The mapping is skipped if the nick is taken by another user; ADC clients will see
+// both users with the same nick in this case. Peers lock must be held.
+func (h *Hub) bindADCName(peer Peer, name string) {
+	an := adcNick(name)
+	if an == name {
+		return
+	}
+	if _, ok := h.peers.byName[an]; ok {
+		return
+	} else if _, ok = h.peers.byADCName[an]; ok {
+		return
+	}
+	h.peers.byADCName[an] = peer
+}
+
+// unbindADCName removes the mapping added by bindADCName. Peers lock must be held.
+func (h *Hub) unbindADCName(peer Peer, name string) {
+	an := adcNick(name)
+	if h.peers.byADCName[an] == peer {
+		delete(h.peers.byADCName, an)
+	}
+}
@@ -0,0 +1,137 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+// expectBridgeCID logs in an ADC user and returns the CID of the NMDC user from the user list.
+func expectBridgeCID(t *testing.T, h *Hub, viewer, name string) adc.CID {
+	p, ok := h.Lookup(name)
+	if !ok {
+		t.Fatalf("%s is not on the hub", name)
+	}
+	c := dialADC(t, h)
+	c.handshake()
+	c.identify(adc.User{Name: viewer})
+	u := c.expectUser(p.SID())
+	if u.Name != name {
+		t.Fatalf("unexpected user: %q", u.Name)
+	}
+	_ = c.conn.Close()
+	return u.Id
+}
+
+func TestBridgeCID(t *testing.T) {
+	h := newTestHub(t)
+	loginNMDC(t, h, "alice")
+	loginNMDC(t, h, "bob")
+
+	cid1 := expectBridgeCID(t, h, "v1", "alice")
+	cid2 := expectBridgeCID(t, h, "v2", "bob")
+	if cid1.IsZero() || cid1 == cid2 {
+		t.Fatalf("expected distinct CIDs, got %v and %v", cid1, cid2)
+	}
+
+	// the CID doesn't depend on the connection, or on the hub instance
+	h2 := newTestHub(t)
+	loginNMDC(t, h2, "alice")
+	if cid := expectBridgeCID(t, h2, "v1", "alice"); cid != cid1 {
+		t.Fatalf("CID is not stable: %v != %v", cid, cid1)
+	}
+}
+
+func TestBridgeCIDHash(t *testing.T) {
+	h := New(Config{Name: "test", BridgeCID: HashBridgeCID(sha256.New)})
+	loginNMDC(t, h, "alice")
+
+	sum := sha256.Sum256([]byte("user\x00alice"))
+	var exp adc.CID
+	copy(exp[:], sum[:])
+	if cid := expectBridgeCID(t, h, "v1", "alice"); cid != exp {
+		t.Fatalf("unexpected CID: %v != %v", cid, exp)
+	}
+}
+
+// addBridgedNMDC adds an NMDC user to the hub without the login, so the test can use
+// nicks that NMDC clients cannot send in MyINFO.
+func addBridgedNMDC(t *testing.T, h *Hub, name string) Peer {
+	c1, c2 := net.Pipe()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, c1)
+	}()
+	conn, err := nmdc.NewConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &nmdcPeer{
+		BasePeer: BasePeer{
+			hub:     h,
+			addr:    &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234},
+			sid:     h.nextSID(),
+			created: h.now(),
+		},
+		conn: conn,
+		user: nmdc.MyInfo{Name: nmdc.Name(name)},
+	}
+	t.Cleanup(func() {
+		_ = peer.Close()
+	})
+	h.peers.Lock()
+	h.peers.bySID[peer.sid] = peer
+	h.peers.byName[name] = peer
+	h.bindADCName(peer, name)
+	h.peers.Unlock()
+	return peer
+}
+
+func TestBridgeNick(t *testing.T) {
+	h := newTestHub(t)
+	p := addBridgedNMDC(t, h, "alice smith")
+
+	bob := dialADC(t, h)
+	bob.handshake()
+	bob.identify(adc.User{Name: "bob"})
+	if u := bob.expectUser(p.SID()); u.Name != "alice_smith" {
+		t.Fatalf("unexpected nick: %q", u.Name)
+	}
+
+	// ADC nick maps back to the NMDC user
+	if p2, ok := h.Lookup("alice_smith"); !ok || p2 != p {
+		t.Fatalf("unexpected peer: %v", p2)
+	}
+	// and cannot be taken by another user
+	carol := dialADC(t, h)
+	carol.handshake()
+	carol.identify(adc.User{Name: "alice_smith"})
+	if st, ok := carol.expectInfo().(adc.Status); !ok || st.Code != adc.CodeNickTaken {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+
+	// the mapping is removed when the user leaves
+	_ = p.Close()
+	if _, ok := h.Lookup("alice_smith"); ok {
+		t.Fatal("mapping was not removed")
+	}
+}
+
+func TestADCNick(t *testing.T) {
+	for _, c := range []struct {
+		name, exp string
+	}{
+		{"alice", "alice"},
+		{"alice smith", "alice_smith"},
+		{"a\tb\nc", "a_b_c"},
+		{"a\xffb", "a\uFFFDb"},
+	} {
+		if got := adcNick(c.name); got != c.exp {
+			t.Errorf("%q: expected %q, got %q", c.name, c.exp, got)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCaptureLimit is the size of the captured data per connection, if not set in the config.
+const defaultCaptureLimit = 1 << 20
+
+// Capture directions.
+const (
+	CaptureIn  = "in"  // data received from the client
+	CaptureOut = "out" // data sent by the hub
+)
+
+// capturePasswords are prefixes of protocol frames that carry passwords. The rest of such frames
+// is never written to the capture.
+var capturePasswords = [][]byte{
+	[]byte("HPAS "),    // ADC
+	[]byte("$MyPass "), // NMDC
+	[]byte("PASS "),    // IRC
+}
+
+// CaptureRecord is a single protocol frame in the traffic capture.
+type CaptureRecord struct {
+	Time time.Time `json:"time"`
+	// Dir is either CaptureIn or CaptureOut.
+	Dir string `json:"dir"`
+	// Data is the frame, including the delimiter. The last frame may be incomplete, if the connection
+	// was closed in the middle of it, or if the capture limit was reached.
+	Data []byte `json:"data"`
+}
+
+// ReadCapture reads the traffic capture written by the hub.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	var out []CaptureRecord
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec CaptureRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return out, err
+		}
+		out = append(out, rec)
+	}
+}
+
+// captureConn writes the traffic of the connection to a file, one frame per record.
+type captureConn struct {
+	net.Conn
+	h *Hub
+
+	mu      sync.Mutex
+	f       *os.File
+	enc     *json.Encoder
+	in, out []byte // incomplete frames
+	left    int64  // bytes that can still be written
+	closed  bool
+}
+
+// shouldCapture checks if the traffic of the client with a given address should be captured.
+func (h *Hub) shouldCapture(addr net.Addr) bool {
+	conf := h.config()
+	if conf.CaptureDir == "" {
+		return false
+	} else if len(conf.CaptureIPs) == 0 {
+		return true
+	}
+	ip := remoteIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range conf.CaptureIPs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCaptured serves the connection with a given protocol handler, and captures its traffic, if enabled.
+func (h *Hub) serveCaptured(conn net.Conn, serve func(conn net.Conn) error) error {
+	if !h.shouldCapture(conn.RemoteAddr()) {
+		return serve(conn)
+	}
+	conf := h.config()
+	name := h.now().UTC().Format("20060102-150405.000000000") + "-" + conn.RemoteAddr().String() + ".jsonl"
+	name = strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(name)
+	f, err := os.Create(filepath.Join(conf.CaptureDir, name))
+	if err != nil {
+		log.Printf("%s: cannot capture traffic: %v", conn.RemoteAddr(), err)
+		return serve(conn)
+	}
+	log.Printf("%s: capturing traffic to %s", conn.RemoteAddr(), f.Name())
+	limit := conf.CaptureLimit
+	if limit <= 0 {
+		limit = defaultCaptureLimit
+	}
+	c := &captureConn{Conn: conn, h: h, f: f, enc: json.NewEncoder(f), left: limit}
+	defer c.Close()
+	return serve(c)
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.in = c.capture(CaptureIn, append(c.in, p[:n]...))
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.out = c.capture(CaptureOut, append(c.out, p[:n]...))
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// capture writes complete frames from the buffer and returns the rest. Lock must be held.
+func (c *captureConn) capture(dir string, buf []byte) []byte {
+	for {
+		if c.closed || c.left <= 0 {
+			return nil
+		}
+		// both ADC and IRC frames end with a newline, and NMDC ones end with a pipe
+		i := bytes.IndexAny(buf, "\n|")
+		if i < 0 && int64(len(buf)) > c.left {
+			// the frame will not fit anyway, don't buffer it
+			c.record(dir, buf)
+			return nil
+		} else if i < 0 {
+			return buf
+		}
+		c.record(dir, buf[:i+1])
+		buf = buf[i+1:]
+	}
+}
+
+// record writes a single frame with the password redacted. Lock must be held.
+func (c *captureConn) record(dir string, frame []byte) {
+	if c.closed || c.left <= 0 {
+		return
+	}
+	for _, pref := range capturePasswords {
+		if bytes.HasPrefix(frame, pref) {
+			redacted := append([]byte{}, pref...)
+			redacted = append(redacted, "<redacted>"...)
+			if last := frame[len(frame)-1]; last == '\n' || last == '|' {
+				redacted = append(redacted, last)
+			}
+			frame = redacted
+			break
+		}
+	}
+	c.left -= int64(len(frame))
+	if c.left <= 0 {
+		log.Printf("%s: capture limit reached", c.RemoteAddr())
+	}
+	err := c.enc.Encode(CaptureRecord{Time: c.h.now().UTC(), Dir: dir, Data: frame})
+	if err != nil {
+		log.Printf("%s: cannot capture traffic: %v", c.RemoteAddr(), err)
+		c.left = 0
+	}
+}
+
+func (c *captureConn) Close() error {
+	err := c.Conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return err
+	}
+	// the connection may be closed in the middle of the frame
+	if len(c.in) != 0 {
+		c.record(CaptureIn, c.in)
+	}
+	if len(c.out) != 0 {
+		c.record(CaptureOut, c.out)
+	}
+	c.in, c.out = nil, nil
+	c.closed = true
+	if err2 := c.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package hub
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+func readCaptures(t *testing.T, dir string) [][]CaptureRecord {
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out [][]CaptureRecord
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs, err := ReadCapture(f)
+		_ = f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		out = append(out, recs)
+	}
+	return out
+}
+
+func TestCapture(t *testing.T) {
+	acc := newTestAccounts(t)
+	if err := acc.SetAccount("carol", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	_, sub, _ := net.ParseCIDR("10.0.0.0/8")
+	h := New(Config{Name: "test", Accounts: acc, CaptureDir: dir, CaptureIPs: []*net.IPNet{sub}})
+
+	t.Run("session", func(t *testing.T) {
+		c := dialADCFrom(t, h, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234})
+		c.handshake()
+		c.identify(adc.User{Name: "bob"})
+		c.expectUser(c.sid)
+		waitPeer(t, h, "bob")
+
+		loginNMDCPass(t, h, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1234}, nmdc.MyInfo{Name: "carol"}, "secret")
+		// other clients are not captured
+		loginADC(t, h, "alice")
+	})
+
+	caps := readCaptures(t, dir)
+	if len(caps) != 2 {
+		t.Fatalf("expected 2 captures, got %d", len(caps))
+	}
+	var all []byte
+	for _, recs := range caps {
+		if len(recs) == 0 {
+			t.Fatal("empty capture")
+		}
+		dirs := make(map[string]bool)
+		for _, r := range recs {
+			if r.Time.IsZero() || len(r.Data) == 0 {
+				t.Fatalf("invalid record: %#v", r)
+			}
+			dirs[r.Dir] = true
+			all = append(all, r.Data...)
+		}
+		if !dirs[CaptureIn] || !dirs[CaptureOut] || len(dirs) != 2 {
+			t.Fatalf("unexpected directions: %v", dirs)
+		}
+	}
+	for _, s := range []string{"HSUP ", "ISID ", "BINF ", "$ValidateNick carol|", "$MyPass <redacted>|"} {
+		if !bytes.Contains(all, []byte(s)) {
+			t.Fatalf("expected %q in the capture", s)
+		}
+	}
+	if bytes.Contains(all, []byte("secret")) {
+		t.Fatal("password is not redacted")
+	}
+}
+
+func TestCaptureLimit(t *testing.T) {
+	dir := t.TempDir()
+	h := New(Config{Name: "test", CaptureDir: dir, CaptureLimit: 10})
+
+	t.Run("session", func(t *testing.T) {
+		loginADC(t, h, "bob")
+	})
+
+	caps := readCaptures(t, dir)
+	if len(caps) != 1 {
+		t.Fatalf("expected 1 capture, got %d", len(caps))
+	}
+	recs := caps[0]
+	n := 0
+	for _, r := range recs[:len(recs)-1] {
+		n += len(r.Data)
+	}
+	if n >= 10 {
+		t.Fatalf("capture is over the limit: %d records", len(recs))
+	}
+}
@@ -0,0 +1,48 @@
+package hub
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// clientKeyprint returns the keyprint of the TLS client certificate,
+// or an empty string if the connection is not encrypted or the client didn't present one.
+func clientKeyprint(conn net.Conn) string {
+	for {
+		switch c := conn.(type) {
+		case *peekedConn:
+			conn = c.Conn
+		case *captureConn:
+			conn = c.Conn
+		case *tls.Conn:
+			certs := c.ConnectionState().PeerCertificates
+			if len(certs) == 0 {
+				return ""
+			}
+			return adc.Keyprint(certs[0].Raw)
+		default:
+			return ""
+		}
+	}
+}
+
+// certOp checks the client certificate of the user with a given name against OpCerts.
+// It returns true if the name is bound to the certificate, and errBadCert if the name
+// is bound to a different one.
+func (h *Hub) certOp(name, keyprint string) (bool, error) {
+	certs := h.config().OpCerts
+	if len(certs) == 0 {
+		return false, nil
+	}
+	if keyprint != "" && certs[keyprint] == name {
+		return true, nil
+	}
+	for _, op := range certs {
+		if op == name {
+			return false, errBadCert
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,60 @@
+package hub
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// dialADCTLS connects to the hub over TLS with a given client certificate.
+func dialADCTLS(t testing.TB, h *Hub, cert *tls.Certificate) *testADC {
+	conf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"adc"},
+	}
+	if cert != nil {
+		conf.Certificates = []tls.Certificate{*cert}
+	}
+	conn := tls.Client(dialPipe(t, h), conf)
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return newTestADC(t, conn)
+}
+
+func TestOpCerts(t *testing.T) {
+	hubCert, opCert, otherCert := newTestCert(t), newTestCert(t), newTestCert(t)
+	h := New(Config{
+		Name:    "test",
+		TLS:     &tls.Config{Certificates: []tls.Certificate{*hubCert}},
+		OpCerts: map[string]string{adc.Keyprint(opCert.Certificate[0]): "admin"},
+	})
+
+	for _, cert := range []*tls.Certificate{nil, otherCert} {
+		c := dialADCTLS(t, h, cert)
+		c.handshake()
+		c.identify(adc.User{Name: "admin"})
+		st, ok := c.expectInfo().(adc.Status)
+		if !ok || st.Sev != adc.Fatal || st.Code != adc.CodeInvalidPassword {
+			t.Fatalf("unexpected status: %#v", st)
+		}
+	}
+
+	// other nicks are not affected by the certificate
+	c := dialADCTLS(t, h, opCert)
+	c.handshake()
+	c.identify(adc.User{Name: "bob"})
+	c.expectUser(c.sid)
+	if p := waitPeer(t, h, "bob"); p.User().Op {
+		t.Fatal("bob should not be an operator")
+	}
+
+	c = dialADCTLS(t, h, opCert)
+	c.handshake()
+	c.identify(adc.User{Name: "admin"})
+	c.expectUser(c.sid)
+	if p := waitPeer(t, h, "admin"); !p.User().Op {
+		t.Fatal("expected an operator")
+	}
+}
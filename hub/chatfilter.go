@@ -0,0 +1,81 @@
+package hub
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// ChatFilter checks and modifies main chat messages before they are broadcasted.
+//
+// Filter returns the text that should be sent instead of the original one, or false to drop the message.
+// Dropped messages are not saved to the history. Filters are called without holding hub locks,
+// so they may use the hub API. Hub commands are never filtered.
+type ChatFilter interface {
+	Filter(from Peer, text string) (string, bool)
+}
+
+// ChatFilterFunc is a function that implements ChatFilter.
+type ChatFilterFunc func(from Peer, text string) (string, bool)
+
+// Filter calls the function.
+func (f ChatFilterFunc) Filter(from Peer, text string) (string, bool) {
+	return f(from, text)
+}
+
+// ChatSanitizer is a default chat filter. It removes control characters except new lines and tabs,
+// truncates long messages and drops messages that become empty.
+type ChatSanitizer struct {
+	// MaxLength is the maximal length of the message in characters. Zero means no limit.
+	MaxLength int
+}
+
+// Filter implements ChatFilter.
+func (s ChatSanitizer) Filter(from Peer, text string) (string, bool) {
+	text = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, text)
+	if s.MaxLength > 0 && utf8.RuneCountInString(text) > s.MaxLength {
+		n := 0
+		for i := range text {
+			if n == s.MaxLength {
+				text = text[:i]
+				break
+			}
+			n++
+		}
+	}
+	if strings.TrimSpace(text) == "" {
+		return "", false
+	}
+	return text, true
+}
+
+// filterChat applies chat filters to the main chat message.
+func (h *Hub) filterChat(from Peer, text string) (string, bool) {
+	for _, f := range h.config().ChatFilters {
+		var ok bool
+		if text, ok = f.Filter(from, text); !ok {
+			return "", false
+		}
+	}
+	return text, true
+}
+
+// withChatText returns a copy of the chat message packet with the text replaced.
+// Other fields of the message are preserved.
+func withChatText(p *adc.BroadcastPacket, text string) *adc.BroadcastPacket {
+	rest := []byte(nil)
+	if i := bytes.IndexByte(p.Data, ' '); i >= 0 {
+		rest = p.Data[i:]
+	}
+	cp := *p
+	cp.Data = append([]byte(adc.Escape(text)), rest...)
+	return &cp
+}
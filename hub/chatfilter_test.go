@@ -0,0 +1,62 @@
+package hub
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+var chatSanitizerCases = []struct {
+	max  int
+	text string
+	exp  string
+	ok   bool
+}{
+	{0, "hello", "hello", true},
+	{0, "a\x00b\x07c\x1b[31md\x7f", "abc[31md", true},
+	{0, "line 1\n\tline 2\r\n", "line 1\n\tline 2\n", true},
+	{5, "hello world", "hello", true},
+	{3, "привет", "при", true},
+	{3, "abc", "abc", true},
+	{0, "\x00\x01", "", false},
+	{0, " \n ", "", false},
+}
+
+func TestChatSanitizer(t *testing.T) {
+	for _, c := range chatSanitizerCases {
+		text, ok := ChatSanitizer{MaxLength: c.max}.Filter(nil, c.text)
+		if text != c.exp || ok != c.ok {
+			t.Fatalf("%q: unexpected result: %q, %v", c.text, text, ok)
+		}
+	}
+}
+
+func TestChatFilter(t *testing.T) {
+	dropSpam := ChatFilterFunc(func(from Peer, text string) (string, bool) {
+		return text, !strings.Contains(text, "spam")
+	})
+	h := New(Config{Name: "test", ChatFilters: []ChatFilter{dropSpam, ChatSanitizer{MaxLength: 5}}})
+	bob := loginADC(t, h, "bob")
+	alice := loginADC(t, h, "alice")
+	carol := loginNMDC(t, h, "carol")
+	bob.expectUser(alice.sid)
+
+	bob.sendChat("buy spam")
+	bob.sendChat("he\x07llo world")
+
+	var m adc.ChatMessage
+	if err := adc.Unmarshal(alice.expect("MSG").Message().Data, &m); err != nil {
+		t.Fatal(err)
+	} else if m.Text != "hello" {
+		t.Fatalf("unexpected message: %q", m.Text)
+	}
+	if m := carol.expect("").(*nmdc.ChatMessage); string(m.Text) != "hello" {
+		t.Fatalf("unexpected message: %q", m.Text)
+	}
+	list := h.history.list()
+	if len(list) != 1 || list[0].Text != "hello" {
+		t.Fatalf("unexpected history: %+v", list)
+	}
+}
@@ -0,0 +1,73 @@
+package hub
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// chatLogQueue is the number of chat messages waiting to be written to the sink.
+// Messages are dropped if the queue is full.
+const chatLogQueue = 1024
+
+// ChatSink receives main chat messages, for example to log them to a file or an external service.
+type ChatSink interface {
+	// Write records the chat message. It is called from a single goroutine, in the order
+	// the messages were sent.
+	Write(from, text string, t time.Time)
+}
+
+// NewJSONChatLog creates a chat sink that writes messages to w as JSON lines.
+func NewJSONChatLog(w io.Writer) ChatSink {
+	return &jsonChatLog{enc: json.NewEncoder(w)}
+}
+
+type jsonChatLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (l *jsonChatLog) Write(from, text string, t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.enc.Encode(struct {
+		Time time.Time `json:"time"`
+		From string    `json:"from"`
+		Text string    `json:"text"`
+	}{t.UTC(), from, text})
+	if err != nil {
+		log.Println("chat log:", err)
+	}
+}
+
+type chatLogEntry struct {
+	from, text string
+	time       time.Time
+}
+
+// startChatLog starts writing chat messages to the sink, if it's set in the config.
+func (h *Hub) startChatLog(conf Config) {
+	if conf.ChatSink == nil {
+		return
+	}
+	h.chatLog = make(chan chatLogEntry, chatLogQueue)
+	go func(sink ChatSink) {
+		for e := range h.chatLog {
+			sink.Write(e.from, e.text, e.time)
+		}
+	}(conf.ChatSink)
+}
+
+// logChat queues the chat message for the sink. It never blocks.
+func (h *Hub) logChat(from, text string, t time.Time) {
+	if h.chatLog == nil {
+		return
+	}
+	select {
+	case h.chatLog <- chatLogEntry{from: from, text: text, time: t}:
+	default:
+		log.Println("chat log: queue is full, message dropped")
+	}
+}
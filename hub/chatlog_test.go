@@ -0,0 +1,64 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+type testChatSink chan string
+
+func (s testChatSink) Write(from, text string, t time.Time) {
+	s <- from + ": " + text
+}
+
+func TestChatSink(t *testing.T) {
+	sink := make(testChatSink, 10)
+	h := New(Config{Name: "test", ChatSink: sink})
+	bob := loginADC(t, h, "bob")
+	alice := loginNMDC(t, h, "alice")
+
+	var exp []string
+	for i := 0; i < 3; i++ {
+		text := "msg " + strconv.Itoa(i)
+		bob.sendChat(text)
+		alice.expectChat("bob")
+		exp = append(exp, "bob: "+text)
+	}
+	alice.write(&nmdc.ChatMessage{Name: "alice", Text: "hi"})
+	alice.expectChat("alice")
+	exp = append(exp, "alice: hi")
+
+	for _, e := range exp {
+		select {
+		case got := <-sink:
+			if got != e {
+				t.Fatalf("expected %q, got %q", e, got)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("timeout waiting for %q", e)
+		}
+	}
+}
+
+func TestJSONChatLog(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	ts := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	NewJSONChatLog(buf).Write("bob", "hello", ts)
+
+	var m struct {
+		Time time.Time `json:"time"`
+		From string    `json:"from"`
+		Text string    `json:"text"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Time.Equal(ts) || m.From != "bob" || m.Text != "hello" {
+		t.Fatalf("unexpected entry: %#v", m)
+	}
+}
@@ -0,0 +1,195 @@
+package hub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// ClientRule bans the client software by name, optionally only the versions below a given one.
+type ClientRule struct {
+	// Name of the client application, for example "DC++". Names are case-insensitive.
+	Name string
+	// MinVersion is the lowest allowed version of the client. If empty, all versions are banned.
+	MinVersion string
+}
+
+// checkClient checks if the client software is allowed on the hub.
+func (h *Hub) checkClient(app Software) error {
+	conf := h.config()
+	if len(conf.AllowedClients) != 0 {
+		allowed := false
+		for _, name := range conf.AllowedClients {
+			if strings.EqualFold(name, app.Name) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("client %q is not allowed on this hub, supported clients: %s",
+				app.Name, strings.Join(conf.AllowedClients, ", "))
+		}
+	}
+	for _, r := range conf.BannedClients {
+		if !strings.EqualFold(r.Name, app.Name) {
+			continue
+		}
+		if r.MinVersion == "" {
+			return fmt.Errorf("client %q is banned on this hub", app.Name)
+		}
+		if compareVersions(app.Vers, r.MinVersion) < 0 {
+			return fmt.Errorf("client %s %s is outdated, please upgrade to version %s or newer",
+				app.Name, app.Vers, r.MinVersion)
+		}
+	}
+	return nil
+}
+
+// compareVersions compares two version strings and returns -1, 0 or 1, if a is lower, equal or higher than b.
+//
+// Versions are split to numeric and text parts, for example "2.10rc1" is compared as [2 10 rc 1].
+// Numbers are compared by value and text parts are compared case-insensitively.
+// A version that has an additional text part is considered a pre-release, thus "1.0" > "1.0-beta",
+// while an additional number makes the version higher: "1.0.1" > "1.0".
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		if i >= len(pa) {
+			return -versionTail(pb[i])
+		} else if i >= len(pb) {
+			return versionTail(pa[i])
+		}
+		na, errA := strconv.ParseUint(pa[i], 10, 64)
+		nb, errB := strconv.ParseUint(pb[i], 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return +1
+			}
+		case errA == nil:
+			// number is higher than a pre-release tag
+			return +1
+		case errB == nil:
+			return -1
+		default:
+			if c := strings.Compare(strings.ToLower(pa[i]), strings.ToLower(pb[i])); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+// versionTail compares the first extra part of a longer version to the end of a shorter one.
+func versionTail(s string) int {
+	if n, err := strconv.ParseUint(s, 10, 64); err != nil {
+		// pre-release
+		return -1
+	} else if n == 0 {
+		// trailing zeros are not significant, but the rest of the version may be
+		return 0
+	}
+	return +1
+}
+
+// versionParts splits the version to numeric and text parts, dropping separators.
+// A leading "v" is ignored.
+func versionParts(s string) []string {
+	s = strings.TrimSpace(s)
+	if len(s) > 1 && (s[0] == 'v' || s[0] == 'V') && unicode.IsDigit(rune(s[1])) {
+		s = s[1:]
+	}
+	var (
+		parts []string
+		start = -1
+		digit bool
+	)
+	for i, r := range s {
+		isLetter, isDigit := unicode.IsLetter(r), unicode.IsDigit(r)
+		if start >= 0 && (!(isLetter || isDigit) || isDigit != digit) {
+			parts = append(parts, s[start:i])
+			start = -1
+		}
+		if start < 0 && (isLetter || isDigit) {
+			start, digit = i, isDigit
+		}
+	}
+	if start >= 0 {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+// userFeatures returns features of the user, named as in the SU field of the ADC user info.
+// For other protocols, TLS and active mode flags are reported as ADC0, TCP4 and TCP6.
+func userFeatures(p Peer) []string {
+	if p, ok := p.(*adcPeer); ok {
+		return adcUserFeatures(p.Info())
+	}
+	u := p.User()
+	var list []string
+	if u.TLS {
+		list = append(list, adc.FeaADC0.String())
+	}
+	if u.IPv4 {
+		list = append(list, adc.FeaTCP4.String())
+	}
+	if u.IPv6 {
+		list = append(list, adc.FeaTCP6.String())
+	}
+	return list
+}
+
+func adcUserFeatures(u adc.User) []string {
+	list := make([]string, 0, len(u.Features))
+	for _, f := range u.Features {
+		list = append(list, f.String())
+	}
+	return list
+}
+
+// countClient adds the client software and features to the hub statistics, or removes them if n is negative.
+// Peers lock must be held.
+func (h *Hub) countClient(app Software, features []string, n int) {
+	if h.peers.clients == nil {
+		h.peers.clients = make(map[Software]int)
+		h.peers.features = make(map[string]int)
+	}
+	if h.peers.clients[app] += n; h.peers.clients[app] <= 0 {
+		delete(h.peers.clients, app)
+	}
+	for _, f := range features {
+		if h.peers.features[f] += n; h.peers.features[f] <= 0 {
+			delete(h.peers.features, f)
+		}
+	}
+}
+
+// clientStats returns the number of users by client software name and version, and by supported feature.
+func (h *Hub) clientStats() (clients map[string]map[string]int, features map[string]int) {
+	h.peers.RLock()
+	defer h.peers.RUnlock()
+	if len(h.peers.clients) == 0 {
+		return nil, nil
+	}
+	clients = make(map[string]map[string]int)
+	for app, n := range h.peers.clients {
+		vers := clients[app.Name]
+		if vers == nil {
+			vers = make(map[string]int)
+			clients[app.Name] = vers
+		}
+		vers[app.Vers] = n
+	}
+	features = make(map[string]int, len(h.peers.features))
+	for f, n := range h.peers.features {
+		features[f] = n
+	}
+	return clients, features
+}
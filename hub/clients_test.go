@@ -0,0 +1,134 @@
+package hub
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+var compareVersionsCases = []struct {
+	a, b string
+	exp  int
+}{
+	{"1.0", "1.0", 0},
+	{"1.0", "1.0.0", 0},
+	{"v2.1", "2.1", 0},
+	{"0.868", "0.870", -1},
+	{"2.10", "2.9", +1},
+	{"2.2.1", "2.2", +1},
+	{"1.0-beta", "1.0", -1},
+	{"1.0beta2", "1.0beta10", -1},
+	{"1.0rc1", "1.0-RC1", 0},
+	{"r504", "r505", -1},
+	{"", "1.0", -1},
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, c := range compareVersionsCases {
+		if got := compareVersions(c.a, c.b); got != c.exp {
+			t.Errorf("compare(%q, %q): expected %d, got %d", c.a, c.b, c.exp, got)
+		}
+		if got := compareVersions(c.b, c.a); got != -c.exp {
+			t.Errorf("compare(%q, %q): expected %d, got %d", c.b, c.a, -c.exp, got)
+		}
+	}
+}
+
+func TestADCClientRules(t *testing.T) {
+	h := New(Config{
+		Name:           "test",
+		AllowedClients: []string{"DC++", "AirDC++"},
+		BannedClients: []ClientRule{
+			{Name: "dc++", MinVersion: "0.870"},
+		},
+	})
+
+	var cases = []struct {
+		name string
+		app  string
+		vers string
+		ok   bool
+	}{
+		{name: "allowed", app: "AirDC++", vers: "4.10", ok: true},
+		{name: "not allowed", app: "Hacker", vers: "1.0"},
+		{name: "outdated", app: "DC++", vers: "0.868"},
+		{name: "minimal", app: "DC++", vers: "0.870", ok: true},
+		{name: "old info", vers: "DC++ 0.700"},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cl := dialADC(t, h)
+			cl.handshake()
+			cl.identify(adc.User{
+				Name:        "bob" + string(rune('0'+i)),
+				Application: c.app, Version: c.vers,
+			})
+			if c.ok {
+				cl.expectUser(cl.sid)
+				return
+			}
+			st, ok := cl.expectInfo().(adc.Status)
+			if !ok || st.Sev != adc.Fatal || st.Code != 20 {
+				t.Fatalf("unexpected status: %#v", st)
+			}
+		})
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	h := newTestHub(t)
+	if st := h.Stats(); st.Clients != nil || st.Features != nil {
+		t.Fatalf("unexpected stats: %v, %v", st.Clients, st.Features)
+	}
+
+	bob := dialADC(t, h)
+	bob.handshake()
+	bob.identify(adc.User{Name: "bob", Application: "AirDC++", Version: "3.0",
+		Features: adc.ExtFeatures{adc.FeaTCP4, adc.FeaADC0, adc.FeaSEGA}})
+	bob.expectUser(bob.sid)
+	waitPeer(t, h, "bob")
+
+	alice := dialADC(t, h)
+	alice.handshake()
+	alice.identify(adc.User{Name: "alice", Application: "AirDC++", Version: "4.0",
+		Features: adc.ExtFeatures{adc.FeaTCP4}})
+	alice.expectUser(alice.sid)
+	waitPeer(t, h, "alice")
+
+	loginNMDCFrom(t, h, nil, nmdc.MyInfo{Name: "carol", Client: "DC++", Version: "0.868",
+		Flag: nmdc.FlagStatusNormal | nmdc.FlagTLS | nmdc.FlagIPv4})
+
+	st := h.Stats()
+	expClients := map[string]map[string]int{
+		"AirDC++": {"3.0": 1, "4.0": 1},
+		"DC++":    {"0.868": 1},
+	}
+	if !reflect.DeepEqual(st.Clients, expClients) {
+		t.Fatalf("unexpected clients: %v", st.Clients)
+	}
+	expFeatures := map[string]int{"TCP4": 3, "ADC0": 2, "SEGA": 1}
+	if !reflect.DeepEqual(st.Features, expFeatures) {
+		t.Fatalf("unexpected features: %v", st.Features)
+	}
+
+	// bob upgrades the client and disables the encryption
+	bob.sendInfo([]byte("VE4.0 SUTCP4,SEGA"))
+	bob.expectUser(bob.sid)
+	// alice leaves
+	h.byName("alice").Close()
+
+	st = h.Stats()
+	expClients = map[string]map[string]int{
+		"AirDC++": {"4.0": 1},
+		"DC++":    {"0.868": 1},
+	}
+	if !reflect.DeepEqual(st.Clients, expClients) {
+		t.Fatalf("unexpected clients: %v", st.Clients)
+	}
+	expFeatures = map[string]int{"TCP4": 2, "ADC0": 1, "SEGA": 1}
+	if !reflect.DeepEqual(st.Features, expFeatures) {
+		t.Fatalf("unexpected features: %v", st.Features)
+	}
+}
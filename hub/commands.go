@@ -0,0 +1,144 @@
+package hub
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// cmdPrefix is a prefix of chat messages that are interpreted as hub commands.
+const cmdPrefix = "!"
+
+var errCmdAccess = errors.New("access denied")
+
+func (h *Hub) initCommands() {
+	h.cmds.byName = make(map[string]Command)
+}
+
+// Command is a hub command triggered by a chat message like "!name args".
+type Command struct {
+	Name string
+	// Op commands can only be used by operators.
+	Op bool
+	// Func is called with the peer that sent the command and the rest of the message.
+	// The error, if any, is sent back to the peer.
+	Func func(p Peer, args string) error
+}
+
+// RegisterCommand adds a hub command. Chat messages that trigger the command
+// are not broadcasted and are passed to the command handler instead.
+func (h *Hub) RegisterCommand(c Command) {
+	h.cmds.Lock()
+	h.cmds.byName[c.Name] = c
+	h.cmds.Unlock()
+}
+
+// chatCommand checks if the chat message is a registered hub command and runs it.
+// It returns false if the message should be handled as a regular chat message.
+func (h *Hub) chatCommand(peer Peer, text string) bool {
+	if !strings.HasPrefix(text, cmdPrefix) {
+		return false
+	}
+	text = strings.TrimPrefix(text, cmdPrefix)
+	name, args := text, ""
+	if i := strings.IndexAny(text, " \n"); i >= 0 {
+		name, args = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	h.cmds.RLock()
+	c, ok := h.cmds.byName[name]
+	h.cmds.RUnlock()
+	if !ok {
+		return false
+	}
+	go func() {
+		var err error
+		if c.Op && !peer.User().Op {
+			err = errCmdAccess
+		} else {
+			err = c.Func(peer, args)
+		}
+		if err != nil {
+			log.Printf("%s: command %q failed: %v", peer.RemoteAddr(), name, err)
+			_ = peer.HubChatMsg(err.Error())
+		}
+	}()
+	return true
+}
+
+// UserCommandFlag controls where the user command is shown and who receives it.
+type UserCommandFlag int
+
+const (
+	// CmdHubMenu shows the command in the hub context menu.
+	CmdHubMenu = UserCommandFlag(adc.CategoryHub)
+	// CmdUserMenu shows the command in the user context menu.
+	CmdUserMenu = UserCommandFlag(adc.CategoryUser)
+	// CmdSearchMenu shows the command in the search results context menu.
+	CmdSearchMenu = UserCommandFlag(adc.CategorySearch)
+	// CmdFileListMenu shows the command in the file list context menu.
+	CmdFileListMenu = UserCommandFlag(adc.CategoryFileList)
+
+	// CmdOpOnly sends the command only to operators.
+	CmdOpOnly = UserCommandFlag(0x100)
+
+	cmdMenuMask = CmdHubMenu | CmdUserMenu | CmdSearchMenu | CmdFileListMenu
+)
+
+type userCommand struct {
+	Name    string
+	Command string
+	Flags   UserCommandFlag
+}
+
+func (c userCommand) adc() adc.UserCommand {
+	return adc.UserCommand{
+		Path:     adc.String(c.Name),
+		Command:  "HMSG " + adc.Escape(c.Command) + "\n",
+		Category: adc.Category(c.Flags & cmdMenuMask),
+	}
+}
+
+// visibleTo checks if the command should be sent to a given peer.
+func (c userCommand) visibleTo(p Peer) bool {
+	return c.Flags&CmdOpOnly == 0 || p.User().Op
+}
+
+// AddUserCommand adds a context menu entry for the clients. The name is a menu path separated by '/'.
+// The command is a chat message the client sends to the hub when the entry is selected.
+// It may contain ADC parameters like %[userNI] and usually triggers a hub command (see RegisterCommand).
+//
+// Commands are sent to the clients after login. Clients that are already on the hub receive it immediately.
+// If no menu flags are set, the command is shown in the hub context menu.
+func (h *Hub) AddUserCommand(name, command string, flags ...UserCommandFlag) {
+	c := userCommand{Name: name, Command: command}
+	for _, f := range flags {
+		c.Flags |= f
+	}
+	if c.Flags&cmdMenuMask == 0 {
+		c.Flags |= CmdHubMenu
+	}
+	h.cmds.Lock()
+	h.cmds.user = append(h.cmds.user, c)
+	h.cmds.Unlock()
+
+	for _, p := range h.Peers() {
+		if p2, ok := p.(*adcPeer); ok && c.visibleTo(p2) {
+			_ = p2.sendUserCommands([]userCommand{c})
+		}
+	}
+}
+
+// userCommands returns user commands that should be sent to a given peer.
+func (h *Hub) userCommands(p Peer) []userCommand {
+	h.cmds.RLock()
+	defer h.cmds.RUnlock()
+	var list []userCommand
+	for _, c := range h.cmds.user {
+		if c.visibleTo(p) {
+			list = append(list, c)
+		}
+	}
+	return list
+}
@@ -0,0 +1,93 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// expectCommand skips packets until the user command is received.
+func (c *testADC) expectCommand() adc.UserCommand {
+	p := c.expect("CMD")
+	var cmd adc.UserCommand
+	if err := adc.Unmarshal(p.Message().Data, &cmd); err != nil {
+		c.t.Fatal(err)
+	}
+	return cmd
+}
+
+// expectHubChat skips packets until the chat message from the hub is received.
+func (c *testADC) expectHubChat() string {
+	for {
+		p, ok := c.expect("MSG").(*adc.InfoPacket)
+		if !ok {
+			continue
+		}
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(p.Data, &m); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(m.Text)
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	h := newTestHub(t)
+	called := make(chan string, 1)
+	h.RegisterCommand(Command{
+		Name: "kick",
+		Func: func(p Peer, args string) error {
+			called <- p.Name() + ":" + args
+			return nil
+		},
+	})
+	h.RegisterCommand(Command{
+		Name: "ban", Op: true,
+		Func: func(p Peer, args string) error {
+			t.Error("operator command called")
+			return nil
+		},
+	})
+	h.AddUserCommand("Moderation/Kick", "!kick %[userNI]", CmdUserMenu)
+	h.AddUserCommand("Moderation/Ban", "!ban %[userNI]", CmdUserMenu, CmdOpOnly)
+
+	bob := dialADC(t, h)
+	bob.handshake(adc.FeaUCMD)
+	bob.identify(adc.User{Name: "bob"})
+	bob.expectUser(bob.sid)
+
+	cmd := bob.expectCommand()
+	if cmd.Path != "Moderation/Kick" || cmd.Command != `HMSG !kick\s%[userNI]`+"\n" || cmd.Category != adc.CategoryUser {
+		t.Fatalf("unexpected command: %#v", cmd)
+	}
+
+	// new commands are sent to users that are already on the hub
+	h.AddUserCommand("Rules", "!rules")
+	cmd = bob.expectCommand()
+	if cmd.Path != "Rules" || cmd.Category != adc.CategoryHub {
+		t.Fatalf("unexpected command: %#v", cmd)
+	}
+
+	// client triggers the command
+	bob.write(&adc.HubPacket{
+		BasePacket: adc.BasePacket{
+			Name: (adc.ChatMessage{}).Cmd(),
+			Data: adc.MustMarshal(adc.ChatMessage{Text: "!kick alice"}),
+		},
+	})
+	select {
+	case s := <-called:
+		if s != "bob:alice" {
+			t.Fatalf("unexpected call: %q", s)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("command was not called")
+	}
+
+	// operator commands are not available for regular users
+	bob.sendChat("!ban alice")
+	if s := bob.expectHubChat(); s != errCmdAccess.Error() {
+		t.Fatalf("unexpected reply: %q", s)
+	}
+}
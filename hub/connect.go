@@ -0,0 +1,71 @@
+package hub
+
+import (
+	"net"
+	"time"
+
+	"github.com/go-irc/irc"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+// rejectTimeout limits the time spent on sending the reason to the rejected connection.
+const rejectTimeout = time.Second
+
+// OnConnect sets a function that is called for each new connection before the protocol handshake,
+// for example to ban IPs or to put the hub in maintenance mode. Connections from trusted proxies
+// report the client address. If the function returns an error, the connection is closed.
+// The error text is sent to the client as the reason, if the protocol allows it without a handshake
+// (ADC, NMDC and IRC without TLS). Setting it to nil removes the hook.
+func (h *Hub) OnConnect(fnc func(conn net.Conn) error) {
+	h.confMu.Lock()
+	h.onConnect = fnc
+	h.confMu.Unlock()
+}
+
+// checkConnect calls the OnConnect hook, if it's set.
+func (h *Hub) checkConnect(conn net.Conn) error {
+	h.confMu.RLock()
+	fnc := h.onConnect
+	h.confMu.RUnlock()
+	if fnc == nil {
+		return nil
+	}
+	return fnc(conn)
+}
+
+// rejectConn sends the reason to the client, if the protocol can be detected
+// without a handshake, and closes the connection.
+func rejectConn(conn net.Conn, reason error) {
+	defer conn.Close()
+	conn, buf, err := peekCoon(conn, 4)
+	_ = conn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	switch {
+	case err != nil:
+		if te, ok := err.(timeoutErr); !ok || !te.Timeout() {
+			return
+		}
+		// only NMDC protocol expects the server to speak first
+		c, err := nmdc.NewConn(conn)
+		if err != nil {
+			return
+		}
+		if err = c.WriteMsg(&nmdc.ChatMessage{Text: nmdc.String(reason.Error())}); err == nil {
+			_ = c.Flush()
+		}
+	case string(buf) == "HSUP":
+		c, err := adc.NewConn(conn)
+		if err != nil {
+			return
+		}
+		if err = c.WriteInfoMsg(adc.NewStatus(adc.Fatal, adc.CodeHubGeneric, reason.Error())); err == nil {
+			_ = c.Flush()
+		}
+	case string(buf) == "NICK" || string(buf) == "PASS":
+		_ = irc.NewConn(conn).WriteMessage(&irc.Message{
+			Command: "ERROR",
+			Params:  []string{reason.Error()},
+		})
+	}
+}
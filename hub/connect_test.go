@@ -0,0 +1,53 @@
+package hub
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+func TestOnConnect(t *testing.T) {
+	h := newTestHub(t)
+	blocked := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	h.OnConnect(func(conn net.Conn) error {
+		if ip := remoteIP(conn.RemoteAddr()); ip.Equal(blocked.IP) {
+			return errors.New("you are banned")
+		}
+		return nil
+	})
+
+	c := dialADCFrom(t, h, blocked)
+	err := c.conn.WriteHubMsg(adc.Supported{Features: adc.ModFeatures{adc.FeaBASE: true, adc.FeaTIGR: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the hub only reads the first bytes of the packet before closing the connection
+	_ = c.conn.Flush()
+	st, ok := c.expectInfo().(adc.Status)
+	if !ok || st.Sev != adc.Fatal || st.Msg != "you are banned" {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+
+	// NMDC clients wait for the hub to speak first
+	conn, err := nmdc.NewConn(dialPipeFrom(t, h, blocked))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m nmdc.ChatMessage
+	if err = conn.ReadMsgTo(time.Now().Add(testTimeout), &m); err != nil {
+		t.Fatal(err)
+	} else if m.Text != "you are banned" {
+		t.Fatalf("unexpected message: %q", m.Text)
+	}
+
+	// other addresses are not affected
+	c = dialADCFrom(t, h, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000})
+	c.handshake()
+	c.identify(adc.User{Name: "bob"})
+	c.expectUser(c.sid)
+	waitPeer(t, h, "bob")
+}
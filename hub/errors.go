@@ -1,7 +1,90 @@
 package hub
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
+
+// ErrNotDC is returned by Serve when the connection obviously uses some other protocol,
+// for example when an HTTP request or a TLS handshake is sent to a plain port.
+// Such connections are usually made by scanners and are closed without logging.
+var ErrNotDC = errors.New("not a DC connection")
+
+// ErrListenerClosed is returned by ListenAndServe after a call to StopListening.
+var ErrListenerClosed = errors.New("hub: listener closed")
+
+// ListenError is an error of the listener on a given address.
+type ListenError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ListenError) Error() string {
+	return "listen " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is a list of errors of multiple listeners.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	list := make([]string, 0, len(e))
+	for _, err := range e {
+		list = append(list, err.Error())
+	}
+	return strings.Join(list, "; ")
+}
+
+// Is reports whether any of the errors matches the target.
+func (e MultiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
 
 var (
 	errNickTaken = errors.New("nick taken")
+	errHubFull   = errors.New("hub is full")
+	errBadPass   = errors.New("invalid password")
+	errBadCert   = errors.New("nick is reserved for a different client certificate")
+
+	errReconnectFlood = errors.New("too many reconnects, try again later")
+	errBanned         = errors.New("you are banned from this hub")
+
+	errBotKick    = errors.New("hub bot cannot be kicked")
+	errBotConnect = errors.New("hub bot does not accept connections")
+
+	errLinkConnect = errors.New("linked hub does not accept connections")
+
+	errBothPassive = errors.New("both users are in passive mode")
 )
+
+// Severity is a protocol-neutral severity of an error sent to the peer.
+type Severity int
+
+const (
+	// SevInfo is an informational message.
+	SevInfo = Severity(iota)
+	// SevWarning is a recoverable error. The peer can continue to use the hub.
+	SevWarning
+	// SevFatal is an error that usually precedes the disconnect.
+	SevFatal
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SevInfo:
+		return "info"
+	case SevWarning:
+		return "warning"
+	case SevFatal:
+		return "error"
+	}
+	return "unknown"
+}
@@ -0,0 +1,81 @@
+package hub
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// defaultMaxFileSize is the size limit of files served by the hub, if not set in the config.
+const defaultMaxFileSize = 256 << 10
+
+var (
+	errFileNotAvailable = errors.New("file not available")
+	errFileTooLarge     = errors.New("file is too large")
+	errFilePart         = errors.New("invalid file range")
+)
+
+// hubFile returns the content of the file the hub serves under a given name.
+// Only the files listed in the config can be served.
+func (h *Hub) hubFile(name string) ([]byte, error) {
+	conf := h.config()
+	path, ok := conf.Files[strings.TrimPrefix(name, "/")]
+	if !ok {
+		return nil, errFileNotAvailable
+	}
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, errFileNotAvailable
+	} else if fi.Size() > conf.MaxFileSize {
+		return nil, errFileTooLarge
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errFileNotAvailable
+	} else if int64(len(data)) > conf.MaxFileSize {
+		// file changed after the check
+		return nil, errFileTooLarge
+	}
+	return data, nil
+}
+
+// adcServeFile responds to the GET request with the file hosted by the hub.
+func (h *Hub) adcServeFile(peer *adcPeer, p *adc.HubPacket) error {
+	fc := adc.StatusParam{Name: "FC", Value: adc.FourCC(p)}
+	var req adc.GetRequest
+	if err := adc.Unmarshal(p.Data, &req); err != nil {
+		return peer.sendError(adc.Recoverable, adc.CodeProtocolGeneric, err, fc)
+	}
+	if req.Type != "file" {
+		return peer.sendError(adc.Recoverable, adc.CodeFileNotAvailable, errFileNotAvailable, fc)
+	}
+	data, err := h.hubFile(req.Path)
+	if err != nil {
+		return peer.sendError(adc.Recoverable, adc.CodeFileNotAvailable, err, fc)
+	}
+	if req.Start < 0 || req.Start > int64(len(data)) {
+		return peer.sendError(adc.Recoverable, adc.CodePartNotAvailable, errFilePart, fc)
+	}
+	data = data[req.Start:]
+	if req.Bytes >= 0 {
+		if req.Bytes > int64(len(data)) {
+			return peer.sendError(adc.Recoverable, adc.CodePartNotAvailable, errFilePart, fc)
+		}
+		data = data[:req.Bytes]
+	}
+	resp := adc.GetResponse{Type: req.Type, Path: req.Path, Start: req.Start, Bytes: int64(len(data))}
+	rdata, err := adc.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	err = peer.conn.WriteBinary(&adc.InfoPacket{
+		BasePacket: adc.BasePacket{Name: resp.Cmd(), Data: rdata},
+	}, data)
+	if err != nil {
+		return err
+	}
+	return peer.conn.Flush()
+}
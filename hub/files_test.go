@@ -0,0 +1,138 @@
+package hub
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/adc/types"
+)
+
+// loginADCSync logs in without reading packets in background, so the binary data can be read from the connection.
+func loginADCSync(t *testing.T, h *Hub, name string) (*adc.Conn, adc.SID) {
+	c, err := adc.NewConn(dialPipe(t, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(testTimeout)
+	err = c.WriteHubMsg(adc.Supported{Features: adc.ModFeatures{adc.FeaBASE: true, adc.FeaTIGR: true}})
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sid adc.SID
+	for sid == (adc.SID{}) {
+		p, err := c.ReadPacket(deadline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip, ok := p.(*adc.InfoPacket); ok && ip.Name == (adc.SIDAssign{}).Cmd() {
+			var m adc.SIDAssign
+			if err := adc.Unmarshal(ip.Data, &m); err != nil {
+				t.Fatal(err)
+			}
+			sid = m.SID
+		}
+	}
+	pid := types.NewPID()
+	err = c.WriteBroadcast(sid, adc.User{
+		Name: name, Id: pid.Hash(), Pid: &pid,
+		Application: "test", Version: "1.0",
+		Features: adc.ExtFeatures{adc.FeaTCP4},
+	})
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// net.Pipe is synchronous, thus the hub is blocked until the packets are read
+	for {
+		p, err := c.ReadPacket(deadline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, ok := p.(*adc.BroadcastPacket); ok && b.ID == sid && b.Name == (adc.User{}).Cmd() {
+			return c, sid
+		}
+	}
+}
+
+func TestHubFiles(t *testing.T) {
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "rules.txt")
+	if err := ioutil.WriteFile(rules, []byte("be nice"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	big := filepath.Join(dir, "banner.png")
+	if err := ioutil.WriteFile(big, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{
+		Name:        "test",
+		Files:       map[string]string{"rules.txt": rules, "banner.png": big},
+		MaxFileSize: 50,
+	})
+	c, _ := loginADCSync(t, h, "bob")
+
+	get := func(req adc.GetRequest) adc.Packet {
+		err := c.WriteHubMsg(req)
+		if err == nil {
+			err = c.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(testTimeout)
+		for {
+			p, err := c.ReadPacket(deadline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch p.Message().Type.String() {
+			case "SND", "STA":
+				return p
+			}
+		}
+	}
+	expectStatus := func(p adc.Packet, code int) {
+		var st adc.Status
+		if p.Message().Type.String() != "STA" {
+			t.Fatalf("expected status, got: %#v", p)
+		} else if err := adc.Unmarshal(p.Message().Data, &st); err != nil {
+			t.Fatal(err)
+		} else if st.Code != code {
+			t.Fatalf("unexpected status: %#v", st)
+		}
+	}
+
+	p := get(adc.GetRequest{Type: "file", Path: "rules.txt", Bytes: -1})
+	var resp adc.GetResponse
+	if p.Message().Type.String() != "SND" {
+		t.Fatalf("expected SND, got: %#v", p)
+	} else if err := adc.Unmarshal(p.Message().Data, &resp); err != nil {
+		t.Fatal(err)
+	} else if resp.Path != "rules.txt" || resp.Bytes != 7 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	r := c.ReadBinary(resp.Bytes)
+	data, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != "be nice" {
+		t.Fatalf("unexpected content: %q", data)
+	}
+
+	// only configured files are served
+	expectStatus(get(adc.GetRequest{Type: "file", Path: rules, Bytes: -1}), adc.CodeFileNotAvailable)
+	expectStatus(get(adc.GetRequest{Type: "file", Path: "../rules.txt", Bytes: -1}), adc.CodeFileNotAvailable)
+	// size limit
+	expectStatus(get(adc.GetRequest{Type: "file", Path: "banner.png", Bytes: -1}), adc.CodeFileNotAvailable)
+	// invalid range
+	expectStatus(get(adc.GetRequest{Type: "file", Path: "rules.txt", Start: 5, Bytes: 10}), adc.CodePartNotAvailable)
+}
@@ -0,0 +1,208 @@
+package hub
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+const (
+	// defaultReconnectWindow is the period during which connections are counted, if not set in the config.
+	defaultReconnectWindow = time.Minute
+	// reconnectTarpit is the time the hub holds the connection of a flooding source before closing it,
+	// to slow down the attacker.
+	reconnectTarpit = time.Second
+)
+
+// reconnectTracker counts recent connections by source (IP or CID).
+type reconnectTracker struct {
+	mu      sync.Mutex
+	bySrc   map[string][]time.Time
+	cleaned time.Time
+	// held are sources that are refused until a given time
+	held map[string]time.Time
+}
+
+// hold refuses the source until a given time.
+func (t *reconnectTracker) hold(now time.Time, src string, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.held == nil {
+		t.held = make(map[string]time.Time)
+	}
+	for s, u := range t.held {
+		if !now.Before(u) {
+			delete(t.held, s)
+		}
+	}
+	t.held[src] = until
+}
+
+// heldFor returns the time left until the source is allowed to reconnect, or zero if it's not held.
+func (t *reconnectTracker) heldFor(now time.Time, src string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.held[src]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(t.held, src)
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// allow records the connection and checks if the source made no more than max connections during the window.
+func (t *reconnectTracker) allow(now time.Time, src string, max int, window time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.bySrc == nil {
+		t.bySrc = make(map[string][]time.Time)
+	}
+	if now.Sub(t.cleaned) >= window {
+		// forget sources that were quiet during the whole window
+		for s, times := range t.bySrc {
+			if now.Sub(times[len(times)-1]) >= window {
+				delete(t.bySrc, s)
+			}
+		}
+		t.cleaned = now
+	}
+	times := t.bySrc[src]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= window {
+		i++
+	}
+	times = append(times[i:], now)
+	t.bySrc[src] = times
+	return len(times) <= max
+}
+
+// allowReconnect checks if the source doesn't reconnect too often. It always allows the source,
+// if the reconnect limit is not set.
+func (h *Hub) allowReconnect(src string) bool {
+	conf := h.config()
+	if conf.ReconnectLimit <= 0 {
+		return true
+	}
+	window := conf.ReconnectWindow
+	if window <= 0 {
+		window = defaultReconnectWindow
+	}
+	return h.reconnects.allow(h.now(), src, conf.ReconnectLimit, window)
+}
+
+// checkReconnectIP tarpits the connection from the IP that reconnects too often.
+func (h *Hub) checkReconnectIP(conn net.Conn) error {
+	ip := remoteIP(conn.RemoteAddr())
+	if ip == nil || h.allowReconnect("ip:"+ip.String()) {
+		return nil
+	}
+	time.Sleep(reconnectTarpit)
+	return errReconnectFlood
+}
+
+// allowReconnectCID checks if the client with a given CID doesn't reconnect too often.
+func (h *Hub) allowReconnectCID(cid adc.CID) bool {
+	return h.allowReconnect("cid:" + cid.String())
+}
+
+// holdCID refuses logins with a given CID for the ReconnectCooldown, and returns the cooldown.
+// It does nothing and returns zero if the cooldown is not set.
+func (h *Hub) holdCID(cid adc.CID) time.Duration {
+	d := h.config().ReconnectCooldown
+	if d <= 0 || cid.IsZero() {
+		return 0
+	}
+	now := h.now()
+	h.reconnects.hold(now, "cid:"+cid.String(), now.Add(d))
+	return d
+}
+
+// cidHeldFor returns the time left until the client with a given CID is allowed to log in again.
+func (h *Hub) cidHeldFor(cid adc.CID) time.Duration {
+	return h.reconnects.heldFor(h.now(), "cid:"+cid.String())
+}
+
+// cooldownSeconds converts the cooldown to seconds for the TL field, rounding up.
+func cooldownSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// delayJoin announces the peer to other users after a given delay, if it's still on the hub.
+// Peers lock must be held.
+func (h *Hub) delayJoin(peer Peer, d time.Duration) {
+	sid := peer.SID()
+	h.peers.pending[sid] = time.AfterFunc(d, func() {
+		h.peers.Lock()
+		if _, ok := h.peers.pending[sid]; !ok || h.peers.bySID[sid] != peer {
+			h.peers.Unlock()
+			return
+		}
+		delete(h.peers.pending, sid)
+		// users that are not announced yet should also learn about this one
+		notify := make([]Peer, 0, len(h.peers.byName))
+		for _, p := range h.listPeers() {
+			if p != peer {
+				notify = append(notify, p)
+			}
+		}
+		h.peers.Unlock()
+		h.notifyJoin(peer, notify)
+	})
+}
+
+// cancelJoin cancels the delayed announcement of the peer.
+// It returns false if the peer was already announced. Peers lock must be held.
+func (h *Hub) cancelJoin(sid adc.SID) bool {
+	t, ok := h.peers.pending[sid]
+	if !ok {
+		return false
+	}
+	t.Stop()
+	delete(h.peers.pending, sid)
+	return true
+}
+
+// isPending reports if the join of the peer is delayed and other users don't know about it yet.
+func (h *Hub) isPending(peer Peer) bool {
+	h.peers.RLock()
+	_, ok := h.peers.pending[peer.SID()]
+	h.peers.RUnlock()
+	return ok
+}
+
+// broadcastTargets filters the recipients of the broadcast from the peer. Until the join is announced,
+// other users don't know about the peer, so its messages only reach the peer itself. The result is never nil.
+func (h *Hub) broadcastTargets(from Peer, peers []Peer) []Peer {
+	if !h.isPending(from) {
+		return peers
+	}
+	for _, p := range peers {
+		if p == from {
+			return []Peer{from}
+		}
+	}
+	return []Peer{}
+}
+
+// visiblePeers returns peers that were announced to other users.
+func (h *Hub) visiblePeers() []Peer {
+	h.peers.RLock()
+	defer h.peers.RUnlock()
+	return h.listVisible()
+}
+
+// listVisible is the same as visiblePeers, but the peers lock must be held.
+func (h *Hub) listVisible() []Peer {
+	list := make([]Peer, 0, len(h.peers.byName))
+	for _, p := range h.peers.byName {
+		if _, ok := h.peers.pending[p.SID()]; !ok {
+			list = append(list, p)
+		}
+	}
+	return list
+}
@@ -0,0 +1,198 @@
+package hub
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+func TestReconnectTracker(t *testing.T) {
+	var tr reconnectTracker
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !tr.allow(now, "a", 3, time.Minute) {
+			t.Fatalf("connection %d should be allowed", i)
+		}
+	}
+	if tr.allow(now, "a", 3, time.Minute) {
+		t.Fatal("connection should be throttled")
+	}
+	if !tr.allow(now, "b", 3, time.Minute) {
+		t.Fatal("other sources should be allowed")
+	}
+	if !tr.allow(now.Add(time.Minute), "a", 3, time.Minute) {
+		t.Fatal("connection should be allowed after the window")
+	}
+}
+
+func TestReconnectWindow(t *testing.T) {
+	clock := newTestClock()
+	h := newHub(Config{Name: "test", ReconnectLimit: 1, ReconnectWindow: time.Minute}, clock.Now)
+	if !h.allowReconnect("ip:10.0.0.1") {
+		t.Fatal("first connection should be allowed")
+	}
+	clock.Advance(time.Minute - time.Second)
+	if h.allowReconnect("ip:10.0.0.1") {
+		t.Fatal("connection should be throttled")
+	}
+	// throttled attempts are counted as well
+	clock.Advance(time.Minute)
+	if !h.allowReconnect("ip:10.0.0.1") {
+		t.Fatal("connection should be allowed after the window")
+	}
+}
+
+func TestReconnectFlood(t *testing.T) {
+	h := New(Config{Name: "test", ReconnectLimit: 2})
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	for _, name := range []string{"bob", "alice"} {
+		c := dialADCFrom(t, h, addr)
+		c.handshake()
+		c.identify(adc.User{Name: name})
+		c.expectUser(c.sid)
+		waitPeer(t, h, name)
+	}
+
+	// third connection is held and closed without the handshake
+	start := time.Now()
+	conn := dialPipeFrom(t, h, addr)
+	_ = conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	if dt := time.Since(start); dt < reconnectTarpit/2 {
+		t.Fatalf("connection closed too early: %v", dt)
+	}
+
+	// other addresses are not affected
+	loginADC(t, h, "carol")
+}
+
+func TestJoinDelay(t *testing.T) {
+	h := New(Config{Name: "test", JoinDelay: 200 * time.Millisecond})
+
+	alice := loginADC(t, h, "alice")
+
+	// bob leaves before he is announced
+	bob := loginADC(t, h, "bob")
+	_ = bob.conn.Close()
+	deadline := time.Now().Add(testTimeout)
+	for h.byName("bob") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("bob didn't leave")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	carol := loginADC(t, h, "carol")
+	for {
+		p := alice.next()
+		switch p := p.(type) {
+		case *adc.BroadcastPacket:
+			if p.ID == bob.sid {
+				t.Fatalf("unexpected packet for bob: %v", p.Message().Type)
+			}
+		case *adc.InfoPacket:
+			if p.Message().Type.String() == "QUI" {
+				t.Fatal("unexpected quit")
+			}
+		}
+		if b, ok := p.(*adc.BroadcastPacket); ok && b.ID == carol.sid {
+			return
+		}
+	}
+}
+
+func TestReconnectCooldown(t *testing.T) {
+	clock := newTestClock()
+	h := newHub(Config{Name: "test", ReconnectCooldown: time.Minute}, clock.Now)
+
+	bob := loginADC(t, h, "bob")
+	if err := h.Redirect(h.byName("bob"), "adcs://example.org:411", "hub restart"); err != nil {
+		t.Fatal(err)
+	}
+	m := bob.expectQuit(bob.sid)
+	if m.Message != "hub restart" || m.Redirect != "adcs://example.org:411" || m.TimeLeft != 60 {
+		t.Fatalf("unexpected quit: %#v", m)
+	}
+
+	relogin := func() *testADC {
+		c := dialADC(t, h)
+		c.handshake()
+		pid := bob.pid
+		c.identify(adc.User{Name: "bob", Id: pid.Hash(), Pid: &pid})
+		return c
+	}
+
+	// reconnect within the cooldown is refused
+	clock.Advance(time.Minute - time.Second)
+	c := relogin()
+	st, ok := c.expectInfo().(adc.Status)
+	if !ok || st.Sev != adc.Fatal || st.Code != adc.CodeTempBanned {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+	if len(st.Params) != 1 || st.Params[0] != (adc.StatusParam{Name: "TL", Value: "1"}) {
+		t.Fatalf("unexpected params: %v", st.Params)
+	}
+
+	// other clients are not affected
+	loginADC(t, h, "alice")
+
+	clock.Advance(time.Second)
+	c = relogin()
+	c.expectUser(c.sid)
+	waitPeer(t, h, "bob")
+}
+
+func TestJoinDelayBroadcast(t *testing.T) {
+	h := newTestHub(t)
+	alice := loginADC(t, h, "alice")
+
+	// users joining from now on are not announced during the test
+	h.confMu.Lock()
+	h.conf.JoinDelay = time.Minute
+	h.confMu.Unlock()
+
+	bob := loginADC(t, h, "bob")
+	bob.sendChat("secret from bob")
+	bob.expectChat("secret from bob")
+	bob.sendInfo([]byte("SS1000"))
+
+	carol := loginNMDC(t, h, "carol")
+	carol.write(&nmdc.ChatMessage{Name: "carol", Text: "secret from carol"})
+	if text := carol.expectChat("carol"); text != "secret from carol" {
+		t.Fatalf("unexpected message: %q", text)
+	}
+
+	alice.sendChat("done")
+	for {
+		p := alice.next()
+		if b, ok := p.(*adc.BroadcastPacket); ok && b.ID == bob.sid {
+			t.Fatalf("unexpected packet from bob: %s %s", b.Name, b.Data)
+		}
+		if p.Message().Type.String() != "MSG" {
+			continue
+		}
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(p.Message().Data, &m); err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Text) == "done" {
+			break
+		} else if strings.Contains(string(m.Text), "secret") {
+			t.Fatalf("unexpected message: %q", m.Text)
+		}
+	}
+	if !h.isPending(h.byName("bob")) || !h.isPending(h.byName("carol")) {
+		t.Fatal("users were announced during the test")
+	}
+	// messages from pending users are not counted or added to the history
+	if n := h.Stats().Messages; n != 1 {
+		t.Fatalf("unexpected message count: %d", n)
+	}
+}
@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultLookupRate is the number of GeoIP and DNS lookups per second, if not set in the config.
+	defaultLookupRate = 10
+	// lookupQueue is the number of peers waiting for lookups. Peers are not annotated if the queue is full.
+	lookupQueue = 256
+)
+
+// GeoIP resolves IP addresses to countries. It must be safe for concurrent use.
+type GeoIP interface {
+	// Country returns an ISO 3166-1 country code of the IP, for example "NL".
+	Country(ip net.IP) (string, error)
+}
+
+// peerLocation is the country and the host name of the peer, resolved after login.
+type peerLocation struct {
+	mu      sync.RWMutex
+	country string
+	host    string
+}
+
+func (p *BasePeer) location() (country, host string) {
+	p.loc.mu.RLock()
+	defer p.loc.mu.RUnlock()
+	return p.loc.country, p.loc.host
+}
+
+func (p *BasePeer) setLocation(country, host string) {
+	p.loc.mu.Lock()
+	p.loc.country, p.loc.host = country, host
+	p.loc.mu.Unlock()
+}
+
+type locatedPeer interface {
+	Peer
+	location() (country, host string)
+	setLocation(country, host string)
+}
+
+// locationOf returns the country and the host name of the peer, if they are known.
+func locationOf(p Peer) (country, host string) {
+	if lp, ok := p.(locatedPeer); ok {
+		return lp.location()
+	}
+	return "", ""
+}
+
+// startLookups starts annotating peers with the country and the host name, if enabled in the config.
+func (h *Hub) startLookups(conf Config) {
+	if conf.GeoIP == nil && !conf.ReverseDNS {
+		return
+	}
+	rate := conf.LookupRate
+	if rate <= 0 {
+		rate = defaultLookupRate
+	}
+	h.lookups = make(chan locatedPeer, lookupQueue)
+	go h.lookupLoop(conf.GeoIP, conf.ReverseDNS, newRateLimiter(int64(rate)))
+}
+
+// lookupPeer queues the peer for lookups. It never blocks.
+func (h *Hub) lookupPeer(p Peer) {
+	lp, ok := p.(locatedPeer)
+	if h.lookups == nil || !ok || isVirtual(p) || remoteIP(p.RemoteAddr()) == nil {
+		return
+	}
+	select {
+	case h.lookups <- lp:
+	default:
+		// too many logins, skip it
+	}
+}
+
+func (h *Hub) lookupLoop(geo GeoIP, rdns bool, limit *rateLimiter) {
+	for p := range h.lookups {
+		limit.wait(1)
+		ip := remoteIP(p.RemoteAddr())
+		var country, host string
+		if geo != nil {
+			country, _ = geo.Country(ip)
+		}
+		if rdns {
+			if names, err := h.lookupAddr(ip.String()); err == nil && len(names) != 0 {
+				host = strings.TrimSuffix(names[0], ".")
+			}
+		}
+		p.setLocation(country, host)
+	}
+}
@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+type stubGeoIP struct {
+	mu      sync.Mutex
+	calls   int
+	release chan struct{}
+}
+
+func (g *stubGeoIP) Country(ip net.IP) (string, error) {
+	if g.release != nil {
+		<-g.release
+	}
+	g.mu.Lock()
+	g.calls++
+	g.mu.Unlock()
+	if ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		return "NL", nil
+	}
+	return "UA", nil
+}
+
+func (g *stubGeoIP) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.calls
+}
+
+// waitLocation waits until the country of the user is resolved.
+func waitLocation(t testing.TB, h *Hub, name string) PeerInfo {
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		for _, p := range h.PeersInfo() {
+			if p.Name == name && p.Country != "" {
+				return p
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("location of %q is not resolved", name)
+	return PeerInfo{}
+}
+
+func TestGeoIP(t *testing.T) {
+	geo := &stubGeoIP{release: make(chan struct{})}
+	h := New(Config{Name: "test", GeoIP: geo, ReverseDNS: true})
+	h.lookupAddr = func(addr string) ([]string, error) {
+		return []string{"host-" + addr + ".example.com."}, nil
+	}
+
+	// lookup is blocked, but the login should not be
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	loginNMDCFrom(t, h, addr, nmdc.MyInfo{Name: "bob"})
+	loginADC(t, h, "alice")
+	if c, _ := locationOf(h.byName("bob")); c != "" {
+		t.Fatalf("unexpected country: %q", c)
+	}
+	close(geo.release)
+
+	p := waitLocation(t, h, "bob")
+	if p.Country != "NL" || p.Host != "host-10.0.0.1.example.com" {
+		t.Fatalf("unexpected info: %+v", p)
+	}
+	for _, u := range h.ListUsers() {
+		if u.Name == "bob" && u.Country != "NL" {
+			t.Fatalf("unexpected snapshot: %+v", u)
+		}
+	}
+	// connections without an IP address are not resolved
+	if n := geo.count(); n != 1 {
+		t.Fatalf("expected 1 lookup, got %d", n)
+	}
+}
+
+func TestGeoIPRate(t *testing.T) {
+	geo := &stubGeoIP{}
+	h := New(Config{Name: "test", GeoIP: geo, LookupRate: 1})
+
+	for i, name := range []string{"bob", "alice", "carol"} {
+		addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 1234}
+		loginNMDCFrom(t, h, addr, nmdc.MyInfo{Name: nmdc.Name(name)})
+	}
+	waitLocation(t, h, "bob")
+	// next lookup is allowed in a second
+	if n := geo.count(); n != 1 {
+		t.Fatalf("expected 1 lookup, got %d", n)
+	}
+}
@@ -0,0 +1,198 @@
+package hub
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// errHybridConn is returned for the secondary HBRI connection after the address was validated.
+var errHybridConn = errors.New("hbri validation connection")
+
+// verifiedAddrs tracks user addresses confirmed by the hub, either by the connection itself or by HBRI.
+type verifiedAddrs struct {
+	ip4, ip6 bool
+}
+
+// hybridRequest is the HBRI validation waiting for the secondary connection of the client.
+type hybridRequest struct {
+	ip6  bool        // the address family being validated
+	done chan net.IP // receives the address of the secondary connection, or nil if the validation failed
+}
+
+func newHybridToken() string {
+	var b [10]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return base32.StdEncoding.EncodeToString(b[:])
+}
+
+// hybridAddr returns the hub address of a given family for HBRI. It's empty if the validation
+// of this family is disabled.
+func (c Config) hybridAddr(ip6 bool) string {
+	if ip6 {
+		return c.HBRIAddr6
+	}
+	return c.HBRIAddr4
+}
+
+// adcVerifyAddrs marks the user addresses that match the connection as verified. If the client
+// claims an address of the other family, it is validated with HBRI, if both the client and the hub support it.
+// The address is replaced with the one observed by the hub on success.
+func (h *Hub) adcVerifyAddrs(peer *adcPeer, u *adc.User, login time.Time) error {
+	ip := remoteIP(peer.addr)
+	if ip == nil {
+		// unknown address type
+		return nil
+	}
+	ip6 := ip.To4() == nil
+	other := u.Ip6
+	if ip6 {
+		peer.verified.ip6 = net.ParseIP(u.Ip6).Equal(ip)
+		other = u.Ip4
+	} else {
+		peer.verified.ip4 = net.ParseIP(u.Ip4).Equal(ip)
+	}
+	conf := h.config()
+	if other == "" || !peer.fea.IsSet(adc.FeaHBRI) || conf.hybridAddr(!ip6) == "" {
+		return nil
+	}
+	vip, err := h.adcValidateHybrid(peer, !ip6, conf.stageDeadline(login))
+	if err != nil {
+		return err
+	} else if vip == nil {
+		log.Printf("%s: hbri: %s address is not validated", peer.RemoteAddr(), other)
+		return nil
+	}
+	if ip6 {
+		u.Ip4 = vip.To4().String()
+		peer.verified.ip4 = true
+	} else {
+		u.Ip6 = vip.String()
+		peer.verified.ip6 = true
+	}
+	return nil
+}
+
+// adcValidateHybrid asks the client to connect to the hub address of a given family and waits for the
+// connection until the deadline. It returns the address of the secondary connection, or nil if the
+// validation failed.
+func (h *Hub) adcValidateHybrid(peer *adcPeer, ip6 bool, deadline time.Time) (net.IP, error) {
+	host, sport, err := net.SplitHostPort(h.config().hybridAddr(ip6))
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(sport)
+	if err != nil {
+		return nil, err
+	}
+	msg := adc.HybridBridge{Token: newHybridToken()}
+	if ip6 {
+		msg.Ip6, msg.Port6 = host, port
+	} else {
+		msg.Ip4, msg.Port4 = host, port
+	}
+	req := &hybridRequest{ip6: ip6, done: make(chan net.IP, 1)}
+	h.hybrid.Lock()
+	if h.hybrid.pending == nil {
+		h.hybrid.pending = make(map[string]*hybridRequest)
+	}
+	h.hybrid.pending[msg.Token] = req
+	h.hybrid.Unlock()
+	defer func() {
+		h.hybrid.Lock()
+		delete(h.hybrid.pending, msg.Token)
+		h.hybrid.Unlock()
+	}()
+
+	if err = peer.conn.WriteInfoMsg(msg); err == nil {
+		err = peer.conn.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case ip := <-req.done:
+		return ip, nil
+	case <-timer.C:
+		return nil, nil
+	}
+}
+
+// adcServeHybrid handles the secondary HBRI connection. The connection is expected to come from
+// the address family that is validated, and it's closed right after the validation.
+func (h *Hub) adcServeHybrid(c *adc.Conn, p *adc.HubPacket) error {
+	var m adc.HybridBridge
+	if err := adc.Unmarshal(p.Data, &m); err != nil {
+		return err
+	}
+	h.hybrid.Lock()
+	req := h.hybrid.pending[m.Token]
+	delete(h.hybrid.pending, m.Token)
+	h.hybrid.Unlock()
+
+	fail := func(err error) error {
+		_ = c.WriteInfoMsg(adc.NewStatus(adc.Fatal, adc.CodeProtocolGeneric, err.Error()))
+		_ = c.Flush()
+		return err
+	}
+	if req == nil {
+		return fail(errors.New("unknown hbri token"))
+	}
+	ip := remoteIP(c.RemoteAddr())
+	if ip == nil || (ip.To4() == nil) != req.ip6 {
+		req.done <- nil
+		return fail(fmt.Errorf("expected %s connection", ipFamily(req.ip6)))
+	}
+	req.done <- ip
+	err := c.WriteInfoMsg(adc.NewStatus(adc.Success, adc.CodeGeneric, "address validated"))
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	return errHybridConn
+}
+
+// adcAllowConnect checks if the user address used for the connection to a given peer was verified.
+// It only refuses connections in the strict HBRI mode.
+func (h *Hub) adcAllowConnect(peer *adcPeer, targ adc.SID) bool {
+	if !h.config().HBRIStrict {
+		return true
+	}
+	to := h.bySID(targ)
+	if to == nil {
+		// will be dropped anyway
+		return true
+	}
+	peer.mu.RLock()
+	ip6 := to.User().IPv6 && peer.user.Ip6 != ""
+	ok := peer.verified.ip4
+	if ip6 {
+		ok = peer.verified.ip6
+	}
+	peer.mu.RUnlock()
+	if !ok {
+		err := fmt.Errorf("your %s address is not verified by the hub", ipFamily(ip6))
+		_ = peer.sendError(adc.Recoverable, adc.CodeDirectConnFailed, err)
+	}
+	return ok
+}
+
+func ipFamily(ip6 bool) string {
+	if ip6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
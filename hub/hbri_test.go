@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"net"
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+func TestADCHybridBridge(t *testing.T) {
+	h := New(Config{Name: "test", HBRIAddr6: "[2001:db8::100]:411", HBRIStrict: true})
+	from := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+	login := func(name, ip4, ip6 string) (*testADC, adc.HybridBridge) {
+		c := dialADCFrom(t, h, from(ip4))
+		c.handshake(adc.FeaHBRI)
+		c.identify(adc.User{Name: name, Ip6: ip6, Features: adc.ExtFeatures{adc.FeaTCP4, adc.FeaTCP6}})
+		req, ok := c.expectInfo().(adc.HybridBridge)
+		if !ok {
+			t.Fatalf("unexpected message: %#v", req)
+		} else if req.Ip6 != "2001:db8::100" || req.Port6 != 411 || req.Token == "" {
+			t.Fatalf("unexpected request: %+v", req)
+		}
+		return c, req
+	}
+	validate := func(ip string, req adc.HybridBridge) adc.Status {
+		c := dialADCFrom(t, h, from(ip))
+		err := c.conn.WriteHubMsg(adc.HybridBridge{Ip6: ip, Port6: 1234, Token: req.Token})
+		if err == nil {
+			err = c.conn.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, ok := c.expectInfo().(adc.Status)
+		if !ok {
+			t.Fatalf("unexpected message: %#v", st)
+		}
+		return st
+	}
+
+	bob, req := login("bob", "192.0.2.1", "2001:db8::1")
+	if st := validate("2001:db8::1", req); !st.Ok() {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+	if u := bob.expectUser(bob.sid); u.Ip4 != "192.0.2.1" || u.Ip6 != "2001:db8::1" {
+		t.Fatalf("unexpected addresses: %q, %q", u.Ip4, u.Ip6)
+	}
+
+	// validation from the wrong family fails, but the user is still accepted
+	alice, req := login("alice", "192.0.2.2", "2001:db8::2")
+	if st := validate("192.0.2.2", req); st.Ok() {
+		t.Fatal("expected an error")
+	}
+	alice.expectUser(alice.sid)
+	bob.expectUser(alice.sid)
+
+	// the unverified address cannot be used for connections in strict mode
+	ctm := &adc.ConnectRequest{Proto: "ADC/1.0", Port: 1000, Token: "1"}
+	err := alice.conn.WriteDirect(alice.sid, bob.sid, ctm)
+	if err == nil {
+		err = alice.conn.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, ok := alice.expectInfo().(adc.Status)
+	if !ok || st.Code != adc.CodeDirectConnFailed {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+	err = bob.conn.WriteDirect(bob.sid, alice.sid, ctm)
+	if err == nil {
+		err = bob.conn.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := alice.expectDirect("CTM"); p.ID != bob.sid {
+		t.Fatalf("unexpected sender: %v", p.ID)
+	}
+}
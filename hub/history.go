@@ -0,0 +1,86 @@
+package hub
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultChatHistory is the number of chat messages replayed to users by default.
+const defaultChatHistory = 10
+
+// chatEntry is a chat message saved in the history.
+type chatEntry struct {
+	Time time.Time
+	Name string
+	Text string
+}
+
+func (e chatEntry) String() string {
+	return fmt.Sprintf("[%s] <%s> %s", e.Time.Format("15:04:05"), e.Name, e.Text)
+}
+
+// chatHistory is a ring buffer of the last main chat messages.
+type chatHistory struct {
+	mu   sync.Mutex
+	buf  []chatEntry
+	next int
+	full bool
+}
+
+func newChatHistory(n int) *chatHistory {
+	if n <= 0 {
+		return nil
+	}
+	return &chatHistory{buf: make([]chatEntry, n)}
+}
+
+func (c *chatHistory) add(e chatEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.buf[c.next] = e
+	c.next++
+	if c.next == len(c.buf) {
+		c.next = 0
+		c.full = true
+	}
+	c.mu.Unlock()
+}
+
+// list returns saved messages, from the oldest to the newest.
+func (c *chatHistory) list() []chatEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.full {
+		return append([]chatEntry(nil), c.buf[:c.next]...)
+	}
+	list := make([]chatEntry, 0, len(c.buf))
+	list = append(list, c.buf[c.next:]...)
+	list = append(list, c.buf[:c.next]...)
+	return list
+}
+
+// saveChat adds the main chat message to the history, counts it in the hub stats
+// and queues it for the chat sink.
+func (h *Hub) saveChat(from Peer, text string) {
+	atomic.AddUint64(&h.counters.messages, 1)
+	now := h.now()
+	h.history.add(chatEntry{Time: now, Name: from.Name(), Text: text})
+	h.logChat(from.Name(), text, now)
+}
+
+// sendHistory replays the chat history to the peer.
+func (h *Hub) sendHistory(peer Peer) error {
+	for _, e := range h.history.list() {
+		if err := peer.HubChatMsg(e.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
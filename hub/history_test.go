@@ -0,0 +1,69 @@
+package hub
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+func TestChatHistoryRing(t *testing.T) {
+	c := newChatHistory(3)
+	texts := func() []string {
+		var out []string
+		for _, e := range c.list() {
+			out = append(out, e.Text)
+		}
+		return out
+	}
+	c.add(chatEntry{Text: "1"})
+	c.add(chatEntry{Text: "2"})
+	if got := texts(); !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Fatalf("unexpected history: %q", got)
+	}
+	c.add(chatEntry{Text: "3"})
+	c.add(chatEntry{Text: "4"})
+	if got := texts(); !reflect.DeepEqual(got, []string{"2", "3", "4"}) {
+		t.Fatalf("unexpected history: %q", got)
+	}
+
+	// disabled history
+	c = newChatHistory(-1)
+	c.add(chatEntry{Text: "1"})
+	if got := texts(); len(got) != 0 {
+		t.Fatalf("unexpected history: %q", got)
+	}
+}
+
+func TestChatHistoryReplay(t *testing.T) {
+	h := New(Config{Name: "test", MOTD: "motd", ChatHistory: 3})
+	bob := loginADC(t, h, "bob")
+	for i := 1; i <= 4; i++ {
+		bob.sendChat("msg " + strconv.Itoa(i))
+		bob.expectChat("msg " + strconv.Itoa(i))
+	}
+
+	alice := loginADC(t, h, "alice")
+	var got []string
+	for len(got) < 4 {
+		p, ok := alice.expect("MSG").(*adc.InfoPacket)
+		if !ok {
+			continue
+		}
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(p.Data, &m); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(m.Text))
+	}
+	if got[0] != "motd" {
+		t.Fatalf("expected MOTD first, got: %q", got)
+	}
+	for i, s := range got[1:] {
+		if exp := "<bob> msg " + strconv.Itoa(i+2); !strings.HasSuffix(s, exp) {
+			t.Fatalf("unexpected history: %q", got)
+		}
+	}
+}
@@ -2,9 +2,14 @@ package hub
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
+	"os"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,43 +21,344 @@ import (
 	"github.com/direct-connect/go-dcpp/version"
 )
 
+// Config is a hub configuration.
+type Config struct {
+	Name string
+	Desc string
+	Soft Software
+	// Topic is shown to users instead of the description, if set.
+	// The description is still reported in the hub stats.
+	Topic string
+	// BotName is a nick of the hub bot. If set, the bot is shown in the user list,
+	// hub messages are sent on its behalf and it runs commands sent to it in private.
+	BotName string
+	// BotCID is a CID of the hub bot for ADC clients. It is derived from the name, if not set.
+	BotCID adc.CID
+	// MOTD is a message sent to users after login. Empty string disables it.
+	MOTD string
+	// ChatHistory is the number of the last main chat messages replayed to users after login.
+	// Default is 10, negative value disables the history.
+	ChatHistory int
+	// HistoryBeforeMOTD replays the chat history before the MOTD instead of after it.
+	HistoryBeforeMOTD bool
+	// ChatTimestamps stamps main chat messages with the server time.
+	// ADC clients receive it in the TS field if they support TS00 extension,
+	// while NMDC clients get a [HH:MM:SS] prefix in the message text.
+	ChatTimestamps bool
+	// SpoofTolerance is the number of ADC packets with the SID of another user the hub drops,
+	// before it disconnects the client. Zero means the client is disconnected on the first one.
+	SpoofTolerance int
+	// ChatFilters are applied in order to main chat messages before they are broadcasted.
+	// See ChatSanitizer for the default one.
+	ChatFilters []ChatFilter
+	// TrustedProxies is a list of networks of load balancers that send the PROXY protocol header (v1 or v2).
+	// The header is required on connections from these networks, and the client address from it
+	// is used instead of the address of the proxy.
+	TrustedProxies []*net.IPNet
+	// CaptureDir enables capturing of the raw traffic for debugging. The data sent and received by each
+	// DC connection is written to a separate file in this directory, and can be read with ReadCapture.
+	// Passwords are redacted. Connections over TLS are captured after decryption.
+	CaptureDir string
+	// CaptureIPs limits the capture to clients from these networks. All connections are captured if it's empty.
+	CaptureIPs []*net.IPNet
+	// CaptureLimit is the size of the captured data per connection. Default is 1 MB.
+	CaptureLimit int64
+	// QuietPresence delivers join and leave notifications only to operators. Other users receive
+	// the full user list on login, but are not notified when users join or leave the hub later.
+	QuietPresence bool
+	// ResyncInterval enables a periodic check of user lists known to clients. Users that missed
+	// join or leave notifications receive them again. It's disabled by default, since the hub
+	// has to remember the user list of each client.
+	ResyncInterval time.Duration
+	// RequiredFeatures is a list of ADC features that clients must advertise in SUP, in addition to BASE and TIGR.
+	// Clients without them are refused.
+	RequiredFeatures []adc.Feature
+	// HBRIAddr4 and HBRIAddr6 are IPv4 and IPv6 addresses of the hub (host:port) used by the HBRI extension.
+	// Clients that connect over one IP family and claim an address of the other one are asked
+	// to connect to the hub address of that family to validate it. Each address enables the validation
+	// of its family.
+	HBRIAddr4 string
+	HBRIAddr6 string
+	// HBRIStrict refuses CTM from ADC users if their address that would be used for the connection
+	// wasn't verified by the hub.
+	HBRIStrict bool
+	// HideIPs hides IP addresses of users from everyone except operators and the users themselves.
+	HideIPs bool
+	// InfoFields is a list of ADC user info fields (for example "SS", "VE" or "SU") forwarded to regular
+	// users. If set, other fields are removed from the info of other users, except ID, NI and CT that
+	// identify the user. Operators and the users themselves receive the full info. NMDC users receive
+	// the info converted to MyINFO, which is not filtered.
+	InfoFields []string
+	// MaxUsers limits the number of users on the hub. Zero means no limit.
+	MaxUsers int
+	// QueueSize enables a waiting room for users that connect when the hub is full.
+	// Up to QueueSize users are kept connected and admitted in the order of arrival
+	// when other users leave. Users that don't fit into the queue are refused.
+	QueueSize int
+	// QueueInterval is the period of notifications about the position in the queue. Default is 30 seconds.
+	QueueInterval time.Duration
+	// ReplaceOnReconnect allows a new connection to take the nick or CID of the user
+	// that is already on the hub, if the old connection turns out to be dead.
+	// The new connection must prove the identity first: ADC clients by the same CID and a valid PID,
+	// others by authenticating for a registered nick. By default, such logins are refused.
+	ReplaceOnReconnect bool
+	// MaxSearchResults limits the number of results relayed to the searcher for a single search.
+	// Duplicate results are always dropped. Default is 100, negative value disables the limit.
+	MaxSearchResults int
+	// SearchResultRate limits the number of search results a single user can send per second.
+	// Zero means no limit.
+	SearchResultRate int
+	// PeerBandwidth limits the traffic of each connection, in bytes per second.
+	// The limit is applied to reads and writes separately. Zero means no limit.
+	PeerBandwidth int64
+	// HubBandwidth limits the traffic of all connections, in bytes per second.
+	// The limit is applied to reads and writes separately. Zero means no limit.
+	HubBandwidth int64
+	// LoginTimeout limits the time of each login stage. Default is 5 seconds.
+	LoginTimeout time.Duration
+	// LoginDeadline limits the total time of the ADC login, across all stages and including
+	// sending the user list. Default is twice the LoginTimeout.
+	LoginDeadline time.Duration
+	// MinShare is a minimal share size (in bytes) required to enter the hub.
+	MinShare uint64
+	// MinSlots is a minimal number of upload slots required to enter the hub.
+	MinSlots int
+	// MinSlotsPerHub is a minimal ratio of upload slots to the number of hubs the user is connected to.
+	MinSlotsPerHub float64
+	// Rules are additional requirements on the user share, slots and hubs, for example "slots >= share / 50GB".
+	// Users that violate them are refused at login, and ADC users are kicked if their info update violates them.
+	// See UserRule for the syntax.
+	Rules []*UserRule
+	// AllowedClients is a list of client applications allowed on the hub (e.g. "DC++").
+	// If empty, all clients are allowed. Only checked for ADC clients.
+	AllowedClients []string
+	// BannedClients rejects specific clients or their outdated versions. Only checked for ADC clients.
+	BannedClients []ClientRule
+	// Files maps the names of files served to ADC clients (e.g. "rules.txt") to paths on disk.
+	// Clients can request them with GET over the hub connection. Other files are not available.
+	Files map[string]string
+	// MaxFileSize is the size limit of files in Files. Default is 256 KB.
+	MaxFileSize int64
+	// BrowserPage responds to HTTP requests sent to the hub port with a page
+	// that explains how to connect to the hub. Otherwise, such connections are closed.
+	BrowserPage bool
+	// TLS enables TLS support if set.
+	// Unless GetCertificate is set, the first certificate from the list is served
+	// and can be replaced later with SetCertificate.
+	TLS *tls.Config
+	// OpCerts maps keyprints of TLS client certificates to nicks of operators. Keyprints use
+	// the ADC format: "SHA256/" followed by the base32 hash of the certificate. Users that present
+	// a listed certificate and login with a matching nick are operators, no password is required.
+	// Listed nicks are reserved: logins without the certificate are refused. Client certificates
+	// are requested by the hub when this is set, but the clients are not required to send them.
+	OpCerts map[string]string
+	// NextSID allocates session IDs for new peers, for example to get predictable SIDs in tests.
+	// It must be safe for concurrent use and must never return the SID that is still in use,
+	// or a zero SID that is reserved for the hub. By default, SIDs are allocated sequentially.
+	NextSID func() adc.SID
+	// BridgeCID derives CIDs of NMDC and IRC users for ADC clients from their nicks. It must return
+	// distinct CIDs for distinct nicks, otherwise ADC clients may treat two users as one.
+	// By default, the CID is a Tiger hash of the nick, see HashBridgeCID for other hash algorithms.
+	BridgeCID func(name string) adc.CID
+	// SIDWarnUsage is a fraction of the SID space, from 0 to 1. The hub logs a warning when the number
+	// of used SIDs crosses it. Default is 0.9. See Stats.SIDUsage.
+	SIDWarnUsage float64
+	// ReconnectLimit is the number of connections allowed from a single IP, or logins with
+	// a single CID, during the ReconnectWindow. Excess connections are held for a while and closed.
+	// Zero means no limit.
+	ReconnectLimit int
+	// ReconnectWindow is the period for the ReconnectLimit. Default is 1 minute.
+	ReconnectWindow time.Duration
+	// ReconnectCooldown is the time during which the hub refuses logins with the CID of the user
+	// it has kicked or redirected. ADC clients are asked to wait for the same time in the QUI message.
+	// Zero disables the cooldown.
+	ReconnectCooldown time.Duration
+	// JoinDelay delays announcing new users to others. Users that leave before the delay
+	// are never announced, so quick reconnects do not flood the user list with joins and quits.
+	JoinDelay time.Duration
+	// GeoIP resolves the countries of users, if set. Lookups are done in background after login.
+	GeoIP GeoIP
+	// ReverseDNS resolves the host names of users in background after login.
+	ReverseDNS bool
+	// LookupRate limits the number of GeoIP and DNS lookups per second. Default is 10.
+	LookupRate int
+	// NMDCEncoding is the charset of legacy NMDC clients, for example "windows-1251".
+	// NMDC connections use UTF-8 and switch to this charset when the client sends a text
+	// that is not valid UTF-8. Default is "windows-1252".
+	NMDCEncoding string
+	// AuditLog records moderation actions, such as kicks and refused logins.
+	AuditLog AuditLogger
+	// ChatSink receives all main chat messages broadcast by the hub, after filtering.
+	// It is called asynchronously; messages are dropped if the sink falls too far behind.
+	ChatSink ChatSink
+	// IPBans is a list of banned IPs and networks, see BanIP. If it's not set, bans are kept in memory.
+	IPBans *IPBans
+	// Accounts is a store of registered users. Registered nicks require a password to login.
+	// ADC clients can only login with registered nicks if the store implements ADCAccounts,
+	// since ADC password authentication requires the hub to know a plain password.
+	Accounts Accounts
+}
+
+// New creates a hub with a given config.
+func New(conf Config) *Hub {
+	return newHub(conf, time.Now)
+}
+
+// Info is the hub name, description and software, see NewHub.
 type Info struct {
 	Name string
 	Desc string
 	Soft Software
 }
 
+// NewHub creates a hub with a given info and TLS config.
+//
+// Deprecated: use New, it accepts the full hub config.
 func NewHub(info Info, tls *tls.Config) *Hub {
-	if info.Soft == (Software{}) {
-		info.Soft = Software{
+	return New(Config{Name: info.Name, Desc: info.Desc, Soft: info.Soft, TLS: tls})
+}
+
+// newHub creates a hub with a given clock.
+func newHub(conf Config, now func() time.Time) *Hub {
+	if conf.Soft == (Software{}) {
+		conf.Soft = Software{
 			Name: version.Name,
 			Vers: version.Vers,
 		}
 	}
-	if tls != nil {
-		tls.NextProtos = []string{"adc", "nmdc"}
+	if conf.LoginTimeout <= 0 {
+		conf.LoginTimeout = 5 * time.Second
+	}
+	if conf.QueueInterval <= 0 {
+		conf.QueueInterval = defaultQueueInterval
+	}
+	if conf.ChatHistory == 0 {
+		conf.ChatHistory = defaultChatHistory
+	}
+	if conf.MaxSearchResults == 0 {
+		conf.MaxSearchResults = defaultSearchResults
+	}
+	if conf.MaxFileSize <= 0 {
+		conf.MaxFileSize = defaultMaxFileSize
+	}
+	if conf.BridgeCID == nil {
+		conf.BridgeCID = defaultBridgeCID
+	}
+	if conf.SIDWarnUsage <= 0 || conf.SIDWarnUsage > 1 {
+		conf.SIDWarnUsage = defaultSIDWarnUsage
+	}
+	if conf.TLS != nil {
+		conf.TLS.NextProtos = []string{"adc", "nmdc"}
+		if len(conf.OpCerts) != 0 && conf.TLS.ClientAuth == tls.NoClientCert {
+			// certificates are self-signed, they are checked by the keyprint
+			conf.TLS.ClientAuth = tls.RequestClientCert
+		}
 	}
 	h := &Hub{
-		created: time.Now(),
-		info:    info,
-		tls:     tls,
+		created:   now(),
+		now:       now,
+		conf:      conf,
+		tls:       conf.TLS,
+		history:   newChatHistory(conf.ChatHistory),
+		sidSource: conf.NextSID,
+		bridgeCID: conf.BridgeCID,
+		sidWarn:   uint32(conf.SIDWarnUsage * sidSpace),
+		resync:    conf.ResyncInterval > 0,
+
+		lookupAddr: net.LookupAddr,
 	}
+	h.listen.ready = make(chan struct{})
+	// hub-wide limiters always exist, so the limit can be changed later
+	h.traffic.rd = new(rateLimiter)
+	h.traffic.wr = new(rateLimiter)
+	h.traffic.rd.setRate(conf.HubBandwidth)
+	h.traffic.wr.setRate(conf.HubBandwidth)
 	h.peers.logging = make(map[string]struct{})
 	h.peers.byName = make(map[string]Peer)
+	h.peers.byADCName = make(map[string]Peer)
 	h.peers.bySID = make(map[adc.SID]Peer)
+	h.peers.pending = make(map[adc.SID]*time.Timer)
+	h.initTLS()
+	h.initBot()
 	h.initADC()
 	h.initHTTP()
+	h.initCommands()
+	if conf.HideIPs {
+		h.addInfoTransform(hideIPs)
+	}
+	if len(conf.InfoFields) != 0 {
+		h.addInfoTransform(allowFields(conf.InfoFields))
+	}
+	h.bans = conf.IPBans
+	if h.bans != nil {
+		// the file may contain expiring bans, or they can be added to it and reloaded later
+		h.startPruneBans()
+	} else {
+		h.bans = &IPBans{}
+	}
+	h.startLookups(conf)
+	h.startChatLog(conf)
+	if h.resync {
+		go h.resyncLoop(conf.ResyncInterval)
+	}
 	return h
 }
 
 type Hub struct {
 	created time.Time
-	info    Info
 	tls     *tls.Config
+	cert    atomic.Value // *tls.Certificate
 	h2      *http2.Server
 	h2conf  *http2.ServeConnOpts
 
-	lastSID uint32
+	lastSID   uint32
+	sidSource func() adc.SID
+	sidWarn   uint32 // number of SIDs that triggers the warning
+
+	bridgeCID func(name string) adc.CID
+
+	// listen tracks addresses bound by ListenAndServe
+	listen struct {
+		sync.RWMutex
+		ready  chan struct{}
+		list   []net.Listener
+		addrs  []net.Addr
+		closed bool
+	}
+
+	reconnects reconnectTracker
+	bans       *IPBans
+	pruneBans  sync.Once
+	// hybrid tracks pending HBRI validations by token
+	hybrid struct {
+		sync.Mutex
+		pending map[string]*hybridRequest
+	}
+	// resync enables tracking of user lists known to clients
+	resync bool
+	// infoTransforms customize the ADC user info for some recipients
+	infoTransforms []infoTransform
+
+	// now returns the current time; tests replace it with a fake clock.
+	// Network deadlines always use the real time.
+	now func() time.Time
+
+	lookups    chan locatedPeer
+	lookupAddr func(addr string) ([]string, error)
+
+	chatLog chan chatLogEntry
+
+	history *chatHistory
+	bot     *botPeer
+
+	confMu    sync.RWMutex
+	conf      Config
+	onConnect func(conn net.Conn) error
+	// maintenance is the message for users that try to log in while the hub is in maintenance;
+	// empty if logins are allowed. Protected by confMu.
+	maintenance string
+	// infoVer is the version of the hub info, changed on each update at runtime. Protected by confMu.
+	infoVer uint64
 
 	peers struct {
 		sync.RWMutex
@@ -63,11 +369,54 @@ type Hub struct {
 		// byName tracks peers by their name.
 		byName map[string]Peer
 		bySID  map[adc.SID]Peer
+		// byADCName tracks bridged peers by their nick shown to ADC clients, if it's different
+		// from the real one, see adcNick.
+		byADCName map[string]Peer
 
 		// ADC-specific
 
 		loggingCID map[adc.CID]struct{}
 		byCID      map[adc.CID]*adcPeer
+		// viewers are read-only peers that are not visible to others
+		viewers map[adc.SID]*adcPeer
+		// pending are the join announcements delayed by JoinDelay
+		pending map[adc.SID]*time.Timer
+		// queue is a list of users waiting for a free slot, see QueueSize
+		queue []chan struct{}
+
+		// share is a total share size of all peers.
+		share uint64
+		// clients and features count users by client software and by supported feature.
+		clients  map[Software]int
+		features map[string]int
+	}
+
+	// user counters; can be read without holding the peers lock
+	users struct {
+		total int32
+		adc   int32
+		nmdc  int32
+	}
+
+	// event counters; updated atomically
+	counters struct {
+		messages uint64
+		searches uint64
+		logins   uint64
+		kicks    uint64
+		dropped  uint64
+	}
+
+	// traffic of all connections
+	traffic struct {
+		recv, sent meter
+		rd, wr     *rateLimiter
+	}
+
+	cmds struct {
+		sync.RWMutex
+		byName map[string]Command
+		user   []userCommand
 	}
 }
 
@@ -75,49 +424,526 @@ type Stats struct {
 	Name  string   `json:"name"`
 	Desc  string   `json:"desc,omitempty"`
 	Users int      `json:"users"`
+	Share uint64   `json:"share"`
 	Enc   string   `json:"enc,omitempty"`
 	Soft  Software `json:"soft"`
-	// TODO: uptime
+	// Uptime is the hub uptime in seconds.
+	Uptime uint64 `json:"uptime"`
+
+	// Event counters since the hub start.
+
+	Messages uint64 `json:"messages,omitempty"`
+	Searches uint64 `json:"searches,omitempty"`
+	Logins   uint64 `json:"logins,omitempty"`
+	Kicks    uint64 `json:"kicks,omitempty"`
+	// Dropped is the number of broadcasts that failed to be written to some of the users.
+	Dropped uint64 `json:"dropped,omitempty"`
+
+	// Traffic of all connections in bytes, and the throughput during the last second in bytes per second.
+
+	BytesRecv uint64 `json:"bytes_recv,omitempty"`
+	BytesSent uint64 `json:"bytes_sent,omitempty"`
+	RecvRate  uint64 `json:"recv_rate,omitempty"`
+	SentRate  uint64 `json:"sent_rate,omitempty"`
+
+	// Clients is the number of users by client name and version.
+	Clients map[string]map[string]int `json:"clients,omitempty"`
+	// Features is the number of users that support each feature, named as in ADC (ADC0, TCP4, SEGA, etc).
+	Features map[string]int `json:"features,omitempty"`
+
+	// SIDs is the number of ADC session IDs used by the hub, and SIDUsage is the fraction of the SID space
+	// they take. SIDs are not reused yet, so SIDs of users that already left are counted as well.
+	// If Config.NextSID is set, only SIDs of users on the hub are counted.
+	SIDs     int     `json:"sids,omitempty"`
+	SIDUsage float64 `json:"sid_usage,omitempty"`
+
+	// Maintenance is set while the hub refuses new logins, see SetMaintenance.
+	Maintenance bool `json:"maintenance,omitempty"`
 }
 
 func (h *Hub) Stats() Stats {
 	h.peers.RLock()
-	users := len(h.peers.byName)
+	share := h.peers.share
 	h.peers.RUnlock()
+	conf := h.config()
+	recv, recvRate := h.traffic.recv.stats()
+	sent, sentRate := h.traffic.sent.stats()
+	clients, features := h.clientStats()
+	sids := h.usedSIDs()
+	maintenance, _ := h.Maintenance()
 	return Stats{
-		Name:  h.info.Name,
-		Desc:  h.info.Desc,
-		Users: users,
+		Name:  conf.Name,
+		Desc:  conf.Desc,
+		Users: h.UserCount(),
+		Share: share,
 		Enc:   "utf8",
-		Soft:  h.info.Soft,
+		Soft:  conf.Soft,
+
+		Uptime: uint64(h.Uptime() / time.Second),
+
+		Messages: atomic.LoadUint64(&h.counters.messages),
+		Searches: atomic.LoadUint64(&h.counters.searches),
+		Logins:   atomic.LoadUint64(&h.counters.logins),
+		Kicks:    atomic.LoadUint64(&h.counters.kicks),
+		Dropped:  atomic.LoadUint64(&h.counters.dropped),
+
+		BytesRecv: recv,
+		BytesSent: sent,
+		RecvRate:  recvRate,
+		SentRate:  sentRate,
+
+		Clients:  clients,
+		Features: features,
+
+		SIDs:     sids,
+		SIDUsage: float64(sids) / sidSpace,
+
+		Maintenance: maintenance,
+	}
+}
+
+// Uptime returns the time passed since the hub was started.
+func (h *Hub) Uptime() time.Duration {
+	return h.now().Sub(h.created)
+}
+
+// initTLS makes the hub serve the certificate via a callback, so it can be replaced at runtime.
+func (h *Hub) initTLS() {
+	if h.tls == nil || h.tls.GetCertificate != nil || len(h.tls.Certificates) == 0 {
+		return
+	}
+	cert := h.tls.Certificates[0]
+	h.cert.Store(&cert)
+	// GetCertificate is only called if the list is empty
+	h.tls.Certificates = nil
+	h.tls.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return h.Certificate(), nil
+	}
+}
+
+// Certificate returns the TLS certificate served by the hub.
+// It returns nil if TLS is disabled or the certificate is served by a custom GetCertificate.
+func (h *Hub) Certificate() *tls.Certificate {
+	cert, _ := h.cert.Load().(*tls.Certificate)
+	return cert
+}
+
+// SetCertificate replaces the TLS certificate served by the hub.
+// Established connections are not affected, new handshakes will use the new certificate.
+func (h *Hub) SetCertificate(cert *tls.Certificate) error {
+	if cert == nil {
+		return errors.New("certificate must be set")
+	} else if h.Certificate() == nil {
+		return errors.New("hub doesn't manage the TLS certificate")
 	}
+	h.cert.Store(cert)
+	return nil
+}
+
+// Config returns a copy of the current hub config, including the changes made by setters like SetMOTD.
+func (h *Hub) Config() Config {
+	return h.config()
+}
+
+// config returns a copy of the current hub config.
+func (h *Hub) config() Config {
+	h.confMu.RLock()
+	defer h.confMu.RUnlock()
+	return h.conf
+}
+
+// SetMOTD changes the message of the day sent to users after login.
+func (h *Hub) SetMOTD(motd string) {
+	h.confMu.Lock()
+	h.conf.MOTD = motd
+	h.confMu.Unlock()
+}
+
+// SetTopic changes the hub topic and sends it to all users.
+// Empty topic makes the hub show the description instead.
+func (h *Hub) SetTopic(topic string) {
+	h.updateHubInfo(func(c *Config) {
+		c.Topic = topic
+	})
+}
+
+// SetName changes the hub name and sends it to all users.
+func (h *Hub) SetName(name string) {
+	h.updateHubInfo(func(c *Config) {
+		c.Name = name
+	})
 }
 
+// SetDesc changes the hub description and sends it to all users.
+// The description is only shown if the topic is not set.
+func (h *Hub) SetDesc(desc string) {
+	h.updateHubInfo(func(c *Config) {
+		c.Desc = desc
+	})
+}
+
+// updateHubInfo changes the config and sends the new hub info to all users.
+func (h *Hub) updateHubInfo(update func(c *Config)) {
+	h.confMu.Lock()
+	update(&h.conf)
+	h.infoVer++
+	h.confMu.Unlock()
+	h.broadcastHubInfo()
+}
+
+// configVersion returns a copy of the current hub config and the version of the hub info.
+func (h *Hub) configVersion() (Config, uint64) {
+	h.confMu.RLock()
+	defer h.confMu.RUnlock()
+	return h.conf, h.infoVer
+}
+
+// hubInfoVersion returns the version of the hub info, see updateHubInfo.
+func (h *Hub) hubInfoVersion() uint64 {
+	h.confMu.RLock()
+	defer h.confMu.RUnlock()
+	return h.infoVer
+}
+
+// broadcastHubInfo sends the current hub info to all users.
+//
+// Users that are logging in are not on the list yet. They remember the version of the info sent
+// to them, and check it again when they are added to the hub, see hubInfoChanged.
+func (h *Hub) broadcastHubInfo() {
+	info := h.adcHubInfo()
+	for _, p := range append(h.Peers(), h.viewerList()...) {
+		switch p := p.(type) {
+		case *adcPeer:
+			_ = p.writeHubInfo(info)
+		case *nmdcPeer:
+			_ = p.sendHubInfo()
+		}
+	}
+}
+
+// hubInfoChanged checks if the hub info was updated after it was sent to the user at login.
+// Peers lock must be held, so the check is ordered with the peer list used by broadcastHubInfo.
+func (h *Hub) hubInfoChanged(p *BasePeer) bool {
+	return h.hubInfoVersion() != p.hubInfo
+}
+
+// topic returns the hub topic, or the description if the topic is not set.
+func (c *Config) topic() string {
+	if c.Topic != "" {
+		return c.Topic
+	}
+	return c.Desc
+}
+
+// SetMaxUsers changes the user limit of the hub. Zero means no limit.
+// Users that are already on the hub are not affected.
+func (h *Hub) SetMaxUsers(n int) {
+	if n < 0 {
+		n = 0
+	}
+	h.updateHubInfo(func(c *Config) {
+		c.MaxUsers = n
+	})
+}
+
+// SetBandwidth changes the traffic limits, in bytes per second. Zero disables the limit.
+// The hub-wide limit applies immediately, while the per-connection limit only applies to new connections.
+func (h *Hub) SetBandwidth(peer, hub int64) {
+	h.confMu.Lock()
+	h.conf.PeerBandwidth = peer
+	h.conf.HubBandwidth = hub
+	h.confMu.Unlock()
+	h.traffic.rd.setRate(hub)
+	h.traffic.wr.setRate(hub)
+}
+
+// SetSearchLimits changes the limit of results relayed for a single search, and the number
+// of results a single user can send per second. See Config.MaxSearchResults and Config.SearchResultRate.
+func (h *Hub) SetSearchLimits(maxResults, resultRate int) {
+	if maxResults == 0 {
+		maxResults = defaultSearchResults
+	}
+	h.confMu.Lock()
+	h.conf.MaxSearchResults = maxResults
+	h.conf.SearchResultRate = resultRate
+	h.confMu.Unlock()
+}
+
+// SetReconnectLimits changes the number of connections allowed from a single IP or CID during the window,
+// and the time during which the CID of a disconnected user is held. See Config.ReconnectLimit.
+func (h *Hub) SetReconnectLimits(limit int, window, cooldown time.Duration) {
+	h.confMu.Lock()
+	h.conf.ReconnectLimit = limit
+	h.conf.ReconnectWindow = window
+	h.conf.ReconnectCooldown = cooldown
+	h.confMu.Unlock()
+}
+
+// SetUserLimits changes share, slots and slots per hub requirements for new users.
+func (h *Hub) SetUserLimits(minShare uint64, minSlots int, minSlotsPerHub float64) {
+	h.updateHubInfo(func(c *Config) {
+		c.MinShare = minShare
+		c.MinSlots = minSlots
+		c.MinSlotsPerHub = minSlotsPerHub
+	})
+}
+
+// SetLoginTimeout changes the time limit of each login stage.
+func (h *Hub) SetLoginTimeout(d time.Duration) {
+	if d <= 0 {
+		d = 5 * time.Second
+	}
+	h.confMu.Lock()
+	h.conf.LoginTimeout = d
+	h.confMu.Unlock()
+}
+
+// SetLoginDeadline changes the time limit of the whole login.
+// Zero or negative value resets it to the default, which is twice the login timeout.
+func (h *Hub) SetLoginDeadline(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.confMu.Lock()
+	h.conf.LoginDeadline = d
+	h.confMu.Unlock()
+}
+
+// loginDeadline returns the deadline of the login that starts now.
+func (c Config) loginDeadline() time.Time {
+	d := c.LoginDeadline
+	if d <= 0 {
+		d = 2 * c.LoginTimeout
+	}
+	return time.Now().Add(d)
+}
+
+// stageDeadline returns the deadline of the next login stage,
+// which cannot end later than the whole login.
+func (c Config) stageDeadline(login time.Time) time.Time {
+	deadline := time.Now().Add(c.LoginTimeout)
+	if login.Before(deadline) {
+		return login
+	}
+	return deadline
+}
+
+const (
+	// sidSpace is the number of SIDs available for peers: 4 base32 characters, except the zero SID.
+	sidSpace = 1<<20 - 1
+	// defaultSIDWarnUsage is the fraction of the SID space that triggers a warning, if not set in the config.
+	defaultSIDWarnUsage = 0.9
+)
+
 func (h *Hub) nextSID() adc.SID {
+	if h.sidSource != nil {
+		return h.sidSource()
+	}
 	// TODO: reuse SIDs
 	v := atomic.AddUint32(&h.lastSID, 1)
+	if v == h.sidWarn {
+		log.Printf("warning: %d of %d SIDs are used (%.0f%%)", v, sidSpace, 100*float64(v)/sidSpace)
+	}
 	return types.SIDFromInt(v)
 }
 
+// usedSIDs returns the number of SIDs used from the SID space. The default allocator never reuses
+// SIDs, thus SIDs of peers that already left are counted as well. If SIDs are allocated by
+// Config.NextSID, only the SIDs of peers on the hub are counted.
+func (h *Hub) usedSIDs() int {
+	if h.sidSource == nil {
+		return int(atomic.LoadUint32(&h.lastSID))
+	}
+	h.peers.RLock()
+	defer h.peers.RUnlock()
+	return len(h.peers.bySID)
+}
+
+// unixPrefix is a prefix of listen addresses for Unix domain sockets, for example "unix:/run/gohub.sock".
+const unixPrefix = "unix:"
+
+// ListenAndServe listens on a given address and serves incoming connections.
+// The address is either a TCP address, or a path of a Unix domain socket with a "unix:" prefix.
+//
+// It blocks until the listener fails or StopListening is called. Temporary accept errors, like running
+// out of file descriptors, are logged and retried with a backoff. Use Ready to find when the hub is listening.
 func (h *Hub) ListenAndServe(addr string) error {
-	lis, err := net.Listen("tcp", addr)
+	lis, err := listen(addr)
 	if err != nil {
 		return err
 	}
 	defer lis.Close()
+	if !h.setListening(lis) {
+		return ErrListenerClosed
+	}
+	return h.acceptLoop(lis)
+}
+
+// ListenAndServeAll listens on all given addresses, see ListenAndServe.
+//
+// If any of the listeners fails, the rest are stopped, and all failures are returned as a MultiError
+// of ListenError, or as a single ListenError. It returns ErrListenerClosed after StopListening.
+func (h *Hub) ListenAndServeAll(addrs []string) error {
+	if len(addrs) == 0 {
+		return errors.New("no addresses to listen on")
+	}
+	errc := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		addr := addr
+		go func() {
+			err := h.ListenAndServe(addr)
+			if err != nil && err != ErrListenerClosed {
+				err = &ListenError{Addr: addr, Err: err}
+			}
+			errc <- err
+		}()
+	}
+	var errs MultiError
+	for range addrs {
+		err := <-errc
+		if err == ErrListenerClosed {
+			continue
+		}
+		errs = append(errs, err)
+		_ = h.StopListening()
+	}
+	switch len(errs) {
+	case 0:
+		return ErrListenerClosed
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
+
+const (
+	acceptMinDelay = 5 * time.Millisecond
+	acceptMaxDelay = time.Second
+)
+
+type temporaryErr interface {
+	Temporary() bool
+}
+
+// acceptLoop serves connections from the listener. It retries temporary errors with an exponential backoff.
+func (h *Hub) acceptLoop(lis net.Listener) error {
+	var delay time.Duration
 	for {
 		conn, err := lis.Accept()
-		if err != nil {
+		if h.isListenerClosed() {
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return ErrListenerClosed
+		} else if e, ok := err.(temporaryErr); ok && e.Temporary() {
+			if delay == 0 {
+				delay = acceptMinDelay
+			} else if delay *= 2; delay > acceptMaxDelay {
+				delay = acceptMaxDelay
+			}
+			log.Printf("%s: accept error: %v; retrying in %v", lis.Addr(), err, delay)
+			time.Sleep(delay)
+			continue
+		} else if err != nil {
 			return err
 		}
+		delay = 0
 		go func() {
-			if err := h.Serve(conn); err != nil {
+			if err := h.Serve(conn); err != nil && err != ErrNotDC {
 				log.Printf("%s: %v", conn.RemoteAddr(), err)
 			}
 		}()
 	}
 }
 
+// Ready returns a channel that is closed once ListenAndServe binds to its address.
+//
+// The listener is open at this point, so connections to the address are queued by the OS
+// and will be served, even if the hub hasn't accepted them yet. If ListenAndServe is called
+// for multiple addresses, the channel is closed after the first one is bound; see Addrs.
+func (h *Hub) Ready() <-chan struct{} {
+	return h.listen.ready
+}
+
+// Addr returns the first address the hub is listening on, or nil if it's not listening.
+// The port is the actual one, even if the hub was asked to listen on port 0.
+func (h *Hub) Addr() net.Addr {
+	h.listen.RLock()
+	defer h.listen.RUnlock()
+	if len(h.listen.addrs) == 0 {
+		return nil
+	}
+	return h.listen.addrs[0]
+}
+
+// Addrs returns addresses the hub is listening on.
+func (h *Hub) Addrs() []net.Addr {
+	h.listen.RLock()
+	defer h.listen.RUnlock()
+	return append([]net.Addr{}, h.listen.addrs...)
+}
+
+// StopListening closes all listeners started by ListenAndServe and removes their Unix socket files.
+// Connected users are not affected.
+func (h *Hub) StopListening() error {
+	h.listen.Lock()
+	list := h.listen.list
+	h.listen.list, h.listen.addrs = nil, nil
+	h.listen.closed = true
+	h.listen.Unlock()
+	var errs MultiError
+	for _, lis := range list {
+		if err := lis.Close(); err != nil {
+			errs = append(errs, &ListenError{Addr: lis.Addr().String(), Err: err})
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
+
+func (h *Hub) setListening(lis net.Listener) bool {
+	h.listen.Lock()
+	defer h.listen.Unlock()
+	if h.listen.closed {
+		return false
+	}
+	h.listen.list = append(h.listen.list, lis)
+	h.listen.addrs = append(h.listen.addrs, lis.Addr())
+	if len(h.listen.addrs) == 1 {
+		close(h.listen.ready)
+	}
+	return true
+}
+
+func (h *Hub) isListenerClosed() bool {
+	h.listen.RLock()
+	defer h.listen.RUnlock()
+	return h.listen.closed
+}
+
+// listen opens a TCP or Unix socket listener.
+func listen(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// the socket file may be left by a hub that was not stopped properly
+		if c, err := net.Dial("unix", path); err == nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("socket is already in use: %s", path)
+		}
+		_ = os.Remove(path)
+	}
+	// the listener removes the file when it's closed
+	return net.Listen("unix", path)
+}
+
 type timeoutErr interface {
 	Timeout() bool
 }
@@ -131,7 +957,7 @@ func (h *Hub) serve(conn net.Conn, allowTLS bool) error {
 	if err != nil {
 		if te, ok := err.(timeoutErr); ok && te.Timeout() {
 			// only NMDC protocol expects the server to speak first
-			return h.ServeNMDC(conn)
+			return h.serveCaptured(conn, h.ServeNMDC)
 		}
 		return err
 	}
@@ -154,9 +980,9 @@ func (h *Hub) serve(conn net.Conn, allowTLS bool) error {
 		}
 		switch proto {
 		case "nmdc":
-			return h.ServeNMDC(tconn)
+			return h.serveCaptured(tconn, h.ServeNMDC)
 		case "adc":
-			return h.ServeADC(tconn)
+			return h.serveCaptured(tconn, h.ServeADC)
 		case "h2":
 			return h.ServeHTTP2(tconn)
 		case "":
@@ -167,19 +993,82 @@ func (h *Hub) serve(conn net.Conn, allowTLS bool) error {
 		}
 	}
 	switch string(buf) {
-	case "HSUP":
-		// ADC client-hub handshake
-		return h.ServeADC(conn)
-	case "NICK":
+	case "HSUP", "HTCP":
+		// ADC client-hub handshake, or the secondary HBRI connection
+		return h.serveCaptured(conn, h.ServeADC)
+	case "NICK", "PASS":
 		// IRC handshake
-		return h.ServeIRC(conn)
+		return h.serveCaptured(conn, h.ServeIRC)
+	}
+	if hasMagic(buf, httpMagic) && h.config().BrowserPage {
+		return h.serveBrowserPage(conn)
+	}
+	if isForeignProtocol(buf) {
+		return ErrNotDC
 	}
 	return fmt.Errorf("unknown protocol magic: %q", string(buf))
 }
 
+// httpMagic is a list of prefixes of HTTP requests.
+var httpMagic = []string{
+	"GET ", "HEAD", "POST", "PUT ", "DELE", "OPTI", "CONN", "TRAC", "PATC", "PRI ",
+}
+
+// foreignMagic is a list of prefixes sent by clients of common non-DC protocols, except HTTP.
+var foreignMagic = []string{
+	// TLS handshake on a port without TLS
+	"\x16\x03",
+	// SSH
+	"SSH-",
+}
+
+// isForeignProtocol checks if the first bytes of the connection belong to a well-known non-DC protocol.
+func isForeignProtocol(buf []byte) bool {
+	return hasMagic(buf, httpMagic) || hasMagic(buf, foreignMagic)
+}
+
+func hasMagic(buf []byte, magic []string) bool {
+	for _, m := range magic {
+		if len(buf) >= len(m) && string(buf[:len(m)]) == m {
+			return true
+		}
+	}
+	return false
+}
+
 // Serve automatically detects the protocol and start the hub-client handshake.
+// The connection is throttled according to the bandwidth limits of the hub.
 func (h *Hub) Serve(conn net.Conn) error {
-	return h.serve(conn, true)
+	if h.trustedProxy(conn.RemoteAddr()) {
+		c, err := readProxyHeader(conn)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		conn = c
+	}
+	if err := h.admit(conn); err != nil {
+		return err
+	}
+	return h.serve(h.limitConn(conn), true)
+}
+
+// admit checks if the connection from a given address is allowed, before the protocol handshake.
+// Refused connections are closed.
+func (h *Hub) admit(conn net.Conn) error {
+	if err := h.checkBan(conn); err != nil {
+		rejectConn(conn, err)
+		return err
+	}
+	if err := h.checkConnect(conn); err != nil {
+		rejectConn(conn, err)
+		return err
+	}
+	if err := h.checkReconnectIP(conn); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	return nil
 }
 
 func (h *Hub) Peers() []Peer {
@@ -188,6 +1077,220 @@ func (h *Hub) Peers() []Peer {
 	return h.listPeers()
 }
 
+// UserCount returns the number of users on the hub.
+func (h *Hub) UserCount() int {
+	return int(atomic.LoadInt32(&h.users.total))
+}
+
+// UserCountByProtocol returns the number of ADC and NMDC users on the hub.
+func (h *Hub) UserCountByProtocol() (adc, nmdc int) {
+	return int(atomic.LoadInt32(&h.users.adc)), int(atomic.LoadInt32(&h.users.nmdc))
+}
+
+// isVirtual checks if the peer is not a real user, but the hub bot or a linked hub.
+func isVirtual(p Peer) bool {
+	switch p.(type) {
+	case *botPeer, *linkPeer:
+		return true
+	}
+	return false
+}
+
+// updateCounters adds the peer to the hub counters, or removes it if n is negative.
+// Virtual peers are not counted. Peers lock must be held.
+func (h *Hub) updateCounters(peer Peer, n int32) {
+	if isVirtual(peer) {
+		return
+	}
+	u := peer.User()
+	if n > 0 {
+		h.peers.share += u.Share
+	} else {
+		h.peers.share -= u.Share
+	}
+	h.countClient(u.App, userFeatures(peer), int(n))
+	atomic.AddInt32(&h.users.total, n)
+	switch peer.(type) {
+	case *adcPeer:
+		atomic.AddInt32(&h.users.adc, n)
+	case *nmdcPeer:
+		atomic.AddInt32(&h.users.nmdc, n)
+	}
+}
+
+// PeersWhere returns a snapshot of peers that match a given predicate.
+// The predicate is called with the peers lock held, thus it must not call Hub methods.
+func (h *Hub) PeersWhere(pred func(p Peer) bool) []Peer {
+	h.peers.RLock()
+	defer h.peers.RUnlock()
+	var list []Peer
+	for _, p := range h.peers.byName {
+		if pred(p) {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// PeersByFeature returns peers that negotiated a given protocol feature.
+func (h *Hub) PeersByFeature(fea string) []Peer {
+	return h.PeersWhere(func(p Peer) bool {
+		for _, f := range p.Features() {
+			if f == fea {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// PeerByNick returns a peer with a given name, or nil if there is no such peer on the hub.
+// Bridged users are also found by the nick shown to ADC clients.
+func (h *Hub) PeerByNick(name string) Peer {
+	p, _ := h.Lookup(name)
+	return p
+}
+
+// Lookup returns a peer with a given name. The second return value reports if the peer was found.
+// Bridged users are also found by the nick shown to ADC clients.
+func (h *Hub) Lookup(name string) (Peer, bool) {
+	h.peers.RLock()
+	defer h.peers.RUnlock()
+	if p, ok := h.peers.byName[name]; ok {
+		return p, true
+	}
+	p, ok := h.peers.byADCName[name]
+	return p, ok
+}
+
+// LookupCID returns an ADC peer with a given client ID. Peers using other protocols have no CID.
+// The second return value reports if the peer was found.
+func (h *Hub) LookupCID(cid adc.CID) (Peer, bool) {
+	h.peers.RLock()
+	p, ok := h.peers.byCID[cid]
+	h.peers.RUnlock()
+	if !ok {
+		// avoid returning a typed nil
+		return nil, false
+	}
+	return p, true
+}
+
+// PeerInfo is a protocol-neutral snapshot of the peer state, useful for debugging.
+type PeerInfo struct {
+	SID      string   `json:"sid"`
+	Name     string   `json:"name"`
+	Addr     string   `json:"addr"`
+	Country  string   `json:"country,omitempty"`
+	Host     string   `json:"host,omitempty"`
+	Features []string `json:"features,omitempty"`
+	Away     bool     `json:"away,omitempty"`
+	// Packets is only set for peers that count packets, currently ADC users.
+	Packets *PacketStats `json:"packets,omitempty"`
+	// Dropped is the number of broadcasts that failed to be written to the peer.
+	// Chronic drops indicate a client that cannot keep up with the hub.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// PacketStats are packet counters of the peer connection. Comparing the last activity time with the
+// current time helps to find connections that stopped responding before the timeout disconnects them.
+type PacketStats struct {
+	In      uint64    `json:"in"`
+	Out     uint64    `json:"out"`
+	LastIn  time.Time `json:"last_in"`
+	LastOut time.Time `json:"last_out"`
+}
+
+// packetCounter is implemented by peers that count packets.
+type packetCounter interface {
+	packetStats() PacketStats
+}
+
+// PeersInfo returns a snapshot of the state of all peers on the hub.
+func (h *Hub) PeersInfo() []PeerInfo {
+	peers := h.Peers()
+	list := make([]PeerInfo, 0, len(peers))
+	for _, p := range peers {
+		country, host := locationOf(p)
+		info := PeerInfo{
+			SID:      p.SID().String(),
+			Name:     p.Name(),
+			Addr:     p.RemoteAddr().String(),
+			Country:  country,
+			Host:     host,
+			Features: p.Features(),
+			Away:     p.User().Away,
+		}
+		if pc, ok := p.(packetCounter); ok {
+			st := pc.packetStats()
+			info.Packets = &st
+		}
+		if d, ok := p.(dropCounter); ok {
+			info.Dropped = d.droppedCount()
+		}
+		list = append(list, info)
+	}
+	return list
+}
+
+// UserSnapshot is a snapshot of the user state, as seen by the hub.
+type UserSnapshot struct {
+	Name string
+	IP   net.IP
+	// Country and Host are set if the lookups are enabled and completed.
+	Country   string
+	Host      string
+	Share     uint64
+	Client    Software
+	Connected time.Time
+	Away      bool
+}
+
+// ListUsers returns a snapshot of all users on the hub, sorted by name.
+// The hub bot and linked hubs are not included.
+func (h *Hub) ListUsers() []UserSnapshot {
+	peers := h.Peers()
+	list := make([]UserSnapshot, 0, len(peers))
+	for _, p := range peers {
+		if isVirtual(p) {
+			continue
+		}
+		u := p.User()
+		country, host := locationOf(p)
+		list = append(list, UserSnapshot{
+			Name:      u.Name,
+			IP:        remoteIP(p.RemoteAddr()),
+			Country:   country,
+			Host:      host,
+			Share:     u.Share,
+			Client:    u.App,
+			Connected: p.ConnectedAt(),
+			Away:      u.Away,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// OpChat sends a chat message to operators only. Regular users and viewers never receive it.
+func (h *Hub) OpChat(from Peer, text string) {
+	ops := h.PeersWhere(func(p Peer) bool {
+		return p.User().Op
+	})
+	for _, p := range ops {
+		_ = p.ChatMsg(from, text)
+	}
+}
+
+// Broadcast sends a message from the hub to all users.
+func (h *Hub) Broadcast(text string) {
+	for _, p := range h.Peers() {
+		_ = p.HubChatMsg(text)
+	}
+}
+
 func (h *Hub) listPeers() []Peer {
 	list := make([]Peer, 0, len(h.peers.byName))
 	for _, p := range h.peers.byName {
@@ -212,30 +1315,94 @@ func (h *Hub) bySID(sid adc.SID) Peer {
 
 func (h *Hub) broadcastUserJoin(peer Peer, notify []Peer) {
 	log.Printf("%s: connected: %s %s", peer.RemoteAddr(), peer.SID(), peer.Name())
+	atomic.AddUint64(&h.counters.logins, 1)
+	h.lookupPeer(peer)
+	if d := h.config().JoinDelay; d > 0 && !isVirtual(peer) {
+		h.peers.Lock()
+		if h.peers.bySID[peer.SID()] == peer {
+			h.delayJoin(peer, d)
+		}
+		h.peers.Unlock()
+		return
+	}
+	h.notifyJoin(peer, notify)
+}
+
+func (h *Hub) notifyJoin(peer Peer, notify []Peer) {
 	if notify == nil {
 		notify = h.Peers()
 	}
-	for _, p := range notify {
-		_ = p.PeersJoin([]Peer{peer})
+	notify = append(notify, h.viewerList()...)
+	for _, p := range h.presenceWatchers(notify) {
+		h.sendSafe(p, func(p Peer) error {
+			return p.PeersJoin([]Peer{peer})
+		})
 	}
 }
 
-func (h *Hub) broadcastUserLeave(peer Peer, name string, notify []Peer) {
-	log.Printf("%s: disconnected: %s %s", peer.RemoteAddr(), peer.SID(), name)
+// broadcastInfo sends the updated info of the peer to users that know about it.
+func (h *Hub) broadcastInfo(peer Peer) {
+	notify := h.broadcastTargets(peer, append(h.Peers(), h.viewerList()...))
+	for _, p := range h.presenceWatchers(notify) {
+		h.sendSafe(p, func(p Peer) error {
+			return p.PeersJoin([]Peer{peer})
+		})
+	}
+}
+
+// sendSafe calls the send function for the peer and counts the failed send as dropped. If it panics,
+// the panic is logged and the peer is disconnected, so a single broken peer doesn't interrupt
+// the broadcast to other users.
+func (h *Hub) sendSafe(p Peer, send func(p Peer) error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%s: panic while sending to %s: %v", p.RemoteAddr(), p.SID(), r)
+			h.countDrop(p, fmt.Errorf("panic: %v", r))
+			_ = p.Close()
+		}
+	}()
+	h.countDrop(p, send(p))
+}
+
+// broadcastUserLeave notifies users that the peer left. If quiet is set, the peer was never announced,
+// and the leave is only logged. If the peer was removed by the hub, the event is recorded in the audit log.
+func (h *Hub) broadcastUserLeave(peer Peer, name, reason string, e *AuditEvent, notify []Peer, quiet bool) {
+	if e != nil {
+		switch e.Action {
+		case AuditKick:
+			log.Printf("%s: kicked: %s %s: %s", peer.RemoteAddr(), peer.SID(), name, reason)
+			atomic.AddUint64(&h.counters.kicks, 1)
+		case AuditRedirect:
+			log.Printf("%s: redirected to %s: %s %s: %s", peer.RemoteAddr(), e.Redirect, peer.SID(), name, reason)
+		}
+		e.Nick = name
+		if p, ok := peer.(*adcPeer); ok {
+			e.CID = p.Info().Id.String()
+		}
+		h.audit(*e, peer.RemoteAddr())
+	} else {
+		log.Printf("%s: disconnected: %s %s", peer.RemoteAddr(), peer.SID(), name)
+	}
+	if quiet {
+		return
+	}
 	if notify == nil {
 		notify = h.Peers()
 	}
-	for _, p := range notify {
-		_ = p.PeersLeave([]Peer{peer})
+	notify = append(notify, h.viewerList()...)
+	for _, p := range h.presenceWatchers(notify) {
+		h.sendSafe(p, func(p Peer) error {
+			return p.PeersLeave([]Peer{peer}, reason)
+		})
 	}
 }
 
 func (h *Hub) broadcastChat(from Peer, text string, notify []Peer) {
 	if notify == nil {
-		notify = h.Peers()
+		notify = append(h.Peers(), h.viewerList()...)
 	}
 	for _, p := range notify {
-		_ = p.ChatMsg(from, text)
+		h.countDrop(p, p.ChatMsg(from, text))
 	}
 }
 
@@ -244,28 +1411,173 @@ func (h *Hub) privateChat(from, to Peer, text string) {
 }
 
 func (h *Hub) sendMOTD(peer Peer) error {
-	return peer.HubChatMsg("Welcome!")
+	motd := h.config().MOTD
+	if motd == "" {
+		return nil
+	}
+	return peer.HubChatMsg(motd)
+}
+
+// sendWelcome sends the MOTD and the chat history to the peer after login.
+func (h *Hub) sendWelcome(peer Peer) error {
+	if h.config().HistoryBeforeMOTD {
+		if err := h.sendHistory(peer); err != nil {
+			return err
+		}
+		return h.sendMOTD(peer)
+	}
+	if err := h.sendMOTD(peer); err != nil {
+		return err
+	}
+	return h.sendHistory(peer)
+}
+
+// account returns an account of a registered user.
+func (h *Hub) account(name string) (Account, bool) {
+	accounts := h.config().Accounts
+	if accounts == nil {
+		return Account{}, false
+	}
+	return accounts.Account(name)
+}
+
+// checkPassword checks the password of a registered user.
+func (h *Hub) checkPassword(name, pass string) bool {
+	accounts := h.config().Accounts
+	if accounts == nil {
+		return false
+	}
+	return accounts.CheckPassword(name, pass)
+}
+
+// isRegistered checks if the nick requires an authentication, either with a password or a client certificate.
+func (h *Hub) isRegistered(name string) bool {
+	if _, ok := h.account(name); ok {
+		return true
+	}
+	for _, op := range h.config().OpCerts {
+		if op == name {
+			return true
+		}
+	}
+	return false
 }
 
-func (h *Hub) leave(peer Peer, sid adc.SID, name string) {
+const (
+	maxShareSize  = 1 << 50 // 1 PiB
+	maxShareFiles = 1 << 31
+	maxSlots      = 1000
+	maxHubs       = 1000
+)
+
+// validateNumbers checks that numeric fields of the user info are within sane bounds.
+func validateNumbers(share uint64, files, slots, freeSlots int, hubs [3]int) error {
+	switch {
+	case share > maxShareSize:
+		return fmt.Errorf("invalid share size: %d", share)
+	case files < 0 || files > maxShareFiles:
+		return fmt.Errorf("invalid number of shared files: %d", files)
+	case slots < 0 || slots > maxSlots:
+		return fmt.Errorf("invalid number of slots: %d", slots)
+	case freeSlots < 0 || freeSlots > maxSlots:
+		return fmt.Errorf("invalid number of free slots: %d", freeSlots)
+	}
+	for _, n := range hubs {
+		if n < 0 || n > maxHubs {
+			return fmt.Errorf("invalid number of hubs: %d", n)
+		}
+	}
+	return nil
+}
+
+// checkLimits checks if the user's share, slots and hubs satisfy hub requirements.
+func (h *Hub) checkLimits(share uint64, slots, hubs int) error {
+	conf := h.config()
+	if share < conf.MinShare {
+		return fmt.Errorf("share size is too small: %d bytes, required: %d bytes", share, conf.MinShare)
+	}
+	if slots < conf.MinSlots {
+		return fmt.Errorf("not enough open slots: %d, required: %d", slots, conf.MinSlots)
+	}
+	if conf.MinSlotsPerHub > 0 && float64(slots) < conf.MinSlotsPerHub*float64(hubs) {
+		need := int(math.Ceil(conf.MinSlotsPerHub * float64(hubs)))
+		return fmt.Errorf("not enough open slots for %d hubs: %d, required: %d", hubs, slots, need)
+	}
+	return nil
+}
+
+// stalePingTimeout is the time given to the old connection to prove it's alive when the user reconnects.
+const stalePingTimeout = time.Second
+
+// dropStale pings the peer and disconnects it, if the connection is dead.
+// It returns true if the peer was disconnected.
+//
+// The caller must make sure that the new connection is authenticated for the same identity,
+// otherwise anyone could disconnect an existing user.
+func (h *Hub) dropStale(peer Peer) bool {
+	p, ok := peer.(interface {
+		ping(timeout time.Duration) error
+	})
+	if !ok {
+		return false
+	}
+	err := p.ping(stalePingTimeout)
+	if err == nil {
+		return false
+	}
+	log.Printf("%s: dropping stale connection of %q: %v", peer.RemoteAddr(), peer.Name(), err)
+	_ = peer.Close()
+	return true
+}
+
+// isFull checks if the hub reached the user limit. Peers lock must be held.
+func (h *Hub) isFull() bool {
+	max := h.config().MaxUsers
+	n := int(atomic.LoadInt32(&h.users.total)) + len(h.peers.logging)
+	return max > 0 && n >= max
+}
+
+// leave removes the peer from the hub and notifies other peers.
+// The notification is sent only once, even if leave is called multiple times.
+// If the reason is set, it is included in the notification. The audit event is set
+// if the peer was removed by the hub, see broadcastUserLeave.
+func (h *Hub) leave(peer Peer, sid adc.SID, name, reason string, e *AuditEvent) {
 	h.peers.Lock()
+	if h.peers.bySID[sid] != peer {
+		// not on the hub or already left
+		h.peers.Unlock()
+		return
+	}
 	delete(h.peers.byName, name)
 	delete(h.peers.bySID, sid)
+	h.unbindADCName(peer, name)
+	h.updateCounters(peer, -1)
+	h.wakeQueue()
+	quiet := h.cancelJoin(sid)
 	notify := h.listPeers()
 	h.peers.Unlock()
 
-	h.broadcastUserLeave(peer, name, notify)
+	h.broadcastUserLeave(peer, name, reason, e, notify, quiet)
 }
 
-func (h *Hub) leaveCID(peer Peer, sid adc.SID, cid adc.CID, name string) {
+// leaveCID is the same as leave, but also removes the peer from the CID map.
+func (h *Hub) leaveCID(peer Peer, sid adc.SID, cid adc.CID, name, reason string, e *AuditEvent) {
 	h.peers.Lock()
+	if h.peers.bySID[sid] != peer {
+		// not on the hub or already left
+		h.peers.Unlock()
+		return
+	}
 	delete(h.peers.byName, name)
 	delete(h.peers.bySID, sid)
+	h.updateCounters(peer, -1)
+	h.wakeQueue()
 	delete(h.peers.byCID, cid)
+	quiet := h.cancelJoin(sid)
 	notify := h.listPeers()
 	h.peers.Unlock()
 
-	h.broadcastUserLeave(peer, name, notify)
+	h.broadcastUserLeave(peer, name, reason, e, notify, quiet)
 }
 
 func (h *Hub) connectReq(from, to Peer, addr, token string, secure bool) {
@@ -289,18 +1601,32 @@ type User struct {
 	IPv4  bool
 	IPv6  bool
 	TLS   bool
+	Op    bool
+	Away  bool
 }
 
 type Peer interface {
 	SID() adc.SID
 	Name() string
 	RemoteAddr() net.Addr
+	// ConnectedAt returns the time when the peer connected to the hub.
+	ConnectedAt() time.Time
 	User() User
+	// Features returns a sorted list of protocol features negotiated with the client.
+	Features() []string
 
 	Close() error
+	// Kick disconnects the peer from the hub. The reason is sent to the peer
+	// and is included in the leave notification for other peers.
+	Kick(reason string) error
+	// SendError sends an error or a warning to the peer. The code is an ADC status code,
+	// it is ignored by protocols that have no notion of error codes.
+	SendError(sev Severity, code int, text string) error
 
 	PeersJoin(peers []Peer) error
-	PeersLeave(peers []Peer) error
+	// PeersLeave notifies the peer that other peers left the hub.
+	// The reason is empty for regular disconnects.
+	PeersLeave(peers []Peer, reason string) error
 	//PeersUpdate(peers []Peer) error
 
 	ChatMsg(from Peer, text string) error
@@ -311,11 +1637,97 @@ type Peer interface {
 	RevConnectTo(peer Peer, token string, secure bool) error
 }
 
+// remoteIP returns an IP address of the remote host (without the port), or nil if it's not an IP address.
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// peerIP returns the IP address of the peer, as seen by other users. It's empty if the address is unknown.
+func peerIP(p Peer) string {
+	if p2, ok := p.(*adcPeer); ok {
+		u := p2.Info()
+		if u.Ip4 != "" {
+			return u.Ip4
+		}
+		return u.Ip6
+	}
+	if isVirtual(p) {
+		return ""
+	}
+	if ip := remoteIP(p.RemoteAddr()); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
 type BasePeer struct {
 	hub *Hub
 
-	addr net.Addr
-	sid  adc.SID
+	addr    net.Addr
+	sid     adc.SID
+	created time.Time
+	// op is set for registered operators at login
+	op bool
+	// keyprint is the keyprint of the TLS client certificate, if any
+	keyprint string
+	// loc is resolved in background after login
+	loc peerLocation
+	// seen is the user list known to the client, tracked for the presence resync
+	seen presence
+	// dropped is the number of broadcasts that failed to be written to the peer
+	dropped uint64
+	// hubInfo is the version of the hub info sent to the client at login
+	hubInfo uint64
+}
+
+func (p *BasePeer) countDrop() {
+	atomic.AddUint64(&p.dropped, 1)
+}
+
+func (p *BasePeer) droppedCount() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// dropCounter is implemented by peers that count broadcasts they failed to receive.
+type dropCounter interface {
+	countDrop()
+	droppedCount() uint64
+}
+
+// countDrop counts the broadcast as dropped by the peer, if the send failed.
+func (h *Hub) countDrop(p Peer, err error) {
+	if err == nil {
+		return
+	}
+	if d, ok := p.(dropCounter); ok {
+		d.countDrop()
+	}
+	atomic.AddUint64(&h.counters.dropped, 1)
+}
+
+// seesIPs checks if the peer is allowed to see IP addresses of other users.
+func (p *BasePeer) seesIPs() bool {
+	return p.op || !p.hub.config().HideIPs
+}
+
+// seesFullInfo checks if the peer receives all the info fields of other users.
+func (p *BasePeer) seesFullInfo() bool {
+	return p.op
+}
+
+// seesPresence checks if the peer is notified when other users join or leave the hub.
+func (p *BasePeer) seesPresence() bool {
+	return p.op || !p.hub.config().QuietPresence
 }
 
 func (p *BasePeer) SID() adc.SID {
@@ -325,3 +1737,7 @@ func (p *BasePeer) SID() adc.SID {
 func (p *BasePeer) RemoteAddr() net.Addr {
 	return p.addr
 }
+
+func (p *BasePeer) ConnectedAt() time.Time {
+	return p.created
+}
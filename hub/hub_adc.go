@@ -1,6 +1,9 @@
 package hub
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -9,18 +12,31 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/direct-connect/go-dcpp/adc"
-	"github.com/direct-connect/go-dcpp/tiger"
+	"github.com/direct-connect/go-dcpp/nmdc"
 )
 
 func (h *Hub) initADC() {
 	h.peers.loggingCID = make(map[adc.CID]struct{})
 	h.peers.byCID = make(map[adc.CID]*adcPeer)
+	h.peers.viewers = make(map[adc.SID]*adcPeer)
 }
 
 func (h *Hub) ServeADC(conn net.Conn) error {
+	switch conn.(type) {
+	case *peekedConn, *tls.Conn, *captureConn:
+		// detected by Serve or negotiated by ALPN
+	default:
+		// make sure it's not an obviously wrong protocol
+		pconn, buf, err := peekCoon(conn, 4)
+		if err == nil && isForeignProtocol(buf) {
+			return ErrNotDC
+		}
+		conn = pconn
+	}
 	log.Printf("%s: using ADC", conn.RemoteAddr())
 	c, err := adc.NewConn(conn)
 	if err != nil {
@@ -28,18 +44,31 @@ func (h *Hub) ServeADC(conn net.Conn) error {
 	}
 	defer c.Close()
 
-	peer, err := h.adcStageProtocol(c)
-	if err != nil {
-		return err
+	// the deadline is checked by each read, but the hub may also block on writes
+	// to the client that doesn't read, so close the connection when the time is out
+	deadline := h.config().loginDeadline()
+	login := time.AfterFunc(time.Until(deadline), func() {
+		_ = c.Close()
+	})
+	peer, err := h.adcStageProtocol(c, deadline)
+	if err == nil {
+		peer.keyprint = clientKeyprint(conn)
+		// connection is not yet valid and we haven't added the client to the hub yet
+		err = h.adcStageIdentity(peer, deadline, login)
 	}
-	// connection is not yet valid and we haven't added the client to the hub yet
-	if err := h.adcStageIdentity(peer); err != nil {
+	login.Stop()
+	if err == errHybridConn {
+		return nil
+	} else if err != nil {
 		return err
 	}
 	// peer registered, now we can start serving things
 	defer peer.Close()
 
-	if err = h.sendMOTD(peer); err != nil {
+	if err = h.sendWelcome(peer); err != nil {
+		return err
+	}
+	if err = peer.sendUserCommands(h.userCommands(peer)); err != nil {
 		return err
 	}
 
@@ -48,6 +77,7 @@ func (h *Hub) ServeADC(conn net.Conn) error {
 
 func (h *Hub) adcServePeer(peer *adcPeer) error {
 	peer.conn.KeepAlive(time.Minute / 2)
+	wrongSID := 0
 	for {
 		p, err := peer.conn.ReadPacket(time.Time{})
 		if err == io.EOF {
@@ -58,30 +88,125 @@ func (h *Hub) adcServePeer(peer *adcPeer) error {
 		switch p := p.(type) {
 		case *adc.BroadcastPacket:
 			if peer.sid != p.ID {
-				return fmt.Errorf("malformed broadcast")
+				wrongSID++
+				if err := h.adcWrongSID(peer, "broadcast", wrongSID); err != nil {
+					return err
+				}
+				continue
+			}
+			if p.Name == (adc.Disconnect{}).Cmd() {
+				// client is leaving, the deferred Close will notify other peers
+				return nil
+			}
+			if p.Name == (adc.ChatMessage{}).Cmd() {
+				var msg adc.ChatMessage
+				if err := adc.Unmarshal(p.Data, &msg); err != nil {
+					// the message cannot be filtered, so it's not broadcasted
+					err = fmt.Errorf("invalid chat message: %v", err)
+					if err = peer.sendError(adc.Recoverable, adc.CodeProtocolGeneric, err); err != nil {
+						return err
+					}
+					continue
+				}
+				if h.chatCommand(peer, string(msg.Text)) {
+					continue
+				}
+				text, ok := h.filterChat(peer, string(msg.Text))
+				if !ok {
+					continue
+				} else if text != string(msg.Text) {
+					p = withChatText(p, text)
+				}
+				if !h.isPending(peer) {
+					h.saveChat(peer, text)
+					if !isLinkClient(peer) {
+						go h.linkChat(peer, text)
+					}
+				}
+			} else if p.Name == (adc.SearchRequest{}).Cmd() {
+				atomic.AddUint64(&h.counters.searches, 1)
+			}
+			if p.Name == (adc.User{}).Cmd() {
+				if err := peer.updateInfo(p.Data); err != nil {
+					if _, ok := err.(*ruleError); ok {
+						// the user is no longer allowed on the hub
+						_ = peer.sendError(adc.Fatal, adc.CodeLoginGeneric, err)
+						_ = peer.Kick(err.Error())
+						return nil
+					}
+					// drop the update, but keep the client online
+					if err = peer.sendError(adc.Recoverable, adc.CodeInfoInvalid, err); err != nil {
+						return err
+					}
+					continue
+				}
 			}
-			// TODO: read INF, update peer info
 			// TODO: update nick, make sure there is no duplicates
 			// TODO: disallow STA and some others
-			go h.adcBroadcast(p, peer, h.Peers())
+			peers := h.Peers()
+			if visibleToViewers(p.Name) {
+				peers = append(peers, h.viewerList()...)
+			}
+			if p.Name == (adc.ChatMessage{}).Cmd() && isLinkClient(peer) {
+				// relayed from the linked hub, see Link
+				peers = localPeers(peers)
+			}
+			go h.adcBroadcast(p, peer, h.broadcastTargets(peer, peers))
 		case *adc.EchoPacket:
 			if peer.sid != p.ID {
-				return fmt.Errorf("malformed echo packet")
+				wrongSID++
+				if err := h.adcWrongSID(peer, "echo packet", wrongSID); err != nil {
+					return err
+				}
+				continue
 			}
-			if err := peer.conn.WritePacket(p); err != nil {
-				return err
+			if p.Name == (adc.SearchResult{}).Cmd() && !h.adcAllowResult(peer, (*adc.DirectPacket)(p)) {
+				continue
 			}
-			if err = peer.conn.Flush(); err != nil {
-				return err
+			if p.Name == (adc.ConnectRequest{}).Cmd() && !h.adcAllowConnect(peer, p.Targ) {
+				continue
 			}
 			// TODO: disallow INF, STA and some others
-			go h.adcDirect((*adc.DirectPacket)(p), peer)
+			go h.adcEcho(p, peer)
 		case *adc.DirectPacket:
 			if peer.sid != p.ID {
-				return fmt.Errorf("malformed direct packet")
+				wrongSID++
+				if err := h.adcWrongSID(peer, "direct packet", wrongSID); err != nil {
+					return err
+				}
+				continue
+			}
+			if p.Name == (adc.SearchResult{}).Cmd() && !h.adcAllowResult(peer, p) {
+				continue
+			}
+			if p.Name == (adc.ConnectRequest{}).Cmd() && !h.adcAllowConnect(peer, p.Targ) {
+				continue
 			}
 			// TODO: disallow INF, STA and some others
 			go h.adcDirect(p, peer)
+		case *adc.HubPacket:
+			if p.Name == (adc.Disconnect{}).Cmd() {
+				// client is leaving, the deferred Close will notify other peers
+				return nil
+			}
+			if p.Name == (adc.ChatMessage{}).Cmd() {
+				var msg adc.ChatMessage
+				if err := adc.Unmarshal(p.Data, &msg); err == nil && h.chatCommand(peer, string(msg.Text)) {
+					continue
+				}
+			} else if p.Name == (adc.GetRequest{}).Cmd() {
+				if err := h.adcServeFile(peer, p); err != nil {
+					return err
+				}
+				continue
+			} else if p.Name == (adc.Supported{}).Cmd() {
+				if err := h.adcRenegotiate(peer, p); err != nil {
+					return err
+				}
+				continue
+			}
+			data, _ := p.MarshalPacket()
+			log.Printf("%s: adc: %s", peer.RemoteAddr(), string(data))
 		default:
 			data, _ := p.MarshalPacket()
 			log.Printf("%s: adc: %s", peer.RemoteAddr(), string(data))
@@ -89,8 +214,43 @@ func (h *Hub) adcServePeer(peer *adcPeer) error {
 	}
 }
 
-func (h *Hub) adcStageProtocol(c *adc.Conn) (*adcPeer, error) {
-	deadline := time.Now().Add(time.Second * 5)
+// adcWrongSID is called when the client sends a packet with the SID of another user. Such packets
+// are dropped, and the client that sent more of them than SpoofTolerance allows is disconnected.
+func (h *Hub) adcWrongSID(peer *adcPeer, kind string, n int) error {
+	log.Printf("%s: malformed %s: wrong SID", peer.RemoteAddr(), kind)
+	if n <= h.config().SpoofTolerance {
+		return nil
+	}
+	err := fmt.Errorf("protocol abuse: %d packets with a wrong SID", n)
+	_ = peer.sendError(adc.Fatal, adc.CodeProtocolGeneric, err)
+	return err
+}
+
+// adcHubFeatures returns ADC features supported by the hub with a given config.
+func adcHubFeatures(conf Config) adc.ModFeatures {
+	fea := adc.ModFeatures{
+		// should always be set for ADC
+		adc.FeaBASE: true,
+		adc.FeaBAS0: true,
+		adc.FeaTIGR: true,
+		// extensions
+		adc.FeaPING: true,
+		adc.FeaUCMD: true,
+	}
+	if conf.ChatTimestamps {
+		fea[adc.FeaTS] = true
+	}
+	if conf.HBRIAddr4 != "" || conf.HBRIAddr6 != "" {
+		fea[adc.FeaHBRI] = true
+	}
+	return fea
+}
+
+// adcStageProtocol negotiates the features and assigns the SID.
+// The stage ends no later than the login deadline.
+func (h *Hub) adcStageProtocol(c *adc.Conn, login time.Time) (*adcPeer, error) {
+	conf := h.config()
+	deadline := conf.stageDeadline(login)
 	// Expect features from the client
 	p, err := c.ReadPacket(deadline)
 	if err != nil {
@@ -99,6 +259,8 @@ func (h *Hub) adcStageProtocol(c *adc.Conn) (*adcPeer, error) {
 	hp, ok := p.(*adc.HubPacket)
 	if !ok {
 		return nil, fmt.Errorf("expected hub messagge, got: %#v", p)
+	} else if hp.Name == (adc.HybridBridge{}).Cmd() {
+		return nil, h.adcServeHybrid(c, hp)
 	} else if hp.Name != (adc.Supported{}).Cmd() {
 		return nil, fmt.Errorf("expected support message, got: %v", hp.Name)
 	}
@@ -106,14 +268,7 @@ func (h *Hub) adcStageProtocol(c *adc.Conn) (*adcPeer, error) {
 	if err := adc.Unmarshal(hp.Data, &sup); err != nil {
 		return nil, err
 	}
-	hubFeatures := adc.ModFeatures{
-		// should always be set for ADC
-		adc.FeaBASE: true,
-		adc.FeaBAS0: true,
-		adc.FeaTIGR: true,
-		// extensions
-		adc.FeaPING: true,
-	}
+	hubFeatures := adcHubFeatures(conf)
 
 	mutual := hubFeatures.Intersect(sup.Features)
 	if !mutual.IsSet(adc.FeaBASE) && !mutual.IsSet(adc.FeaBAS0) {
@@ -121,6 +276,17 @@ func (h *Hub) adcStageProtocol(c *adc.Conn) (*adcPeer, error) {
 	} else if !mutual.IsSet(adc.FeaTIGR) {
 		return nil, fmt.Errorf("client does not support TIGR")
 	}
+	for _, f := range conf.RequiredFeatures {
+		if sup.Features.IsSet(f) {
+			continue
+		}
+		err = fmt.Errorf("client does not support %s, it's required by the hub", f)
+		_ = c.WriteInfoMsg(adc.NewStatus(adc.Fatal, adc.CodeFeatureMissing, err.Error(),
+			adc.StatusParam{Name: "FC", Value: f.String()}))
+		_ = c.Flush()
+		h.audit(AuditEvent{Action: AuditLoginReject, Reason: err.Error()}, c.RemoteAddr())
+		return nil, err
+	}
 
 	// send features supported by the hub
 	err = c.WriteInfoMsg(adc.Supported{
@@ -131,29 +297,142 @@ func (h *Hub) adcStageProtocol(c *adc.Conn) (*adcPeer, error) {
 	}
 	// and allocate a SID for the client
 	sid := h.nextSID()
+	// any hub info sent to the client is at least this recent
+	infoVer := h.hubInfoVersion()
 	err = c.WriteInfoMsg(adc.SIDAssign{
 		SID: sid,
 	})
 	if err != nil {
 		return nil, err
 	}
+	if mutual.IsSet(adc.FeaPING) {
+		// pingers may disconnect right after receiving the hub info,
+		// so send it before the client identifies itself
+		if err = c.WriteInfoMsg(h.adcHubInfo()); err != nil {
+			return nil, err
+		}
+	}
 	err = c.Flush()
 	if err != nil {
 		return nil, err
 	}
 	return &adcPeer{
 		BasePeer: BasePeer{
-			hub:  h,
-			addr: c.RemoteAddr(),
-			sid:  sid,
+			hub:     h,
+			addr:    c.RemoteAddr(),
+			sid:     sid,
+			created: h.now(),
+			hubInfo: infoVer,
 		},
 		conn: c,
 		fea:  mutual,
 	}, nil
 }
 
-func (h *Hub) adcStageIdentity(peer *adcPeer) error {
-	deadline := time.Now().Add(time.Second * 5)
+// adcRenegotiate handles the SUP message sent by the client after login.
+// Features can be added or removed, as long as the ones mandatory for ADC or required by the hub are kept.
+// Features unknown to the hub are ignored, same as during the login. Refused changes are reported with
+// a recoverable error and the current features are left unchanged.
+func (h *Hub) adcRenegotiate(peer *adcPeer, p *adc.HubPacket) error {
+	var sup adc.Supported
+	if err := adc.Unmarshal(p.Data, &sup); err != nil {
+		return peer.sendError(adc.Recoverable, adc.CodeProtocolGeneric, fmt.Errorf("invalid features: %v", err))
+	}
+	conf := h.config()
+	refuse := func(f adc.Feature) error {
+		return peer.sendError(adc.Recoverable, adc.CodeFeatureMissing, fmt.Errorf("feature %s cannot be removed", f),
+			adc.StatusParam{Name: "FC", Value: f.String()})
+	}
+
+	// only this goroutine changes the features, so the lock is only needed for the update
+	fea := adcHubFeatures(conf).Intersect(peer.fea.SetFrom(sup.Features))
+	if !fea.IsSet(adc.FeaBASE) && !fea.IsSet(adc.FeaBAS0) {
+		return refuse(adc.FeaBASE)
+	} else if !fea.IsSet(adc.FeaTIGR) {
+		return refuse(adc.FeaTIGR)
+	}
+	for _, f := range conf.RequiredFeatures {
+		if add, ok := sup.Features[f]; ok && !add {
+			return refuse(f)
+		}
+	}
+	peer.mu.Lock()
+	peer.fea = fea
+	peer.mu.Unlock()
+	return nil
+}
+
+// adcRejectLogin sends a fatal error to the client and records the refused login in the audit log.
+// The user info is optional.
+func (h *Hub) adcRejectLogin(peer *adcPeer, u *adc.User, code int, err error, params ...adc.StatusParam) error {
+	_ = peer.sendError(adc.Fatal, code, err, params...)
+	e := AuditEvent{Action: AuditLoginReject, Reason: err.Error()}
+	if u != nil {
+		e.Nick = u.Name
+		if !u.Id.IsZero() {
+			e.CID = u.Id.String()
+		}
+	}
+	h.audit(e, peer.addr)
+	return err
+}
+
+// adcCheckPassword requests the password of a registered user and checks it. See ADCAccounts.
+func (h *Hub) adcCheckPassword(peer *adcPeer, name string, deadline time.Time) error {
+	accounts, ok := h.config().Accounts.(ADCAccounts)
+	if !ok {
+		return errors.New("nick is registered, password authentication is not supported for ADC")
+	}
+	salt := make([]byte, 24)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	err := peer.conn.WriteInfoMsg(adc.GetPassword{Salt: salt})
+	if err == nil {
+		err = peer.conn.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	p, err := peer.conn.ReadPacket(deadline)
+	if err != nil {
+		return err
+	}
+	hp, ok := p.(*adc.HubPacket)
+	if !ok || hp.Name != (adc.Password{}).Cmd() {
+		return fmt.Errorf("expected password, got %#v", p)
+	}
+	var pass adc.Password
+	if err = adc.Unmarshal(hp.Data, &pass); err != nil {
+		return fmt.Errorf("invalid password: %v", err)
+	}
+	if !accounts.CheckADCPassword(name, salt, pass.Hash) {
+		return errBadPass
+	}
+	return nil
+}
+
+// adcHubInfo returns the hub info, including additional fields of the PING extension.
+func (h *Hub) adcHubInfo() adc.HubInfo {
+	conf := h.config()
+	return adc.HubInfo{
+		Name:    conf.Name,
+		Version: conf.Soft.Name + " " + conf.Soft.Vers,
+		Desc:    conf.topic(),
+
+		Users:    h.UserCount(),
+		MinShare: int(conf.MinShare),
+		MinSlots: conf.MinSlots,
+		Uptime:   int(h.Uptime() / time.Second),
+	}
+}
+
+// adcStageIdentity validates the user info and accepts the user on the hub.
+// The stage ends no later than the login deadline. The timer closes the connection at the deadline;
+// it's paused while the user waits in the queue, and the login time is reset after that.
+func (h *Hub) adcStageIdentity(peer *adcPeer, login time.Time, timer *time.Timer) error {
+	conf := h.config()
+	deadline := conf.stageDeadline(login)
 	// client should send INF with ID and PID set
 	p, err := peer.conn.ReadPacket(deadline)
 	if err != nil {
@@ -165,51 +444,126 @@ func (h *Hub) adcStageIdentity(peer *adcPeer) error {
 	} else if b.Name != (adc.User{}).Cmd() {
 		return fmt.Errorf("expected user info message, got %v", b.Name)
 	}
+	// check the PID first, so the client gets a specific error instead of an invalid info
+	pid, err := userInfoPID(b.Data)
+	if err != nil {
+		return h.adcRejectLogin(peer, nil, adc.CodeInvalidPID, err)
+	}
 	var u adc.User
 	if err := adc.Unmarshal(b.Data, &u); err != nil {
-		return err
+		err = fmt.Errorf("invalid user info: %v", err)
+		return h.adcRejectLogin(peer, &u, adc.CodeInfoInvalid, err)
 	}
-	if u.Id != u.Pid.Hash() {
-		err = errors.New("invalid pid supplied")
-		_ = peer.sendError(adc.Fatal, 27, err)
-		return err
+	if err := validateUserInfo(&u); err != nil {
+		return h.adcRejectLogin(peer, &u, adc.CodeInfoInvalid, err)
+	}
+	if u.Id != pid.Hash() {
+		err = errors.New("invalid pid supplied: CID is not a hash of the PID")
+		return h.adcRejectLogin(peer, &u, adc.CodeInvalidPID, err)
 	}
 	u.Pid = nil
+	if err := h.checkMaintenance(); err != nil {
+		return h.adcRejectLogin(peer, &u, adc.CodeHubDisabled, err)
+	}
+	if left := h.cidHeldFor(u.Id); left > 0 {
+		n := cooldownSeconds(left)
+		err = fmt.Errorf("reconnecting too fast, try again in %d seconds", n)
+		return h.adcRejectLogin(peer, &u, adc.CodeTempBanned, err, adc.StatusParam{Name: "TL", Value: strconv.Itoa(n)})
+	}
+	if !h.allowReconnectCID(u.Id) {
+		return h.adcRejectLogin(peer, &u, adc.CodeLoginGeneric, errReconnectFlood)
+	}
 	if u.Name == "" {
 		err = errors.New("invalid nick")
-		_ = peer.sendError(adc.Fatal, 21, err)
-		return err
+		return h.adcRejectLogin(peer, &u, adc.CodeNickInvalid, err)
+	}
+	err = h.checkLimits(uint64(u.ShareSize), u.Slots, u.HubsNormal+u.HubsRegistered+u.HubsOperator)
+	if err == nil {
+		err = h.checkRules(adcRuleValues(u))
+	}
+	if err != nil {
+		return h.adcRejectLogin(peer, &u, adc.CodeLoginGeneric, err)
+	}
+	if err = h.checkClient(adcSoftware(u)); err != nil {
+		return h.adcRejectLogin(peer, &u, adc.CodeLoginGeneric, err)
 	}
 
 	// do not lock for writes first
 	h.peers.RLock()
 	_, sameName1 := h.peers.logging[u.Name]
-	_, sameName2 := h.peers.byName[u.Name]
+	old, sameName2 := h.peers.byName[u.Name]
 	_, sameCID1 := h.peers.loggingCID[u.Id]
-	_, sameCID2 := h.peers.byCID[u.Id]
+	oldCID, sameCID2 := h.peers.byCID[u.Id]
 	h.peers.RUnlock()
 
+	// check the credentials before the old connection can be replaced
+	op, err := h.certOp(u.Name, peer.keyprint)
+	if err != nil {
+		return h.adcRejectLogin(peer, &u, adc.CodeInvalidPassword, err)
+	}
+	authed := op
+	if acc, ok := h.account(u.Name); ok && !op {
+		if err = h.adcCheckPassword(peer, u.Name, deadline); err != nil {
+			return h.adcRejectLogin(peer, &u, adc.CodeInvalidPassword, err)
+		}
+		op, authed = acc.Op, true
+	}
+
+	if h.config().ReplaceOnReconnect {
+		// the client may reconnect before the hub notices that the old connection is dead;
+		// the valid PID proves that the CID belongs to the user
+		if sameCID2 && h.dropStale(oldCID) {
+			sameCID2 = false
+			sameName2 = sameName2 && old != Peer(oldCID)
+		}
+		// the nick of another user can only be taken after an authentication
+		if sameName2 && authed && h.dropStale(old) {
+			sameName2 = false
+		}
+	}
+
 	if sameName1 || sameName2 {
 		err = errNickTaken
-		_ = peer.sendError(adc.Fatal, 22, err)
-		return err
+		return h.adcRejectLogin(peer, &u, adc.CodeNickTaken, err)
 	}
 	if sameCID1 || sameCID2 {
 		err = errors.New("CID taken")
-		_ = peer.sendError(adc.Fatal, 24, err)
-		return err
+		return h.adcRejectLogin(peer, &u, adc.CodeCIDTaken, err)
 	}
 
-	// ok, now lock for writes and try to bind nick and CID
+	// ok, now lock for writes, wait for a free slot and try to bind nick and CID
 	h.peers.Lock()
+	queued := false
+	err = h.waitSlot(func(pos int) error {
+		if !queued {
+			queued = true
+			timer.Stop()
+		}
+		return peer.sendInfo(adc.NewStatus(adc.Success, adc.CodeGeneric, queueMessage(pos)))
+	})
+	if queued {
+		login = conf.loginDeadline()
+		timer.Reset(time.Until(login))
+	}
+	if err != nil {
+		h.peers.Unlock()
+
+		if err == errHubFull {
+			return h.adcRejectLogin(peer, &u, adc.CodeHubFull, err)
+		}
+		return err
+	}
 	_, sameName1 = h.peers.logging[u.Name]
 	_, sameName2 = h.peers.byName[u.Name]
+	if _, ok := h.peers.byADCName[u.Name]; ok {
+		// the nick is shown to ADC clients for a bridged user
+		sameName2 = true
+	}
 	if sameName1 || sameName2 {
 		h.peers.Unlock()
 
 		err = errNickTaken
-		_ = peer.sendError(adc.Fatal, 22, err)
-		return err
+		return h.adcRejectLogin(peer, &u, adc.CodeNickTaken, err)
 	}
 	_, sameCID1 = h.peers.loggingCID[u.Id]
 	_, sameCID2 = h.peers.byCID[u.Id]
@@ -217,57 +571,73 @@ func (h *Hub) adcStageIdentity(peer *adcPeer) error {
 		h.peers.Unlock()
 
 		err = errors.New("CID taken")
-		_ = peer.sendError(adc.Fatal, 24, err)
-		return err
+		return h.adcRejectLogin(peer, &u, adc.CodeCIDTaken, err)
 	}
 	// bind nick and cid, still no one will see us yet
 	h.peers.logging[u.Name] = struct{}{}
 	h.peers.loggingCID[u.Id] = struct{}{}
 	h.peers.Unlock()
 
-	unbind := func() {
+	// release the nick and cid on any failure until the user is accepted
+	accepted := false
+	defer func() {
+		if accepted {
+			return
+		}
 		h.peers.Lock()
 		delete(h.peers.logging, u.Name)
 		delete(h.peers.loggingCID, u.Id)
 		h.peers.Unlock()
-	}
+	}()
 
-	if u.Ip4 == "0.0.0.0" {
-		ip, _, _ := net.SplitHostPort(peer.addr.String())
-		if ip != "" {
-			u.Ip4 = ip
+	// fill the address, if client asked for it or haven't set it,
+	// depending on the address family of the connection
+	if ip := remoteIP(peer.addr); ip == nil {
+		// unknown address type
+	} else if ip4 := ip.To4(); ip4 != nil {
+		if u.Ip4 == "" || u.Ip4 == "0.0.0.0" {
+			u.Ip4 = ip4.String()
+		}
+		if u.Ip6 == "::" {
+			// cannot detect it on IPv4 connection
+			u.Ip6 = ""
+		}
+	} else {
+		if u.Ip6 == "" || u.Ip6 == "::" {
+			u.Ip6 = ip.String()
 		}
+		if u.Ip4 == "0.0.0.0" {
+			// cannot detect it on IPv6 connection
+			u.Ip4 = ""
+		}
+	}
+	if err = h.adcVerifyAddrs(peer, &u, login); err != nil {
+		return err
 	}
 	peer.user = u
+	peer.op = op
 
-	// send hub info
-	err = peer.conn.WriteInfoMsg(adc.HubInfo{
-		Name:    h.info.Name,
-		Version: h.info.Soft.Name + " " + h.info.Soft.Vers,
-		Desc:    h.info.Desc,
-	})
+	// send hub info, if it wasn't sent to the pinger already
+	if !peer.fea.IsSet(adc.FeaPING) {
+		if err = peer.conn.WriteInfoMsg(h.adcHubInfo()); err != nil {
+			return err
+		}
+	}
+	// send OK status
+	err = peer.conn.WriteInfoMsg(adc.NewStatus(adc.Success, adc.CodeGeneric, "powered by Gophers"))
 	if err != nil {
-		unbind()
 		return err
 	}
-	// send OK status
-	err = peer.conn.WriteInfoMsg(adc.Status{
-		Sev:  adc.Success,
-		Code: 0,
-		Msg:  "powered by Gophers",
-	})
 
 	// send user list (except his own info)
-	err = peer.PeersJoin(h.Peers())
+	err = peer.PeersJoin(h.visiblePeers())
 	if err != nil {
-		unbind()
 		return err
 	}
 
 	// write his info and flush
 	err = peer.PeersJoin([]Peer{peer})
 	if err != nil {
-		unbind()
 		return err
 	}
 
@@ -282,10 +652,18 @@ func (h *Hub) adcStageIdentity(peer *adcPeer) error {
 
 	// add user to the hub
 	h.peers.bySID[peer.sid] = peer
+	h.updateCounters(peer, +1)
 	h.peers.byCID[u.Id] = peer
 	h.peers.byName[u.Name] = peer
+	accepted = true
+	stale := h.hubInfoChanged(&peer.BasePeer)
 	h.peers.Unlock()
 
+	if stale {
+		// the hub info was updated during the login, and the broadcast missed the user
+		_ = peer.sendHubInfo()
+	}
+
 	// notify other users about the new one
 	// TODO: this will block the client
 	h.broadcastUserJoin(peer, list)
@@ -296,11 +674,32 @@ func (h *Hub) adcBroadcast(p *adc.BroadcastPacket, from Peer, peers []Peer) {
 	if peers == nil {
 		peers = h.Peers()
 	}
+	// only clients that support TS00 receive the timestamp
+	stamped := p
+	if p.Name == (adc.ChatMessage{}).Cmd() && h.config().ChatTimestamps {
+		stamped = withTimestamp(p, h.now())
+	}
+	// info updates may differ between recipients
+	var info *infoVariants
+	if p.Name == (adc.User{}).Cmd() && len(h.infoTransforms) != 0 {
+		info = h.newInfoVariants(p, from)
+	}
 	var nmdc []Peer
 	for _, peer := range peers {
 		if p2, ok := peer.(*adcPeer); ok {
-			_ = p2.conn.WritePacket(p)
-			_ = p2.conn.Flush()
+			if info != nil {
+				if p3 := info.packetFor(peer); p3 != p {
+					if p3 != nil {
+						h.countDrop(p2, p2.writePacket(p3))
+					}
+					continue
+				}
+			}
+			if p2.hasFeature(adc.FeaTS) {
+				h.countDrop(p2, p2.writePacket(stamped))
+			} else {
+				h.countDrop(p2, p2.writePacket(p))
+			}
 		} else {
 			nmdc = append(nmdc, peer)
 		}
@@ -316,11 +715,51 @@ func (h *Hub) adcBroadcast(p *adc.BroadcastPacket, from Peer, peers []Peer) {
 	switch msg := msg.(type) {
 	case adc.ChatMessage:
 		h.broadcastChat(from, string(msg.Text), nmdc)
+	case adc.SearchRequest:
+		h.adcSearchNMDC(from, msg, nmdc)
 	default:
 		// TODO: decode other packets
 	}
 }
 
+// withTimestamp returns a copy of the chat message packet with a TS field set to a given time.
+// Other fields of the message are preserved.
+func withTimestamp(p *adc.BroadcastPacket, t time.Time) *adc.BroadcastPacket {
+	fields := bytes.Split(p.Data, []byte(" "))
+	data := make([]byte, 0, len(p.Data)+16)
+	for i, f := range fields {
+		if i != 0 && bytes.HasPrefix(f, []byte("TS")) {
+			// timestamps from clients are not trusted
+			continue
+		}
+		if i != 0 {
+			data = append(data, ' ')
+		}
+		data = append(data, f...)
+	}
+	data = append(data, " TS"...)
+	data = strconv.AppendInt(data, t.Unix(), 10)
+	cp := *p
+	cp.Data = data
+	return &cp
+}
+
+// adcEcho delivers the echo packet to the target and sends it back to the sender.
+// Each of them receives the packet exactly once, even if the sender is the target.
+func (h *Hub) adcEcho(p *adc.EchoPacket, from *adcPeer) {
+	if p.Targ != from.sid {
+		if peer, ok := h.bySID(p.Targ).(*adcPeer); ok {
+			// ADC clients receive it as an echo packet as well
+			_ = peer.conn.WritePacket(p)
+			_ = peer.conn.Flush()
+		} else {
+			h.adcDirect((*adc.DirectPacket)(p), from)
+		}
+	}
+	_ = from.conn.WritePacket(p)
+	_ = from.conn.Flush()
+}
+
 func (h *Hub) adcDirect(p *adc.DirectPacket, from *adcPeer) {
 	peer := h.bySID(p.Targ)
 	if peer == nil {
@@ -345,17 +784,30 @@ func (h *Hub) adcDirect(p *adc.DirectPacket, from *adcPeer) {
 		var ip string
 		if pinf.IPv6 && info.Ip6 != "" {
 			ip = info.Ip6
-		} else if pinf.IPv4 {
+		} else if pinf.IPv4 || !pinf.IPv6 {
+			// passive NMDC clients do not set address family flags
 			ip = info.Ip4
 		}
 		if ip == "" {
 			return
 		}
 		secure := strings.HasPrefix(msg.Proto, "ADCS")
-		h.connectReq(from, peer, ip+":"+strconv.Itoa(msg.Port), msg.Token, secure)
+		h.connectReq(from, peer, net.JoinHostPort(ip, strconv.Itoa(msg.Port)), msg.Token, secure)
 	case adc.RevConnectRequest:
+		if p, ok := peer.(*nmdcPeer); ok {
+			if p.Info().Mode == nmdc.UserModePassive {
+				// NMDC clients silently ignore such requests
+				_ = from.sendError(adc.Recoverable, adc.CodeDirectConnFailed, errBothPassive)
+				return
+			}
+			from.saveRCMToken(peer.SID(), msg.Token)
+		}
 		secure := strings.HasPrefix(msg.Proto, "ADCS")
 		h.revConnectReq(from, peer, msg.Token, secure)
+	case adc.SearchResult:
+		if p, ok := peer.(*nmdcPeer); ok {
+			h.adcResultNMDC(from, p, msg)
+		}
 	default:
 		// TODO: decode other packets
 	}
@@ -368,6 +820,16 @@ type adcPeer struct {
 
 	conn *adc.Conn
 	fea  adc.ModFeatures
+	// verified addresses of the user; changed under mu after login
+	verified verifiedAddrs
+
+	search searchLimits
+
+	// tokens of RCM sent to NMDC users, by SID; NMDC replies with a CTM without the token
+	rcm struct {
+		sync.Mutex
+		tokens map[adc.SID]string
+	}
 
 	mu   sync.RWMutex
 	user adc.User
@@ -390,25 +852,53 @@ func (p *adcPeer) Info() adc.User {
 	return u
 }
 
-func (p *adcPeer) User() User {
-	u := p.Info()
+func (p *adcPeer) packetStats() PacketStats {
+	st := p.conn.Stats()
+	return PacketStats{In: st.PacketsIn, Out: st.PacketsOut, LastIn: st.LastIn, LastOut: st.LastOut}
+}
+
+// adcSoftware returns the client software from the user info.
+// Old clients do not set the application field and send both name and version in VE.
+func adcSoftware(u adc.User) Software {
 	if u.Application == "" {
 		if i := strings.Index(u.Version, " "); i >= 0 {
 			u.Application, u.Version = u.Version[:i], u.Version[i+1:]
 		}
 	}
+	return Software{
+		Name: u.Application,
+		Vers: u.Version,
+	}
+}
+
+func (p *adcPeer) User() User {
+	u := p.Info()
 	return User{
 		Name:  u.Name,
 		Share: uint64(u.ShareSize),
 		Email: u.Email,
-		App: Software{
-			Name: u.Application,
-			Vers: u.Version,
-		},
-		IPv4: u.Features.Has(adc.FeaTCP4),
-		IPv6: u.Features.Has(adc.FeaTCP6),
-		TLS:  u.Features.Has(adc.FeaADC0),
+		App:   adcSoftware(u),
+		IPv4:  u.Features.Has(adc.FeaTCP4),
+		IPv6:  u.Features.Has(adc.FeaTCP6),
+		TLS:   u.Features.Has(adc.FeaADC0),
+		Op:    p.op,
+		Away:  u.Away != adc.AwayTypeNone,
+	}
+}
+
+func (p *adcPeer) Features() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.fea.List()
+}
+
+// writePacket writes the packet and flushes the connection.
+func (p *adcPeer) writePacket(pkt adc.Packet) error {
+	err := p.conn.WritePacket(pkt)
+	if err != nil {
+		return err
 	}
+	return p.conn.Flush()
 }
 
 func (p *adcPeer) sendInfo(m adc.Message) error {
@@ -419,24 +909,207 @@ func (p *adcPeer) sendInfo(m adc.Message) error {
 	return p.conn.Flush()
 }
 
-func (p *adcPeer) sendError(sev adc.Severity, code int, err error) error {
-	return p.sendInfo(adc.Status{
-		Sev: sev, Code: code, Msg: err.Error(),
-	})
+// userInfoPID decodes the PID field of the user info.
+// It fails if the PID is missing or has an invalid length.
+func userInfoPID(data []byte) (adc.PID, error) {
+	var pid adc.PID
+	for _, f := range bytes.Split(data, []byte(" ")) {
+		if !bytes.HasPrefix(f, []byte("PD")) {
+			continue
+		}
+		if err := pid.UnmarshalAdc(f[2:]); err != nil {
+			return pid, fmt.Errorf("invalid pid supplied: %v", err)
+		}
+		return pid, nil
+	}
+	return pid, errors.New("pid is not set")
+}
+
+// validateUserInfo checks numeric fields of the user info.
+func validateUserInfo(u *adc.User) error {
+	if u.ShareSize < 0 {
+		return fmt.Errorf("invalid share size: %d", u.ShareSize)
+	}
+	return validateNumbers(uint64(u.ShareSize), u.ShareFiles, u.Slots, u.SlotsFree,
+		[3]int{u.HubsNormal, u.HubsRegistered, u.HubsOperator})
+}
+
+// mergeUserInfo applies a partial INF update to the user info. Empty fields in the update are removed.
+func mergeUserInfo(u adc.User, upd []byte) (adc.User, error) {
+	cur, err := adc.Marshal(u)
+	if err != nil {
+		return u, err
+	}
+	var (
+		keys   [][2]byte
+		fields = make(map[[2]byte][]byte)
+	)
+	add := func(data []byte) error {
+		for _, f := range bytes.Split(data, []byte(" ")) {
+			if len(f) == 0 {
+				continue
+			} else if len(f) < 2 {
+				return fmt.Errorf("invalid field: %q", f)
+			}
+			k := [2]byte{f[0], f[1]}
+			if _, ok := fields[k]; !ok {
+				keys = append(keys, k)
+			}
+			fields[k] = f
+		}
+		return nil
+	}
+	if err = add(cur); err != nil {
+		return u, err
+	}
+	if err = add(upd); err != nil {
+		return u, err
+	}
+	merged := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		if f := fields[k]; len(f) > 2 {
+			merged = append(merged, f)
+		}
+	}
+	var nu adc.User
+	if err = adc.Unmarshal(bytes.Join(merged, []byte(" ")), &nu); err != nil {
+		return u, err
+	}
+	return nu, nil
+}
+
+// updateInfo validates a partial INF update from the client and applies it to the peer info.
+func (p *adcPeer) updateInfo(data []byte) error {
+	var mod adc.UserMod
+	if err := mod.UnmarshalAdc(data); err != nil {
+		return err
+	}
+	if _, ok := mod[[2]byte{'P', 'D'}]; ok {
+		return errors.New("PD cannot be sent after login")
+	}
+	// lock peers first to keep the total share consistent with the peer info
+	h := p.hub
+	h.peers.Lock()
+	defer h.peers.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// TODO: support nick changes
+	if v, ok := mod[[2]byte{'N', 'I'}]; ok && v != adc.Escape(p.user.Name) {
+		return errors.New("nick cannot be changed")
+	}
+	if v, ok := mod[[2]byte{'I', 'D'}]; ok && v != p.user.Id.String() {
+		return errors.New("CID cannot be changed")
+	}
+	u, err := mergeUserInfo(p.user, data)
+	if err != nil {
+		return fmt.Errorf("invalid user info: %v", err)
+	}
+	if err = validateUserInfo(&u); err != nil {
+		return err
+	}
+	if err = h.checkRules(adcRuleValues(u)); err != nil {
+		return err
+	}
+	if h.peers.bySID[p.sid] == p {
+		h.peers.share += uint64(u.ShareSize) - uint64(p.user.ShareSize)
+		h.countClient(adcSoftware(p.user), adcUserFeatures(p.user), -1)
+		h.countClient(adcSoftware(u), adcUserFeatures(u), +1)
+	}
+	// changed addresses are no longer verified
+	if u.Ip4 != p.user.Ip4 {
+		p.verified.ip4 = false
+	}
+	if u.Ip6 != p.user.Ip6 {
+		p.verified.ip6 = false
+	}
+	p.user = u
+	return nil
+}
+
+// hasFeature checks if the feature was negotiated with the client.
+func (p *adcPeer) hasFeature(f adc.Feature) bool {
+	p.mu.RLock()
+	ok := p.fea.IsSet(f)
+	p.mu.RUnlock()
+	return ok
+}
+
+// sendUserCommands sends context menu commands to the client, if it supports them.
+func (p *adcPeer) sendUserCommands(cmds []userCommand) error {
+	if len(cmds) == 0 || !p.hasFeature(adc.FeaUCMD) {
+		return nil
+	}
+	for _, c := range cmds {
+		if err := p.conn.WriteInfoMsg(c.adc()); err != nil {
+			return err
+		}
+	}
+	return p.conn.Flush()
+}
+
+func (p *adcPeer) sendError(sev adc.Severity, code int, err error, params ...adc.StatusParam) error {
+	return p.sendInfo(adc.NewStatus(sev, code, err.Error(), params...))
+}
+
+func (p *adcPeer) SendError(sev Severity, code int, text string) error {
+	var asev adc.Severity
+	switch sev {
+	case SevInfo:
+		asev = adc.Success
+	case SevWarning:
+		asev = adc.Recoverable
+	default:
+		asev = adc.Fatal
+	}
+	return p.sendInfo(adc.NewStatus(asev, code, text))
 }
 
 func (p *adcPeer) Close() error {
+	return p.closeWith("", nil)
+}
+
+// closeWith closes the connection and notifies other peers with a given leave reason.
+// The audit event is set if the peer is removed by the hub.
+func (p *adcPeer) closeWith(reason string, e *AuditEvent) error {
 	p.closeMu.Lock()
-	defer p.closeMu.Unlock()
-	p.mu.RLock()
-	defer p.mu.RUnlock()
 	if p.closed {
+		p.closeMu.Unlock()
 		return nil
 	}
-	err := p.conn.Close()
 	p.closed = true
+	p.closeMu.Unlock()
+
+	err := p.conn.Close()
+	u := p.Info()
+	p.hub.leaveCID(p, p.sid, u.Id, u.Name, reason, e)
+	return err
+}
+
+func (p *adcPeer) Kick(reason string) error {
+	return p.disconnect(reason, "")
+}
+
+// Redirect disconnects the peer and asks the client to connect to the hub at a given address.
+func (p *adcPeer) Redirect(addr, reason string) error {
+	return p.disconnect(reason, addr)
+}
 
-	p.hub.leaveCID(p, p.sid, p.user.Id, p.user.Name)
+// disconnect sends the QUI with a given reason and redirect address, and closes the connection.
+// If the ReconnectCooldown is set, the client is asked to wait before reconnecting, and its CID
+// is refused until then.
+func (p *adcPeer) disconnect(reason, redirect string) error {
+	m := adc.Disconnect{ID: p.sid, Message: reason, Redirect: redirect}
+	if d := p.hub.holdCID(p.Info().Id); d > 0 {
+		m.TimeLeft = cooldownSeconds(d)
+	}
+	e := &AuditEvent{Action: AuditKick, Reason: reason}
+	if redirect != "" {
+		e = &AuditEvent{Action: AuditRedirect, Reason: reason, Redirect: redirect}
+	}
+	err := p.sendInfo(m)
+	if err2 := p.closeWith(reason, e); err == nil {
+		err = err2
+	}
 	return err
 }
 
@@ -445,16 +1118,17 @@ func (p *adcPeer) PeersJoin(peers []Peer) error {
 		var u adc.User
 		if p2, ok := peer.(*adcPeer); ok {
 			u = p2.Info()
+		} else if b, ok := peer.(*botPeer); ok {
+			u = b.adcInfo()
+		} else if l, ok := peer.(*linkPeer); ok {
+			u = l.adcInfo()
 		} else {
-			// TODO: same address from multiple clients behind NAT, so we addend the name
-			addr, _, _ := net.SplitHostPort(peer.RemoteAddr().String())
 			info := peer.User()
 			// TODO: once we support name changes, we should make the user
 			//       virtually leave and rejoin with a new CID
-			cid := adc.CID(tiger.HashBytes([]byte(info.Name + "\x00" + addr)))
 			u = adc.User{
-				Name:        info.Name,
-				Id:          cid,
+				Name:        adcNick(info.Name),
+				Id:          p.hub.bridgeCID(info.Name),
 				Application: info.App.Name,
 				Version:     info.App.Vers,
 				ShareSize:   int64(info.Share),
@@ -469,34 +1143,60 @@ func (p *adcPeer) PeersJoin(peers []Peer) error {
 			if info.IPv6 {
 				u.Features = append(u.Features, adc.FeaTCP6)
 			}
-			if strings.HasPrefix(addr, "[") {
-				u.Ip6 = addr
+			if ip := remoteIP(peer.RemoteAddr()); ip == nil {
+				// unknown address type
+			} else if ip4 := ip.To4(); ip4 != nil {
+				u.Ip4 = ip4.String()
 			} else {
-				u.Ip4 = addr
+				u.Ip6 = ip.String()
 			}
 		}
-		if err := p.conn.WriteBroadcast(peer.SID(), &u); err != nil {
+		if mask := p.hub.infoMask(p, peer); mask != 0 {
+			data, err := adc.Marshal(u)
+			if err != nil {
+				return err
+			}
+			err = p.conn.WritePacket(&adc.BroadcastPacket{
+				ID:         peer.SID(),
+				BasePacket: adc.BasePacket{Name: u.Cmd(), Data: p.hub.transformInfo(mask, data)},
+			})
+			if err != nil {
+				return err
+			}
+		} else if err := p.conn.WriteBroadcast(peer.SID(), &u); err != nil {
 			return err
 		}
 	}
-	return p.conn.Flush()
+	if err := p.conn.Flush(); err != nil {
+		return err
+	}
+	p.markJoined(peers)
+	return nil
 }
 
-func (p *adcPeer) PeersLeave(peers []Peer) error {
+func (p *adcPeer) PeersLeave(peers []Peer, reason string) error {
 	for _, peer := range peers {
 		if err := p.conn.WriteInfoMsg(&adc.Disconnect{
-			ID: peer.SID(),
+			ID: peer.SID(), Message: reason,
 		}); err != nil {
 			return err
 		}
 	}
-	return p.conn.Flush()
+	if err := p.conn.Flush(); err != nil {
+		return err
+	}
+	p.markLeft(peers)
+	return nil
 }
 
 func (p *adcPeer) ChatMsg(from Peer, text string) error {
-	err := p.conn.WriteBroadcast(from.SID(), &adc.ChatMessage{
+	msg := &adc.ChatMessage{
 		Text: adc.String(text),
-	})
+	}
+	if p.hasFeature(adc.FeaTS) {
+		msg.TS = p.hub.now().Unix()
+	}
+	err := p.conn.WriteBroadcast(from.SID(), msg)
 	if err != nil {
 		return err
 	}
@@ -515,9 +1215,33 @@ func (p *adcPeer) PrivateMsg(from Peer, text string) error {
 }
 
 func (p *adcPeer) HubChatMsg(text string) error {
-	err := p.conn.WriteInfoMsg(&adc.ChatMessage{
+	msg := &adc.ChatMessage{
 		Text: adc.String(text),
-	})
+	}
+	var err error
+	if bot := p.hub.bot; bot != nil {
+		err = p.conn.WriteBroadcast(bot.sid, msg)
+	} else {
+		err = p.conn.WriteInfoMsg(msg)
+	}
+	if err != nil {
+		return err
+	}
+	return p.conn.Flush()
+}
+
+func (p *adcPeer) ping(timeout time.Duration) error {
+	return p.conn.Ping(timeout)
+}
+
+// sendHubInfo sends the current hub info to the peer.
+func (p *adcPeer) sendHubInfo() error {
+	return p.writeHubInfo(p.hub.adcHubInfo())
+}
+
+// writeHubInfo sends a given hub info to the peer.
+func (p *adcPeer) writeHubInfo(info adc.HubInfo) error {
+	err := p.conn.WriteInfoMsg(info)
 	if err != nil {
 		return err
 	}
@@ -535,16 +1259,26 @@ func (p *adcPeer) ConnectTo(peer Peer, addr string, token string, secure bool) e
 	}
 
 	// make sure we are on the same page - fake an update of an address for that peer
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid address: %q", addr)
+	}
 	field := [2]byte{'I', '4'} // IPv4
-	if strings.HasPrefix(host, "[") {
+	if ip.To4() == nil {
 		field = [2]byte{'I', '6'} // IPv6
 	}
-	err = p.conn.WriteInfoMsg(adc.UserMod{
+	err = p.conn.WriteBroadcast(peer.SID(), adc.UserMod{
 		field: host,
 	})
 	if err != nil {
 		return err
 	}
+	if token == nmdcFakeToken {
+		// NMDC has no tokens, but the client expects the one from its RCM
+		if tok, ok := p.takeRCMToken(peer.SID()); ok {
+			token = tok
+		}
+	}
 
 	// we need to pretend that peer speaks the same protocol as we do
 	proto := adc.ProtoADC
@@ -563,6 +1297,26 @@ func (p *adcPeer) ConnectTo(peer Peer, addr string, token string, secure bool) e
 	return p.conn.Flush()
 }
 
+// maxRCMTokens limits the number of RCM tokens remembered for NMDC users that never replied.
+const maxRCMTokens = 64
+
+func (p *adcPeer) saveRCMToken(sid adc.SID, token string) {
+	p.rcm.Lock()
+	defer p.rcm.Unlock()
+	if p.rcm.tokens == nil || len(p.rcm.tokens) >= maxRCMTokens {
+		p.rcm.tokens = make(map[adc.SID]string)
+	}
+	p.rcm.tokens[sid] = token
+}
+
+func (p *adcPeer) takeRCMToken(sid adc.SID) (string, bool) {
+	p.rcm.Lock()
+	defer p.rcm.Unlock()
+	token, ok := p.rcm.tokens[sid]
+	delete(p.rcm.tokens, sid)
+	return token, ok
+}
+
 func (p *adcPeer) RevConnectTo(peer Peer, token string, secure bool) error {
 	// we need to pretend that peer speaks the same protocol as we do
 	proto := adc.ProtoADC
@@ -0,0 +1,1266 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/adc/types"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+// expectQuit skips packets until the QUI for a given user is received.
+func (c *testADC) expectQuit(sid adc.SID) adc.Disconnect {
+	for {
+		p := c.expect("QUI")
+		var m adc.Disconnect
+		if err := adc.Unmarshal(p.Message().Data, &m); err != nil {
+			c.t.Fatal(err)
+		}
+		if m.ID == sid {
+			return m
+		}
+	}
+}
+
+// sendChat broadcasts a chat message from the client.
+func (c *testADC) sendChat(text string) {
+	err := c.conn.WriteBroadcast(c.sid, &adc.ChatMessage{Text: adc.String(text)})
+	if err == nil {
+		err = c.conn.Flush()
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expectChat skips packets until the chat message with a given text is received.
+func (c *testADC) expectChat(text string) {
+	for {
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(c.expect("MSG").Message().Data, &m); err != nil {
+			c.t.Fatal(err)
+		}
+		if string(m.Text) == text {
+			return
+		}
+	}
+}
+
+// expectNoQuit fails if the QUI is received before a given chat message.
+func (c *testADC) expectNoQuit(text string) {
+	for {
+		p := c.next()
+		switch p.Message().Type.String() {
+		case "QUI":
+			c.t.Fatalf("unexpected QUI: %s", p.Message().Data)
+		case "MSG":
+			var m adc.ChatMessage
+			if err := adc.Unmarshal(p.Message().Data, &m); err != nil {
+				c.t.Fatal(err)
+			}
+			if string(m.Text) == text {
+				return
+			}
+		}
+	}
+}
+
+func TestADCClientQuit(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginADC(t, h, "alice")
+
+	alice.write(&adc.HubPacket{
+		BasePacket: adc.BasePacket{Name: (adc.Disconnect{}).Cmd()},
+	})
+	bob.expectQuit(alice.sid)
+	if h.byName("alice") != nil {
+		t.Fatal("peer is still on the hub")
+	}
+
+	// make sure the leave notification is not sent twice
+	bob.sendChat("ping")
+	bob.expectNoQuit("ping")
+}
+
+func TestADCCloseTwice(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginADC(t, h, "alice")
+
+	p := h.byName("alice")
+	done := make(chan struct{})
+	go func() {
+		_ = p.Close()
+		close(done)
+	}()
+	_ = p.Close()
+	<-done
+	_ = p.Close()
+
+	bob.expectQuit(alice.sid)
+	bob.sendChat("ping")
+	bob.expectNoQuit("ping")
+}
+
+func TestADCIdentityUnbind(t *testing.T) {
+	h := newTestHub(t)
+
+	// client disconnects right after sending INF, so the hub fails to write the reply
+	c := dialADC(t, h)
+	c.handshake()
+	c.identify(adc.User{Name: "bob"})
+	_ = c.conn.Close()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		h.peers.RLock()
+		_, bound := h.peers.logging["bob"]
+		h.peers.RUnlock()
+		if !bound {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("nick is still bound")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the same user should be able to login
+	loginADC(t, h, "bob")
+}
+
+func TestADCIdentityUnbindDeadline(t *testing.T) {
+	h := New(Config{Name: "test", LoginDeadline: time.Second / 4})
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Serve(c2)
+	}()
+
+	// client sends INF, but stops reading, so the hub blocks after reserving the nick
+	c, err := adc.NewConn(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteHubMsg(adc.Supported{Features: adc.ModFeatures{adc.FeaBASE: true, adc.FeaTIGR: true}})
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sid adc.SID
+	for sid == (adc.SID{}) {
+		p, err := c.ReadPacket(time.Now().Add(testTimeout))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip, ok := p.(*adc.InfoPacket); ok && ip.Name == (adc.SIDAssign{}).Cmd() {
+			var m adc.SIDAssign
+			if err = adc.Unmarshal(ip.Data, &m); err != nil {
+				t.Fatal(err)
+			}
+			sid = m.SID
+		}
+	}
+	pid := types.NewPID()
+	err = c.WriteBroadcast(sid, adc.User{
+		Name: "bob", Id: pid.Hash(), Pid: &pid,
+		Application: "test", Version: "1.0",
+	})
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("login was not aborted")
+	}
+	h.peers.RLock()
+	_, bound := h.peers.logging["bob"]
+	h.peers.RUnlock()
+	if bound {
+		t.Fatal("nick is still bound")
+	}
+
+	// the same user should be able to login right away
+	loginADC(t, h, "bob")
+}
+
+func TestADCLoginDeadline(t *testing.T) {
+	h := New(Config{
+		Name:          "test",
+		LoginTimeout:  testTimeout,
+		LoginDeadline: time.Second / 4,
+	})
+
+	// client completes the first stage, but stalls before sending INF
+	start := time.Now()
+	c := dialADC(t, h)
+	c.handshake()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case _, ok := <-c.recv:
+			if ok {
+				continue
+			}
+		case <-timeout:
+			t.Fatal("client was not dropped")
+		}
+		break
+	}
+	if dt := time.Since(start); dt < time.Second/4 {
+		t.Fatalf("client dropped too early: %v", dt)
+	}
+}
+
+func TestADCRemoteIP(t *testing.T) {
+	h := newTestHub(t)
+
+	var cases = []struct {
+		name string
+		addr string
+		ip4  string
+		ip6  string
+	}{
+		{name: "v4", addr: "1.2.3.4:54321", ip4: "1.2.3.4"},
+		{name: "v6", addr: "[2001:db8::1]:54321", ip6: "2001:db8::1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr, err := net.ResolveTCPAddr("tcp", c.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cl := dialADCFrom(t, h, addr)
+			cl.handshake()
+			cl.identify(adc.User{Name: c.name, Ip4: "0.0.0.0"})
+			u := cl.expectUser(cl.sid)
+			if u.Ip4 != c.ip4 || u.Ip6 != c.ip6 {
+				t.Fatalf("unexpected address: %q, %q", u.Ip4, u.Ip6)
+			}
+		})
+	}
+}
+
+func TestADCDualStack(t *testing.T) {
+	h := newTestHub(t)
+
+	resolve := func(s string) net.Addr {
+		addr, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+	bob := dialADCFrom(t, h, resolve("1.2.3.4:54321"))
+	bob.handshake()
+	bob.identify(adc.User{Name: "bob"})
+	bob.expectUser(bob.sid)
+	waitPeer(t, h, "bob")
+
+	alice := dialADCFrom(t, h, resolve("[2001:db8::1]:54321"))
+	alice.handshake()
+	alice.identify(adc.User{Name: "alice", Features: adc.ExtFeatures{adc.FeaTCP6}})
+	if u := alice.expectUser(bob.sid); u.Ip4 != "1.2.3.4" || u.Ip6 != "" {
+		t.Fatalf("unexpected address: %q, %q", u.Ip4, u.Ip6)
+	}
+	alice.expectUser(alice.sid)
+	waitPeer(t, h, "alice")
+	if u := bob.expectUser(alice.sid); u.Ip4 != "" || u.Ip6 != "2001:db8::1" {
+		t.Fatalf("unexpected address: %q, %q", u.Ip4, u.Ip6)
+	}
+
+	carol := loginNMDCFrom(t, h, resolve("[2001:db8::2]:54321"), nmdc.MyInfo{
+		Name: "carol", Flag: nmdc.FlagStatusNormal | nmdc.FlagIPv6,
+	})
+	csid := h.byName("carol").SID()
+	if u := alice.expectUser(csid); u.Ip6 != "2001:db8::2" {
+		t.Fatalf("unexpected address: %q", u.Ip6)
+	}
+
+	// ADC (v6) -> NMDC (v6)
+	err := alice.conn.WriteDirect(alice.sid, csid, &adc.ConnectRequest{
+		Proto: adc.ProtoADC, Port: 3000, Token: "tok",
+	})
+	if err == nil {
+		err = alice.conn.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctm := carol.expect("ConnectToMe").(*nmdc.ConnectToMe)
+	if ctm.Address != "[2001:db8::1]:3000" {
+		t.Fatalf("unexpected address: %q", ctm.Address)
+	}
+
+	// NMDC (v6) -> ADC (v6)
+	carol.write(&nmdc.ConnectToMe{Targ: "alice", Address: "[2001:db8::2]:4000"})
+	p := alice.expectDirect("CTM")
+	var req adc.ConnectRequest
+	if err := adc.Unmarshal(p.Data, &req); err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != csid || req.Port != 4000 {
+		t.Fatalf("unexpected request: %#v", req)
+	}
+}
+
+func TestADCConnectNMDC(t *testing.T) {
+	h := newTestHub(t)
+	resolve := func(s string) net.Addr {
+		addr, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+	writeDirect := func(c *testADC, to adc.SID, m adc.Message) {
+		err := c.conn.WriteDirect(c.sid, to, m)
+		if err == nil {
+			err = c.conn.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// active ADC user
+	alice := dialADCFrom(t, h, resolve("1.2.3.4:54321"))
+	alice.handshake()
+	alice.identify(adc.User{Name: "alice", Features: adc.ExtFeatures{adc.FeaTCP4}})
+	alice.expectUser(alice.sid)
+	waitPeer(t, h, "alice")
+	// passive ADC user
+	bob := loginADC(t, h, "bob")
+	// passive and active NMDC users
+	carol := loginNMDCFrom(t, h, resolve("5.6.7.8:54321"), nmdc.MyInfo{
+		Name: "carol", Mode: nmdc.UserModePassive, Flag: nmdc.FlagStatusNormal,
+	})
+	dave := loginNMDCFrom(t, h, resolve("5.6.7.9:54321"), nmdc.MyInfo{
+		Name: "dave", Mode: nmdc.UserModeActive, Flag: nmdc.FlagStatusNormal,
+	})
+	carolSID, daveSID := h.byName("carol").SID(), h.byName("dave").SID()
+
+	// passive NMDC -> active ADC
+	carol.write(&nmdc.RevConnectToMe{From: "carol", To: "alice"})
+	p := alice.expectDirect("RCM")
+	var rcm adc.RevConnectRequest
+	if err := adc.Unmarshal(p.Data, &rcm); err != nil {
+		t.Fatal(err)
+	} else if p.ID != carolSID {
+		t.Fatalf("unexpected request: %#v", p)
+	}
+	writeDirect(alice, carolSID, &adc.ConnectRequest{Proto: adc.ProtoADC, Port: 3000, Token: rcm.Token})
+	ctm := carol.expect("ConnectToMe").(*nmdc.ConnectToMe)
+	if ctm.Targ != "carol" || ctm.Address != "1.2.3.4:3000" {
+		t.Fatalf("unexpected request: %#v", ctm)
+	}
+
+	// passive ADC -> active NMDC
+	writeDirect(bob, daveSID, &adc.RevConnectRequest{Proto: adc.ProtoADC, Token: "tok"})
+	if m := dave.expect("RevConnectToMe").(*nmdc.RevConnectToMe); m.From != "bob" || m.To != "dave" {
+		t.Fatalf("unexpected request: %#v", m)
+	}
+	// the address is announced before the request
+	dave.write(&nmdc.ConnectToMe{Targ: "bob", Address: "5.6.7.10:4000"})
+	for {
+		b := bob.expect("INF").(*adc.BroadcastPacket)
+		var u adc.User
+		if err := adc.Unmarshal(b.Data, &u); err != nil {
+			t.Fatal(err)
+		}
+		if b.ID == daveSID && u.Ip4 == "5.6.7.10" {
+			break
+		}
+	}
+	p = bob.expectDirect("CTM")
+	var req adc.ConnectRequest
+	if err := adc.Unmarshal(p.Data, &req); err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != daveSID || req.Port != 4000 || req.Token != "tok" {
+		t.Fatalf("unexpected request: %#v", req)
+	}
+
+	// passive ADC -> passive NMDC
+	writeDirect(bob, carolSID, &adc.RevConnectRequest{Proto: adc.ProtoADC, Token: "tok2"})
+	st, ok := bob.expectInfo().(adc.Status)
+	if !ok || st.Code != adc.CodeDirectConnFailed {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+}
+
+func TestADCMaxUsers(t *testing.T) {
+	h := New(Config{Name: "test", MaxUsers: 1})
+	loginADC(t, h, "bob")
+
+	c := dialADC(t, h)
+	c.handshake()
+	c.identify(adc.User{Name: "alice"})
+	st, ok := c.expectInfo().(adc.Status)
+	if !ok {
+		t.Fatal("expected status")
+	}
+	if st.Sev != adc.Fatal || st.Code != 11 {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+}
+
+func TestADCMOTD(t *testing.T) {
+	h := New(Config{Name: "test", MOTD: "hello there"})
+	bob := loginADC(t, h, "bob")
+	p := bob.expect("MSG")
+	var m adc.ChatMessage
+	if err := adc.Unmarshal(p.Message().Data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Text != "hello there" {
+		t.Fatalf("unexpected MOTD: %q", m.Text)
+	}
+}
+
+func TestADCSetMaxUsers(t *testing.T) {
+	h := newTestHub(t)
+	loginADC(t, h, "bob")
+	h.SetMaxUsers(1)
+	h.SetMOTD("updated")
+
+	c := dialADC(t, h)
+	c.handshake()
+	c.identify(adc.User{Name: "alice"})
+	if st, ok := c.expectInfo().(adc.Status); !ok || st.Code != 11 {
+		t.Fatalf("expected hub full status, got: %#v", st)
+	}
+
+	// existing users are not affected, new settings are used for the next login
+	h.SetMaxUsers(0)
+	alice := loginADC(t, h, "alice")
+	p := alice.expect("MSG")
+	var m adc.ChatMessage
+	if err := adc.Unmarshal(p.Message().Data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Text != "updated" {
+		t.Fatalf("unexpected MOTD: %q", m.Text)
+	}
+}
+
+func TestADCMinShareSlots(t *testing.T) {
+	h := New(Config{Name: "test", MinShare: 1000, MinSlots: 2, MinSlotsPerHub: 0.5})
+
+	var cases = []struct {
+		name string
+		user adc.User
+		ok   bool
+	}{
+		{name: "share", user: adc.User{ShareSize: 999, Slots: 2, HubsNormal: 1}},
+		{name: "slots", user: adc.User{ShareSize: 1000, Slots: 1, HubsNormal: 1}},
+		{name: "ratio", user: adc.User{ShareSize: 1000, Slots: 2, HubsNormal: 3, HubsRegistered: 2}},
+		{name: "ok", user: adc.User{ShareSize: 1000, Slots: 3, HubsNormal: 3, HubsRegistered: 2}, ok: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cl := dialADC(t, h)
+			cl.handshake()
+			c.user.Name = c.name
+			cl.identify(c.user)
+			if c.ok {
+				cl.expectUser(cl.sid)
+				return
+			}
+			st, ok := cl.expectInfo().(adc.Status)
+			if !ok || st.Sev != adc.Fatal || st.Code != 20 {
+				t.Fatalf("unexpected status: %#v", st)
+			}
+		})
+	}
+}
+
+func TestADCInvalidInfo(t *testing.T) {
+	h := newTestHub(t)
+
+	var cases = []struct {
+		name  string
+		field string
+	}{
+		{name: "not a number", field: "SSabc"},
+		{name: "negative share", field: "SS-1"},
+		{name: "huge share", field: "SS9000000000000000000"},
+		{name: "too many slots", field: "SL100000"},
+		{name: "negative hubs", field: "HN-5"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cl := dialADC(t, h)
+			cl.handshake()
+			data := adc.MustMarshal(cl.loginInfo(adc.User{Name: "bob"}))
+			data = bytes.Replace(data, []byte(" "+c.field[:2]+"0 "), []byte(" "+c.field+" "), 1)
+			cl.sendInfo(data)
+			st, ok := cl.expectInfo().(adc.Status)
+			if !ok || st.Sev != adc.Fatal || st.Code != 43 {
+				t.Fatalf("unexpected status: %#v", st)
+			}
+		})
+	}
+}
+
+func TestADCInvalidPID(t *testing.T) {
+	h := newTestHub(t)
+
+	pid := types.NewPID()
+	other := types.NewPID()
+	var cases = []struct {
+		name string
+		pid  string
+	}{
+		{name: "no pid", pid: ""},
+		{name: "short pid", pid: " PD" + pid.ToBase32()[:10]},
+		{name: "wrong pid", pid: " PD" + other.ToBase32()},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cl := dialADC(t, h)
+			cl.handshake()
+			data := adc.MustMarshal(cl.loginInfo(adc.User{Name: "bob", Id: pid.Hash()}))
+			cl.sendInfo(append(data, c.pid...))
+			st, ok := cl.expectInfo().(adc.Status)
+			if !ok || st.Sev != adc.Fatal || st.Code != 27 {
+				t.Fatalf("unexpected status: %#v", st)
+			}
+		})
+	}
+}
+
+func TestADCRequiredFeatures(t *testing.T) {
+	h := New(Config{Name: "test", RequiredFeatures: []adc.Feature{adc.FeaUCMD}})
+
+	for _, fea := range []adc.ModFeatures{
+		{adc.FeaBASE: true, adc.FeaTIGR: true},
+		// removed feature is not supported
+		{adc.FeaBASE: true, adc.FeaTIGR: true, adc.FeaUCMD: false},
+	} {
+		c := dialADC(t, h)
+		err := c.conn.WriteHubMsg(adc.Supported{Features: fea})
+		if err == nil {
+			err = c.conn.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, ok := c.expectInfo().(adc.Status)
+		if !ok || st.Sev != adc.Fatal || st.Code != adc.CodeFeatureMissing {
+			t.Fatalf("unexpected status: %#v", st)
+		}
+		if fc, _ := st.Param("FC"); fc != "UCMD" {
+			t.Fatalf("unexpected feature: %q", fc)
+		}
+	}
+
+	// clients with the feature are accepted
+	c := dialADC(t, h)
+	c.handshake(adc.FeaUCMD)
+	c.identify(adc.User{Name: "bob"})
+	c.expectUser(c.sid)
+}
+
+func TestADCInfoUpdate(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginADC(t, h, "alice")
+	bob.expectUser(alice.sid)
+
+	// valid update is applied and broadcasted
+	alice.sendInfo([]byte("SS1000 SL5"))
+	b := bob.expect("INF").(*adc.BroadcastPacket)
+	if b.ID != alice.sid || string(b.Data) != "SS1000 SL5" {
+		t.Fatalf("unexpected update: %q", b.Data)
+	}
+	if u := h.byName("alice").User(); u.Share != 1000 {
+		t.Fatalf("info was not updated: %+v", u)
+	}
+
+	// invalid update is dropped
+	for _, upd := range []string{"SS9000000000000000000", "SSabc", "NIcarol"} {
+		alice.sendInfo([]byte(upd))
+		var st adc.Status
+		if err := adc.Unmarshal(alice.expect("STA").Message().Data, &st); err != nil {
+			t.Fatal(err)
+		} else if st.Sev != adc.Recoverable || st.Code != 43 {
+			t.Fatalf("unexpected status: %#v", st)
+		}
+	}
+	if u := h.byName("alice").User(); u.Share != 1000 {
+		t.Fatalf("invalid update applied: %+v", u)
+	}
+	alice.sendChat("ping")
+	for {
+		p := bob.next()
+		if p.Message().Type.String() == "INF" {
+			t.Fatalf("invalid update broadcasted: %q", p.Message().Data)
+		} else if p.Message().Type.String() == "MSG" {
+			break
+		}
+	}
+}
+
+func TestADCAway(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginADC(t, h, "alice")
+	bob.expectUser(alice.sid)
+
+	for _, c := range []struct {
+		upd  string
+		away bool
+	}{
+		{"AW1", true},
+		{"AW2", true},
+		{"AW", false},
+	} {
+		alice.sendInfo([]byte(c.upd))
+		b := bob.expect("INF").(*adc.BroadcastPacket)
+		if b.ID != alice.sid || string(b.Data) != c.upd {
+			t.Fatalf("unexpected update: %q", b.Data)
+		}
+		if u := h.byName("alice").User(); u.Away != c.away {
+			t.Fatalf("%s: unexpected away state: %v", c.upd, u.Away)
+		}
+		for _, u := range h.ListUsers() {
+			if u.Name == "alice" && u.Away != c.away {
+				t.Fatalf("%s: unexpected away state in the user list", c.upd)
+			}
+		}
+	}
+}
+
+func TestADCShareStats(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginADC(t, h, "alice")
+	bob.expectUser(alice.sid)
+
+	alice.sendInfo([]byte("SS1000"))
+	bob.expect("INF")
+	bob.sendInfo([]byte("SS500"))
+	alice.expect("INF")
+	if st := h.Stats(); st.Share != 1500 {
+		t.Fatalf("unexpected total share: %d", st.Share)
+	}
+
+	alice.write(&adc.HubPacket{
+		BasePacket: adc.BasePacket{Name: (adc.Disconnect{}).Cmd()},
+	})
+	bob.expectQuit(alice.sid)
+	if st := h.Stats(); st.Share != 500 {
+		t.Fatalf("unexpected total share: %d", st.Share)
+	}
+}
+
+func TestADCKick(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginADC(t, h, "alice")
+	bob.expectUser(alice.sid)
+
+	if err := h.byName("alice").Kick("flood"); err != nil {
+		t.Fatal(err)
+	}
+	if m := alice.expectQuit(alice.sid); m.Message != "flood" {
+		t.Fatalf("unexpected reason: %q", m.Message)
+	}
+	if m := bob.expectQuit(alice.sid); m.Message != "flood" {
+		t.Fatalf("unexpected reason: %q", m.Message)
+	}
+	if h.byName("alice") != nil {
+		t.Fatal("peer is still on the hub")
+	}
+}
+
+func TestADCEcho(t *testing.T) {
+	h := newTestHub(t)
+	alice := loginADC(t, h, "alice")
+	bob := loginADC(t, h, "bob")
+	alice.expectUser(bob.sid)
+
+	echo := func(from *testADC, to adc.SID, text string) {
+		data, err := adc.Marshal(adc.ChatMessage{Text: adc.String(text), PM: &from.sid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		from.write(&adc.EchoPacket{
+			ID: from.sid, Targ: to,
+			BasePacket: adc.BasePacket{Name: (adc.ChatMessage{}).Cmd(), Data: data},
+		})
+	}
+	// expectOnce receives the echo packet once, and fails if it's received again before the done message.
+	// Packets are relayed asynchronously, thus the done message may arrive before the echo.
+	expectOnce := func(c *testADC, text, done string) {
+		echoed, isDone := 0, false
+		for echoed == 0 || !isDone {
+			p := c.expect("MSG")
+			var m adc.ChatMessage
+			if err := adc.Unmarshal(p.Message().Data, &m); err != nil {
+				t.Fatal(err)
+			}
+			switch string(m.Text) {
+			case done:
+				isDone = true
+			case text:
+				if _, ok := p.(*adc.EchoPacket); !ok {
+					t.Fatalf("expected echo packet, got %T", p)
+				}
+				if echoed++; echoed > 1 {
+					t.Fatalf("%q is received twice", text)
+				}
+			}
+		}
+	}
+
+	echo(alice, bob.sid, "hi")
+	alice.sendChat("done")
+	expectOnce(alice, "hi", "done")
+	expectOnce(bob, "hi", "done")
+
+	// the sender is the target as well
+	echo(bob, bob.sid, "self")
+	bob.sendChat("done2")
+	expectOnce(bob, "self", "done2")
+	alice.expectNoChat("self", "done2")
+}
+
+func TestADCSendError(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+
+	if err := h.byName("bob").SendError(SevWarning, 40, "slow down"); err != nil {
+		t.Fatal(err)
+	}
+	var st adc.Status
+	if err := adc.Unmarshal(bob.expect("STA").Message().Data, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Sev != adc.Recoverable || st.Code != 40 || st.Msg != "slow down" {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+}
+
+func TestADCPingUptime(t *testing.T) {
+	h := newTestHub(t)
+	c := dialADC(t, h)
+	c.handshake(adc.FeaPING)
+
+	// hub info is sent to the pinger without waiting for the user info
+	p, ok := c.next().(*adc.InfoPacket)
+	if !ok || p.Name != (adc.HubInfo{}).Cmd() {
+		t.Fatalf("expected hub info, got: %#v", p)
+	}
+	var info adc.HubInfo
+	if err := adc.Unmarshal(p.Data, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "test" || info.Uptime < 0 || info.Uptime > 5 {
+		t.Fatalf("unexpected hub info: %+v", info)
+	}
+
+	up := h.Uptime()
+	time.Sleep(10 * time.Millisecond)
+	if up2 := h.Uptime(); up2 <= up || up2 > time.Minute {
+		t.Fatalf("unexpected uptime: %v -> %v", up, up2)
+	}
+}
+
+func TestADCChatTimestamps(t *testing.T) {
+	h := New(Config{Name: "test", ChatTimestamps: true})
+	alice := dialADC(t, h)
+	alice.handshake(adc.FeaTS)
+	alice.identify(adc.User{Name: "alice"})
+	alice.expectUser(alice.sid)
+	waitPeer(t, h, "alice")
+	bob := loginADC(t, h, "bob")
+	carol := loginNMDC(t, h, "carol")
+	alice.expectUser(bob.sid)
+
+	bob.sendChat("hi")
+	now := time.Now().Unix()
+	recv := func(c *testADC) adc.ChatMessage {
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(c.expect("MSG").Message().Data, &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Text != "hi" {
+			t.Fatalf("unexpected message: %+v", m)
+		}
+		return m
+	}
+	if m := recv(alice); m.TS < now-5 || m.TS > now+5 {
+		t.Fatalf("unexpected timestamp: %d (now: %d)", m.TS, now)
+	}
+	if m := recv(bob); m.TS != 0 {
+		t.Fatalf("unexpected timestamp: %d", m.TS)
+	}
+	m := carol.expect("").(*nmdc.ChatMessage)
+	if text := string(m.Text); len(text) != len("[15:04:05] hi") || text[0] != '[' || text[9:] != "] hi" {
+		t.Fatalf("unexpected message: %q", text)
+	}
+}
+
+func TestADCInvalidChat(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginADC(t, h, "alice")
+	bob.expectUser(alice.sid)
+
+	// invalid timestamp makes the message unparsable, so it cannot be filtered
+	bob.write(&adc.BroadcastPacket{
+		ID:         bob.sid,
+		BasePacket: adc.BasePacket{Name: (adc.ChatMessage{}).Cmd(), Data: []byte(`bad\nmessage TSx`)},
+	})
+	for {
+		if st, ok := bob.expectInfo().(adc.Status); ok {
+			if st.Sev != adc.Recoverable || st.Code != adc.CodeProtocolGeneric {
+				t.Fatalf("unexpected status: %#v", st)
+			}
+			break
+		}
+	}
+	bob.sendChat("done")
+	alice.expectNoChat("message", "done")
+	if st := h.Stats(); st.Messages != 1 {
+		t.Fatalf("unexpected message count: %d", st.Messages)
+	}
+}
+
+func TestADCPacketStats(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginADC(t, h, "alice")
+	carol := loginNMDC(t, h, "carol")
+	bob.expectUser(alice.sid)
+
+	stats := func() map[string]*PacketStats {
+		m := make(map[string]*PacketStats)
+		for _, p := range h.PeersInfo() {
+			m[p.Name] = p.Packets
+		}
+		return m
+	}
+	before := stats()
+	if before[carol.name] != nil {
+		t.Fatalf("unexpected stats for NMDC peer: %+v", before[carol.name])
+	}
+	if st := before["bob"]; st == nil || st.In == 0 || st.Out == 0 || st.LastIn.IsZero() || st.LastOut.IsZero() {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	bob.sendChat("hi")
+	bob.expect("MSG")
+	alice.expect("MSG")
+	after := stats()
+	if in := after["bob"].In - before["bob"].In; in != 1 {
+		t.Fatalf("expected one packet from bob, got %d", in)
+	}
+	if out := after["alice"].Out - before["alice"].Out; out != 1 {
+		t.Fatalf("expected one packet to alice, got %d", out)
+	}
+	if after["alice"].In != before["alice"].In {
+		t.Fatalf("unexpected packets from alice: %d", after["alice"].In-before["alice"].In)
+	}
+}
+
+// failConn fails all writes after fail is called, simulating a broken connection.
+type failConn struct {
+	net.Conn
+	failed int32
+}
+
+func (c *failConn) fail() {
+	atomic.StoreInt32(&c.failed, 1)
+}
+
+func (c *failConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.failed) != 0 {
+		return 0, errors.New("write failed")
+	}
+	return c.Conn.Write(p)
+}
+
+func TestADCDroppedBroadcasts(t *testing.T) {
+	h := newTestHub(t)
+	c1, c2 := net.Pipe()
+	conn := &failConn{Conn: c2}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = h.Serve(conn)
+	}()
+	t.Cleanup(func() {
+		_ = c1.Close()
+		<-done
+	})
+	bob := newTestADC(t, c1)
+	bob.handshake()
+	bob.identify(adc.User{Name: "bob"})
+	bob.expectUser(bob.sid)
+	alice := loginADC(t, h, "alice")
+	bob.expectUser(alice.sid)
+
+	conn.fail()
+	const n = 3
+	for i := 0; i < n; i++ {
+		alice.sendChat("hi")
+		alice.expectChat("hi")
+	}
+	dropped := func() map[string]uint64 {
+		m := make(map[string]uint64)
+		for _, p := range h.PeersInfo() {
+			m[p.Name] = p.Dropped
+		}
+		return m
+	}
+	// broadcasts are sent asynchronously, bob may be the last one to receive it
+	deadline := time.Now().Add(testTimeout)
+	for dropped()["bob"] < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if m := dropped(); m["bob"] != n || m["alice"] != 0 {
+		t.Fatalf("unexpected drops: %v", m)
+	}
+	if st := h.Stats(); st.Dropped != n {
+		t.Fatalf("unexpected total drops: %d", st.Dropped)
+	}
+}
+
+func TestADCRenegotiate(t *testing.T) {
+	h := New(Config{Name: "test", ChatTimestamps: true, RequiredFeatures: []adc.Feature{adc.FeaUCMD}})
+	bob := dialADC(t, h)
+	bob.handshake(adc.FeaUCMD)
+	bob.identify(adc.User{Name: "bob"})
+	bob.expectUser(bob.sid)
+	peer := waitPeer(t, h, "bob")
+
+	sup := func(fea adc.ModFeatures) {
+		err := bob.conn.WriteHubMsg(adc.Supported{Features: fea})
+		if err == nil {
+			err = bob.conn.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// chat is processed after the SUP, so the echo shows the current features
+	chatTS := func() int64 {
+		bob.sendChat("hi")
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(bob.expect("MSG").Message().Data, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m.TS
+	}
+	if ts := chatTS(); ts != 0 {
+		t.Fatalf("unexpected timestamp: %d", ts)
+	}
+
+	sup(adc.ModFeatures{adc.FeaTS: true})
+	if ts := chatTS(); ts == 0 {
+		t.Fatal("expected a timestamp")
+	}
+	if fea := peer.Features(); !reflect.DeepEqual(fea, []string{"BASE", "TIGR", "TS00", "UCMD"}) {
+		t.Fatalf("unexpected features: %v", fea)
+	}
+	sup(adc.ModFeatures{adc.FeaTS: false})
+	if ts := chatTS(); ts != 0 {
+		t.Fatalf("unexpected timestamp: %d", ts)
+	}
+
+	// mandatory and required features cannot be removed
+	for _, f := range []adc.Feature{adc.FeaTIGR, adc.FeaUCMD} {
+		sup(adc.ModFeatures{f: false})
+		st, ok := bob.expectInfo().(adc.Status)
+		if !ok || st.Sev != adc.Recoverable || st.Code != adc.CodeFeatureMissing {
+			t.Fatalf("unexpected status: %#v", st)
+		}
+		if fc, _ := st.Param("FC"); fc != f.String() {
+			t.Fatalf("unexpected feature: %q", fc)
+		}
+	}
+	if fea := peer.Features(); !reflect.DeepEqual(fea, []string{"BASE", "TIGR", "UCMD"}) {
+		t.Fatalf("unexpected features: %v", fea)
+	}
+
+	// a single SUP may add and remove features
+	sup(adc.ModFeatures{adc.FeaTS: true})
+	sup(adc.ModFeatures{adc.FeaTS: false, adc.FeaPING: true, adc.FeaBZIP: false})
+	if ts := chatTS(); ts != 0 {
+		t.Fatalf("unexpected timestamp: %d", ts)
+	}
+	if fea := peer.Features(); !reflect.DeepEqual(fea, []string{"BASE", "PING", "TIGR", "UCMD"}) {
+		t.Fatalf("unexpected features: %v", fea)
+	}
+}
+
+// stallConn stops reading from the connection after stall is called, simulating a dead client.
+type stallConn struct {
+	net.Conn
+	stalled int32
+}
+
+func (c *stallConn) stall() {
+	atomic.StoreInt32(&c.stalled, 1)
+}
+
+func (c *stallConn) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.stalled) != 0 {
+		return 0, io.EOF
+	}
+	return c.Conn.Read(p)
+}
+
+// loginStale logs in and stops reading from the connection, so the hub cannot write to it.
+// The password is only sent for registered nicks.
+func loginStale(t *testing.T, h *Hub, name, pass string) *testADC {
+	conn := &stallConn{Conn: dialPipe(t, h)}
+	c := newTestADC(t, conn)
+	c.handshake()
+	c.identify(adc.User{Name: name})
+	if pass != "" {
+		c.password(pass)
+	}
+	c.expectUser(c.sid)
+	waitPeer(t, h, name)
+
+	conn.stall()
+	// unblock the pending read, the next one will fail
+	if err := h.byName(name).HubChatMsg("stall"); err != nil {
+		t.Fatal(err)
+	}
+	c.expect("MSG")
+	return c
+}
+
+func TestADCReconnectRefuse(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		h := newTestHub(t)
+		old := loginStale(t, h, "bob", "")
+
+		c := dialADC(t, h)
+		c.handshake()
+		c.identify(adc.User{Name: "bob", Pid: &old.pid, Id: old.pid.Hash()})
+		if st, ok := c.expectInfo().(adc.Status); !ok || st.Sev != adc.Fatal || st.Code != 22 {
+			t.Fatalf("unexpected status: %#v", st)
+		}
+		if p := h.byName("bob"); p == nil || p.SID() != old.sid {
+			t.Fatal("old connection should stay on the hub")
+		}
+	})
+	t.Run("alive", func(t *testing.T) {
+		h := New(Config{Name: "test", ReplaceOnReconnect: true})
+		old := loginADC(t, h, "bob")
+
+		c := dialADC(t, h)
+		c.handshake()
+		c.identify(adc.User{Name: "bob", Pid: &old.pid, Id: old.pid.Hash()})
+		if st, ok := c.expectInfo().(adc.Status); !ok || st.Sev != adc.Fatal || st.Code != 22 {
+			t.Fatalf("unexpected status: %#v", st)
+		}
+		if p := h.byName("bob"); p == nil || p.SID() != old.sid {
+			t.Fatal("old connection should stay on the hub")
+		}
+	})
+	t.Run("other CID", func(t *testing.T) {
+		// the user didn't prove that the nick is theirs
+		h := New(Config{Name: "test", ReplaceOnReconnect: true})
+		old := loginStale(t, h, "bob", "")
+
+		c := dialADC(t, h)
+		c.handshake()
+		c.identify(adc.User{Name: "bob"})
+		if st, ok := c.expectInfo().(adc.Status); !ok || st.Sev != adc.Fatal || st.Code != 22 {
+			t.Fatalf("unexpected status: %#v", st)
+		}
+		if p := h.byName("bob"); p == nil || p.SID() != old.sid {
+			t.Fatal("old connection should stay on the hub")
+		}
+	})
+}
+
+func TestADCReconnectReplace(t *testing.T) {
+	h := New(Config{Name: "test", ReplaceOnReconnect: true})
+	alice := loginADC(t, h, "alice")
+	old := loginStale(t, h, "bob", "")
+	alice.expectUser(old.sid)
+
+	c := dialADC(t, h)
+	c.handshake()
+	c.identify(adc.User{Name: "bob", Pid: &old.pid, Id: old.pid.Hash()})
+	c.expectUser(c.sid)
+	alice.expectQuit(old.sid)
+	alice.expectUser(c.sid)
+	if p := h.byName("bob"); p == nil || p.SID() != c.sid {
+		t.Fatal("new connection should replace the old one")
+	}
+	if n := h.UserCount(); n != 2 {
+		t.Fatalf("unexpected user count: %d", n)
+	}
+}
+
+func TestADCReconnectReplacePassword(t *testing.T) {
+	acc := newTestAccounts(t)
+	if err := acc.SetAccount("bob", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.SetADCPassword("bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Name: "test", ReplaceOnReconnect: true, Accounts: acc})
+	old := loginStale(t, h, "bob", "secret")
+
+	// different CID, but the user proved that the nick is theirs
+	c := dialADC(t, h)
+	c.handshake()
+	c.identify(adc.User{Name: "bob"})
+	c.password("secret")
+	c.expectUser(c.sid)
+	if p := waitPeer(t, h, "bob"); p.SID() == old.sid {
+		t.Fatal("new connection should replace the old one")
+	}
+}
+
+func TestADCHideIPs(t *testing.T) {
+	acc := newTestAccounts(t)
+	if err := acc.SetAccount("carol", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Name: "test", HideIPs: true, Accounts: acc})
+
+	bob := dialADCFrom(t, h, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234})
+	bob.handshake()
+	bob.identify(adc.User{Name: "bob"})
+	if u := bob.expectUser(bob.sid); u.Ip4 != "1.2.3.4" {
+		t.Fatalf("user should see his own address: %q", u.Ip4)
+	}
+	waitPeer(t, h, "bob")
+
+	alice := dialADCFrom(t, h, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 5), Port: 1234})
+	alice.handshake()
+	alice.identify(adc.User{Name: "alice"})
+	if u := alice.expectUser(bob.sid); u.Ip4 != "" || u.Ip6 != "" {
+		t.Fatalf("unexpected address: %q, %q", u.Ip4, u.Ip6)
+	}
+	alice.expectUser(alice.sid)
+	waitPeer(t, h, "alice")
+	if u := bob.expectUser(alice.sid); u.Ip4 != "" {
+		t.Fatalf("unexpected address: %q", u.Ip4)
+	}
+
+	// updates are also stripped
+	bob.sendInfo([]byte("SS100 I41.2.3.4"))
+	if u := alice.expectUser(bob.sid); u.Ip4 != "" || u.ShareSize != 100 {
+		t.Fatalf("unexpected update: %+v", u)
+	}
+	if u := bob.expectUser(bob.sid); u.Ip4 != "1.2.3.4" {
+		t.Fatalf("user should see his own address: %q", u.Ip4)
+	}
+
+	// operators see all addresses
+	carol := loginNMDCPass(t, h, nil, nmdc.MyInfo{Name: "carol"}, "secret")
+	ips := make(map[nmdc.Name]string)
+	for len(ips) < 2 {
+		m := carol.expect("UserIP").(*nmdc.UserIP)
+		ips[m.Name] = m.IP
+	}
+	if ips["bob"] != "1.2.3.4" || ips["alice"] != "1.2.3.5" {
+		t.Fatalf("unexpected addresses: %v", ips)
+	}
+}
+
+func TestADCInfoFields(t *testing.T) {
+	h := New(Config{Name: "test", InfoFields: []string{"SS", "VE"}})
+
+	bob := dialADC(t, h)
+	bob.handshake()
+	bob.identify(adc.User{Name: "bob", Email: "bob@example.com", ShareSize: 100, Slots: 3})
+	if u := bob.expectUser(bob.sid); u.Email != "bob@example.com" || u.Slots != 3 {
+		t.Fatalf("user should see his own info: %+v", u)
+	}
+	waitPeer(t, h, "bob")
+
+	alice := dialADC(t, h)
+	alice.handshake()
+	alice.identify(adc.User{Name: "alice"})
+	u := alice.expectUser(bob.sid)
+	if u.Name != "bob" || u.Id.IsZero() || u.ShareSize != 100 || u.Version == "" {
+		t.Fatalf("allowed fields are missing: %+v", u)
+	}
+	if u.Email != "" || u.Slots != 0 || len(u.Features) != 0 {
+		t.Fatalf("unexpected fields: %+v", u)
+	}
+	alice.expectUser(alice.sid)
+	waitPeer(t, h, "alice")
+	bob.expectUser(alice.sid)
+
+	// updates are also filtered
+	bob.sendInfo([]byte("EMnew@example.com SS200"))
+	if u := alice.expectUser(bob.sid); u.Email != "" || u.ShareSize != 200 {
+		t.Fatalf("unexpected update: %+v", u)
+	}
+	if u := bob.expectUser(bob.sid); u.Email != "new@example.com" {
+		t.Fatalf("user should see his own info: %+v", u)
+	}
+}
+
+func TestADCSpoofTolerance(t *testing.T) {
+	for _, tol := range []int{0, 2} {
+		tol := tol
+		t.Run(fmt.Sprint(tol), func(t *testing.T) {
+			h := New(Config{Name: "test", SpoofTolerance: tol})
+			alice := loginADC(t, h, "alice")
+			bob := loginADC(t, h, "bob")
+			alice.expectUser(bob.sid)
+
+			spoof := func() {
+				bob.write(&adc.BroadcastPacket{
+					ID: alice.sid,
+					BasePacket: adc.BasePacket{
+						Name: (adc.ChatMessage{}).Cmd(),
+						Data: adc.MustMarshal(adc.ChatMessage{Text: "spoofed"}),
+					},
+				})
+			}
+			for i := 0; i < tol; i++ {
+				spoof()
+			}
+			// packets within the tolerance are dropped, but the client stays online
+			bob.sendChat("hello")
+			bob.expectChat("hello")
+			alice.expectNoChat("spoofed", "hello")
+
+			spoof()
+			st, ok := bob.expectInfo().(adc.Status)
+			if !ok || st.Sev != adc.Fatal || st.Code != adc.CodeProtocolGeneric {
+				t.Fatalf("unexpected status: %#v", st)
+			}
+			if m := alice.expectQuit(bob.sid); m.ID != bob.sid {
+				t.Fatalf("unexpected quit: %#v", m)
+			}
+			if h.byName("bob") != nil {
+				t.Fatal("bob should be disconnected")
+			}
+		})
+	}
+}
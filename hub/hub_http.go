@@ -1,12 +1,22 @@
 package hub
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"html/template"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/http2"
+
+	"github.com/direct-connect/go-dcpp/adc"
 )
 
 func (h *Hub) initHTTP() {
@@ -31,7 +41,214 @@ func (h *Hub) ServeHTTP2(conn net.Conn) error {
 	return nil
 }
 
+// ServeHTTP serves the hub stats as JSON, or as an HTML page for browsers.
+// The user list on the page is only shown to registered operators, authenticated with HTTP basic auth.
+// WebSocket requests are passed to ServeWebSocket.
 func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebSocket(r) {
+		h.ServeWebSocket(w, r)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		h.serveDashboard(w, r)
+		return
+	}
 	st := h.Stats()
 	_ = json.NewEncoder(w).Encode(st)
 }
+
+// dashboardRefresh is the period of automatic reloads of the stats page, in seconds.
+const dashboardRefresh = 10
+
+var dashboardPage = template.Must(template.New("").Funcs(template.FuncMap{
+	"size": formatSize,
+	"since": func(t time.Time) time.Duration {
+		return time.Since(t).Truncate(time.Second)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>{{.Name}}</title>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+{{if .Desc}}<p>{{.Desc}}</p>{{end}}
+<table>
+<tr><th>Uptime</th><td>{{.UptimeDur}}</td></tr>
+<tr><th>Users</th><td>{{.Users}}</td></tr>
+<tr><th>Share</th><td>{{size .Share}}</td></tr>
+<tr><th>Received</th><td>{{size .BytesRecv}} ({{size .RecvRate}}/s)</td></tr>
+<tr><th>Sent</th><td>{{size .BytesSent}} ({{size .SentRate}}/s)</td></tr>
+</table>
+{{if .ShowUsers}}
+<table>
+<tr>
+<th><a href="?users&sort=name">Name</a></th>
+<th><a href="?users&sort=client">Client</a></th>
+<th><a href="?users&sort=share">Share</a></th>
+<th><a href="?users&sort=online">Online</a></th>
+<th>Country</th>
+</tr>
+{{range .List}}<tr><td>{{.Name}}{{if .Away}} (away){{end}}</td><td>{{.Client.Name}} {{.Client.Vers}}</td><td>{{size .Share}}</td><td>{{since .Connected}}</td><td>{{.Country}}</td></tr>
+{{end}}</table>
+{{else}}
+<p><a href="?users">Show users</a> (operators only)</p>
+{{end}}
+</body>
+</html>
+`))
+
+// serveDashboard renders the HTML stats page.
+func (h *Hub) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	_, users := q["users"]
+	op := h.httpOp(r)
+	if users && !op {
+		w.Header().Set("WWW-Authenticate", `Basic realm="hub"`)
+		http.Error(w, "operator login required", http.StatusUnauthorized)
+		return
+	}
+	st := h.Stats()
+	data := struct {
+		Stats
+		UptimeDur time.Duration
+		Refresh   int
+		ShowUsers bool
+		List      []UserSnapshot
+	}{
+		Stats:     st,
+		UptimeDur: time.Duration(st.Uptime) * time.Second,
+		Refresh:   dashboardRefresh,
+		ShowUsers: op,
+	}
+	if op {
+		data.List = h.ListUsers()
+		sortUsers(data.List, q.Get("sort"))
+	}
+	var buf bytes.Buffer
+	if err := dashboardPage.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = buf.WriteTo(w)
+}
+
+// httpOp checks if the HTTP request is authenticated as a registered operator.
+func (h *Hub) httpOp(r *http.Request) bool {
+	name, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	acc, ok := h.account(name)
+	return ok && acc.Op && h.checkPassword(name, pass)
+}
+
+// sortUsers sorts the user list by a given column of the stats page. Users are already sorted by name.
+func sortUsers(list []UserSnapshot, by string) {
+	var less func(a, b *UserSnapshot) bool
+	switch by {
+	case "share":
+		less = func(a, b *UserSnapshot) bool { return a.Share > b.Share }
+	case "client":
+		less = func(a, b *UserSnapshot) bool {
+			if a.Client.Name != b.Client.Name {
+				return a.Client.Name < b.Client.Name
+			}
+			return a.Client.Vers < b.Client.Vers
+		}
+	case "online":
+		less = func(a, b *UserSnapshot) bool { return a.Connected.Before(b.Connected) }
+	default:
+		return
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return less(&list[i], &list[j])
+	})
+}
+
+// formatSize formats the number of bytes with a binary unit suffix.
+func formatSize(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return strconv.FormatUint(n, 10) + " B"
+	}
+	v, i := float64(n)/1024, 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64) + " " + units[i:i+1] + "iB"
+}
+
+var browserPage = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}}</title></head>
+<body>
+<h1>{{.Name}}</h1>
+{{if .Desc}}<p>{{.Desc}}</p>{{end}}
+<p>This is a Direct Connect hub. Open it in a DC client: <a href="{{.URL}}">{{.URL}}</a></p>
+</body>
+</html>
+`))
+
+// serveBrowserPage responds to an HTTP request sent to the hub port by a browser.
+func (h *Hub) serveBrowserPage(conn net.Conn) error {
+	conf := h.config()
+	_ = conn.SetReadDeadline(time.Now().Add(conf.LoginTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return ErrNotDC
+	}
+	host := req.Host
+	if !validHost(host) {
+		host = conn.LocalAddr().String()
+	}
+	scheme := adc.SchemaADC
+	if h.tls != nil {
+		scheme = adc.SchemaADCS
+	}
+	var buf bytes.Buffer
+	err = browserPage.Execute(&buf, struct {
+		Name, Desc string
+		URL        template.URL
+	}{
+		Name: conf.Name,
+		Desc: conf.topic(),
+		// the scheme is not in the list of safe URLs of html/template
+		URL: template.URL(scheme + host),
+	})
+	if err != nil {
+		return err
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		ContentLength: int64(buf.Len()),
+		Body:          ioutil.NopCloser(&buf),
+		Close:         true,
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(conf.LoginTimeout))
+	return resp.Write(conn)
+}
+
+// validHost checks that the host from the HTTP request can be safely used in the hub URL.
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, r := range host {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.' || r == '-' || r == ':' || r == '[' || r == ']':
+		default:
+			return false
+		}
+	}
+	return true
+}
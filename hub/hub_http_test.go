@@ -0,0 +1,97 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBrowserPage(t *testing.T) {
+	h := New(Config{Name: "test", BrowserPage: true})
+	conn := dialPipe(t, h)
+
+	req, err := http.NewRequest("GET", "http://hub.example.com:1411/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = req.Write(conn)
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v", resp.Status)
+	} else if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("unexpected content type: %q", ct)
+	} else if !strings.Contains(string(body), `href="adc://hub.example.com:1411"`) {
+		t.Fatalf("no hub URL in the page:\n%s", body)
+	}
+
+	// DC clients are not affected
+	loginADC(t, h, "bob")
+}
+
+func TestDashboard(t *testing.T) {
+	acc := newTestAccounts(t)
+	if err := acc.SetAccount("admin", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.SetAccount("alice", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Name: "test", Accounts: acc})
+	loginADC(t, h, "bob")
+
+	get := func(url, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Accept", "text/html")
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", w.Code)
+	} else if body := w.Body.String(); !strings.Contains(body, "<h1>test</h1>") || strings.Contains(body, "bob") {
+		t.Fatalf("unexpected page:\n%s", body)
+	}
+
+	// the user list requires an operator account
+	for _, user := range []string{"", "alice"} {
+		if w = get("/?users", user); w.Code != http.StatusUnauthorized {
+			t.Fatalf("unexpected status: %v", w.Code)
+		}
+	}
+	w = get("/?users&sort=share", "admin")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", w.Code)
+	} else if body := w.Body.String(); !strings.Contains(body, "<td>bob</td>") {
+		t.Fatalf("no user in the page:\n%s", body)
+	}
+
+	// other clients still get JSON
+	req := httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	var st Stats
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	} else if st.Name != "test" || st.Users != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
@@ -47,9 +47,26 @@ func (h *Hub) ServeIRC(conn net.Conn) error {
 			}
 			dst, msg := m.Params[0], m.Params[1]
 			if dst == ircHubChan {
-				go h.broadcastChat(peer, msg, nil)
-			} else if dst := h.byName(dst); dst != nil {
-				go h.privateChat(peer, dst, msg)
+				if !h.chatCommand(peer, msg) {
+					if msg, ok := h.filterChat(peer, msg); ok {
+						if !h.isPending(peer) {
+							h.saveChat(peer, msg)
+							go h.linkChat(peer, msg)
+						}
+						go h.broadcastChat(peer, msg, h.broadcastTargets(peer, append(h.Peers(), h.viewerList()...)))
+					}
+				}
+			} else if targ := h.byName(dst); targ != nil {
+				go h.privateChat(peer, targ, msg)
+			} else {
+				err = peer.writeMessage(&irc.Message{
+					Prefix:  peer.hostPref,
+					Command: "401",
+					Params:  []string{peer.Name(), dst, "No such nick/channel"},
+				})
+				if err != nil {
+					return err
+				}
 			}
 		case "QUIT":
 			return nil
@@ -73,12 +90,18 @@ func (h *Hub) ircHandshake(conn net.Conn) (*ircPeer, error) {
 	var (
 		name string
 		user string
+		pass string
 	)
 	for {
-		deadline := time.Now().Add(time.Second * 5)
+		deadline := time.Now().Add(h.config().LoginTimeout)
 		_ = conn.SetReadDeadline(deadline)
 
 		m, err := c.ReadMessage()
+		if err == nil && name == "" && m.Command == "PASS" && len(m.Params) == 1 {
+			// optional password for registered users
+			pass = m.Params[0]
+			m, err = c.ReadMessage()
+		}
 		if err != nil {
 			return nil, fmt.Errorf("expected nick: %v", err)
 		} else if m.Command != "NICK" || len(m.Params) != 1 {
@@ -100,6 +123,15 @@ func (h *Hub) ircHandshake(conn net.Conn) (*ircPeer, error) {
 		}
 		name = tname
 
+		if err := h.checkMaintenance(); err != nil {
+			_ = c.WriteMessage(&irc.Message{
+				Command: "ERROR",
+				Params:  []string{err.Error()},
+			})
+			h.auditLoginReject(conn.RemoteAddr(), name, err)
+			return nil, err
+		}
+
 		h.peers.RLock()
 		_, sameName1 := h.peers.logging[name]
 		_, sameName2 := h.peers.byName[name]
@@ -113,8 +145,32 @@ func (h *Hub) ircHandshake(conn net.Conn) (*ircPeer, error) {
 			continue
 		}
 		h.peers.Lock()
+		err = h.waitSlot(func(pos int) error {
+			return c.WriteMessage(&irc.Message{
+				Prefix:  pref,
+				Command: "NOTICE",
+				Params:  []string{"*", queueMessage(pos)},
+			})
+		})
+		if err == errHubFull {
+			h.peers.Unlock()
+
+			_ = c.WriteMessage(&irc.Message{
+				Command: "ERROR",
+				Params:  []string{errHubFull.Error()},
+			})
+			h.auditLoginReject(conn.RemoteAddr(), name, errHubFull)
+			return nil, errHubFull
+		} else if err != nil {
+			h.peers.Unlock()
+			return nil, err
+		}
 		_, sameName1 = h.peers.logging[name]
 		_, sameName2 = h.peers.byName[name]
+		if _, ok := h.peers.byADCName[name]; ok {
+			// the nick is shown to ADC clients for another user
+			sameName2 = true
+		}
 		if sameName1 || sameName2 {
 			h.peers.Unlock()
 
@@ -131,11 +187,33 @@ func (h *Hub) ircHandshake(conn net.Conn) (*ircPeer, error) {
 	}
 	conn.SetReadDeadline(time.Time{})
 
+	kp := clientKeyprint(conn)
+	op, err := h.certOp(name, kp)
+	acc, registered := h.account(name)
+	if err == nil && registered && !op && !h.checkPassword(name, pass) {
+		err = errBadPass
+	}
+	if err != nil {
+		h.peers.Lock()
+		delete(h.peers.logging, name)
+		h.peers.Unlock()
+
+		_ = c.WriteMessage(&irc.Message{
+			Prefix:  pref,
+			Command: "464",
+			Params:  []string{name, "Password incorrect"},
+		})
+		h.auditLoginReject(conn.RemoteAddr(), name, err)
+		return nil, err
+	}
+
 	peer := &ircPeer{
 		BasePeer: BasePeer{
-			hub:  h,
-			addr: conn.RemoteAddr(),
-			sid:  h.nextSID(),
+			hub:      h,
+			addr:     conn.RemoteAddr(),
+			sid:      h.nextSID(),
+			created:  h.now(),
+			keyprint: kp,
 		},
 		hostPref: pref,
 		ownPref: &irc.Prefix{
@@ -147,8 +225,9 @@ func (h *Hub) ircHandshake(conn net.Conn) (*ircPeer, error) {
 		c:    c,
 		conn: conn,
 	}
+	peer.op = acc.Op || op
 
-	err := h.ircAccept(peer)
+	err = h.ircAccept(peer)
 	if err != nil {
 		h.peers.Lock()
 		delete(h.peers.logging, name)
@@ -160,19 +239,20 @@ func (h *Hub) ircHandshake(conn net.Conn) (*ircPeer, error) {
 }
 
 func (h *Hub) ircAccept(peer *ircPeer) error {
+	conf := h.config()
 	err := peer.writeMessage(&irc.Message{
 		Prefix:  peer.hostPref,
 		Command: "001",
 		Params: []string{
 			peer.name,
 			fmt.Sprintf("Welcome to the %s Internet Relay Chat Network %s",
-				h.info.Name, peer.name),
+				conf.Name, peer.name),
 		},
 	})
 	if err != nil {
 		return err
 	}
-	vers := h.info.Soft.Name + "-" + h.info.Soft.Vers
+	vers := conf.Soft.Name + "-" + conf.Soft.Vers
 
 	host, port, _ := net.SplitHostPort(peer.conn.LocalAddr().String())
 	err = peer.writeMessage(&irc.Message{
@@ -269,7 +349,7 @@ waitJoin:
 	if err != nil {
 		return err
 	}
-	err = peer.PeersJoin(h.Peers())
+	err = peer.PeersJoin(h.visiblePeers())
 	if err != nil {
 		return err
 	}
@@ -279,6 +359,7 @@ waitJoin:
 	delete(h.peers.logging, peer.name)
 	h.peers.byName[peer.name] = peer
 	h.peers.bySID[peer.sid] = peer
+	h.updateCounters(peer, +1)
 	notify := h.listPeers()
 	h.peers.Unlock()
 
@@ -334,21 +415,42 @@ func (p *ircPeer) User() User {
 			Name: "DC-IRC bridge",
 			Vers: version.Vers,
 		},
+		Op: p.op,
 	}
 }
 
+func (p *ircPeer) Features() []string {
+	return nil
+}
+
 func (p *ircPeer) Close() error {
+	return p.closeWith("", nil)
+}
+
+// closeWith closes the connection and notifies other peers with a given leave reason.
+// The audit event is set if the peer is removed by the hub.
+func (p *ircPeer) closeWith(reason string, e *AuditEvent) error {
 	p.closeMu.Lock()
-	defer p.closeMu.Unlock()
-	p.mu.RLock()
-	defer p.mu.RUnlock()
 	if p.closed {
+		p.closeMu.Unlock()
 		return nil
 	}
-	err := p.conn.Close()
 	p.closed = true
+	p.closeMu.Unlock()
+
+	err := p.conn.Close()
+	p.hub.leave(p, p.sid, p.Name(), reason, e)
+	return err
+}
 
-	p.hub.leave(p, p.sid, p.name)
+func (p *ircPeer) Kick(reason string) error {
+	err := p.writeMessage(&irc.Message{
+		Command: "ERROR",
+		Params:  []string{"kicked: " + reason},
+	})
+	if err2 := p.closeWith(reason, &AuditEvent{Action: AuditKick, Reason: reason}); err == nil {
+		err = err2
+	}
 	return err
 }
 
@@ -372,14 +474,19 @@ func (p *ircPeer) PeersJoin(peers []Peer) error {
 			return err
 		}
 	}
+	p.markJoined(peers)
 	return nil
 }
 
-func (p *ircPeer) PeersLeave(peers []Peer) error {
+func (p *ircPeer) PeersLeave(peers []Peer, reason string) error {
+	msg := "disconnect"
+	if reason != "" {
+		msg = "kicked: " + reason
+	}
 	for _, peer := range peers {
 		m := &irc.Message{
 			Command: "PART",
-			Params:  []string{ircHubChan, "disconnect"},
+			Params:  []string{ircHubChan, msg},
 		}
 		if p2, ok := peer.(*ircPeer); ok {
 			m.Prefix = p2.ownPref
@@ -395,6 +502,7 @@ func (p *ircPeer) PeersLeave(peers []Peer) error {
 			return err
 		}
 	}
+	p.markLeft(peers)
 	return nil
 }
 
@@ -443,6 +551,17 @@ func (p *ircPeer) HubChatMsg(text string) error {
 	return nil
 }
 
+func (p *ircPeer) SendError(sev Severity, code int, text string) error {
+	if sev != SevInfo {
+		text = sev.String() + ": " + text
+	}
+	return p.writeMessage(&irc.Message{
+		Prefix:  p.hostPref,
+		Command: "NOTICE",
+		Params:  []string{p.Name(), text},
+	})
+}
+
 func (p *ircPeer) ConnectTo(peer Peer, addr string, token string, secure bool) error {
 	// TODO: DCC?
 	return nil
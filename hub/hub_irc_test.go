@@ -0,0 +1,105 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-irc/irc"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+type testIRC struct {
+	t    testing.TB
+	c    *irc.Conn
+	recv chan *irc.Message
+}
+
+// loginIRC connects to the hub over IRC and joins the hub channel.
+func loginIRC(t testing.TB, h *Hub, name string) *testIRC {
+	c := &testIRC{
+		t:    t,
+		c:    irc.NewConn(dialPipe(t, h)),
+		recv: make(chan *irc.Message, 100),
+	}
+	go func() {
+		defer close(c.recv)
+		for {
+			m, err := c.c.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.recv <- m
+		}
+	}()
+	c.write(&irc.Message{Command: "NICK", Params: []string{name}})
+	c.write(&irc.Message{Command: "USER", Params: []string{name, "0", "*", name}})
+	c.expect("005")
+	c.write(&irc.Message{Command: "JOIN", Params: []string{ircHubChan}})
+	c.expect("JOIN")
+	waitPeer(t, h, name)
+	return c
+}
+
+func (c *testIRC) write(m *irc.Message) {
+	if err := c.c.WriteMessage(m); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect skips messages until the one with a given command is received.
+func (c *testIRC) expect(cmd string) *irc.Message {
+	for {
+		select {
+		case m, ok := <-c.recv:
+			if !ok {
+				c.t.Fatal("connection closed")
+			}
+			if m.Command == cmd {
+				return m
+			}
+		case <-time.After(testTimeout):
+			c.t.Fatalf("timeout waiting for %s", cmd)
+		}
+	}
+}
+
+func TestIRCPrivateMessage(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginIRC(t, h, "alice")
+
+	// IRC -> ADC
+	alice.write(&irc.Message{Command: "PRIVMSG", Params: []string{"bob", "hi bob"}})
+	p := bob.expectDirect("MSG")
+	var msg adc.ChatMessage
+	if err := adc.Unmarshal(p.Data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	from := h.byName("alice").SID()
+	if msg.Text != "hi bob" || msg.PM == nil || *msg.PM != from || p.ID != from {
+		t.Fatalf("unexpected message: %#v", msg)
+	}
+
+	// ADC -> IRC
+	err := bob.conn.WriteDirect(bob.sid, from, &adc.ChatMessage{
+		Text: "hi alice", PM: &bob.sid,
+	})
+	if err == nil {
+		err = bob.conn.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := alice.expect("PRIVMSG")
+	if m.Prefix.Name != "bob" || len(m.Params) != 2 || m.Params[0] != "alice" || m.Params[1] != "hi alice" {
+		t.Fatalf("unexpected message: %v", m)
+	}
+
+	// unknown nick
+	alice.write(&irc.Message{Command: "PRIVMSG", Params: []string{"carol", "hi"}})
+	m = alice.expect("401")
+	if len(m.Params) < 2 || m.Params[1] != "carol" {
+		t.Fatalf("unexpected reply: %v", m)
+	}
+}
@@ -6,9 +6,13 @@ import (
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/text/encoding"
+
 	"github.com/direct-connect/go-dcpp/nmdc"
 )
 
@@ -22,7 +26,7 @@ func (h *Hub) ServeNMDC(conn net.Conn) error {
 	}
 	defer c.Close()
 
-	peer, err := h.nmdcHandshake(c)
+	peer, err := h.nmdcHandshake(c, clientKeyprint(conn))
 	if err != nil {
 		return err
 	}
@@ -30,10 +34,12 @@ func (h *Hub) ServeNMDC(conn net.Conn) error {
 	return h.nmdcServePeer(peer)
 }
 
-func (h *Hub) nmdcHandshake(c *nmdc.Conn) (*nmdcPeer, error) {
+// nmdcHandshake performs the login of the NMDC user. The keyprint of the TLS client certificate is optional.
+func (h *Hub) nmdcHandshake(c *nmdc.Conn, keyprint string) (*nmdcPeer, error) {
+	conf := h.config()
 	lock := &nmdc.Lock{
 		Lock: "EXTENDEDPROTOCOL_godcpp", // TODO: randomize
-		PK:   h.info.Soft.Name + " " + h.info.Soft.Vers,
+		PK:   conf.Soft.Name + " " + conf.Soft.Vers,
 	}
 	err := c.WriteMsg(lock)
 	if err != nil {
@@ -44,7 +50,7 @@ func (h *Hub) nmdcHandshake(c *nmdc.Conn) (*nmdcPeer, error) {
 		return nil, err
 	}
 
-	deadline := time.Now().Add(time.Second * 5)
+	deadline := time.Now().Add(conf.LoginTimeout)
 	msg, err := c.ReadMsg(deadline)
 	if err != nil {
 		return nil, fmt.Errorf("expected supports: %v", err)
@@ -66,6 +72,7 @@ func (h *Hub) nmdcHandshake(c *nmdc.Conn) (*nmdcPeer, error) {
 	our := nmdc.Features{
 		nmdc.FeaNoHello:   {},
 		nmdc.FeaNoGetINFO: {},
+		nmdc.FeaUserIP2:   {},
 	}
 	mutual := our.IntersectList(sup.Ext)
 	if _, ok := mutual[nmdc.FeaNoHello]; !ok {
@@ -87,42 +94,79 @@ func (h *Hub) nmdcHandshake(c *nmdc.Conn) (*nmdcPeer, error) {
 
 	peer := &nmdcPeer{
 		BasePeer: BasePeer{
-			hub:  h,
-			addr: c.RemoteAddr(),
-			sid:  h.nextSID(),
+			hub:      h,
+			addr:     c.RemoteAddr(),
+			sid:      h.nextSID(),
+			created:  h.now(),
+			keyprint: keyprint,
 		},
 		conn: c,
 		fea:  mutual,
 	}
-	peer.user.Name = nick.Name
-	name := string(nick.Name)
+	peer.user.Name = peer.decodeName(nick.Name)
+	name := string(peer.user.Name)
+	if err := h.checkMaintenance(); err != nil {
+		_ = peer.error(err.Error())
+		h.auditLoginReject(peer.addr, name, err)
+		return nil, err
+	}
 
 	// do not lock for writes first
 	h.peers.RLock()
 	_, sameName1 := h.peers.logging[name]
-	_, sameName2 := h.peers.byName[name]
+	old, sameName2 := h.peers.byName[name]
 	h.peers.RUnlock()
 
+	// the client may reconnect before the hub notices that the old connection is dead,
+	// but only a registered user can prove that the nick is theirs, see nmdcAccept
+	var replace Peer
+	if sameName2 && h.config().ReplaceOnReconnect && h.isRegistered(name) {
+		replace = old
+		sameName2 = false
+	}
+
 	if sameName1 || sameName2 {
-		_ = peer.writeOne(&nmdc.ValidateDenide{nick.Name})
+		_ = peer.writeOne(&nmdc.ValidateDenide{Name: nick.Name})
+		h.auditLoginReject(peer.addr, name, errNickTaken)
 		return nil, errNickTaken
 	}
 
-	// ok, now lock for writes and try to bind nick
+	// ok, now lock for writes, wait for a free slot and try to bind nick
 	h.peers.Lock()
+	err = h.waitSlot(func(pos int) error {
+		return peer.HubChatMsg(queueMessage(pos))
+	})
+	if err == errHubFull {
+		h.peers.Unlock()
+
+		_ = peer.writeOne(&nmdc.HubIsFull{})
+		h.auditLoginReject(peer.addr, name, errHubFull)
+		return nil, errHubFull
+	} else if err != nil {
+		h.peers.Unlock()
+		return nil, err
+	}
 	_, sameName1 = h.peers.logging[name]
-	_, sameName2 = h.peers.byName[name]
+	old, sameName2 = h.peers.byName[name]
+	if sameName2 && replace != nil && old == replace {
+		sameName2 = false
+	}
+	if _, ok := h.peers.byADCName[name]; ok {
+		// the nick is shown to ADC clients for another user
+		sameName2 = true
+	}
 	if sameName1 || sameName2 {
 		h.peers.Unlock()
 
-		_ = peer.writeOne(&nmdc.ValidateDenide{nick.Name})
+		_ = peer.writeOne(&nmdc.ValidateDenide{Name: nick.Name})
+		h.auditLoginReject(peer.addr, name, errNickTaken)
 		return nil, errNickTaken
 	}
 	// bind nick, still no one will see us yet
 	h.peers.logging[name] = struct{}{}
 	h.peers.Unlock()
 
-	err = h.nmdcAccept(peer, our)
+	err = h.nmdcAccept(peer, our, replace)
 	if err != nil {
 		h.peers.Lock()
 		delete(h.peers.logging, name)
@@ -140,9 +184,17 @@ func (h *Hub) nmdcHandshake(c *nmdc.Conn) (*nmdcPeer, error) {
 
 	// add user to the hub
 	h.peers.bySID[peer.sid] = peer
+	h.updateCounters(peer, +1)
 	h.peers.byName[name] = peer
+	h.bindADCName(peer, name)
+	stale := h.hubInfoChanged(&peer.BasePeer)
 	h.peers.Unlock()
 
+	if stale {
+		// the hub info was updated during the login, and the broadcast missed the user
+		_ = peer.sendHubInfo()
+	}
+
 	// notify other users about the new one
 	// TODO: this will block the client
 	h.broadcastUserJoin(peer, list)
@@ -150,8 +202,12 @@ func (h *Hub) nmdcHandshake(c *nmdc.Conn) (*nmdcPeer, error) {
 	return peer, nil
 }
 
-func (h *Hub) nmdcAccept(peer *nmdcPeer, our nmdc.Features) error {
-	deadline := time.Now().Add(time.Second * 5)
+// nmdcAccept authenticates the user and completes the login. If replace is set, the user takes the
+// nick of that peer after the authentication, if the old connection turns out to be dead.
+func (h *Hub) nmdcAccept(peer *nmdcPeer, our nmdc.Features, replace Peer) error {
+	conf, infoVer := h.configVersion()
+	peer.hubInfo = infoVer
+	deadline := time.Now().Add(conf.LoginTimeout)
 
 	c := peer.conn
 	err := c.WriteMsg(&nmdc.Supports{
@@ -161,17 +217,61 @@ func (h *Hub) nmdcAccept(peer *nmdcPeer, our nmdc.Features) error {
 		return err
 	}
 	err = c.WriteMsg(&nmdc.HubName{
-		Name: nmdc.Name(h.info.Name),
+		Name: peer.encodeName(conf.Name),
 	})
 	if err != nil {
 		return err
 	}
+	// operators with a client certificate don't need a password,
+	// other registered users must provide one
+	name := string(peer.user.Name)
+	peer.op, err = h.certOp(name, peer.keyprint)
+	if err != nil {
+		_ = peer.writeOne(&nmdc.BadPass{})
+		h.auditLoginReject(peer.addr, name, err)
+		return err
+	}
+	if acc, ok := h.account(name); ok && !peer.op {
+		err = c.WriteMsg(&nmdc.GetPass{})
+		if err == nil {
+			err = c.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		msg, err := c.ReadMsg(deadline)
+		if err != nil {
+			return fmt.Errorf("expected password: %v", err)
+		}
+		pass, ok := msg.(*nmdc.MyPass)
+		if !ok {
+			return fmt.Errorf("expected password from the client, got: %#v", msg)
+		} else if !h.checkPassword(name, string(pass.String)) {
+			_ = peer.writeOne(&nmdc.BadPass{})
+			h.auditLoginReject(peer.addr, name, errBadPass)
+			return errBadPass
+		}
+		peer.op = acc.Op
+	}
+	if replace != nil && !h.dropStale(replace) {
+		_ = peer.writeOne(&nmdc.ValidateDenide{Name: peer.encodeName(name)})
+		h.auditLoginReject(peer.addr, name, errNickTaken)
+		return errNickTaken
+	}
 	err = c.WriteMsg(&nmdc.Hello{
-		Name: peer.user.Name,
+		Name: peer.encodeName(name),
 	})
 	if err != nil {
 		return err
 	}
+	if peer.op {
+		err = c.WriteMsg(&nmdc.LogedIn{
+			Name: peer.encodeName(name),
+		})
+		if err != nil {
+			return err
+		}
+	}
 	err = c.Flush()
 	if err != nil {
 		return err
@@ -202,28 +302,43 @@ func (h *Hub) nmdcAccept(peer *nmdcPeer, our nmdc.Features) error {
 	user, ok := msg.(*nmdc.MyInfo)
 	if !ok {
 		return fmt.Errorf("expected user info from the client, got: %#v", msg)
-	} else if user.Name != peer.user.Name {
+	}
+	info := peer.decodeInfo(*user)
+	if info.Name != peer.user.Name {
 		return errors.New("nick missmatch")
 	}
-	peer.user = *user
+	err = validateNumbers(user.ShareSize, 0, user.Slots, 0, user.Hubs)
+	if err == nil {
+		err = h.checkLimits(user.ShareSize, user.Slots, user.Hubs[0]+user.Hubs[1]+user.Hubs[2])
+	}
+	if err == nil {
+		err = h.checkRules(ruleValues{share: user.ShareSize, slots: user.Slots, hubs: user.Hubs})
+	}
+	if err != nil {
+		_ = peer.error(err.Error())
+		h.auditLoginReject(peer.addr, name, err)
+		return err
+	}
+	peer.user = info
 
-	err = c.WriteMsg(&peer.user)
+	echo := peer.encodeInfo(info)
+	err = c.WriteMsg(&echo)
 	if err != nil {
 		return err
 	}
 	err = c.WriteMsg(&nmdc.HubTopic{
-		Text: h.info.Desc,
+		Text: peer.encode(conf.topic()),
 	})
 	if err != nil {
 		return err
 	}
-	err = h.sendMOTD(peer)
+	err = h.sendWelcome(peer)
 	if err != nil {
 		return err
 	}
 
 	// send user list (except his own info)
-	err = peer.PeersJoin(h.Peers())
+	err = peer.PeersJoin(h.visiblePeers())
 	if err != nil {
 		return err
 	}
@@ -247,35 +362,78 @@ func (h *Hub) nmdcServePeer(peer *nmdcPeer) error {
 		}
 		switch msg := msg.(type) {
 		case *nmdc.ChatMessage:
-			if string(msg.Name) != peer.Name() {
+			if peer.decode(string(msg.Name)) != peer.Name() {
 				return errors.New("invalid name in the chat message")
 			}
-			go h.broadcastChat(peer, string(msg.Text), nil)
+			text := peer.decode(string(msg.Text))
+			if h.chatCommand(peer, text) {
+				continue
+			}
+			text, ok := h.filterChat(peer, text)
+			if !ok {
+				continue
+			}
+			if !h.isPending(peer) {
+				h.saveChat(peer, text)
+				go h.linkChat(peer, text)
+			}
+			go h.broadcastChat(peer, text, h.broadcastTargets(peer, append(h.Peers(), h.viewerList()...)))
 		case *nmdc.ConnectToMe:
-			targ := h.byName(string(msg.Targ))
+			targ := h.byName(peer.decode(string(msg.Targ)))
 			if targ == nil {
 				continue
 			}
 			// TODO: token?
 			go h.connectReq(peer, targ, msg.Address, nmdcFakeToken, msg.Secure)
 		case *nmdc.RevConnectToMe:
-			if string(msg.From) != peer.Name() {
+			if peer.decode(string(msg.From)) != peer.Name() {
 				return errors.New("invalid name in RevConnectToMe")
 			}
-			targ := h.byName(string(msg.To))
+			targ := h.byName(peer.decode(string(msg.To)))
 			if targ == nil {
 				continue
 			}
 			go h.revConnectReq(peer, targ, nmdcFakeToken, targ.User().TLS)
 		case *nmdc.PrivateMessage:
-			if string(msg.From) != peer.Name() {
+			if peer.decode(string(msg.From)) != peer.Name() {
 				return errors.New("invalid name in PrivateMessage")
 			}
-			targ := h.byName(string(msg.To))
+			targ := h.byName(peer.decode(string(msg.To)))
+			if targ == nil {
+				continue
+			}
+			go h.privateChat(peer, targ, peer.decode(string(msg.Text)))
+		case *nmdc.Search:
+			s := peer.decodeSearch(*msg)
+			if s.Address == "" && string(s.Nick) != peer.Name() {
+				return errors.New("invalid name in the search")
+			}
+			atomic.AddUint64(&h.counters.searches, 1)
+			go h.nmdcSearch(peer, s)
+		case *nmdc.SR:
+			sr := peer.decodeResult(*msg)
+			if string(sr.From) != peer.Name() {
+				return errors.New("invalid name in the search result")
+			}
+			targ := h.byName(string(sr.To))
 			if targ == nil {
 				continue
 			}
-			go h.privateChat(peer, targ, string(msg.Text))
+			go h.nmdcResult(peer, sr, targ)
+		case *nmdc.MyInfo:
+			if err := peer.updateInfo(peer.decodeInfo(*msg)); err != nil {
+				if _, ok := err.(*ruleError); ok {
+					// the user is no longer allowed on the hub
+					_ = peer.Kick(err.Error())
+					return nil
+				}
+				// drop the update, but keep the client online
+				if err = peer.error(err.Error()); err != nil {
+					return err
+				}
+				continue
+			}
+			go h.broadcastInfo(peer)
 		default:
 			// TODO
 			data, _ := msg.MarshalNMDC()
@@ -293,13 +451,20 @@ type nmdcPeer struct {
 	fea  nmdc.Features
 
 	mu      sync.RWMutex
-	user    nmdc.MyInfo
+	user    nmdc.MyInfo       // text fields are in UTF-8
+	enc     encoding.Encoding // legacy encoding of the client; nil means UTF-8
 	closeMu sync.Mutex
 	closed  bool
 }
 
 func (p *nmdcPeer) User() User {
 	u := p.Info()
+	ip4 := u.Flag.IsSet(nmdc.FlagIPv4)
+	ip6 := u.Flag.IsSet(nmdc.FlagIPv6)
+	if !ip4 && !ip6 && u.Mode == nmdc.UserModeActive {
+		// legacy clients do not set address family flags
+		ip4 = true
+	}
 	return User{
 		Name: string(u.Name),
 		App: Software{
@@ -308,9 +473,11 @@ func (p *nmdcPeer) User() User {
 		},
 		Email: u.Email,
 		Share: u.ShareSize,
-		IPv4:  u.Flag.IsSet(nmdc.FlagIPv4),
-		IPv6:  u.Flag.IsSet(nmdc.FlagIPv6),
+		IPv4:  ip4,
+		IPv6:  ip6,
 		TLS:   u.Flag.IsSet(nmdc.FlagTLS),
+		Op:    p.op,
+		Away:  u.Flag.IsSet(nmdc.FlagStatusAway),
 	}
 }
 
@@ -328,22 +495,73 @@ func (p *nmdcPeer) Info() nmdc.MyInfo {
 	return u
 }
 
-func (p *nmdcPeer) Close() error {
-	p.closeMu.Lock()
-	defer p.closeMu.Unlock()
+func (p *nmdcPeer) Features() []string {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
+	return p.fea.List()
+}
+
+func (p *nmdcPeer) Close() error {
+	return p.closeWith("", nil)
+}
+
+// closeWith closes the connection and notifies other peers with a given leave reason.
+// The audit event is set if the peer is removed by the hub.
+func (p *nmdcPeer) closeWith(reason string, e *AuditEvent) error {
+	p.closeMu.Lock()
 	if p.closed {
+		p.closeMu.Unlock()
 		return nil
 	}
-	err := p.conn.Close()
 	p.closed = true
+	p.closeMu.Unlock()
+
+	err := p.conn.Close()
+	p.hub.leave(p, p.sid, p.Name(), reason, e)
+	return err
+}
 
-	name := string(p.user.Name)
-	p.hub.leave(p, p.sid, name)
+func (p *nmdcPeer) Kick(reason string) error {
+	// NMDC has no way to pass a reason with the disconnect, so send it to the chat first
+	err := p.HubChatMsg("You were kicked: " + reason)
+	if err2 := p.closeWith(reason, &AuditEvent{Action: AuditKick, Reason: reason}); err == nil {
+		err = err2
+	}
 	return err
 }
 
+// updateInfo validates the MyINFO update from the client and applies it to the peer info.
+// Text fields of the info must be in UTF-8.
+func (p *nmdcPeer) updateInfo(u nmdc.MyInfo) error {
+	if string(u.Name) != p.Name() {
+		return errors.New("nick cannot be changed")
+	}
+	if err := validateNumbers(u.ShareSize, 0, u.Slots, 0, u.Hubs); err != nil {
+		return err
+	}
+	h := p.hub
+	if err := h.checkRules(ruleValues{share: u.ShareSize, slots: u.Slots, hubs: u.Hubs}); err != nil {
+		return err
+	}
+	// lock peers first to keep the total share consistent with the peer info
+	h.peers.Lock()
+	defer h.peers.Unlock()
+	onHub := h.peers.bySID[p.sid] == p
+	if onHub {
+		old := p.User()
+		h.peers.share -= old.Share
+		h.countClient(old.App, userFeatures(p), -1)
+	}
+	p.mu.Lock()
+	p.user = u
+	p.mu.Unlock()
+	if onHub {
+		h.peers.share += u.ShareSize
+		h.countClient(p.User().App, userFeatures(p), +1)
+	}
+	return nil
+}
+
 func (p *nmdcPeer) writeOne(msg nmdc.Message) error {
 	err := p.conn.WriteMsg(msg)
 	if err != nil {
@@ -353,6 +571,9 @@ func (p *nmdcPeer) writeOne(msg nmdc.Message) error {
 }
 
 func (p *nmdcPeer) PeersJoin(peers []Peer) error {
+	// only operators receive IPs of other users
+	_, userIP := p.fea[nmdc.FeaUserIP2]
+	userIP = userIP && p.op
 	for _, peer := range peers {
 		var u nmdc.MyInfo
 		if p2, ok := peer.(*nmdcPeer); ok {
@@ -369,6 +590,10 @@ func (p *nmdcPeer) PeersJoin(peers []Peer) error {
 			if info.TLS {
 				flag |= nmdc.FlagTLS
 			}
+			mode := nmdc.UserModePassive
+			if info.IPv4 || info.IPv6 {
+				mode = nmdc.UserModeActive
+			}
 			u = nmdc.MyInfo{
 				Name:      nmdc.Name(info.Name),
 				Client:    info.App.Name,
@@ -376,55 +601,109 @@ func (p *nmdcPeer) PeersJoin(peers []Peer) error {
 				Email:     info.Email,
 				ShareSize: info.Share,
 				Flag:      flag,
+				Mode:      mode,
 
 				// TODO
-				Mode:  nmdc.UserModeActive,
 				Hubs:  [3]int{1, 0, 0},
 				Slots: 1,
 				Conn:  "LAN(T3)",
 			}
 		}
+		u = p.encodeInfo(u)
 		if err := p.conn.WriteMsg(&u); err != nil {
 			return err
 		}
+		if !userIP {
+			continue
+		}
+		if ip := peerIP(peer); ip != "" {
+			if err := p.conn.WriteMsg(&nmdc.UserIP{Name: u.Name, IP: ip}); err != nil {
+				return err
+			}
+		}
 	}
-	return p.conn.Flush()
+	if err := p.conn.Flush(); err != nil {
+		return err
+	}
+	p.markJoined(peers)
+	return nil
 }
 
-func (p *nmdcPeer) PeersLeave(peers []Peer) error {
+func (p *nmdcPeer) PeersLeave(peers []Peer, reason string) error {
 	for _, peer := range peers {
+		if reason != "" {
+			if err := p.conn.WriteMsg(&nmdc.ChatMessage{
+				Text: p.encodeText(peer.Name() + " was kicked: " + reason),
+			}); err != nil {
+				return err
+			}
+		}
 		if err := p.conn.WriteMsg(&nmdc.Quit{
-			Name: nmdc.Name(peer.Name()),
+			Name: p.encodeName(peer.Name()),
 		}); err != nil {
 			return err
 		}
 	}
-	return p.conn.Flush()
+	if err := p.conn.Flush(); err != nil {
+		return err
+	}
+	p.markLeft(peers)
+	return nil
 }
 
 func (p *nmdcPeer) ChatMsg(from Peer, text string) error {
+	if p.hub.config().ChatTimestamps {
+		text = "[" + p.hub.now().Format("15:04:05") + "] " + text
+	}
 	return p.writeOne(&nmdc.ChatMessage{
-		Name: nmdc.Name(from.Name()),
-		Text: nmdc.String(text),
+		Name: p.encodeName(from.Name()),
+		Text: p.encodeText(text),
 	})
 }
 
 func (p *nmdcPeer) PrivateMsg(from Peer, text string) error {
 	return p.writeOne(&nmdc.PrivateMessage{
-		To:   nmdc.Name(p.Name()),
-		From: nmdc.Name(from.Name()),
-		Text: nmdc.String(text),
+		To:   p.encodeName(p.Name()),
+		From: p.encodeName(from.Name()),
+		Text: p.encodeText(text),
 	})
 }
 
 func (p *nmdcPeer) HubChatMsg(text string) error {
-	return p.writeOne(&nmdc.ChatMessage{Text: nmdc.String(text)})
+	msg := &nmdc.ChatMessage{Text: p.encodeText(text)}
+	if bot := p.hub.bot; bot != nil {
+		msg.Name = p.encodeName(bot.name)
+	}
+	return p.writeOne(msg)
+}
+
+func (p *nmdcPeer) ping(timeout time.Duration) error {
+	return p.conn.Ping(timeout)
+}
+
+// sendHubInfo sends the current hub name and topic to the peer.
+func (p *nmdcPeer) sendHubInfo() error {
+	conf := p.hub.config()
+	err := p.conn.WriteMsg(&nmdc.HubName{Name: p.encodeName(conf.Name)})
+	if err != nil {
+		return err
+	}
+	return p.writeOne(&nmdc.HubTopic{Text: p.encode(conf.topic())})
+}
+
+func (p *nmdcPeer) SendError(sev Severity, code int, text string) error {
+	// NMDC has no error codes, so the error is sent as a system chat message
+	if sev != SevInfo {
+		text = strings.Title(sev.String()) + ": " + text
+	}
+	return p.HubChatMsg(text)
 }
 
 func (p *nmdcPeer) ConnectTo(peer Peer, addr string, token string, secure bool) error {
 	// TODO: save token somewhere?
+	// the request is addressed to the receiver, the sender is only known by the address
 	return p.writeOne(&nmdc.ConnectToMe{
-		Targ:    nmdc.Name(peer.Name()),
+		Targ:    p.encodeName(p.Name()),
 		Address: addr,
 		Secure:  secure,
 	})
@@ -433,15 +712,15 @@ func (p *nmdcPeer) ConnectTo(peer Peer, addr string, token string, secure bool)
 func (p *nmdcPeer) RevConnectTo(peer Peer, token string, secure bool) error {
 	// TODO: save token somewhere?
 	return p.writeOne(&nmdc.RevConnectToMe{
-		From: nmdc.Name(peer.Name()),
-		To:   nmdc.Name(p.Name()),
+		From: p.encodeName(peer.Name()),
+		To:   p.encodeName(p.Name()),
 	})
 }
 
 func (p *nmdcPeer) failed(text string) error {
-	return p.writeOne(&nmdc.Failed{Text: nmdc.String(text)})
+	return p.writeOne(&nmdc.Failed{Text: p.encodeText(text)})
 }
 
 func (p *nmdcPeer) error(text string) error {
-	return p.writeOne(&nmdc.Error{Text: nmdc.String(text)})
+	return p.writeOne(&nmdc.Error{Text: p.encodeText(text)})
 }
@@ -0,0 +1,424 @@
+package hub
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/charmap"
+
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+type testNMDC struct {
+	t    testing.TB
+	conn *nmdc.Conn
+	name string
+	recv chan nmdc.Message
+}
+
+// loginNMDC connects to the hub over NMDC and completes the login with a given name.
+func loginNMDC(t testing.TB, h *Hub, name string) *testNMDC {
+	return loginNMDCFrom(t, h, nil, nmdc.MyInfo{Name: nmdc.Name(name)})
+}
+
+// loginNMDCFrom is the same as loginNMDC, but the hub will see a given remote address.
+func loginNMDCFrom(t testing.TB, h *Hub, addr net.Addr, info nmdc.MyInfo) *testNMDC {
+	return loginNMDCPass(t, h, addr, info, "")
+}
+
+// loginNMDCPass is the same as loginNMDCFrom, but also sends a password for registered nicks.
+func loginNMDCPass(t testing.TB, h *Hub, addr net.Addr, info nmdc.MyInfo, pass string) *testNMDC {
+	c := dialNMDC(t, h, addr, info, pass)
+	waitPeer(t, h, c.name)
+	return c
+}
+
+// dialNMDC sends the login sequence, but doesn't wait for the hub to accept the user.
+func dialNMDC(t testing.TB, h *Hub, addr net.Addr, info nmdc.MyInfo, pass string) *testNMDC {
+	return dialNMDCConn(t, dialPipeFrom(t, h, addr), info, pass)
+}
+
+// dialNMDCConn is the same as dialNMDC, but uses an existing connection to the hub.
+func dialNMDCConn(t testing.TB, nc net.Conn, info nmdc.MyInfo, pass string) *testNMDC {
+	conn, err := nmdc.NewConn(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testNMDC{t: t, conn: conn, name: string(info.Name), recv: make(chan nmdc.Message, 100)}
+	deadline := time.Now().Add(testTimeout)
+	_, err = conn.SendClientHandshake(deadline, c.name, nmdc.FeaNoHello, nmdc.FeaNoGetINFO, nmdc.FeaUserIP2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer close(c.recv)
+		for {
+			m, err := conn.ReadMsg(time.Time{})
+			if err != nil {
+				return
+			}
+			c.recv <- m
+		}
+	}()
+	if pass != "" {
+		c.expect("GetPass")
+		c.write(&nmdc.MyPass{String: nmdc.String(pass)})
+	}
+	c.expect("Hello")
+	if info.Client == "" {
+		info.Client, info.Version = "test", "1.0"
+	}
+	if info.Mode == nmdc.UserModeUnknown {
+		info.Mode = nmdc.UserModeActive
+	}
+	if info.Flag == 0 {
+		info.Flag = nmdc.FlagStatusNormal
+	}
+	if info.Conn == "" {
+		info.Conn = "LAN(T3)"
+	}
+	if err = conn.SendClientInfo(deadline, &info); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// expect skips messages until the one with a given command is received.
+func (c *testNMDC) expect(cmd string) nmdc.Message {
+	for {
+		select {
+		case m, ok := <-c.recv:
+			if !ok {
+				c.t.Fatal("connection closed")
+			}
+			if m.Cmd() == cmd {
+				return m
+			}
+		case <-time.After(testTimeout):
+			c.t.Fatalf("timeout waiting for %s", cmd)
+		}
+	}
+}
+
+func (c *testNMDC) write(m nmdc.Message) {
+	err := c.conn.WriteMsg(m)
+	if err == nil {
+		err = c.conn.Flush()
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func TestNMDCMaxUsers(t *testing.T) {
+	h := New(Config{Name: "test", MaxUsers: 1})
+	loginADC(t, h, "bob")
+
+	conn, err := nmdc.NewConn(dialPipe(t, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(testTimeout)
+	_, err = conn.SendClientHandshake(deadline, "alice", nmdc.FeaNoHello, nmdc.FeaNoGetINFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var full nmdc.HubIsFull
+	if err = conn.ReadMsgTo(deadline, &full); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNMDCKick(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginNMDC(t, h, "alice")
+	carol := loginNMDC(t, h, "carol")
+	sid := h.byName("alice").SID()
+	bob.expectUser(sid)
+
+	if err := h.byName("alice").Kick("flood"); err != nil {
+		t.Fatal(err)
+	}
+	m := alice.expect("")
+	if text := string(m.(*nmdc.ChatMessage).Text); text != "You were kicked: flood" {
+		t.Fatalf("unexpected message: %q", text)
+	}
+	if m := bob.expectQuit(sid); m.Message != "flood" {
+		t.Fatalf("unexpected reason: %q", m.Message)
+	}
+	m = carol.expect("")
+	if text := string(m.(*nmdc.ChatMessage).Text); text != "alice was kicked: flood" {
+		t.Fatalf("unexpected message: %q", text)
+	}
+	carol.expect("Quit")
+}
+
+func TestNMDCSendError(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginNMDC(t, h, "bob")
+
+	for _, c := range []struct {
+		sev  Severity
+		text string
+	}{
+		{SevInfo, "slow down"},
+		{SevWarning, "Warning: slow down"},
+		{SevFatal, "Error: slow down"},
+	} {
+		if err := h.byName("bob").SendError(c.sev, 40, "slow down"); err != nil {
+			t.Fatal(err)
+		}
+		m := bob.expect("").(*nmdc.ChatMessage)
+		if m.Name != "" || string(m.Text) != c.text {
+			t.Fatalf("unexpected message: %+v", m)
+		}
+	}
+}
+
+// expectChat skips messages until the chat message from a given user is received.
+func (c *testNMDC) expectChat(name nmdc.Name) nmdc.String {
+	for {
+		if m := c.expect("").(*nmdc.ChatMessage); m.Name == name {
+			return m.Text
+		}
+	}
+}
+
+func TestNMDCEncoding(t *testing.T) {
+	h := New(Config{Name: "test", NMDCEncoding: "windows-1251"})
+	alice := loginADC(t, h, "Алиса")
+	jorg := loginNMDC(t, h, "Jörg")
+	if u := alice.expectUser(h.byName("Jörg").SID()); u.Name != "Jörg" {
+		t.Fatalf("unexpected name: %q", u.Name)
+	}
+
+	cp1251 := func(s string) string {
+		out, err := charmap.Windows1251.NewEncoder().String(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	// legacy client sends the nick in its own encoding
+	vasya := dialNMDC(t, h, nil, nmdc.MyInfo{Name: nmdc.Name(cp1251("Вася"))}, "")
+	if u := alice.expectUser(waitPeer(t, h, "Вася").SID()); u.Name != "Вася" {
+		t.Fatalf("unexpected name: %q", u.Name)
+	}
+
+	vasya.write(&nmdc.ChatMessage{Name: nmdc.Name(cp1251("Вася")), Text: nmdc.String(cp1251("привет"))})
+	alice.expectChat("привет")
+	if text := jorg.expectChat("Вася"); text != "привет" {
+		t.Fatalf("unexpected text: %q", text)
+	}
+
+	alice.sendChat("здравствуй")
+	if text := vasya.expectChat(nmdc.Name(cp1251("Алиса"))); string(text) != cp1251("здравствуй") {
+		t.Fatalf("unexpected text: %q", text)
+	}
+	if text := jorg.expectChat("Алиса"); text != "здравствуй" {
+		t.Fatalf("unexpected text: %q", text)
+	}
+
+	jorg.write(&nmdc.ChatMessage{Name: "Jörg", Text: "grüß dich"})
+	alice.expectChat("grüß dich")
+	if text := vasya.expectChat(nmdc.Name(cp1251("J?rg"))); string(text) != cp1251("gr?? dich") {
+		t.Fatalf("unexpected text: %q", text)
+	}
+}
+
+func TestNMDCInfoUpdate(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	carol := loginNMDC(t, h, "carol")
+	info := nmdc.MyInfo{
+		Name: "alice", Client: "test", Version: "1.0", ShareSize: 1000,
+		Mode: nmdc.UserModeActive, Flag: nmdc.FlagStatusNormal, Conn: "LAN(T3)",
+		Hubs: [3]int{1, 0, 0}, Slots: 2,
+	}
+	alice := loginNMDCFrom(t, h, nil, info)
+	sid := h.byName("alice").SID()
+	bob.expectUser(sid)
+	if st := h.Stats(); st.Share != 1000 {
+		t.Fatalf("unexpected total share: %d", st.Share)
+	}
+
+	info.ShareSize = 3000
+	info.Flag |= nmdc.FlagStatusAway
+	alice.write(&info)
+	for {
+		if u := bob.expectUser(sid); u.ShareSize == 3000 {
+			break
+		}
+	}
+	for {
+		if u := carol.expect("MyINFO").(*nmdc.MyInfo); u.Name == "alice" && u.ShareSize == 3000 {
+			break
+		}
+	}
+	if st := h.Stats(); st.Share != 3000 {
+		t.Fatalf("unexpected total share: %d", st.Share)
+	}
+	if !h.byName("alice").User().Away {
+		t.Fatal("expected alice to be away")
+	}
+}
+
+func TestNMDCInvalidInfoUpdate(t *testing.T) {
+	h := newTestHub(t)
+	carol := loginNMDC(t, h, "carol")
+	info := nmdc.MyInfo{
+		Name: "alice", Client: "test", Version: "1.0", ShareSize: 1000,
+		Mode: nmdc.UserModeActive, Flag: nmdc.FlagStatusNormal, Conn: "LAN(T3)",
+		Hubs: [3]int{1, 0, 0}, Slots: 2,
+	}
+	alice := loginNMDCFrom(t, h, nil, info)
+
+	for _, upd := range []func(u *nmdc.MyInfo){
+		func(u *nmdc.MyInfo) { u.ShareSize = 9000000000000000000 },
+		func(u *nmdc.MyInfo) { u.Slots = 100000 },
+		func(u *nmdc.MyInfo) { u.Hubs[1] = 100000 },
+	} {
+		u := info
+		upd(&u)
+		alice.write(&u)
+		alice.expect("Error")
+	}
+	if u := h.byName("alice").User(); u.Share != 1000 {
+		t.Fatalf("invalid update applied: %+v", u)
+	}
+	if st := h.Stats(); st.Share != 1000 {
+		t.Fatalf("unexpected total share: %d", st.Share)
+	}
+	alice.write(&nmdc.ChatMessage{Name: "alice", Text: "ping"})
+	for {
+		var m nmdc.Message
+		select {
+		case m = <-carol.recv:
+		case <-time.After(testTimeout):
+			t.Fatal("timeout waiting for the chat message")
+		}
+		if u, ok := m.(*nmdc.MyInfo); ok && u.Name == "alice" && u.ShareSize != 1000 {
+			t.Fatalf("invalid update broadcasted: %+v", u)
+		} else if c, ok := m.(*nmdc.ChatMessage); ok && c.Name == "alice" {
+			break
+		}
+	}
+}
+
+// loginNMDCStale logs in and stops reading from the connection, so the hub cannot write to it.
+func loginNMDCStale(t *testing.T, h *Hub, name, pass string) *testNMDC {
+	conn := &stallConn{Conn: dialPipe(t, h)}
+	c := dialNMDCConn(t, conn, nmdc.MyInfo{Name: nmdc.Name(name)}, pass)
+	waitPeer(t, h, name)
+
+	conn.stall()
+	// unblock the pending read, the next one will fail
+	if err := h.byName(name).HubChatMsg("stall"); err != nil {
+		t.Fatal(err)
+	}
+	c.expect("")
+	return c
+}
+
+// nmdcLoginResult sends the login sequence and returns the first message that accepts or refuses the user.
+func nmdcLoginResult(t *testing.T, h *Hub, name, pass string) nmdc.Message {
+	conn, err := nmdc.NewConn(dialPipe(t, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(testTimeout)
+	_, err = conn.SendClientHandshake(deadline, name, nmdc.FeaNoHello, nmdc.FeaNoGetINFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := conn.ReadMsg(deadline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch m.(type) {
+		case *nmdc.GetPass:
+			err = conn.WriteMsg(&nmdc.MyPass{String: nmdc.String(pass)})
+			if err == nil {
+				err = conn.Flush()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		case *nmdc.ValidateDenide, *nmdc.BadPass, *nmdc.Hello:
+			return m
+		}
+	}
+}
+
+func TestNMDCReconnectReplace(t *testing.T) {
+	acc := newTestAccounts(t)
+	if err := acc.SetAccount("bob", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Name: "test", ReplaceOnReconnect: true, Accounts: acc})
+	alice := loginADC(t, h, "alice")
+	loginNMDCStale(t, h, "bob", "secret")
+	old := h.byName("bob")
+	alice.expectUser(old.SID())
+
+	loginNMDCPass(t, h, nil, nmdc.MyInfo{Name: "bob"}, "secret")
+	alice.expectQuit(old.SID())
+	p := h.byName("bob")
+	if p == nil || p == old {
+		t.Fatal("new connection should replace the old one")
+	}
+	alice.expectUser(p.SID())
+	if n := h.UserCount(); n != 2 {
+		t.Fatalf("unexpected user count: %d", n)
+	}
+}
+
+func TestNMDCReconnectRefuse(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		stale  bool
+		pass   string
+		expect string
+	}{
+		{name: "alive", pass: "secret", expect: "ValidateDenide"},
+		{name: "bad password", stale: true, pass: "wrong", expect: "BadPass"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			acc := newTestAccounts(t)
+			if err := acc.SetAccount("bob", "secret", false); err != nil {
+				t.Fatal(err)
+			}
+			h := New(Config{Name: "test", ReplaceOnReconnect: true, Accounts: acc})
+			if c.stale {
+				loginNMDCStale(t, h, "bob", "secret")
+			} else {
+				loginNMDCPass(t, h, nil, nmdc.MyInfo{Name: "bob"}, "secret")
+			}
+			p := h.byName("bob")
+
+			if m := nmdcLoginResult(t, h, "bob", c.pass); m.Cmd() != c.expect {
+				t.Fatalf("unexpected reply: %#v", m)
+			}
+			if h.byName("bob") != p {
+				t.Fatal("old connection should stay on the hub")
+			}
+		})
+	}
+	t.Run("unregistered", func(t *testing.T) {
+		// the user cannot prove that the nick is theirs
+		h := New(Config{Name: "test", ReplaceOnReconnect: true})
+		loginNMDCStale(t, h, "bob", "")
+		p := h.byName("bob")
+
+		if m := nmdcLoginResult(t, h, "bob", ""); m.Cmd() != "ValidateDenide" {
+			t.Fatalf("unexpected reply: %#v", m)
+		}
+		if h.byName("bob") != p {
+			t.Fatal("old connection should stay on the hub")
+		}
+	})
+}
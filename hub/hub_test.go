@@ -0,0 +1,995 @@
+package hub
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/adc/types"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+const testTimeout = time.Second * 5
+
+func newTestHub(t testing.TB) *Hub {
+	return New(Config{Name: "test", Desc: "test hub"})
+}
+
+// testClock is a fake clock that only moves when the test advances it.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// dialPipe connects to the hub using an in-memory connection.
+func dialPipe(t testing.TB, h *Hub) net.Conn {
+	return dialPipeFrom(t, h, nil)
+}
+
+// addrConn overrides the remote address of the connection.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// dialPipeFrom is the same as dialPipe, but the hub will see a given remote address.
+func dialPipeFrom(t testing.TB, h *Hub, addr net.Addr) net.Conn {
+	c1, c2 := net.Pipe()
+	if addr != nil {
+		c2 = &addrConn{Conn: c2, addr: addr}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := h.Serve(c2); err != nil {
+			t.Log(err)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = c1.Close()
+		<-done
+	})
+	return c1
+}
+
+// waitPeer waits until the peer with a given name is accepted by the hub.
+func waitPeer(t testing.TB, h *Hub, name string) Peer {
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		if p := h.byName(name); p != nil {
+			return p
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("peer %q didn't join", name)
+	return nil
+}
+
+type testADC struct {
+	t    testing.TB
+	conn *adc.Conn
+	sid  adc.SID
+	pid  adc.PID
+	recv chan adc.Packet
+}
+
+// dialADC connects to the hub over ADC and starts reading packets in background.
+func dialADC(t testing.TB, h *Hub) *testADC {
+	return dialADCFrom(t, h, nil)
+}
+
+// dialADCFrom is the same as dialADC, but the hub will see a given remote address.
+func dialADCFrom(t testing.TB, h *Hub, addr net.Addr) *testADC {
+	return newTestADC(t, dialPipeFrom(t, h, addr))
+}
+
+// newTestADC starts reading ADC packets from the connection in background.
+func newTestADC(t testing.TB, conn net.Conn) *testADC {
+	c, err := adc.NewConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &testADC{t: t, conn: c, recv: make(chan adc.Packet, 100)}
+	go func() {
+		defer close(tc.recv)
+		for {
+			p, err := c.ReadPacket(time.Time{})
+			if err != nil {
+				return
+			}
+			tc.recv <- p
+		}
+	}()
+	return tc
+}
+
+// loginADC connects to the hub and completes ADC login with a given name.
+func loginADC(t testing.TB, h *Hub, name string) *testADC {
+	c := dialADC(t, h)
+	c.handshake()
+	c.identify(adc.User{Name: name})
+	c.expectUser(c.sid)
+	waitPeer(t, h, name)
+	return c
+}
+
+// handshake sends the SUP with BASE, TIGR and a given features, and waits for the SID.
+func (c *testADC) handshake(features ...adc.Feature) {
+	sup := adc.ModFeatures{
+		adc.FeaBASE: true,
+		adc.FeaTIGR: true,
+	}
+	for _, f := range features {
+		sup[f] = true
+	}
+	err := c.conn.WriteHubMsg(adc.Supported{
+		Features: sup,
+	})
+	if err == nil {
+		err = c.conn.Flush()
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, ok := c.expectInfo().(adc.Supported); !ok {
+		c.t.Fatal("expected SUP")
+	}
+	sid, ok := c.expectInfo().(adc.SIDAssign)
+	if !ok {
+		c.t.Fatal("expected SID")
+	}
+	c.sid = sid.SID
+}
+
+// loginInfo fills required fields of the user info and generates a PID, if it's not set.
+func (c *testADC) loginInfo(u adc.User) adc.User {
+	if u.Id.IsZero() {
+		c.pid = types.NewPID()
+		u.Pid = &c.pid
+		u.Id = c.pid.Hash()
+	}
+	if u.Version == "" {
+		u.Application, u.Version = "test", "1.0"
+	}
+	if u.Features == nil {
+		u.Features = adc.ExtFeatures{adc.FeaTCP4}
+	}
+	return u
+}
+
+func (c *testADC) identify(u adc.User) {
+	c.sendInfo(adc.MustMarshal(c.loginInfo(u)))
+}
+
+// password waits for the password request from the hub and replies with a given password.
+func (c *testADC) password(pass string) {
+	gpa, ok := c.expectInfo().(adc.GetPassword)
+	if !ok {
+		c.t.Fatal("expected password request")
+	}
+	data := adc.MustMarshal(adc.Password{Hash: adc.HashPassword(pass, gpa.Salt)})
+	c.write(&adc.HubPacket{
+		BasePacket: adc.BasePacket{
+			Name: (adc.Password{}).Cmd(), Data: data,
+		},
+	})
+}
+
+// sendInfo broadcasts a raw INF message.
+func (c *testADC) sendInfo(data []byte) {
+	c.write(&adc.BroadcastPacket{
+		ID: c.sid,
+		BasePacket: adc.BasePacket{
+			Name: (adc.User{}).Cmd(), Data: data,
+		},
+	})
+}
+
+func (c *testADC) write(p adc.Packet) {
+	err := c.conn.WritePacket(p)
+	if err == nil {
+		err = c.conn.Flush()
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next returns the next packet received from the hub.
+func (c *testADC) next() adc.Packet {
+	select {
+	case p, ok := <-c.recv:
+		if !ok {
+			c.t.Fatal("connection closed")
+		}
+		return p
+	case <-time.After(testTimeout):
+		c.t.Fatal("timeout")
+	}
+	return nil
+}
+
+// expect skips packets until the one with a given name is received.
+func (c *testADC) expect(name string) adc.Packet {
+	for {
+		p := c.next()
+		if p.Message().Type.String() == name {
+			return p
+		}
+	}
+}
+
+// expectDirect skips packets until the direct packet with a given name is received.
+func (c *testADC) expectDirect(name string) *adc.DirectPacket {
+	for {
+		if p, ok := c.expect(name).(*adc.DirectPacket); ok {
+			return p
+		}
+	}
+}
+
+func (c *testADC) expectInfo() adc.Message {
+	p, ok := c.next().(*adc.InfoPacket)
+	if !ok {
+		c.t.Fatalf("expected info packet, got: %#v", p)
+	}
+	m, err := p.Decode()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// expectUser skips packets until the INF of a given user is received.
+func (c *testADC) expectUser(sid adc.SID) adc.User {
+	for {
+		b, ok := c.expect("INF").(*adc.BroadcastPacket)
+		if !ok || b.ID != sid {
+			continue
+		}
+		var u adc.User
+		if err := adc.Unmarshal(b.Data, &u); err != nil {
+			c.t.Fatal(err)
+		}
+		return u
+	}
+}
+
+// newTestCert generates a self-signed TLS certificate.
+func newTestCert(t testing.TB) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshakeTLS connects to the hub over TLS and returns the certificate served by the hub.
+func handshakeTLS(t testing.TB, h *Hub) []byte {
+	conn := tls.Client(dialPipe(t, h), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"adc"},
+	})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return conn.ConnectionState().PeerCertificates[0].Raw
+}
+
+func TestSetCertificate(t *testing.T) {
+	cert1, cert2 := newTestCert(t), newTestCert(t)
+	h := New(Config{
+		Name: "test",
+		TLS:  &tls.Config{Certificates: []tls.Certificate{*cert1}},
+	})
+	if got := handshakeTLS(t, h); !bytes.Equal(got, cert1.Certificate[0]) {
+		t.Fatal("unexpected certificate")
+	}
+	if err := h.SetCertificate(cert2); err != nil {
+		t.Fatal(err)
+	}
+	if got := handshakeTLS(t, h); !bytes.Equal(got, cert2.Certificate[0]) {
+		t.Fatal("certificate was not replaced")
+	}
+
+	if err := newTestHub(t).SetCertificate(cert2); err == nil {
+		t.Fatal("expected an error for hub without TLS")
+	}
+}
+
+func TestPeersQuery(t *testing.T) {
+	h := newTestHub(t)
+	c := dialADC(t, h)
+	c.handshake(adc.FeaUCMD)
+	c.identify(adc.User{Name: "bob"})
+	waitPeer(t, h, "bob")
+	loginADC(t, h, "alice")
+
+	if p := h.PeerByNick("bob"); p == nil || p.Name() != "bob" {
+		t.Fatalf("unexpected peer: %v", p)
+	}
+	if p := h.PeerByNick("carol"); p != nil {
+		t.Fatalf("unexpected peer: %v", p.Name())
+	}
+	if list := h.PeersByFeature("UCMD"); len(list) != 1 || list[0].Name() != "bob" {
+		t.Fatalf("unexpected peers: %v", list)
+	}
+	list := h.PeersWhere(func(p Peer) bool {
+		return p.Name() != "bob"
+	})
+	if len(list) != 1 || list[0].Name() != "alice" {
+		t.Fatalf("unexpected peers: %v", list)
+	}
+}
+
+func TestUptime(t *testing.T) {
+	clock := newTestClock()
+	h := newHub(Config{Name: "test"}, clock.Now)
+	if d := h.Uptime(); d != 0 {
+		t.Fatalf("unexpected uptime: %v", d)
+	}
+	clock.Advance(time.Hour)
+	if d := h.Uptime(); d != time.Hour {
+		t.Fatalf("unexpected uptime: %v", d)
+	}
+	if st := h.Stats(); st.Uptime != 3600 {
+		t.Fatalf("unexpected uptime: %v", st.Uptime)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	loginNMDC(t, h, "carol")
+
+	if p, ok := h.Lookup("bob"); !ok || p.SID() != bob.sid {
+		t.Fatalf("unexpected peer: %v", p)
+	}
+	if p, ok := h.Lookup("carol"); !ok || p.Name() != "carol" {
+		t.Fatalf("unexpected peer: %v", p)
+	}
+	if p, ok := h.Lookup("dave"); ok || p != nil {
+		t.Fatalf("unexpected peer: %v", p)
+	}
+
+	if p, ok := h.LookupCID(bob.pid.Hash()); !ok || p.SID() != bob.sid {
+		t.Fatalf("unexpected peer: %v", p)
+	}
+	if p, ok := h.LookupCID(types.NewPID().Hash()); ok || p != nil {
+		t.Fatalf("unexpected peer: %v", p)
+	}
+
+	// the peer is removed on disconnect
+	_ = bob.conn.Close()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		if _, ok := h.LookupCID(bob.pid.Hash()); !ok {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("peer is still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := h.Lookup("bob"); ok {
+		t.Fatal("peer is still registered")
+	}
+}
+
+// goroutineTB is used by helpers called from goroutines started by the test. FailNow must only
+// be called from the test goroutine, so fatal errors are recorded and only the calling goroutine exits.
+type goroutineTB struct {
+	testing.TB
+}
+
+func (t goroutineTB) FailNow() {
+	t.Fail()
+	runtime.Goexit()
+}
+
+func (t goroutineTB) Fatal(args ...interface{}) {
+	t.Error(args...)
+	runtime.Goexit()
+}
+
+func (t goroutineTB) Fatalf(format string, args ...interface{}) {
+	t.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+func TestUserCount(t *testing.T) {
+	const n = 10
+	h := newTestHub(t)
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns []func() error
+	)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c := loginADC(goroutineTB{t}, h, "adc"+strconv.Itoa(i))
+			mu.Lock()
+			conns = append(conns, c.conn.Close)
+			mu.Unlock()
+		}()
+		go func() {
+			defer wg.Done()
+			c := loginNMDC(goroutineTB{t}, h, "nmdc"+strconv.Itoa(i))
+			mu.Lock()
+			conns = append(conns, c.conn.Close)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+	if cnt := h.UserCount(); cnt != 2*n {
+		t.Fatalf("unexpected user count: %d", cnt)
+	}
+	if a, b := h.UserCountByProtocol(); a != n || b != n {
+		t.Fatalf("unexpected user count: %d, %d", a, b)
+	}
+
+	for _, closeConn := range conns {
+		wg.Add(1)
+		go func(closeConn func() error) {
+			defer wg.Done()
+			_ = closeConn()
+		}(closeConn)
+	}
+	wg.Wait()
+	deadline := time.Now().Add(testTimeout)
+	for h.UserCount() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if cnt := h.UserCount(); cnt != 0 || cnt != len(h.Peers()) {
+		t.Fatalf("unexpected user count: %d", cnt)
+	}
+	if a, b := h.UserCountByProtocol(); a != 0 || b != 0 {
+		t.Fatalf("unexpected user count: %d, %d", a, b)
+	}
+}
+
+func TestNewHubInfo(t *testing.T) {
+	h := NewHub(Info{Name: "test", Desc: "test hub"}, nil)
+	if st := h.Stats(); st.Name != "test" || st.Desc != "test hub" || st.Soft.Name == "" {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	loginADC(t, h, "bob")
+}
+
+func TestSetTopic(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginNMDC(t, h, "alice")
+	alice.expect("HubTopic")
+
+	h.SetTopic("new topic")
+
+	var info adc.HubInfo
+	for {
+		if p, ok := bob.expect("INF").(*adc.InfoPacket); ok {
+			if err := adc.Unmarshal(p.Data, &info); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if info.Name != "test" || info.Desc != "new topic" {
+		t.Fatalf("unexpected hub info: %+v", info)
+	}
+	if m := alice.expect("HubTopic").(*nmdc.HubTopic); m.Text != "new topic" {
+		t.Fatalf("unexpected topic: %q", m.Text)
+	}
+	if st := h.Stats(); st.Desc != "test hub" {
+		t.Fatalf("unexpected description: %q", st.Desc)
+	}
+
+	// new users receive the topic on login
+	carol := loginNMDC(t, h, "carol")
+	if m := carol.expect("HubTopic").(*nmdc.HubTopic); m.Text != "new topic" {
+		t.Fatalf("unexpected topic: %q", m.Text)
+	}
+}
+
+func TestSetName(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginNMDC(t, h, "alice")
+	alice.expect("HubTopic")
+
+	h.SetName("renamed")
+
+	var info adc.HubInfo
+	for {
+		if p, ok := bob.expect("INF").(*adc.InfoPacket); ok {
+			if err := adc.Unmarshal(p.Data, &info); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if info.Name != "renamed" || info.Desc != "test hub" {
+		t.Fatalf("unexpected hub info: %+v", info)
+	}
+	if m := alice.expect("HubName").(*nmdc.HubName); m.Name != "renamed" {
+		t.Fatalf("unexpected name: %q", m.Name)
+	}
+	if st := h.Stats(); st.Name != "renamed" {
+		t.Fatalf("unexpected name: %q", st.Name)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	h := newTestHub(t)
+	start := time.Now()
+
+	bob := dialADCFrom(t, h, &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 54321})
+	bob.handshake()
+	bob.identify(adc.User{Name: "bob", ShareSize: 1000})
+	bob.expectUser(bob.sid)
+	waitPeer(t, h, "bob")
+	loginNMDCFrom(t, h, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 54321}, nmdc.MyInfo{
+		Name: "alice", ShareSize: 2000, Client: "client", Version: "2.0",
+	})
+
+	list := h.ListUsers()
+	if len(list) != 2 {
+		t.Fatalf("unexpected users: %+v", list)
+	}
+	for _, u := range list {
+		if u.Connected.Before(start) || u.Connected.After(time.Now()) {
+			t.Fatalf("unexpected connect time: %v", u.Connected)
+		}
+	}
+	alice, bobu := list[0], list[1]
+	if alice.Name != "alice" || alice.IP.String() != "2001:db8::1" || alice.Share != 2000 ||
+		alice.Client != (Software{Name: "client", Vers: "2.0"}) {
+		t.Fatalf("unexpected snapshot: %+v", alice)
+	}
+	if bobu.Name != "bob" || bobu.IP.String() != "1.2.3.4" || bobu.Share != 1000 ||
+		bobu.Client != (Software{Name: "test", Vers: "1.0"}) {
+		t.Fatalf("unexpected snapshot: %+v", bobu)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginNMDC(t, h, "alice")
+
+	h.Broadcast("hub restarts in 5 minutes")
+
+	p, ok := bob.expect("MSG").(*adc.InfoPacket)
+	if !ok {
+		t.Fatalf("expected message from the hub, got: %#v", p)
+	}
+	var m adc.ChatMessage
+	if err := adc.Unmarshal(p.Data, &m); err != nil {
+		t.Fatal(err)
+	} else if m.Text != "hub restarts in 5 minutes" {
+		t.Fatalf("unexpected message: %q", m.Text)
+	}
+	m2 := alice.expect("").(*nmdc.ChatMessage)
+	if m2.Name != "" || m2.Text != "hub restarts in 5 minutes" {
+		t.Fatalf("unexpected message: %+v", m2)
+	}
+}
+
+func TestOpChat(t *testing.T) {
+	acc := newTestAccounts(t)
+	if err := acc.SetAccount("alice", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.SetAccount("carol", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Name: "test", Accounts: acc})
+	bob := loginADC(t, h, "bob")
+	alice := loginNMDCPass(t, h, nil, nmdc.MyInfo{Name: "alice"}, "secret")
+	carol := loginNMDCPass(t, h, nil, nmdc.MyInfo{Name: "carol"}, "secret")
+	dave := loginNMDC(t, h, "dave")
+
+	h.OpChat(h.byName("alice"), "ops only")
+	h.broadcastChat(h.byName("bob"), "everyone", nil)
+
+	m := alice.expect("").(*nmdc.ChatMessage)
+	if m.Name != "alice" || m.Text != "ops only" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	for _, c := range []*testNMDC{carol, dave} {
+		if m := c.expect("").(*nmdc.ChatMessage); m.Text != "everyone" {
+			t.Fatalf("unexpected message: %+v", m)
+		}
+	}
+	var text string
+	for text != "everyone" {
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(bob.expect("MSG").Message().Data, &m); err != nil {
+			t.Fatal(err)
+		}
+		text = string(m.Text)
+		if text == "ops only" {
+			t.Fatal("regular user received the op chat")
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	h := newTestHub(t)
+	select {
+	case <-h.Ready():
+		t.Fatal("hub is not listening yet")
+	default:
+	}
+	if addr := h.Addr(); addr != nil {
+		t.Fatalf("unexpected address: %v", addr)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- h.ListenAndServe("127.0.0.1:0")
+	}()
+	select {
+	case <-h.Ready():
+	case err := <-errc:
+		t.Fatal(err)
+	case <-time.After(testTimeout):
+		t.Fatal("timeout")
+	}
+	addrs := h.Addrs()
+	if len(addrs) != 1 {
+		t.Fatalf("unexpected addresses: %v", addrs)
+	}
+	addr, ok := h.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 || addr.String() != addrs[0].String() {
+		t.Fatalf("unexpected address: %v", h.Addr())
+	}
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := newTestADC(t, conn)
+	c.handshake()
+	c.identify(adc.User{Name: "bob"})
+	c.expectUser(c.sid)
+}
+
+func TestListenUnix(t *testing.T) {
+	h := newTestHub(t)
+	path := filepath.Join(t.TempDir(), "hub.sock")
+
+	// stale socket from a previous run
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- h.ListenAndServe("unix:" + path)
+	}()
+	select {
+	case <-h.Ready():
+	case err := <-errc:
+		t.Fatal(err)
+	case <-time.After(testTimeout):
+		t.Fatal("timeout")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := newTestADC(t, conn)
+	c.handshake()
+	c.identify(adc.User{Name: "bob"})
+	c.expectUser(c.sid)
+	waitPeer(t, h, "bob")
+
+	if err = h.StopListening(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-errc:
+		if err != ErrListenerClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timeout")
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file is not removed: %v", err)
+	}
+}
+
+// tempError is a temporary accept error, like EMFILE.
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// testListener returns results of Accept from a channel.
+type testListener struct {
+	accept chan net.Conn
+	errs   chan error
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	}
+}
+
+func (l *testListener) Close() error   { return nil }
+func (l *testListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 411} }
+
+func TestAcceptTemporaryError(t *testing.T) {
+	h := newTestHub(t)
+	lis := &testListener{accept: make(chan net.Conn), errs: make(chan error)}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- h.acceptLoop(lis)
+	}()
+	for i := 0; i < 3; i++ {
+		lis.errs <- tempError{}
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	lis.accept <- c2
+	c := newTestADC(t, c1)
+	c.handshake()
+	c.identify(adc.User{Name: "bob"})
+	c.expectUser(c.sid)
+
+	errFatal := errors.New("listener failed")
+	lis.errs <- errFatal
+	select {
+	case err := <-errc:
+		if err != errFatal {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timeout")
+	}
+}
+
+func TestListenAndServeAllErrors(t *testing.T) {
+	h := newTestHub(t)
+	dir := filepath.Join(t.TempDir(), "missing")
+	addrs := []string{"unix:" + filepath.Join(dir, "a.sock"), "unix:" + filepath.Join(dir, "b.sock")}
+	err := h.ListenAndServeAll(addrs)
+	list, ok := err.(MultiError)
+	if !ok || len(list) != 2 {
+		t.Fatalf("expected two errors, got: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, err := range list {
+		var e *ListenError
+		if !errors.As(err, &e) {
+			t.Fatalf("unexpected error: %#v", err)
+		}
+		seen[e.Addr] = true
+	}
+	if !seen[addrs[0]] || !seen[addrs[1]] {
+		t.Fatalf("unexpected errors: %v", err)
+	}
+}
+
+func TestServeForeignProtocol(t *testing.T) {
+	h := newTestHub(t)
+	serve := func(fnc func(net.Conn) error, data string) error {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		go func() {
+			_, _ = c1.Write([]byte(data))
+		}()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- fnc(c2)
+		}()
+		select {
+		case err := <-errc:
+			return err
+		case <-time.After(testTimeout):
+			t.Fatal("timeout")
+		}
+		return nil
+	}
+	for _, c := range []struct {
+		name string
+		data string
+	}{
+		{"http", "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"},
+		{"tls", "\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03"},
+		{"ssh", "SSH-2.0-OpenSSH_8.0\r\n"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := serve(h.Serve, c.data); err != ErrNotDC {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := serve(h.ServeADC, c.data); err != ErrNotDC {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+	// genuine protocol errors are still reported
+	if err := serve(h.Serve, "HELLO\n"); err == nil || err == ErrNotDC {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := serve(h.ServeADC, "HINF\n"); err == nil || err == ErrNotDC {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNextSID(t *testing.T) {
+	sids := []adc.SID{types.SIDFromInt(1000), types.SIDFromInt(2000)}
+	var (
+		mu   sync.Mutex
+		next int
+	)
+	h := New(Config{Name: "test", NextSID: func() adc.SID {
+		mu.Lock()
+		defer mu.Unlock()
+		sid := sids[next]
+		next++
+		return sid
+	}})
+	bob := loginADC(t, h, "bob")
+	if bob.sid != sids[0] {
+		t.Fatalf("unexpected SID: %v", bob.sid)
+	}
+	alice := loginADC(t, h, "alice")
+	if alice.sid != sids[1] {
+		t.Fatalf("unexpected SID: %v", alice.sid)
+	}
+	bob.expectUser(sids[1])
+	// custom SIDs are only counted while in use
+	if st := h.Stats(); st.SIDs != 2 {
+		t.Fatalf("unexpected SID count: %d", st.SIDs)
+	}
+}
+
+func TestSIDUsage(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	const n = 50
+	for i := 0; i < n; i++ {
+		c := loginADC(t, h, "user"+strconv.Itoa(i))
+		_ = c.conn.Close()
+		bob.expectQuit(c.sid)
+	}
+	st := h.Stats()
+	// SIDs are not reused, users that left are counted as well
+	if st.Users != 1 || st.SIDs != n+1 {
+		t.Fatalf("unexpected SID count: %d (users: %d)", st.SIDs, st.Users)
+	}
+	if exp := float64(n+1) / sidSpace; st.SIDUsage != exp {
+		t.Fatalf("unexpected SID usage: %v vs %v", st.SIDUsage, exp)
+	}
+}
+
+// panicPeer is a fake peer that panics when notified about other users.
+type panicPeer struct {
+	*botPeer
+}
+
+func (p *panicPeer) PeersJoin(peers []Peer) error {
+	panic("broken encoder")
+}
+
+func (p *panicPeer) PeersLeave(peers []Peer, reason string) error {
+	panic("broken encoder")
+}
+
+func (p *panicPeer) Close() error {
+	p.hub.leave(p, p.sid, p.name, "", nil)
+	return nil
+}
+
+// addPanicPeer adds a fake peer to the hub without announcing it.
+func addPanicPeer(h *Hub, name string) *panicPeer {
+	p := &panicPeer{&botPeer{
+		BasePeer: BasePeer{hub: h, addr: botAddr{}, sid: h.nextSID(), created: h.now()},
+		name:     name,
+	}}
+	h.peers.Lock()
+	h.peers.byName[p.name] = p
+	h.peers.bySID[p.sid] = p
+	h.peers.Unlock()
+	return p
+}
+
+func TestBroadcastPanic(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+
+	bad := addPanicPeer(h, "bad1")
+	alice := loginADC(t, h, "alice")
+	// the broken peer is disconnected in the middle of the broadcast, so the order may vary
+	joined, left := false, false
+	for !joined || !left {
+		p := bob.next()
+		switch p.Message().Type.String() {
+		case "INF":
+			joined = joined || p.(*adc.BroadcastPacket).ID == alice.sid
+		case "QUI":
+			var m adc.Disconnect
+			if err := adc.Unmarshal(p.Message().Data, &m); err != nil {
+				t.Fatal(err)
+			}
+			left = left || m.ID == bad.sid
+		}
+	}
+	if h.byName(bad.name) != nil {
+		t.Fatal("panicking peer is still on the hub")
+	}
+
+	bad = addPanicPeer(h, "bad2")
+	_ = alice.conn.Close()
+	quits := map[adc.SID]bool{alice.sid: true, bad.sid: true}
+	for len(quits) != 0 {
+		var m adc.Disconnect
+		if err := adc.Unmarshal(bob.expect("QUI").Message().Data, &m); err != nil {
+			t.Fatal(err)
+		}
+		delete(quits, m.ID)
+	}
+	if h.byName(bad.name) != nil {
+		t.Fatal("panicking peer is still on the hub")
+	}
+}
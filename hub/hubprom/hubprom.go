@@ -0,0 +1,62 @@
+// Package hubprom exports hub metrics with the Prometheus client library.
+//
+// The package is a separate module, so the hub doesn't depend on the Prometheus client.
+package hubprom
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+// NewCollector returns a Prometheus collector that exports hub metrics. The metric names
+// are the same as served by hub.PrometheusHandler, and are considered stable.
+func NewCollector(h *hub.Hub) prometheus.Collector {
+	return &collector{hub: h, descs: make(map[string]*prometheus.Desc)}
+}
+
+type collector struct {
+	hub *hub.Hub
+
+	// descs caches descriptors by metric name; they never change for a given name
+	mu    sync.Mutex
+	descs map[string]*prometheus.Desc
+}
+
+// Describe implements prometheus.Collector.
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	c.hub.CollectMetrics(func(m hub.Metric) {
+		typ := prometheus.GaugeValue
+		if m.Type == "counter" {
+			typ = prometheus.CounterValue
+		}
+		var labels []string
+		if m.Label != "" {
+			labels = []string{m.LabelValue}
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc(m), typ, m.Value, labels...)
+	})
+}
+
+// desc returns the descriptor of the metric.
+func (c *collector) desc(m hub.Metric) *prometheus.Desc {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.descs[m.Name]
+	if !ok {
+		var labels []string
+		if m.Label != "" {
+			labels = []string{m.Label}
+		}
+		d = prometheus.NewDesc(m.Name, m.Help, labels, nil)
+		c.descs[m.Name] = d
+	}
+	return d
+}
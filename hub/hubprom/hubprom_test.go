@@ -0,0 +1,52 @@
+package hubprom
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/direct-connect/go-dcpp/hub"
+	"github.com/direct-connect/go-dcpp/hub/hubtest"
+)
+
+func TestCollector(t *testing.T) {
+	h := hubtest.New(t, hub.Config{})
+	alice := h.LoginADC("alice")
+	h.LoginADC("bob")
+	alice.SendChat("hi")
+	alice.ExpectChat("hi")
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(NewCollector(h.Hub)); err != nil {
+		t.Fatal(err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			name := f.GetName()
+			for _, l := range m.GetLabel() {
+				name += "{" + l.GetName() + "=" + l.GetValue() + "}"
+			}
+			if g := m.GetGauge(); g != nil {
+				values[name] = g.GetValue()
+			} else if c := m.GetCounter(); c != nil {
+				values[name] = c.GetValue()
+			}
+		}
+	}
+	for name, exp := range map[string]float64{
+		"dc_hub_users":                         2,
+		"dc_hub_protocol_users{protocol=adc}":  2,
+		"dc_hub_protocol_users{protocol=nmdc}": 0,
+		"dc_hub_chat_messages_total":           1,
+		"dc_hub_logins_total":                  2,
+	} {
+		if v, ok := values[name]; !ok || v != exp {
+			t.Errorf("unexpected value of %s: %v (%v)", name, v, ok)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Package hubtest provides an in-memory harness for testing the hub and its clients.
+//
+// The hub is served over net.Pipe, so tests do not need to open real sockets.
+package hubtest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/adc/types"
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+// Timeout is the time the helpers wait for the hub to respond before failing the test.
+const Timeout = 5 * time.Second
+
+// Hub is a hub that serves in-memory connections.
+type Hub struct {
+	*hub.Hub
+	t testing.TB
+}
+
+// New creates a new hub for the test. If the name is not set in the config, "test" is used.
+func New(t testing.TB, conf hub.Config) *Hub {
+	if conf.Name == "" {
+		conf.Name = "test"
+	}
+	return &Hub{Hub: hub.New(conf), t: t}
+}
+
+// Dial connects to the hub using an in-memory connection.
+// The connection is closed when the test ends.
+func (h *Hub) Dial() net.Conn {
+	c1, c2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := h.Serve(c2); err != nil {
+			h.t.Log(err)
+		}
+	}()
+	h.t.Cleanup(func() {
+		_ = c1.Close()
+		<-done
+	})
+	return c1
+}
+
+// WaitUser waits until the user with a given name is accepted by the hub.
+func (h *Hub) WaitUser(name string) hub.Peer {
+	deadline := time.Now().Add(Timeout)
+	for time.Now().Before(deadline) {
+		if p := h.PeerByNick(name); p != nil {
+			return p
+		}
+		time.Sleep(time.Millisecond)
+	}
+	h.t.Fatalf("timeout waiting for %q", name)
+	return nil
+}
+
+// Client is an ADC client connected to the hub.
+// Packets from the hub are read in background and can be received with Next or Expect.
+type Client struct {
+	Conn *adc.Conn
+	SID  adc.SID
+	PID  adc.PID
+
+	t    testing.TB
+	recv chan adc.Packet
+}
+
+// DialADC connects to the hub over ADC without completing the handshake.
+func (h *Hub) DialADC() *Client {
+	conn, err := adc.NewConn(h.Dial())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	c := &Client{Conn: conn, t: h.t, recv: make(chan adc.Packet, 100)}
+	go func() {
+		defer close(c.recv)
+		for {
+			p, err := conn.ReadPacket(time.Time{})
+			if err != nil {
+				return
+			}
+			c.recv <- p
+		}
+	}()
+	return c
+}
+
+// LoginADC connects to the hub and logs in with a given name.
+func (h *Hub) LoginADC(name string) *Client {
+	c := h.DialADC()
+	c.Handshake()
+	c.Identify(adc.User{Name: name})
+	c.ExpectUser(c.SID)
+	h.WaitUser(name)
+	return c
+}
+
+// Handshake sends the SUP with BASE, TIGR and a given features, and waits for the SID.
+func (c *Client) Handshake(features ...adc.Feature) {
+	sup := adc.ModFeatures{
+		adc.FeaBASE: true,
+		adc.FeaTIGR: true,
+	}
+	for _, f := range features {
+		sup[f] = true
+	}
+	c.write(func() error {
+		return c.Conn.WriteHubMsg(adc.Supported{Features: sup})
+	})
+	for {
+		p, ok := c.Next().(*adc.InfoPacket)
+		if !ok {
+			continue
+		}
+		if p.Name == (adc.SIDAssign{}).Cmd() {
+			var m adc.SIDAssign
+			if err := adc.Unmarshal(p.Data, &m); err != nil {
+				c.t.Fatal(err)
+			}
+			c.SID = m.SID
+			return
+		}
+	}
+}
+
+// Identify sends the user info. Required fields and the PID are filled automatically, if not set.
+func (c *Client) Identify(u adc.User) {
+	if u.Id.IsZero() {
+		c.PID = types.NewPID()
+		u.Pid = &c.PID
+		u.Id = c.PID.Hash()
+	}
+	if u.Version == "" {
+		u.Application, u.Version = "test", "1.0"
+	}
+	if u.Features == nil {
+		u.Features = adc.ExtFeatures{adc.FeaTCP4}
+	}
+	c.write(func() error {
+		return c.Conn.WriteBroadcast(c.SID, u)
+	})
+}
+
+// SendChat sends a message to the main chat.
+func (c *Client) SendChat(text string) {
+	c.write(func() error {
+		return c.Conn.WriteBroadcast(c.SID, adc.ChatMessage{Text: adc.String(text)})
+	})
+}
+
+// Search broadcasts a search request.
+func (c *Client) Search(req adc.SearchRequest) {
+	c.write(func() error {
+		return c.Conn.WriteBroadcast(c.SID, req)
+	})
+}
+
+// SendResult sends a search result to a given user.
+func (c *Client) SendResult(to adc.SID, res adc.SearchResult) {
+	c.write(func() error {
+		return c.Conn.WriteDirect(c.SID, to, res)
+	})
+}
+
+func (c *Client) write(fnc func() error) {
+	err := fnc()
+	if err == nil {
+		err = c.Conn.Flush()
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Next returns the next packet received from the hub.
+func (c *Client) Next() adc.Packet {
+	select {
+	case p, ok := <-c.recv:
+		if !ok {
+			c.t.Fatal("connection closed")
+		}
+		return p
+	case <-time.After(Timeout):
+		c.t.Fatal("timeout")
+	}
+	return nil
+}
+
+// Expect skips packets until the one with a given command name (e.g. "MSG") is received.
+func (c *Client) Expect(cmd string) adc.Packet {
+	for {
+		p := c.Next()
+		if p.Message().Type.String() == cmd {
+			return p
+		}
+	}
+}
+
+// ExpectUser skips packets until the INF of a given user is received.
+func (c *Client) ExpectUser(sid adc.SID) adc.User {
+	for {
+		b, ok := c.Expect("INF").(*adc.BroadcastPacket)
+		if !ok || b.ID != sid {
+			continue
+		}
+		var u adc.User
+		if err := adc.Unmarshal(b.Data, &u); err != nil {
+			c.t.Fatal(err)
+		}
+		return u
+	}
+}
+
+// ExpectChat skips packets until the main chat message with a given text is received,
+// and returns the SID of the sender. Zero SID means that the message was sent by the hub.
+func (c *Client) ExpectChat(text string) adc.SID {
+	for {
+		p := c.Expect("MSG")
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(p.Message().Data, &m); err != nil {
+			c.t.Fatal(err)
+		}
+		if string(m.Text) != text {
+			continue
+		}
+		if b, ok := p.(*adc.BroadcastPacket); ok {
+			return b.ID
+		}
+		return adc.SID{}
+	}
+}
+
+// ExpectSearch skips packets until the search request is received and returns the SID of the sender.
+func (c *Client) ExpectSearch() (adc.SID, adc.SearchRequest) {
+	for {
+		b, ok := c.Expect("SCH").(*adc.BroadcastPacket)
+		if !ok {
+			continue
+		}
+		var req adc.SearchRequest
+		if err := adc.Unmarshal(b.Data, &req); err != nil {
+			c.t.Fatal(err)
+		}
+		return b.ID, req
+	}
+}
+
+// ExpectResult skips packets until the search result is received and returns the SID of the sender.
+func (c *Client) ExpectResult() (adc.SID, adc.SearchResult) {
+	for {
+		d, ok := c.Expect("RES").(*adc.DirectPacket)
+		if !ok {
+			continue
+		}
+		var res adc.SearchResult
+		if err := adc.Unmarshal(d.Data, &res); err != nil {
+			c.t.Fatal(err)
+		}
+		return d.ID, res
+	}
+}
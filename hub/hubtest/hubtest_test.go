@@ -0,0 +1,39 @@
+package hubtest_test
+
+import (
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/hub"
+	"github.com/direct-connect/go-dcpp/hub/hubtest"
+)
+
+func TestChatFanOut(t *testing.T) {
+	h := hubtest.New(t, hub.Config{})
+	alice := h.LoginADC("alice")
+	bob := h.LoginADC("bob")
+	carol := h.LoginADC("carol")
+
+	alice.SendChat("hello")
+	for _, c := range []*hubtest.Client{alice, bob, carol} {
+		if from := c.ExpectChat("hello"); from != alice.SID {
+			t.Fatalf("unexpected sender: %v", from)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	h := hubtest.New(t, hub.Config{})
+	alice := h.LoginADC("alice")
+	bob := h.LoginADC("bob")
+
+	alice.Search(adc.SearchRequest{Token: "1", And: []string{"file"}})
+	from, req := bob.ExpectSearch()
+	if from != alice.SID || req.Token != "1" {
+		t.Fatalf("unexpected search: %v %+v", from, req)
+	}
+	bob.SendResult(from, adc.SearchResult{Token: req.Token, Path: "/file", Size: 1})
+	if from, res := alice.ExpectResult(); from != bob.SID || res.Path != "/file" {
+		t.Fatalf("unexpected result: %v %+v", from, res)
+	}
+}
@@ -0,0 +1,146 @@
+package hub
+
+import (
+	"bytes"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// maxInfoTransforms limits the number of info transforms, so a set of them fits into a bit mask.
+const maxInfoTransforms = 64
+
+// infoTransform changes the ADC user info sent to some of the recipients.
+//
+// Most recipients receive the same info, so transforms are split into a cheap check that selects
+// recipients and a rewrite of the info fields. The rewrite is done once for each distinct set
+// of transforms, not for each recipient.
+type infoTransform struct {
+	// applies checks if the info of the peer must be changed for a given recipient.
+	applies func(to, from Peer) bool
+	// apply rewrites raw INF fields. The info may be partial, if the user sends an update.
+	// The data of the fields is shared and must not be modified.
+	apply func(fields [][]byte) [][]byte
+}
+
+// addInfoTransform registers the info transform. It must only be called before the hub starts serving users.
+func (h *Hub) addInfoTransform(t infoTransform) {
+	if len(h.infoTransforms) >= maxInfoTransforms {
+		panic("too many info transforms")
+	}
+	h.infoTransforms = append(h.infoTransforms, t)
+}
+
+// infoMask returns the set of transforms for the info of one peer sent to another.
+// Zero means the info is sent unchanged.
+func (h *Hub) infoMask(to, from Peer) uint64 {
+	var mask uint64
+	for i, t := range h.infoTransforms {
+		if t.applies(to, from) {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask
+}
+
+// transformInfo applies the set of transforms to the raw INF data.
+func (h *Hub) transformInfo(mask uint64, data []byte) []byte {
+	fields := bytes.Split(data, []byte(" "))
+	for i, t := range h.infoTransforms {
+		if mask&(1<<uint(i)) != 0 {
+			fields = t.apply(fields)
+		}
+	}
+	return bytes.Join(fields, []byte(" "))
+}
+
+// removeFields returns the INF fields without the fields with given names. Empty fields are also removed.
+func removeFields(fields [][]byte, names ...string) [][]byte {
+	out := make([][]byte, 0, len(fields))
+	for _, f := range fields {
+		skip := len(f) == 0
+		for _, name := range names {
+			if bytes.HasPrefix(f, []byte(name)) {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// infoVariants encodes each variant of the user info broadcast once.
+type infoVariants struct {
+	h     *Hub
+	from  Peer
+	p     *adc.BroadcastPacket
+	cache map[uint64]*adc.BroadcastPacket
+}
+
+func (h *Hub) newInfoVariants(p *adc.BroadcastPacket, from Peer) *infoVariants {
+	return &infoVariants{h: h, from: from, p: p}
+}
+
+// packetFor returns the info packet for a given recipient. It returns nil if nothing is left to send.
+func (v *infoVariants) packetFor(to Peer) *adc.BroadcastPacket {
+	mask := v.h.infoMask(to, v.from)
+	if mask == 0 {
+		return v.p
+	}
+	if p, ok := v.cache[mask]; ok {
+		return p
+	}
+	if v.cache == nil {
+		v.cache = make(map[uint64]*adc.BroadcastPacket)
+	}
+	var p *adc.BroadcastPacket
+	if data := v.h.transformInfo(mask, v.p.Data); len(data) != 0 {
+		cp := *v.p
+		cp.Data = data
+		p = &cp
+	}
+	v.cache[mask] = p
+	return p
+}
+
+// hideIPs removes IP addresses from the info sent to users that are not allowed to see them.
+var hideIPs = infoTransform{
+	applies: func(to, from Peer) bool {
+		p, ok := to.(interface{ seesIPs() bool })
+		return to != from && ok && !p.seesIPs()
+	},
+	apply: func(fields [][]byte) [][]byte {
+		return removeFields(fields, "I4", "I6")
+	},
+}
+
+// identityFields are the info fields that identify the user. They are never removed by allowFields.
+var identityFields = []string{"ID", "NI", "CT"}
+
+// allowFields keeps only the listed info fields in the info sent to regular users.
+func allowFields(names []string) infoTransform {
+	allowed := make(map[string]bool, len(names)+len(identityFields))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	for _, name := range identityFields {
+		allowed[name] = true
+	}
+	return infoTransform{
+		applies: func(to, from Peer) bool {
+			p, ok := to.(interface{ seesFullInfo() bool })
+			return to != from && ok && !p.seesFullInfo()
+		},
+		apply: func(fields [][]byte) [][]byte {
+			out := make([][]byte, 0, len(fields))
+			for _, f := range fields {
+				if len(f) >= 2 && allowed[string(f[:2])] {
+					out = append(out, f)
+				}
+			}
+			return out
+		},
+	}
+}
@@ -0,0 +1,108 @@
+package hub
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// discardConn is a connection that drops all writes.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) {
+	return ioutil.Discard.Write(p)
+}
+
+func infoPacket(from adc.SID, data string) *adc.BroadcastPacket {
+	return &adc.BroadcastPacket{
+		ID:         from,
+		BasePacket: adc.BasePacket{Name: (adc.User{}).Cmd(), Data: []byte(data)},
+	}
+}
+
+func TestInfoVariants(t *testing.T) {
+	h := New(Config{Name: "test", HideIPs: true})
+	from := &adcPeer{BasePeer: BasePeer{hub: h, sid: h.nextSID()}}
+	user := &adcPeer{BasePeer: BasePeer{hub: h, sid: h.nextSID()}}
+	op := &adcPeer{BasePeer: BasePeer{hub: h, sid: h.nextSID(), op: true}}
+	user2 := &adcPeer{BasePeer: BasePeer{hub: h, sid: h.nextSID()}}
+
+	p := infoPacket(from.sid, "SS100 I41.2.3.4 I6::1")
+	v := h.newInfoVariants(p, from)
+	if v.packetFor(from) != p || v.packetFor(op) != p {
+		t.Fatal("expected the original packet")
+	}
+	hidden := v.packetFor(user)
+	if hidden == p || string(hidden.Data) != "SS100" || hidden.ID != from.sid {
+		t.Fatalf("unexpected packet: %+v", hidden)
+	}
+	if v.packetFor(user2) != hidden {
+		t.Fatal("the variant should be encoded once")
+	}
+	if string(p.Data) != "SS100 I41.2.3.4 I6::1" {
+		t.Fatalf("original packet was modified: %q", p.Data)
+	}
+
+	// nothing is left to send
+	v = h.newInfoVariants(infoPacket(from.sid, "I41.2.3.5"), from)
+	if p := v.packetFor(user); p != nil {
+		t.Fatalf("unexpected packet: %+v", p)
+	}
+}
+
+func TestInfoFields(t *testing.T) {
+	h := New(Config{Name: "test", InfoFields: []string{"SS", "VE"}})
+	from := &adcPeer{BasePeer: BasePeer{hub: h, sid: h.nextSID()}}
+	user := &adcPeer{BasePeer: BasePeer{hub: h, sid: h.nextSID()}}
+	op := &adcPeer{BasePeer: BasePeer{hub: h, sid: h.nextSID(), op: true}}
+
+	const full = "IDAAAA NIbob CT0 SS100 SL3 EMbob@example.com VEtest SUTCP4"
+	p := infoPacket(from.sid, full)
+	v := h.newInfoVariants(p, from)
+	if v.packetFor(from) != p || v.packetFor(op) != p {
+		t.Fatal("expected the original packet")
+	}
+	if p := v.packetFor(user); p == nil || string(p.Data) != "IDAAAA NIbob CT0 SS100 VEtest" {
+		t.Fatalf("unexpected packet: %+v", p)
+	}
+
+	// updates with stripped fields only are not sent
+	v = h.newInfoVariants(infoPacket(from.sid, "EMnew@example.com SL4"), from)
+	if p := v.packetFor(user); p != nil {
+		t.Fatalf("unexpected packet: %+v", p)
+	}
+}
+
+func benchmarkADCBroadcastInfo(b *testing.B, conf Config) {
+	h := New(conf)
+	peers := make([]Peer, 100)
+	for i := range peers {
+		c, err := adc.NewConn(discardConn{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		peers[i] = &adcPeer{
+			BasePeer: BasePeer{hub: h, sid: h.nextSID(), op: i%10 == 0},
+			conn:     c,
+		}
+	}
+	p := infoPacket(peers[0].SID(), "SS100 SF10 I41.2.3.4 VEtest\\s1.0")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.adcBroadcast(p, peers[0], peers)
+	}
+}
+
+func BenchmarkADCBroadcastInfo(b *testing.B) {
+	b.Run("plain", func(b *testing.B) {
+		benchmarkADCBroadcastInfo(b, Config{Name: "test"})
+	})
+	b.Run("hide ips", func(b *testing.B) {
+		benchmarkADCBroadcastInfo(b, Config{Name: "test", HideIPs: true})
+	})
+}
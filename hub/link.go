@@ -0,0 +1,388 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/adc/types"
+	"github.com/direct-connect/go-dcpp/tiger"
+)
+
+var _ Peer = (*linkPeer)(nil)
+
+// linkOriginField is a custom field of the chat message that holds the name of the hub
+// where the message was sent originally. It is used to prevent relaying the message back.
+const linkOriginField = "OR"
+
+// linkPeer is a virtual user that represents a linked hub.
+//
+// The hub connects to the linked hub as an ADC client. Main chat of the linked hub is relayed
+// to local users on behalf of this peer, and local main chat is sent to the linked hub.
+type linkPeer struct {
+	BasePeer
+	name string // name of the linked hub
+	cid  adc.CID
+
+	conn *adc.Conn
+	rsid adc.SID // SID of the link on the remote hub
+
+	mu    sync.Mutex
+	users map[adc.SID]string // names of remote users
+}
+
+// Link connects to another hub and starts relaying the main chat in both directions.
+// The address is an ADC URL, for example adcs://example.com:1511.
+//
+// The link is a user on the other hub, named after this hub and marked with the hub user type.
+// Linked hubs must have distinct names, since the name tags relayed messages. Messages are only
+// relayed between hubs that are linked directly and never forwarded to a third hub, so hubs can be
+// linked in any topology, including rings, without duplicate messages. A single link relays messages
+// in both directions, thus two hubs should not link to each other.
+func (h *Hub) Link(addr string) error {
+	c, err := adc.Dial(addr)
+	if err != nil {
+		return err
+	}
+	return h.link(c)
+}
+
+// LinkConn is the same as Link, but uses an existing connection to the other hub.
+func (h *Hub) LinkConn(conn net.Conn) error {
+	c, err := adc.NewConn(conn)
+	if err != nil {
+		return err
+	}
+	return h.link(c)
+}
+
+func (h *Hub) link(c *adc.Conn) error {
+	l, err := h.linkHandshake(c)
+	if err != nil {
+		_ = c.Close()
+		return err
+	}
+	h.peers.Lock()
+	if _, ok := h.peers.byName[l.name]; ok {
+		h.peers.Unlock()
+		_ = c.Close()
+		return fmt.Errorf("cannot link %q: %v", l.name, errNickTaken)
+	}
+	l.sid = h.nextSID()
+	h.peers.byName[l.name] = l
+	h.peers.bySID[l.sid] = l
+	h.updateCounters(l, +1)
+	notify := h.listPeers()
+	h.peers.Unlock()
+
+	h.broadcastUserJoin(l, notify)
+	go func() {
+		err := h.serveLink(l)
+		if err != nil {
+			log.Printf("%s: link %q: %v", l.RemoteAddr(), l.name, err)
+		}
+		_ = l.Close()
+	}()
+	return nil
+}
+
+// linkHandshake logs into the other hub and waits until the link is accepted.
+func (h *Hub) linkHandshake(c *adc.Conn) (*linkPeer, error) {
+	conf := h.config()
+	deadline := time.Now().Add(conf.LoginTimeout)
+	err := c.WriteHubMsg(adc.Supported{Features: adc.ModFeatures{adc.FeaBASE: true, adc.FeaTIGR: true}})
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &linkPeer{
+		BasePeer: BasePeer{
+			hub:     h,
+			addr:    c.RemoteAddr(),
+			created: h.now(),
+		},
+		conn:  c,
+		users: make(map[adc.SID]string),
+	}
+	// the hub sends SUP and SID
+	for l.rsid == (adc.SID{}) {
+		p, err := c.ReadPacket(deadline)
+		if err != nil {
+			return nil, err
+		}
+		ip, ok := p.(*adc.InfoPacket)
+		if !ok {
+			return nil, fmt.Errorf("unexpected packet during link: %s", adc.FourCC(p))
+		}
+		switch ip.Name {
+		case (adc.SIDAssign{}).Cmd():
+			var m adc.SIDAssign
+			if err = adc.Unmarshal(ip.Data, &m); err != nil {
+				return nil, err
+			}
+			l.rsid = m.SID
+		case (adc.Status{}).Cmd():
+			var st adc.Status
+			if err = adc.Unmarshal(ip.Data, &st); err == nil && !st.Ok() {
+				return nil, st.Err()
+			}
+		}
+	}
+	pid := types.NewPID()
+	err = c.WriteBroadcast(l.rsid, adc.User{
+		Name:        conf.Name,
+		Id:          pid.Hash(),
+		Pid:         &pid,
+		Application: conf.Soft.Name,
+		Version:     conf.Soft.Vers,
+		Type:        adc.UserTypeHub,
+	})
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// wait for the hub info and the user list, which ends with our own info
+	for {
+		p, err := c.ReadPacket(deadline)
+		if err != nil {
+			return nil, err
+		}
+		switch p := p.(type) {
+		case *adc.BroadcastPacket:
+			if p.Name != (adc.User{}).Cmd() {
+				continue
+			}
+			if p.ID != l.rsid {
+				l.updateUser(p.ID, p.Data)
+				continue
+			}
+			if l.name == "" {
+				return nil, errors.New("linked hub has no name")
+			}
+			l.cid = adc.CID(tiger.HashBytes([]byte("link\x00" + l.name)))
+			return l, nil
+		case *adc.InfoPacket:
+			if p.Name == (adc.HubInfo{}).Cmd() {
+				var m adc.HubInfo
+				if err = adc.Unmarshal(p.Data, &m); err != nil {
+					return nil, err
+				}
+				l.name = m.Name
+			} else if p.Name == (adc.Status{}).Cmd() {
+				var st adc.Status
+				if err = adc.Unmarshal(p.Data, &st); err == nil && !st.Ok() {
+					return nil, st.Err()
+				}
+			} else if p.Name == (adc.Disconnect{}).Cmd() {
+				var m adc.Disconnect
+				if err = adc.Unmarshal(p.Data, &m); err == nil && m.ID == l.rsid {
+					return nil, fmt.Errorf("link refused: %s", m.Message)
+				}
+			}
+		}
+	}
+}
+
+// serveLink relays the main chat of the linked hub to local users.
+func (h *Hub) serveLink(l *linkPeer) error {
+	l.conn.KeepAlive(time.Minute / 2)
+	for {
+		p, err := l.conn.ReadPacket(time.Time{})
+		if err != nil {
+			return err
+		}
+		switch p := p.(type) {
+		case *adc.BroadcastPacket:
+			if p.ID == l.rsid {
+				continue
+			}
+			switch p.Name {
+			case (adc.User{}).Cmd():
+				l.updateUser(p.ID, p.Data)
+			case (adc.ChatMessage{}).Cmd():
+				origin := linkOrigin(p.Data)
+				if origin == h.config().Name {
+					// our own message that was relayed back
+					continue
+				} else if origin == "" {
+					origin = l.name
+				}
+				var msg adc.ChatMessage
+				if err := adc.Unmarshal(p.Data, &msg); err != nil {
+					continue
+				}
+				l.mu.Lock()
+				name := l.users[p.ID]
+				l.mu.Unlock()
+				h.linkRelay(l, origin, "<"+name+"> "+string(msg.Text))
+			}
+		case *adc.InfoPacket:
+			if p.Name != (adc.Disconnect{}).Cmd() {
+				continue
+			}
+			var m adc.Disconnect
+			if err := adc.Unmarshal(p.Data, &m); err != nil {
+				continue
+			}
+			if m.ID == l.rsid {
+				return fmt.Errorf("link closed: %s", m.Message)
+			}
+			l.mu.Lock()
+			delete(l.users, m.ID)
+			l.mu.Unlock()
+		}
+	}
+}
+
+// linkRelay sends the message from the linked hub to local users.
+func (h *Hub) linkRelay(l *linkPeer, origin, text string) {
+	data, err := linkChatData(text, origin)
+	if err != nil {
+		return
+	}
+	p := &adc.BroadcastPacket{
+		ID:         l.sid,
+		BasePacket: adc.BasePacket{Name: (adc.ChatMessage{}).Cmd(), Data: data},
+	}
+	h.adcBroadcast(p, l, localPeers(append(h.Peers(), h.viewerList()...)))
+}
+
+// isLinkClient checks if the peer is another hub that linked to this one, see Link.
+func isLinkClient(p Peer) bool {
+	a, ok := p.(*adcPeer)
+	return ok && a.Info().Type.Is(adc.UserTypeHub)
+}
+
+// localPeers removes hubs that linked to this one from the list. Messages relayed from linked hubs
+// are only sent to local users, so they never reach a third hub.
+func localPeers(peers []Peer) []Peer {
+	out := make([]Peer, 0, len(peers))
+	for _, p := range peers {
+		if !isLinkClient(p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// linkChat sends the main chat message of a local user to all linked hubs.
+// Hubs that linked to this one receive local messages as regular users.
+func (h *Hub) linkChat(from Peer, text string) {
+	links := h.PeersWhere(func(p Peer) bool {
+		_, ok := p.(*linkPeer)
+		return ok
+	})
+	if len(links) == 0 {
+		return
+	}
+	data, err := linkChatData("<"+from.Name()+"> "+text, h.config().Name)
+	if err != nil {
+		return
+	}
+	for _, p := range links {
+		l := p.(*linkPeer)
+		err := l.conn.WritePacket(&adc.BroadcastPacket{
+			ID:         l.rsid,
+			BasePacket: adc.BasePacket{Name: (adc.ChatMessage{}).Cmd(), Data: data},
+		})
+		if err == nil {
+			err = l.conn.Flush()
+		}
+		if err != nil {
+			_ = l.Close()
+		}
+	}
+}
+
+// linkChatData encodes the chat message with the origin field.
+func linkChatData(text, origin string) ([]byte, error) {
+	data, err := adc.Marshal(adc.ChatMessage{Text: adc.String(text)})
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, " "+linkOriginField+adc.Escape(origin)...)
+	return data, nil
+}
+
+// linkOrigin returns the origin hub of the chat message, if it's set.
+func linkOrigin(data []byte) string {
+	for i, f := range bytes.Split(data, []byte(" ")) {
+		if i != 0 && bytes.HasPrefix(f, []byte(linkOriginField)) {
+			var s adc.String
+			_ = s.UnmarshalAdc(f[len(linkOriginField):])
+			return string(s)
+		}
+	}
+	return ""
+}
+
+func (l *linkPeer) updateUser(sid adc.SID, data []byte) {
+	var u adc.User
+	if err := adc.Unmarshal(data, &u); err != nil || u.Name == "" {
+		return
+	}
+	l.mu.Lock()
+	l.users[sid] = u.Name
+	l.mu.Unlock()
+}
+
+func (l *linkPeer) Name() string {
+	return l.name
+}
+
+func (l *linkPeer) User() User {
+	return User{Name: l.name}
+}
+
+// adcInfo returns the info of the linked hub for ADC clients.
+func (l *linkPeer) adcInfo() adc.User {
+	return adc.User{
+		Name: l.name,
+		Id:   l.cid,
+		Type: adc.UserTypeHub,
+	}
+}
+
+func (l *linkPeer) Features() []string { return nil }
+
+// Close disconnects from the linked hub and removes the link from the user list.
+func (l *linkPeer) Close() error {
+	err := l.conn.Close()
+	l.hub.leave(l, l.sid, l.name, "", nil)
+	return err
+}
+
+func (l *linkPeer) Kick(reason string) error {
+	return l.Close()
+}
+
+func (l *linkPeer) SendError(sev Severity, code int, text string) error { return nil }
+
+func (l *linkPeer) PeersJoin(peers []Peer) error { return nil }
+
+func (l *linkPeer) PeersLeave(peers []Peer, reason string) error { return nil }
+
+// ChatMsg does nothing, since local messages are relayed by linkChat and relayed messages
+// should not be sent back.
+func (l *linkPeer) ChatMsg(from Peer, text string) error { return nil }
+
+func (l *linkPeer) PrivateMsg(from Peer, text string) error { return nil }
+
+func (l *linkPeer) HubChatMsg(text string) error { return nil }
+
+func (l *linkPeer) ConnectTo(peer Peer, addr string, token string, secure bool) error {
+	return errLinkConnect
+}
+
+func (l *linkPeer) RevConnectTo(peer Peer, token string, secure bool) error {
+	return errLinkConnect
+}
@@ -0,0 +1,109 @@
+package hub
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// linkHubs links hub a to hub b and waits until users of both hubs see the link.
+func linkHubs(t *testing.T, a, b *Hub) {
+	if err := a.LinkConn(dialPipe(t, b)); err != nil {
+		t.Fatal(err)
+	}
+	waitPeer(t, b, a.config().Name)
+}
+
+func TestLinkChat(t *testing.T) {
+	a := New(Config{Name: "hubA"})
+	b := New(Config{Name: "hubB"})
+	alice := loginADC(t, a, "alice")
+	bob := loginADC(t, b, "bob")
+	linkHubs(t, a, b)
+
+	// the linked hub is shown as a user
+	link := a.byName("hubB")
+	if link == nil {
+		t.Fatal("linked hub is not in the user list")
+	}
+	if u := alice.expectUser(link.SID()); u.Type != adc.UserTypeHub {
+		t.Fatalf("unexpected user type: %v", u.Type)
+	}
+	if n := a.UserCount(); n != 1 {
+		t.Fatalf("linked hub should not be counted: %d", n)
+	}
+
+	alice.sendChat("hi")
+	bob.expectChat("<alice> hi")
+	bob.sendChat("hello")
+	alice.expectChat("<bob> hello")
+
+	// closing the link removes the user
+	_ = link.Close()
+	alice.expectQuit(link.SID())
+}
+
+// expectNoChat fails if a chat message containing a given text is received before the done message.
+func (c *testADC) expectNoChat(text, done string) {
+	for {
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(c.expect("MSG").Message().Data, &m); err != nil {
+			c.t.Fatal(err)
+		}
+		if strings.HasSuffix(string(m.Text), done) {
+			return
+		} else if strings.Contains(string(m.Text), text) {
+			c.t.Fatalf("unexpected message: %q", m.Text)
+		}
+	}
+}
+
+// chatUntil returns the text of all chat messages received before the done message.
+func (c *testADC) chatUntil(done string) []string {
+	var list []string
+	for {
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(c.expect("MSG").Message().Data, &m); err != nil {
+			c.t.Fatal(err)
+		}
+		if string(m.Text) == done {
+			return list
+		}
+		list = append(list, string(m.Text))
+	}
+}
+
+func TestLinkNoLoop(t *testing.T) {
+	a := New(Config{Name: "hubA"})
+	b := New(Config{Name: "hubB"})
+	c := New(Config{Name: "hubC"})
+	// hubs linked in a ring, so each message could reach every hub in two ways
+	linkHubs(t, a, b)
+	linkHubs(t, b, c)
+	linkHubs(t, c, a)
+	hubs := []*Hub{a, b, c}
+	users := []*testADC{
+		loginADC(t, a, "alice"),
+		loginADC(t, b, "bob"),
+		loginADC(t, c, "carol"),
+	}
+	names := []string{"alice", "bob", "carol"}
+
+	for i, from := range users {
+		from.sendChat("ping")
+		// give duplicates, if any, a chance to arrive
+		time.Sleep(200 * time.Millisecond)
+		for j, to := range users {
+			hubs[j].Broadcast("done")
+			exp := "<" + names[i] + "> ping"
+			if i == j {
+				exp = "ping"
+			}
+			if got := to.chatUntil("done"); len(got) != 1 || got[0] != exp {
+				t.Fatalf("%s: unexpected messages from %s: %q", names[j], names[i], got)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package hub
+
+import (
+	"errors"
+	"log"
+)
+
+// defaultMaintenanceMessage is sent to users that try to log in during maintenance, if the message is not set.
+const defaultMaintenanceMessage = "hub is under maintenance, try again later"
+
+// SetMaintenance puts the hub into the maintenance mode, or lifts it. While the hub is in maintenance,
+// new logins are refused with a given message, and users that are already on the hub stay connected.
+// An empty message is replaced with a default one.
+func (h *Hub) SetMaintenance(on bool, msg string) {
+	if !on {
+		msg = ""
+	} else if msg == "" {
+		msg = defaultMaintenanceMessage
+	}
+	h.confMu.Lock()
+	h.maintenance = msg
+	h.confMu.Unlock()
+	if on {
+		log.Printf("maintenance mode: %s", msg)
+	} else {
+		log.Println("maintenance mode lifted")
+	}
+}
+
+// Maintenance reports if the hub is in the maintenance mode, and returns the message sent to users.
+func (h *Hub) Maintenance() (bool, string) {
+	h.confMu.RLock()
+	defer h.confMu.RUnlock()
+	return h.maintenance != "", h.maintenance
+}
+
+// checkMaintenance returns an error with the maintenance message, if the hub refuses new logins.
+func (h *Hub) checkMaintenance() error {
+	if on, msg := h.Maintenance(); on {
+		return errors.New(msg)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+func TestMaintenance(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+
+	h.SetMaintenance(true, "back in 5 minutes")
+	if on, msg := h.Maintenance(); !on || msg != "back in 5 minutes" {
+		t.Fatalf("unexpected maintenance: %v %q", on, msg)
+	}
+	if !h.Stats().Maintenance {
+		t.Fatal("expected maintenance in stats")
+	}
+
+	alice := dialADC(t, h)
+	alice.handshake()
+	alice.identify(adc.User{Name: "alice"})
+	st, ok := alice.expectInfo().(adc.Status)
+	if !ok || st.Sev != adc.Fatal || st.Code != adc.CodeHubDisabled || st.Msg != "back in 5 minutes" {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+
+	conn, err := nmdc.NewConn(dialPipe(t, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(testTimeout)
+	_, err = conn.SendClientHandshake(deadline, "carol", nmdc.FeaNoHello, nmdc.FeaNoGetINFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := conn.ReadMsg(deadline)
+	if err != nil {
+		t.Fatal(err)
+	} else if e, ok := m.(*nmdc.Error); !ok || string(e.Text) != "back in 5 minutes" {
+		t.Fatalf("unexpected message: %#v", m)
+	}
+
+	// users on the hub are not affected
+	if h.byName("bob") == nil {
+		t.Fatal("bob was disconnected")
+	}
+	bob.sendChat("still here")
+	bob.expectChat("still here")
+
+	h.SetMaintenance(false, "")
+	if on, _ := h.Maintenance(); on || h.Stats().Maintenance {
+		t.Fatal("maintenance should be lifted")
+	}
+	loginADC(t, h, "alice")
+	loginNMDC(t, h, "carol")
+}
+
+func TestMaintenanceDefaultMessage(t *testing.T) {
+	h := newTestHub(t)
+	h.SetMaintenance(true, "")
+	if _, msg := h.Maintenance(); msg != defaultMaintenanceMessage {
+		t.Fatalf("unexpected message: %q", msg)
+	}
+}
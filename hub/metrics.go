@@ -0,0 +1,130 @@
+package hub
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+)
+
+// metricDesc describes a hub metric. Metrics with a label have one value per label value.
+type metricDesc struct {
+	name, typ, help string
+	label           string
+}
+
+// metricSample is the current value of a hub metric.
+type metricSample struct {
+	desc       *metricDesc
+	labelValue string
+	value      float64
+}
+
+var (
+	metricUsers         = &metricDesc{name: "dc_hub_users", typ: "gauge", help: "Number of users on the hub."}
+	metricProtocolUsers = &metricDesc{name: "dc_hub_protocol_users", typ: "gauge", help: "Number of users on the hub by protocol.", label: "protocol"}
+	metricShare         = &metricDesc{name: "dc_hub_share_bytes", typ: "gauge", help: "Total share size of all users."}
+	metricMessages      = &metricDesc{name: "dc_hub_chat_messages_total", typ: "counter", help: "Number of main chat messages."}
+	metricSearches      = &metricDesc{name: "dc_hub_searches_total", typ: "counter", help: "Number of search requests."}
+	metricLogins        = &metricDesc{name: "dc_hub_logins_total", typ: "counter", help: "Number of successful logins."}
+	metricKicks         = &metricDesc{name: "dc_hub_kicks_total", typ: "counter", help: "Number of kicked users."}
+	metricBytesRecv     = &metricDesc{name: "dc_hub_received_bytes_total", typ: "counter", help: "Number of bytes received from all connections."}
+	metricBytesSent     = &metricDesc{name: "dc_hub_sent_bytes_total", typ: "counter", help: "Number of bytes sent to all connections."}
+	metricSIDs          = &metricDesc{name: "dc_hub_sids", typ: "gauge", help: "Number of ADC session IDs used by the hub."}
+	metricSIDUsage      = &metricDesc{name: "dc_hub_sid_usage_ratio", typ: "gauge", help: "Fraction of the ADC session ID space used by the hub."}
+)
+
+// hubMetrics lists all metrics exported by the hub, in the order they are collected.
+var hubMetrics = []*metricDesc{
+	metricUsers, metricProtocolUsers, metricShare,
+	metricMessages, metricSearches, metricLogins, metricKicks,
+	metricBytesRecv, metricBytesSent,
+	metricSIDs, metricSIDUsage,
+}
+
+// collectMetrics reads the current values of all hub metrics.
+// The values are read from the same counters as Stats.
+func (h *Hub) collectMetrics(fnc func(s metricSample)) {
+	st := h.Stats()
+	nADC, nNMDC := h.UserCountByProtocol()
+	value := func(d *metricDesc, v float64) {
+		fnc(metricSample{desc: d, value: v})
+	}
+	value(metricUsers, float64(st.Users))
+	fnc(metricSample{desc: metricProtocolUsers, labelValue: "adc", value: float64(nADC)})
+	fnc(metricSample{desc: metricProtocolUsers, labelValue: "nmdc", value: float64(nNMDC)})
+	value(metricShare, float64(st.Share))
+	value(metricMessages, float64(st.Messages))
+	value(metricSearches, float64(st.Searches))
+	value(metricLogins, float64(st.Logins))
+	value(metricKicks, float64(st.Kicks))
+	value(metricBytesRecv, float64(st.BytesRecv))
+	value(metricBytesSent, float64(st.BytesSent))
+	value(metricSIDs, float64(st.SIDs))
+	value(metricSIDUsage, st.SIDUsage)
+}
+
+// Metric is the current value of a hub metric. See PrometheusHandler for the list of metrics.
+type Metric struct {
+	Name string
+	// Type is either "gauge" or "counter".
+	Type string
+	Help string
+	// Label is set for metrics that have one value per label value.
+	Label      string
+	LabelValue string
+	Value      float64
+}
+
+// CollectMetrics reads the current values of all hub metrics. Metrics are always reported
+// in the same order, and all values of the metric with a label are reported one after another.
+// It allows to export the metrics to other monitoring systems, see the hubprom package.
+func (h *Hub) CollectMetrics(fnc func(m Metric)) {
+	h.collectMetrics(func(s metricSample) {
+		d := s.desc
+		fnc(Metric{
+			Name: d.name, Type: d.typ, Help: d.help,
+			Label: d.label, LabelValue: s.labelValue,
+			Value: s.value,
+		})
+	})
+}
+
+// PrometheusHandler serves hub metrics in the Prometheus text exposition format.
+// Programs that already use the Prometheus client can register hubprom.NewCollector instead.
+//
+// The following metric names are stable and will not change in future versions:
+//
+//	dc_hub_users                   gauge    users on the hub
+//	dc_hub_protocol_users          gauge    users on the hub, by the "protocol" label (adc or nmdc)
+//	dc_hub_share_bytes             gauge    total share size of all users
+//	dc_hub_chat_messages_total     counter  main chat messages
+//	dc_hub_searches_total          counter  search requests
+//	dc_hub_logins_total            counter  successful logins
+//	dc_hub_kicks_total             counter  kicked users
+//	dc_hub_received_bytes_total    counter  bytes received from all connections
+//	dc_hub_sent_bytes_total        counter  bytes sent to all connections
+//	dc_hub_sids                    gauge    ADC session IDs used by the hub
+//	dc_hub_sid_usage_ratio         gauge    fraction of the SID space used by the hub
+//
+// The values are read from the same counters as Stats.
+func PrometheusHandler(h *Hub) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		bw := bufio.NewWriter(w)
+		var last *metricDesc
+		h.collectMetrics(func(s metricSample) {
+			d := s.desc
+			if d != last {
+				bw.WriteString("# HELP " + d.name + " " + d.help + "\n")
+				bw.WriteString("# TYPE " + d.name + " " + d.typ + "\n")
+				last = d
+			}
+			name := d.name
+			if d.label != "" {
+				name += "{" + d.label + "=" + strconv.Quote(s.labelValue) + "}"
+			}
+			bw.WriteString(name + " " + strconv.FormatFloat(s.value, 'g', -1, 64) + "\n")
+		})
+		_ = bw.Flush()
+	})
+}
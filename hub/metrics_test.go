@@ -0,0 +1,60 @@
+package hub
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	loginNMDC(t, h, "alice")
+	bob.sendChat("hi")
+	bob.expectChat("hi")
+	alice := h.byName("alice")
+	if err := alice.Kick("flood"); err != nil {
+		t.Fatal(err)
+	}
+	bob.expectQuit(alice.SID())
+
+	w := httptest.NewRecorder()
+	PrometheusHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"dc_hub_users 1",
+		`dc_hub_protocol_users{protocol="adc"} 1`,
+		`dc_hub_protocol_users{protocol="nmdc"} 0`,
+		"dc_hub_chat_messages_total 1",
+		"dc_hub_logins_total 2",
+		"dc_hub_kicks_total 1",
+		"dc_hub_sids 2",
+	} {
+		if !strings.Contains(body, "\n"+line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestCollectMetrics(t *testing.T) {
+	h := newTestHub(t)
+	loginNMDC(t, h, "alice")
+
+	var got []*metricDesc
+	h.collectMetrics(func(s metricSample) {
+		if s.desc.label == "" && s.labelValue != "" {
+			t.Errorf("unexpected label value for %s: %q", s.desc.name, s.labelValue)
+		}
+		if n := len(got); n == 0 || got[n-1] != s.desc {
+			got = append(got, s.desc)
+		}
+	})
+	if len(got) != len(hubMetrics) {
+		t.Fatalf("expected %d metrics, got %d", len(hubMetrics), len(got))
+	}
+	for i, d := range hubMetrics {
+		if got[i] != d {
+			t.Errorf("unexpected metric %d: %s != %s", i, got[i].name, d.name)
+		}
+	}
+}
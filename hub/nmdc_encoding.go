@@ -0,0 +1,148 @@
+package hub
+
+import (
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+// nmdcDefaultEncoding is the charset of legacy NMDC clients, if not set in the config.
+var nmdcDefaultEncoding encoding.Encoding = charmap.Windows1252
+
+// nmdcLegacyEncoding returns the charset of NMDC clients that do not use UTF-8.
+func (h *Hub) nmdcLegacyEncoding() encoding.Encoding {
+	name := h.config().NMDCEncoding
+	if name == "" {
+		return nmdcDefaultEncoding
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		log.Printf("nmdc: unsupported encoding %q, using the default", name)
+		return nmdcDefaultEncoding
+	}
+	return enc
+}
+
+// setLegacy switches the connection to the legacy encoding.
+func (p *nmdcPeer) setLegacy() {
+	p.mu.Lock()
+	if p.enc == nil {
+		p.enc = p.hub.nmdcLegacyEncoding()
+	}
+	p.mu.Unlock()
+}
+
+func (p *nmdcPeer) encoding() encoding.Encoding {
+	p.mu.RLock()
+	enc := p.enc
+	p.mu.RUnlock()
+	return enc
+}
+
+// decode converts the text received from the client to UTF-8.
+//
+// Connections use UTF-8 until the client sends a text that is not valid UTF-8.
+// After this, the connection is switched to the legacy encoding in both directions.
+func (p *nmdcPeer) decode(s string) string {
+	enc := p.encoding()
+	if enc == nil {
+		if utf8.ValidString(s) {
+			return s
+		}
+		p.setLegacy()
+		enc = p.encoding()
+	}
+	out, err := enc.NewDecoder().String(s)
+	if err != nil {
+		return s
+	}
+	return out
+}
+
+// encode converts the UTF-8 text to the encoding of the client.
+// Characters that cannot be represented in the legacy encoding are replaced with '?'.
+func (p *nmdcPeer) encode(s string) string {
+	enc := p.encoding()
+	if enc == nil {
+		return s
+	}
+	e := enc.NewEncoder()
+	if out, err := e.String(s); err == nil {
+		return out
+	}
+	var buf strings.Builder
+	for _, r := range s {
+		out, err := e.String(string(r))
+		if err != nil {
+			out = "?"
+		}
+		buf.WriteString(out)
+	}
+	return buf.String()
+}
+
+func (p *nmdcPeer) decodeName(s nmdc.Name) nmdc.Name {
+	return nmdc.Name(p.decode(string(s)))
+}
+
+func (p *nmdcPeer) encodeName(s string) nmdc.Name {
+	return nmdc.Name(p.encode(s))
+}
+
+func (p *nmdcPeer) encodeText(s string) nmdc.String {
+	return nmdc.String(p.encode(s))
+}
+
+// decodeInfo converts the text fields of the user info received from the client to UTF-8.
+func (p *nmdcPeer) decodeInfo(u nmdc.MyInfo) nmdc.MyInfo {
+	u.Name = p.decodeName(u.Name)
+	u.Desc = nmdc.String(p.decode(string(u.Desc)))
+	u.Email = p.decode(u.Email)
+	return u
+}
+
+// encodeInfo converts the text fields of the user info to the encoding of the client.
+func (p *nmdcPeer) encodeInfo(u nmdc.MyInfo) nmdc.MyInfo {
+	u.Name = p.encodeName(string(u.Name))
+	u.Desc = p.encodeText(string(u.Desc))
+	u.Email = p.encode(u.Email)
+	return u
+}
+
+// decodeSearch converts the text fields of the search received from the client to UTF-8.
+func (p *nmdcPeer) decodeSearch(s nmdc.Search) nmdc.Search {
+	s.Nick = p.decodeName(s.Nick)
+	s.Pattern = nmdc.String(p.decode(string(s.Pattern)))
+	return s
+}
+
+// encodeSearch converts the text fields of the search to the encoding of the client.
+func (p *nmdcPeer) encodeSearch(s nmdc.Search) nmdc.Search {
+	s.Nick = p.encodeName(string(s.Nick))
+	s.Pattern = p.encodeText(string(s.Pattern))
+	return s
+}
+
+// decodeResult converts the text fields of the search result received from the client to UTF-8.
+func (p *nmdcPeer) decodeResult(sr nmdc.SR) nmdc.SR {
+	sr.From = p.decodeName(sr.From)
+	sr.To = p.decodeName(sr.To)
+	sr.Path = nmdc.String(p.decode(string(sr.Path)))
+	sr.HubName = nmdc.String(p.decode(string(sr.HubName)))
+	return sr
+}
+
+// encodeResult converts the text fields of the search result to the encoding of the client.
+func (p *nmdcPeer) encodeResult(sr nmdc.SR) nmdc.SR {
+	sr.From = p.encodeName(string(sr.From))
+	sr.To = p.encodeName(string(sr.To))
+	sr.Path = p.encodeText(string(sr.Path))
+	sr.HubName = p.encodeText(string(sr.HubName))
+	return sr
+}
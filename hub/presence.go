@@ -0,0 +1,150 @@
+package hub
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// presence is the user list as the client is expected to see it: users that were announced to it
+// and didn't leave since. It's only tracked if the presence resync is enabled, since it costs
+// memory proportional to the number of users for each user.
+type presence struct {
+	mu    sync.Mutex
+	known map[adc.SID]Peer
+}
+
+// markJoined records that the peers were successfully announced to the client.
+func (p *BasePeer) markJoined(peers []Peer) {
+	if !p.hub.resync {
+		return
+	}
+	p.seen.mu.Lock()
+	defer p.seen.mu.Unlock()
+	if p.seen.known == nil {
+		p.seen.known = make(map[adc.SID]Peer)
+	}
+	for _, peer := range peers {
+		p.seen.known[peer.SID()] = peer
+	}
+}
+
+// markLeft records that the client was notified about peers leaving.
+func (p *BasePeer) markLeft(peers []Peer) {
+	if !p.hub.resync {
+		return
+	}
+	p.seen.mu.Lock()
+	defer p.seen.mu.Unlock()
+	for _, peer := range peers {
+		if p.seen.known[peer.SID()] == peer {
+			delete(p.seen.known, peer.SID())
+		}
+	}
+}
+
+func (p *BasePeer) knownPeers() map[adc.SID]Peer {
+	p.seen.mu.Lock()
+	defer p.seen.mu.Unlock()
+	m := make(map[adc.SID]Peer, len(p.seen.known))
+	for sid, peer := range p.seen.known {
+		m[sid] = peer
+	}
+	return m
+}
+
+type presencePeer interface {
+	Peer
+	knownPeers() map[adc.SID]Peer
+	seesPresence() bool
+}
+
+// presenceDelta compares the user list known to the client with the actual one.
+// It returns peers that were never announced to the client, and peers that left, but the client
+// was not notified. A peer that reconnected with the same SID is reported in both lists.
+// The client itself is ignored. Both lists are sorted by SID.
+func presenceDelta(self adc.SID, known map[adc.SID]Peer, actual []Peer) (joined, left []Peer) {
+	cur := make(map[adc.SID]struct{}, len(actual))
+	for _, p := range actual {
+		sid := p.SID()
+		if sid == self {
+			continue
+		}
+		cur[sid] = struct{}{}
+		if old, ok := known[sid]; !ok {
+			joined = append(joined, p)
+		} else if old != p {
+			left = append(left, old)
+			joined = append(joined, p)
+		}
+	}
+	for sid, p := range known {
+		if _, ok := cur[sid]; !ok && sid != self {
+			left = append(left, p)
+		}
+	}
+	sortBySID(joined)
+	sortBySID(left)
+	return joined, left
+}
+
+func sortBySID(list []Peer) {
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].SID(), list[j].SID()
+		return string(a[:]) < string(b[:])
+	})
+}
+
+// resyncLoop periodically sends the difference between the known and the actual user list to each client.
+//
+// The resync runs concurrently with regular notifications, so the client may receive a duplicate
+// join or leave, or even a stale one, if the user list changes during the resync. Such errors
+// are also recorded in the known list, and are fixed by the next resync.
+func (h *Hub) resyncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.peers.RLock()
+		list := h.listPeers()
+		h.peers.RUnlock()
+		list = append(list, h.viewerList()...)
+		for _, p := range list {
+			if pp, ok := p.(presencePeer); ok && !isVirtual(p) && pp.seesPresence() {
+				h.resyncPeer(pp)
+			}
+		}
+	}
+}
+
+// resyncPeer sends missed join and leave notifications to the peer.
+func (h *Hub) resyncPeer(p presencePeer) {
+	// pending users are only visible to themselves, and the self is ignored in the delta
+	joined, left := presenceDelta(p.SID(), p.knownPeers(), h.visiblePeers())
+	if len(left) != 0 {
+		_ = p.PeersLeave(left, "")
+	}
+	if len(joined) != 0 {
+		_ = p.PeersJoin(joined)
+	}
+	if len(joined) != 0 || len(left) != 0 {
+		log.Printf("%s: resync: %d joined, %d left", p.RemoteAddr(), len(joined), len(left))
+	}
+}
+
+// presenceWatchers filters the list of peers to notify about a join or a leave of a user.
+// If QuietPresence is set, only operators and virtual peers are notified.
+func (h *Hub) presenceWatchers(list []Peer) []Peer {
+	if !h.config().QuietPresence {
+		return list
+	}
+	out := make([]Peer, 0, len(list))
+	for _, p := range list {
+		if pp, ok := p.(interface{ seesPresence() bool }); !ok || isVirtual(p) || pp.seesPresence() {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+package hub
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/adc/types"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+func sidsOf(peers []Peer) []adc.SID {
+	var out []adc.SID
+	for _, p := range peers {
+		out = append(out, p.SID())
+	}
+	return out
+}
+
+func TestPresenceDelta(t *testing.T) {
+	h := newTestHub(t)
+	newPeer := func(sid uint32) Peer {
+		return &adcPeer{BasePeer: BasePeer{hub: h, sid: types.SIDFromInt(sid)}}
+	}
+	self, a, b, c, d := newPeer(1), newPeer(2), newPeer(3), newPeer(4), newPeer(5)
+	// reconnected with the same SID
+	d2 := newPeer(5)
+
+	known := map[adc.SID]Peer{
+		self.SID(): self,
+		a.SID():    a,
+		b.SID():    b,
+		d.SID():    d,
+	}
+	actual := []Peer{c, a, self, d2}
+	joined, left := presenceDelta(self.SID(), known, actual)
+	if exp := []adc.SID{c.SID(), d2.SID()}; !reflect.DeepEqual(sidsOf(joined), exp) || joined[1] != d2 {
+		t.Fatalf("unexpected joined: %v", sidsOf(joined))
+	}
+	if exp := []adc.SID{b.SID(), d.SID()}; !reflect.DeepEqual(sidsOf(left), exp) || left[1] != d {
+		t.Fatalf("unexpected left: %v", sidsOf(left))
+	}
+
+	joined, left = presenceDelta(self.SID(), map[adc.SID]Peer{a.SID(): a}, []Peer{a, self})
+	if len(joined) != 0 || len(left) != 0 {
+		t.Fatalf("expected no changes, got %v, %v", sidsOf(joined), sidsOf(left))
+	}
+}
+
+func TestPresenceResync(t *testing.T) {
+	// the loop is not expected to run during the test
+	h := New(Config{Name: "test", ResyncInterval: time.Hour})
+	bob := loginADC(t, h, "bob")
+	alice := loginADC(t, h, "alice")
+	bob.expectUser(alice.sid)
+	carol := loginADC(t, h, "carol")
+	bob.expectUser(carol.sid)
+
+	peer := h.byName("bob").(*adcPeer)
+	known := peer.knownPeers()
+	if _, ok := known[alice.sid]; !ok {
+		t.Fatalf("alice is not tracked: %v", known)
+	}
+
+	// simulate notifications dropped on the way to bob:
+	// he never saw alice, and didn't see dave leaving
+	dave := &adcPeer{BasePeer: BasePeer{hub: h, sid: h.nextSID()}}
+	peer.seen.mu.Lock()
+	delete(peer.seen.known, alice.sid)
+	peer.seen.known[dave.sid] = dave
+	peer.seen.mu.Unlock()
+
+	h.resyncPeer(peer)
+	st, ok := bob.expectInfo().(adc.Disconnect)
+	if !ok || st.ID != dave.sid {
+		t.Fatalf("expected quit for dave, got %#v", st)
+	}
+	if u := bob.expectUser(alice.sid); u.Name != "alice" {
+		t.Fatalf("unexpected user: %+v", u)
+	}
+
+	// now the list is consistent
+	joined, left := presenceDelta(peer.SID(), peer.knownPeers(), h.visiblePeers())
+	if len(joined) != 0 || len(left) != 0 {
+		t.Fatalf("expected no changes, got %v, %v", sidsOf(joined), sidsOf(left))
+	}
+}
+
+func TestQuietPresence(t *testing.T) {
+	for _, quiet := range []bool{false, true} {
+		quiet := quiet
+		t.Run(fmt.Sprint(quiet), func(t *testing.T) {
+			acc := newTestAccounts(t)
+			if err := acc.SetAccount("op", "secret", true); err != nil {
+				t.Fatal(err)
+			}
+			h := New(Config{Name: "test", Accounts: acc, QuietPresence: quiet})
+			op := loginNMDCPass(t, h, nil, nmdc.MyInfo{Name: "op"}, "secret")
+			bob := loginADC(t, h, "bob")
+			alice := loginADC(t, h, "alice")
+
+			// new users always receive the full list
+			carol := dialADC(t, h)
+			carol.handshake()
+			carol.identify(adc.User{Name: "carol"})
+			seen := make(map[adc.SID]bool)
+			for !seen[carol.sid] {
+				if b, ok := carol.expect("INF").(*adc.BroadcastPacket); ok {
+					seen[b.ID] = true
+				}
+			}
+			if !seen[bob.sid] || !seen[alice.sid] {
+				t.Fatalf("incomplete user list: %v", seen)
+			}
+			waitPeer(t, h, "carol")
+
+			// operators are always notified
+			for op.expect("MyINFO").(*nmdc.MyInfo).Name != "alice" {
+			}
+			if err := h.byName("alice").Kick("bye"); err != nil {
+				t.Fatal(err)
+			}
+			for op.expect("Quit").(*nmdc.Quit).Name != "alice" {
+			}
+
+			h.Broadcast("done")
+			joined, left := false, false
+			for {
+				p := bob.next()
+				m := p.Message()
+				if m.Type.String() == "MSG" {
+					break
+				} else if m.Type.String() == "INF" && p.(*adc.BroadcastPacket).ID == alice.sid {
+					joined = true
+				} else if m.Type.String() == "QUI" {
+					var d adc.Disconnect
+					if err := adc.Unmarshal(m.Data, &d); err != nil {
+						t.Fatal(err)
+					}
+					left = left || d.ID == alice.sid
+				}
+			}
+			if joined == quiet || left == quiet {
+				t.Fatalf("unexpected notifications: joined=%v, left=%v", joined, left)
+			}
+		})
+	}
+}
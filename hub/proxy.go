@@ -0,0 +1,154 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout is the time given to a trusted proxy to send the PROXY protocol header.
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLen is the maximal length of the PROXY protocol v1 header, including CRLF.
+	proxyV1MaxLen = 107
+)
+
+// proxyV2Sig is the signature of the PROXY protocol v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// trustedProxy checks if the connection comes from a proxy that sends the PROXY protocol header.
+func (h *Hub) trustedProxy(addr net.Addr) bool {
+	ip := remoteIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.config().TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY protocol header from the connection and returns a connection
+// with the remote address of the client. The address of the proxy is kept if the header doesn't
+// carry the client address, for example for proxy health checks.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	r := bufio.NewReaderSize(conn, 256)
+	addr, err := parseProxyHeader(r)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	var c net.Conn = conn
+	if n := r.Buffered(); n != 0 {
+		buf, _ := r.Peek(n)
+		c = &peekedConn{buf: append([]byte{}, buf...), Conn: conn}
+	}
+	if addr != nil {
+		c = &proxiedConn{Conn: c, addr: addr}
+	}
+	return c, nil
+}
+
+// parseProxyHeader reads the PROXY protocol v1 or v2 header. It returns nil address if the header
+// doesn't carry the client address.
+func parseProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read proxy header: %v", err)
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return parseProxyV2(r)
+	} else if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return parseProxyV1(r)
+	}
+	return nil, errors.New("missing proxy header")
+}
+
+func parseProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("cannot read proxy header: %v", err)
+	} else if len(line) > proxyV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid proxy header")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	} else if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid proxy header: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid proxy header: %q", line)
+	}
+	switch fields[1] {
+	case "TCP4":
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("invalid proxy header: %q", line)
+		}
+	case "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol: %q", fields[1])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func parseProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("cannot read proxy header: %v", err)
+	}
+	if vers := hdr[12] >> 4; vers != 2 {
+		return nil, fmt.Errorf("unsupported proxy header version: %d", vers)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("cannot read proxy header: %v", err)
+	}
+	switch cmd := hdr[12] & 0xf; cmd {
+	case 0:
+		// LOCAL, the connection is made by the proxy itself
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported proxy command: %d", cmd)
+	}
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(data) < 12 {
+			return nil, errors.New("invalid proxy header")
+		}
+		ip := net.IP(append([]byte{}, data[:4]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(data[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(data) < 36 {
+			return nil, errors.New("invalid proxy header")
+		}
+		ip := net.IP(append([]byte{}, data[:16]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(data[32:]))}, nil
+	}
+	// other address families carry no client address we can use
+	return nil, nil
+}
+
+// proxiedConn is a connection with the client address received from the proxy.
+type proxiedConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.addr
+}
@@ -0,0 +1,147 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+func proxyV2Header(cmd, fam byte, addr []byte) []byte {
+	buf := append([]byte{}, proxyV2Sig...)
+	buf = append(buf, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(buf[14:], uint16(len(addr)))
+	return append(buf, addr...)
+}
+
+var proxyHeaderCases = []struct {
+	name   string
+	header []byte
+	addr   string
+	err    bool
+}{
+	{
+		name:   "v1 tcp4",
+		header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 411\r\n"),
+		addr:   "192.0.2.1:56324",
+	},
+	{
+		name:   "v1 tcp6",
+		header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 411\r\n"),
+		addr:   "[2001:db8::1]:56324",
+	},
+	{
+		name:   "v1 unknown",
+		header: []byte("PROXY UNKNOWN\r\n"),
+	},
+	{
+		name:   "v1 bad address",
+		header: []byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 411\r\n"),
+		err:    true,
+	},
+	{
+		name:   "v1 no crlf",
+		header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 411\n"),
+		err:    true,
+	},
+	{
+		name: "v2 tcp4",
+		header: proxyV2Header(1, 0x11, []byte{
+			192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0x9b,
+		}),
+		addr: "192.0.2.1:56324",
+	},
+	{
+		name: "v2 tcp6 with tlv",
+		header: proxyV2Header(1, 0x21, append(append(append(
+			net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...),
+			0xdc, 0x04, 0x01, 0x9b),
+			0x04, 0x00, 0x01, 0x00, // NOOP TLV
+		)),
+		addr: "[2001:db8::1]:56324",
+	},
+	{
+		name:   "v2 local",
+		header: proxyV2Header(0, 0x00, nil),
+	},
+	{
+		name:   "v2 short",
+		header: proxyV2Header(1, 0x11, []byte{192, 0, 2, 1}),
+		err:    true,
+	},
+	{
+		name:   "no header",
+		header: []byte("HSUP ADBASE ADTIGR\n"),
+		err:    true,
+	},
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	for _, c := range proxyHeaderCases {
+		t.Run(c.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(c.header, "HSUP"...)))
+			addr, err := parseProxyHeader(r)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", addr)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if c.addr == "" {
+				if addr != nil {
+					t.Fatalf("unexpected address: %v", addr)
+				}
+			} else if addr == nil || addr.String() != c.addr {
+				t.Fatalf("unexpected address: %v", addr)
+			}
+			// the rest of the stream is not consumed
+			if rest, _ := r.Peek(4); string(rest) != "HSUP" {
+				t.Fatalf("unexpected data after the header: %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	h := New(Config{Name: "test", TrustedProxies: []*net.IPNet{lb}})
+
+	for _, c := range []struct {
+		header string
+		ip     string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 411\r\n", "192.0.2.1"},
+		{string(proxyV2Header(1, 0x11, []byte{192, 0, 2, 2, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0x9b})), "192.0.2.2"},
+	} {
+		conn := dialPipeFrom(t, h, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234})
+		if _, err := conn.Write([]byte(c.header)); err != nil {
+			t.Fatal(err)
+		}
+		cl := newTestADC(t, conn)
+		cl.handshake()
+		cl.identify(adc.User{Name: "user-" + c.ip})
+		u := cl.expectUser(cl.sid)
+		if u.Ip4 != c.ip {
+			t.Fatalf("unexpected address: %q", u.Ip4)
+		}
+		p := waitPeer(t, h, u.Name)
+		if ip := remoteIP(p.RemoteAddr()); ip.String() != c.ip {
+			t.Fatalf("unexpected address: %v", p.RemoteAddr())
+		}
+	}
+
+	// untrusted clients cannot spoof the address
+	conn := dialPipeFrom(t, h, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 1234})
+	go func() {
+		_, _ = conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 411\r\n"))
+	}()
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
@@ -0,0 +1,92 @@
+package hub
+
+import (
+	"strconv"
+	"time"
+)
+
+const defaultQueueInterval = 30 * time.Second
+
+// waitSlot waits for a free slot on the hub. Peers lock must be held. The lock is released
+// while waiting, and is held again when the function returns.
+//
+// If the hub is full, or other users are already waiting, the user is added to the end of
+// the queue and is admitted when it gets to the head of the queue and the slot is free.
+// The notify function is called with the position in the queue when it changes, and
+// periodically with QueueInterval. An error from it removes the user from the queue.
+// If the queue is full, errHubFull is returned.
+func (h *Hub) waitSlot(notify func(pos int) error) error {
+	if !h.isFull() && len(h.peers.queue) == 0 {
+		return nil
+	}
+	conf := h.config()
+	if len(h.peers.queue) >= conf.QueueSize {
+		return errHubFull
+	}
+	wake := make(chan struct{}, 1)
+	h.peers.queue = append(h.peers.queue, wake)
+	defer func() {
+		h.dequeue(wake)
+		// positions changed, and the next user may fit as well
+		h.wakeQueue()
+	}()
+
+	ticker := time.NewTicker(conf.QueueInterval)
+	defer ticker.Stop()
+	last, tick := 0, true
+	for {
+		pos := h.queuePos(wake)
+		if pos == 1 && !h.isFull() {
+			return nil
+		}
+		h.peers.Unlock()
+		var err error
+		if tick || pos != last {
+			err = notify(pos)
+			last, tick = pos, false
+		}
+		if err == nil {
+			select {
+			case <-wake:
+			case <-ticker.C:
+				tick = true
+			}
+		}
+		h.peers.Lock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// queuePos returns the position of the user in the queue, starting from 1. Peers lock must be held.
+func (h *Hub) queuePos(wake chan struct{}) int {
+	for i, c := range h.peers.queue {
+		if c == wake {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// dequeue removes the user from the queue. Peers lock must be held.
+func (h *Hub) dequeue(wake chan struct{}) {
+	if i := h.queuePos(wake) - 1; i >= 0 {
+		h.peers.queue = append(h.peers.queue[:i], h.peers.queue[i+1:]...)
+	}
+}
+
+// wakeQueue notifies users in the queue that the slot may be free. Peers lock must be held.
+func (h *Hub) wakeQueue() {
+	for _, c := range h.peers.queue {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// queueMessage returns a text sent to the user waiting in the queue.
+func queueMessage(pos int) string {
+	return "hub is full, your position in the queue: " + strconv.Itoa(pos)
+}
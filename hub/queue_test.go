@@ -0,0 +1,54 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+func TestQueue(t *testing.T) {
+	// closed connections are only noticed by the next notification
+	h := New(Config{Name: "test", MaxUsers: 1, QueueSize: 1, QueueInterval: 50 * time.Millisecond})
+	bob := loginADC(t, h, "bob")
+
+	alice := dialADC(t, h)
+	alice.handshake()
+	alice.identify(adc.User{Name: "alice"})
+	st, ok := alice.expectInfo().(adc.Status)
+	if !ok || st.Sev != adc.Success || st.Msg != queueMessage(1) {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+
+	// the queue is full as well
+	carol := dialADC(t, h)
+	carol.handshake()
+	carol.identify(adc.User{Name: "carol"})
+	st, ok = carol.expectInfo().(adc.Status)
+	if !ok || st.Sev != adc.Fatal || st.Code != adc.CodeHubFull {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+
+	// the slot is free, alice is admitted
+	_ = bob.conn.Close()
+	alice.expectUser(alice.sid)
+	waitPeer(t, h, "alice")
+
+	// NMDC users wait in the same queue
+	conn, err := nmdc.NewConn(dialPipe(t, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(testTimeout)
+	_, err = conn.SendClientHandshake(deadline, "dave", nmdc.FeaNoHello, nmdc.FeaNoGetINFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m nmdc.ChatMessage
+	if err = conn.ReadMsgTo(deadline, &m); err != nil {
+		t.Fatal(err)
+	} else if string(m.Text) != queueMessage(1) {
+		t.Fatalf("unexpected message: %q", m.Text)
+	}
+}
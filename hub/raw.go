@@ -0,0 +1,76 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// rawManaged is a list of commands that change the state managed by the hub,
+// and thus cannot be sent as raw packets.
+var rawManaged = map[string]bool{
+	"SUP": true, // features are negotiated by the hub
+	"SID": true, // SIDs are allocated by the hub
+	"INF": true, // user list is tracked by the hub
+	"QUI": true, // same as above
+}
+
+// parseRawPacket checks that the data is a single ADC packet that the hub allows to send as-is.
+func parseRawPacket(data []byte) (adc.Packet, error) {
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	if bytes.IndexByte(data, '\n') >= 0 {
+		return nil, errors.New("raw data must contain a single packet")
+	}
+	p, err := adc.DecodePacket(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raw packet: %v", err)
+	}
+	if name := p.Message().Type.String(); rawManaged[name] {
+		return nil, fmt.Errorf("%s cannot be sent as a raw packet", name)
+	}
+	return p, nil
+}
+
+// SendRawTo writes a pre-encoded ADC packet to the peer with a given SID.
+// The trailing newline of the packet is optional.
+//
+// This is an advanced API for testing and reproducing client bugs. The hub only checks that
+// the data is a single well-formed packet, and never interprets its content. Packets that
+// change the state managed by the hub (SUP, SID, INF and QUI) are refused, as well as
+// peers that don't use ADC.
+func (h *Hub) SendRawTo(sid adc.SID, data []byte) error {
+	p, err := parseRawPacket(data)
+	if err != nil {
+		return err
+	}
+	peer := h.bySID(sid)
+	if peer == nil {
+		return fmt.Errorf("no peer with SID %s", sid)
+	}
+	ap, ok := peer.(*adcPeer)
+	if !ok {
+		return fmt.Errorf("peer %s doesn't use ADC", sid)
+	}
+	if err = ap.conn.WritePacket(p); err != nil {
+		return err
+	}
+	return ap.conn.Flush()
+}
+
+// SendRawBroadcast writes a pre-encoded ADC packet to all ADC peers. Peers using other
+// protocols are skipped. See SendRawTo for the restrictions.
+func (h *Hub) SendRawBroadcast(data []byte) error {
+	p, err := parseRawPacket(data)
+	if err != nil {
+		return err
+	}
+	for _, peer := range h.Peers() {
+		if ap, ok := peer.(*adcPeer); ok {
+			_ = ap.conn.WritePacket(p)
+			_ = ap.conn.Flush()
+		}
+	}
+	return nil
+}
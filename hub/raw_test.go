@@ -0,0 +1,52 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+func TestSendRaw(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	alice := loginADC(t, h, "alice")
+	carol := loginNMDC(t, h, "carol")
+	bob.expectUser(alice.sid)
+
+	err := h.SendRawTo(bob.sid, []byte("ISTA 000 raw\\stest\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := bob.expect("STA").Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, ok := m.(adc.Status); !ok || st.Msg != "raw test" {
+		t.Fatalf("unexpected message: %#v", m)
+	}
+
+	if err = h.SendRawBroadcast([]byte("IMSG hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*testADC{bob, alice} {
+		if m := c.expect("MSG").Message(); string(m.Data) != "hello" {
+			t.Fatalf("unexpected message: %q", m.Data)
+		}
+	}
+
+	for _, data := range []string{
+		"",
+		"IMSG a\nIMSG b",
+		"BINF AAAB NIbob2",
+		"IQUI AAAB",
+		"ISID AAAB",
+		"XMSG hello",
+	} {
+		if err := h.SendRawTo(bob.sid, []byte(data)); err == nil {
+			t.Fatalf("expected an error for %q", data)
+		}
+	}
+	if err := h.SendRawTo(h.byName(carol.name).SID(), []byte("IMSG hello")); err == nil {
+		t.Fatal("expected an error for NMDC peer")
+	}
+}
@@ -0,0 +1,282 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// ruleParams are user parameters available in rule expressions.
+var ruleParams = map[string]func(v ruleValues) float64{
+	"share":           func(v ruleValues) float64 { return float64(v.share) },
+	"slots":           func(v ruleValues) float64 { return float64(v.slots) },
+	"hubs":            func(v ruleValues) float64 { return float64(v.hubs[0] + v.hubs[1] + v.hubs[2]) },
+	"hubs_normal":     func(v ruleValues) float64 { return float64(v.hubs[0]) },
+	"hubs_registered": func(v ruleValues) float64 { return float64(v.hubs[1]) },
+	"hubs_operator":   func(v ruleValues) float64 { return float64(v.hubs[2]) },
+}
+
+// ruleUnits are size suffixes for numbers in rule expressions.
+var ruleUnits = map[string]float64{
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// ruleValues are user parameters checked by rules.
+type ruleValues struct {
+	share uint64
+	slots int
+	hubs  [3]int // normal, registered, operator
+}
+
+// UserRule is a requirement on the user info, for example "slots >= share / 50GB" or "hubs <= 10".
+//
+// A rule compares two arithmetic expressions with one of <, <=, >, >=, ==, !=. Expressions consist
+// of numbers, user parameters, operators +, -, *, / and parentheses. Numbers may have a size suffix:
+// KB, MB, GB or TB. The parameters are: share (in bytes), slots, hubs (the total number of hubs),
+// hubs_normal, hubs_registered and hubs_operator. If the value of the expression is undefined
+// (e.g. 0/0), the rule is not applied.
+type UserRule struct {
+	// Message is sent to users that violate the rule. By default, the message includes the rule
+	// and the values of the user parameters.
+	Message string
+
+	expr        string
+	op          string
+	left, right ruleExpr
+	params      []string
+}
+
+// ParseUserRule parses the rule expression.
+func ParseUserRule(s string) (*UserRule, error) {
+	p := &ruleParser{toks: tokenizeRule(s)}
+	r := &UserRule{expr: strings.Join(p.toks, " ")}
+	var err error
+	if r.left, err = p.expr(); err != nil {
+		return nil, fmt.Errorf("invalid rule %q: %v", s, err)
+	}
+	switch op := p.next(); op {
+	case "<", "<=", ">", ">=", "==", "!=":
+		r.op = op
+	default:
+		return nil, fmt.Errorf("invalid rule %q: expected comparison, got %q", s, op)
+	}
+	if r.right, err = p.expr(); err != nil {
+		return nil, fmt.Errorf("invalid rule %q: %v", s, err)
+	}
+	if tok := p.next(); tok != "" {
+		return nil, fmt.Errorf("invalid rule %q: unexpected %q", s, tok)
+	}
+	seen := make(map[string]bool)
+	for _, tok := range p.toks {
+		if _, ok := ruleParams[tok]; ok && !seen[tok] {
+			seen[tok] = true
+			r.params = append(r.params, tok)
+		}
+	}
+	return r, nil
+}
+
+// String returns the normalized rule expression.
+func (r *UserRule) String() string {
+	return r.expr
+}
+
+// check returns an error if the user parameters violate the rule.
+func (r *UserRule) check(v ruleValues) error {
+	a, b := r.left(v), r.right(v)
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return nil
+	}
+	var ok bool
+	switch r.op {
+	case "<":
+		ok = a < b
+	case "<=":
+		ok = a <= b
+	case ">":
+		ok = a > b
+	case ">=":
+		ok = a >= b
+	case "==":
+		ok = a == b
+	case "!=":
+		ok = a != b
+	}
+	if ok {
+		return nil
+	}
+	if r.Message != "" {
+		return &ruleError{msg: r.Message}
+	}
+	vals := make([]string, 0, len(r.params))
+	for _, name := range r.params {
+		vals = append(vals, name+" = "+strconv.FormatFloat(ruleParams[name](v), 'f', -1, 64))
+	}
+	msg := "hub rule is not satisfied: " + r.expr
+	if len(vals) != 0 {
+		msg += " (" + strings.Join(vals, ", ") + ")"
+	}
+	return &ruleError{msg: msg}
+}
+
+// ruleError is returned when the user violates one of the hub rules.
+type ruleError struct {
+	msg string
+}
+
+func (e *ruleError) Error() string {
+	return e.msg
+}
+
+func adcRuleValues(u adc.User) ruleValues {
+	return ruleValues{
+		share: uint64(u.ShareSize),
+		slots: u.Slots,
+		hubs:  [3]int{u.HubsNormal, u.HubsRegistered, u.HubsOperator},
+	}
+}
+
+// checkRules checks the user parameters against all hub rules.
+func (h *Hub) checkRules(v ruleValues) error {
+	for _, r := range h.config().Rules {
+		if err := r.check(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type ruleExpr func(v ruleValues) float64
+
+func tokenizeRule(s string) []string {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("<>=!", c) >= 0:
+			j := i + 1
+			if j < len(s) && s[j] == '=' {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		case strings.IndexByte("+-*/()", c) >= 0:
+			toks = append(toks, s[i:i+1])
+			i++
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t<>=!+-*/()", s[j]) < 0 {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return toks
+}
+
+type ruleParser struct {
+	toks []string
+	i    int
+}
+
+func (p *ruleParser) peek() string {
+	if p.i < len(p.toks) {
+		return p.toks[p.i]
+	}
+	return ""
+}
+
+func (p *ruleParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.i++
+	}
+	return tok
+}
+
+// expr parses a sum of terms.
+func (p *ruleParser) expr() (ruleExpr, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == "+" || op == "-"; op = p.peek() {
+		p.next()
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		a := left
+		if op == "+" {
+			left = func(v ruleValues) float64 { return a(v) + right(v) }
+		} else {
+			left = func(v ruleValues) float64 { return a(v) - right(v) }
+		}
+	}
+	return left, nil
+}
+
+// term parses a product of factors.
+func (p *ruleParser) term() (ruleExpr, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == "*" || op == "/"; op = p.peek() {
+		p.next()
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		a := left
+		if op == "*" {
+			left = func(v ruleValues) float64 { return a(v) * right(v) }
+		} else {
+			left = func(v ruleValues) float64 { return a(v) / right(v) }
+		}
+	}
+	return left, nil
+}
+
+// factor parses a number, a parameter or an expression in parentheses.
+func (p *ruleParser) factor() (ruleExpr, error) {
+	tok := p.next()
+	switch {
+	case tok == "":
+		return nil, errors.New("unexpected end of expression")
+	case tok == "(":
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if tok = p.next(); tok != ")" {
+			return nil, fmt.Errorf("expected ')', got %q", tok)
+		}
+		return e, nil
+	case ruleParams[tok] != nil:
+		return ruleParams[tok], nil
+	}
+	num, mul := tok, 1.0
+	for unit, m := range ruleUnits {
+		if strings.HasSuffix(strings.ToUpper(tok), unit) {
+			num, mul = tok[:len(tok)-len(unit)], m
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	f *= mul
+	return func(ruleValues) float64 { return f }, nil
+}
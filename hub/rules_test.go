@@ -0,0 +1,106 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+const gb = 1 << 30
+
+var userRuleCases = []struct {
+	rule string
+	vals ruleValues
+	ok   bool
+}{
+	{"hubs <= 10", ruleValues{hubs: [3]int{8, 1, 1}}, true},
+	{"hubs <= 10", ruleValues{hubs: [3]int{8, 2, 1}}, false},
+	{"slots >= share / 50GB", ruleValues{share: 100 * gb, slots: 2}, true},
+	{"slots >= share / 50GB", ruleValues{share: 100 * gb, slots: 1}, false},
+	{"slots>=share/50gb", ruleValues{share: 10 * gb, slots: 1}, true},
+	{"slots >= 2 * (hubs_normal + hubs_registered)", ruleValues{slots: 4, hubs: [3]int{1, 1, 5}}, true},
+	{"slots >= 2 * (hubs_normal + hubs_registered)", ruleValues{slots: 3, hubs: [3]int{1, 1, 5}}, false},
+	{"hubs_operator == 0", ruleValues{hubs: [3]int{1, 0, 1}}, false},
+	{"share > 1.5TB - 512GB", ruleValues{share: 1025 * gb}, true},
+	// undefined values do not violate the rule
+	{"slots / hubs >= 1", ruleValues{}, true},
+}
+
+func TestUserRule(t *testing.T) {
+	for _, c := range userRuleCases {
+		r, err := ParseUserRule(c.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = r.check(c.vals); (err == nil) != c.ok {
+			t.Fatalf("%q with %+v: unexpected result: %v", c.rule, c.vals, err)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"slots",
+		"slots >= ",
+		"slots >= 1 1",
+		"slots >= (1",
+		"slots >= files",
+		"slots >= 1XB",
+		"slots => 1",
+		"slots >= inf",
+	} {
+		if _, err := ParseUserRule(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestUserRuleMessage(t *testing.T) {
+	r, err := ParseUserRule("slots>=share/50GB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := r.String(); s != "slots >= share / 50GB" {
+		t.Fatalf("unexpected rule: %q", s)
+	}
+	err = r.check(ruleValues{share: 100 * gb, slots: 1})
+	if exp := "hub rule is not satisfied: slots >= share / 50GB (slots = 1, share = 107374182400)"; err == nil || err.Error() != exp {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r.Message = "open at least one slot per 50 GB of share"
+	if err = r.check(ruleValues{share: 100 * gb, slots: 1}); err == nil || err.Error() != r.Message {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestADCRules(t *testing.T) {
+	r, err := ParseUserRule("slots >= share / 50GB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := New(Config{Name: "test", Rules: []*UserRule{r}})
+
+	// refused at login
+	c := dialADC(t, h)
+	c.handshake()
+	c.identify(adc.User{Name: "bob", ShareSize: 100 * gb, Slots: 1})
+	st, ok := c.expectInfo().(adc.Status)
+	if !ok || st.Sev != adc.Fatal || st.Code != adc.CodeLoginGeneric {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+
+	// kicked on update
+	bob := dialADC(t, h)
+	bob.handshake()
+	bob.identify(adc.User{Name: "bob", ShareSize: 100 * gb, Slots: 2})
+	bob.expectUser(bob.sid)
+	alice := loginADC(t, h, "alice")
+	bob.expectUser(alice.sid)
+
+	bob.sendInfo([]byte("SL1"))
+	st, ok = bob.expectInfo().(adc.Status)
+	if !ok || st.Sev != adc.Fatal || st.Code != adc.CodeLoginGeneric {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+	if m := alice.expectQuit(bob.sid); m.Message == "" {
+		t.Fatalf("expected a reason: %#v", m)
+	}
+}
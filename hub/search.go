@@ -0,0 +1,136 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+const (
+	defaultSearchResults = 100
+	// searchResultsTTL is the time after which the search is forgotten and no longer counted.
+	searchResultsTTL = time.Minute
+	// maxRecentSearches is the number of searches remembered to route results from NMDC users.
+	maxRecentSearches = 10
+)
+
+// searchLimits tracks search results relayed to and from a peer.
+type searchLimits struct {
+	mu sync.Mutex
+	// searches counts the results received by the peer, by search token
+	searches map[string]*searchResults
+	// window and sent count the results sent by the peer during the last second
+	window time.Time
+	sent   int
+	// recent searches sent by the peer, oldest first; results from NMDC users have no tokens,
+	// so they are matched against these searches
+	recent []recentSearch
+}
+
+type recentSearch struct {
+	started time.Time
+	req     adc.SearchRequest
+}
+
+type searchResults struct {
+	started time.Time
+	count   int
+	seen    map[string]struct{}
+}
+
+// addSearch remembers the search sent by the peer. Only the last few searches
+// are kept, and they are forgotten after searchResultsTTL.
+func (l *searchLimits) addSearch(now time.Time, req adc.SearchRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := 0
+	for i < len(l.recent) && now.Sub(l.recent[i].started) >= searchResultsTTL {
+		i++
+	}
+	if n := len(l.recent) - i + 1; n > maxRecentSearches {
+		i += n - maxRecentSearches
+	}
+	l.recent = append(l.recent[i:], recentSearch{started: now, req: req})
+}
+
+// matchToken returns the token of the most recent search that matches the result.
+// If none of the searches match, the token of the last one is returned.
+func (l *searchLimits) matchToken(now time.Time, match func(req adc.SearchRequest) bool) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(l.recent) - 1; i >= 0; i-- {
+		s := l.recent[i]
+		if now.Sub(s.started) >= searchResultsTTL {
+			break
+		}
+		if match(s.req) {
+			return s.req.Token
+		}
+	}
+	if n := len(l.recent); n != 0 {
+		return l.recent[n-1].req.Token
+	}
+	return ""
+}
+
+// allowSend checks if the peer can send one more result without exceeding the rate.
+func (l *searchLimits) allowSend(now time.Time, rate int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.window) >= time.Second {
+		l.window, l.sent = now, 0
+	}
+	if l.sent >= rate {
+		return false
+	}
+	l.sent++
+	return true
+}
+
+// allowRecv checks if the peer can receive a result for a given search.
+// Duplicate results are rejected as well. Negative max disables the cap.
+func (l *searchLimits) allowRecv(now time.Time, token, key string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.searches[token]
+	if s == nil || now.Sub(s.started) >= searchResultsTTL {
+		if l.searches == nil {
+			l.searches = make(map[string]*searchResults)
+		}
+		for tok, s := range l.searches {
+			if now.Sub(s.started) >= searchResultsTTL {
+				delete(l.searches, tok)
+			}
+		}
+		s = &searchResults{started: now, seen: make(map[string]struct{})}
+		l.searches[token] = s
+	}
+	if max >= 0 && s.count >= max {
+		return false
+	}
+	if _, ok := s.seen[key]; ok {
+		return false
+	}
+	s.seen[key] = struct{}{}
+	s.count++
+	return true
+}
+
+// adcAllowResult checks if the search result can be relayed to the searcher.
+func (h *Hub) adcAllowResult(from *adcPeer, p *adc.DirectPacket) bool {
+	to, ok := h.bySID(p.Targ).(*adcPeer)
+	if !ok {
+		return true
+	}
+	var res adc.SearchResult
+	if err := adc.Unmarshal(p.Data, &res); err != nil {
+		return false
+	}
+	conf := h.config()
+	now := h.now()
+	if conf.SearchResultRate > 0 && !from.search.allowSend(now, conf.SearchResultRate) {
+		return false
+	}
+	return to.search.allowRecv(now, res.Token, from.sid.String()+" "+res.Path, conf.MaxSearchResults)
+}
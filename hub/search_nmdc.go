@@ -0,0 +1,217 @@
+package hub
+
+import (
+	"math"
+	"strings"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+	"github.com/direct-connect/go-dcpp/tiger"
+)
+
+// nmdcSearchGroups maps NMDC search types to ADC extension groups (SEGA extension).
+var nmdcSearchGroups = map[nmdc.DataType]adc.ExtGroup{
+	nmdc.DataTypeAudio:      adc.ExtAudio,
+	nmdc.DataTypeCompressed: adc.ExtArch,
+	nmdc.DataTypeDocument:   adc.ExtDoc,
+	nmdc.DataTypeExecutable: adc.ExtExe,
+	nmdc.DataTypePicture:    adc.ExtImage,
+	nmdc.DataTypeVideo:      adc.ExtVideo,
+}
+
+// nmdcSearchToADC converts the search from the NMDC user to ADC SCH.
+//
+// NMDC has no search tokens, so the fake token is used. Results for the search are sent to the SID
+// of the NMDC user via the hub, since the hub never advertises UDP ports of NMDC users to ADC users.
+func nmdcSearchToADC(s nmdc.Search) adc.SearchRequest {
+	req := adc.SearchRequest{Token: nmdcFakeToken}
+	switch s.DataType {
+	case nmdc.DataTypeTTH:
+		req.Tiger = s.TTH.Base32()
+		return req
+	case nmdc.DataTypeFolder:
+		req.Type = adc.FileTypeDir
+	default:
+		req.Group = nmdcSearchGroups[s.DataType]
+	}
+	req.And = strings.Fields(string(s.Pattern))
+	if s.SizeRestricted && s.Size <= math.MaxInt64 {
+		if s.IsMaxSize {
+			req.Le = int64(s.Size)
+		} else {
+			req.Ge = int64(s.Size)
+		}
+	}
+	return req
+}
+
+// adcSearchToNMDC converts the ADC SCH to NMDC search. The nick of the searcher must be set by the caller.
+//
+// NMDC searches are less expressive, so the search may return more results than the original one.
+// It returns false if the search cannot be represented in NMDC at all.
+func adcSearchToNMDC(req adc.SearchRequest) (nmdc.Search, bool) {
+	s := nmdc.Search{DataType: nmdc.DataTypeAny}
+	if req.Tiger != "" {
+		if err := s.TTH.FromBase32(req.Tiger); err != nil {
+			return s, false
+		}
+		s.DataType = nmdc.DataTypeTTH
+		return s, true
+	}
+	if len(req.And) == 0 {
+		return s, false
+	}
+	s.Pattern = nmdc.String(strings.Join(req.And, " "))
+	switch {
+	case req.Le > 0:
+		s.SizeRestricted, s.IsMaxSize, s.Size = true, true, uint64(req.Le)
+	case req.Ge > 0:
+		s.SizeRestricted, s.Size = true, uint64(req.Ge)
+	case req.Eq > 0:
+		// NMDC cannot search for an exact size
+		s.SizeRestricted, s.Size = true, uint64(req.Eq)
+	}
+	if req.Type == adc.FileTypeDir {
+		s.DataType = nmdc.DataTypeFolder
+	} else {
+		for typ, g := range nmdcSearchGroups {
+			if req.Group == g {
+				s.DataType = typ
+				break
+			}
+		}
+	}
+	return s, true
+}
+
+// nmdcResultToADC converts the search result from the NMDC user to ADC RES with a given token.
+func nmdcResultToADC(sr nmdc.SR, token string) adc.SearchResult {
+	path := "/" + strings.ReplaceAll(string(sr.Path), "\\", "/")
+	if sr.IsDir {
+		path += "/"
+	}
+	return adc.SearchResult{
+		Token: token,
+		Path:  path,
+		Size:  int64(sr.Size),
+		Slots: sr.FreeSlots,
+		Tiger: sr.TTH,
+	}
+}
+
+// adcResultToNMDC converts the ADC RES to NMDC search result. ADC results have no total number of slots,
+// so it should be taken from the user info. The nick and the hub fields must be set by the caller.
+func adcResultToNMDC(res adc.SearchResult, slots int) nmdc.SR {
+	path := strings.TrimPrefix(res.Path, "/")
+	isDir := strings.HasSuffix(path, "/")
+	path = strings.TrimSuffix(path, "/")
+	return nmdc.SR{
+		Path:       nmdc.String(strings.ReplaceAll(path, "/", "\\")),
+		IsDir:      isDir,
+		Size:       uint64(res.Size),
+		FreeSlots:  res.Slots,
+		TotalSlots: slots,
+		TTH:        res.Tiger,
+	}
+}
+
+// nmdcSearch relays the search from the NMDC user to other users. Text fields must be in UTF-8.
+func (h *Hub) nmdcSearch(from *nmdcPeer, s nmdc.Search) {
+	req := nmdcSearchToADC(s)
+	for _, peer := range h.broadcastTargets(from, h.Peers()) {
+		if peer == from {
+			continue
+		}
+		switch p := peer.(type) {
+		case *nmdcPeer:
+			ps := p.encodeSearch(s)
+			h.countDrop(p, p.writeOne(&ps))
+		case *adcPeer:
+			if err := p.conn.WriteBroadcast(from.SID(), &req); err == nil {
+				_ = p.conn.Flush()
+			}
+		}
+	}
+}
+
+// adcSearchNMDC relays the search from the ADC user to NMDC users.
+// The token is remembered to route NMDC results back to the searcher.
+func (h *Hub) adcSearchNMDC(from Peer, req adc.SearchRequest, peers []Peer) {
+	if p, ok := from.(*adcPeer); ok {
+		p.search.addSearch(h.now(), req)
+	}
+	s, ok := adcSearchToNMDC(req)
+	if !ok {
+		return
+	}
+	// results should be sent via the hub, since ADC users cannot receive NMDC results over UDP
+	s.Nick = nmdc.Name(from.Name())
+	for _, peer := range peers {
+		if p, ok := peer.(*nmdcPeer); ok {
+			ps := p.encodeSearch(s)
+			_ = p.writeOne(&ps)
+		}
+	}
+}
+
+// nmdcResult relays the passive search result from the NMDC user to the searcher.
+// Text fields must be in UTF-8.
+func (h *Hub) nmdcResult(from *nmdcPeer, sr nmdc.SR, to Peer) {
+	switch p := to.(type) {
+	case *nmdcPeer:
+		sr.To = ""
+		sr = p.encodeResult(sr)
+		_ = p.writeOne(&sr)
+	case *adcPeer:
+		token := p.search.matchToken(h.now(), func(req adc.SearchRequest) bool {
+			return nmdcResultMatches(req, sr)
+		})
+		res := nmdcResultToADC(sr, token)
+		if !p.search.allowRecv(h.now(), token, from.SID().String()+" "+res.Path, h.config().MaxSearchResults) {
+			return
+		}
+		if err := p.conn.WriteDirect(from.SID(), p.SID(), &res); err == nil {
+			_ = p.conn.Flush()
+		}
+	}
+}
+
+// nmdcResultMatches checks if the result from the NMDC user satisfies the ADC search.
+// It's used to find the search token, since NMDC results have none.
+func nmdcResultMatches(req adc.SearchRequest, sr nmdc.SR) bool {
+	if req.Tiger != "" {
+		return sr.TTH != (tiger.Hash{}) && sr.TTH.Base32() == req.Tiger
+	}
+	if req.Type == adc.FileTypeDir && !sr.IsDir {
+		return false
+	}
+	path := strings.ToLower(string(sr.Path))
+	for _, w := range req.And {
+		if !strings.Contains(path, strings.ToLower(w)) {
+			return false
+		}
+	}
+	for _, w := range req.Not {
+		if strings.Contains(path, strings.ToLower(w)) {
+			return false
+		}
+	}
+	if sr.IsDir {
+		return true
+	}
+	size := int64(sr.Size)
+	return (req.Le <= 0 || size <= req.Le) && (req.Ge <= 0 || size >= req.Ge) &&
+		(req.Eq <= 0 || size == req.Eq)
+}
+
+// adcResultNMDC relays the search result from the ADC user to the NMDC searcher.
+func (h *Hub) adcResultNMDC(from *adcPeer, to *nmdcPeer, res adc.SearchResult) {
+	sr := adcResultToNMDC(res, from.Info().Slots)
+	sr.From = nmdc.Name(from.Name())
+	sr.HubName = nmdc.String(h.config().Name)
+	if addr := h.Addr(); addr != nil {
+		sr.HubAddr = addr.String()
+	}
+	sr = to.encodeResult(sr)
+	_ = to.writeOne(&sr)
+}
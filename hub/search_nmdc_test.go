@@ -0,0 +1,134 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+	"github.com/direct-connect/go-dcpp/tiger"
+)
+
+const testTTH = "TO32WPD6AQE7VA7654HEAM5GKFQGIL7F2BEKFNA"
+
+func TestNMDCSearchTTH(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+	carol := loginNMDC(t, h, "carol")
+	carolSID := h.byName("carol").SID()
+	bob.expectUser(carolSID)
+
+	carol.write(&nmdc.Search{Nick: "carol", DataType: nmdc.DataTypeTTH, TTH: tiger.MustParseBase32(testTTH)})
+	b := bob.expect("SCH").(*adc.BroadcastPacket)
+	var req adc.SearchRequest
+	if err := adc.Unmarshal(b.Data, &req); err != nil {
+		t.Fatal(err)
+	}
+	if b.ID != carolSID || req.Tiger != testTTH || req.Token == "" || len(req.And) != 0 {
+		t.Fatalf("unexpected search: %+v", req)
+	}
+
+	bob.sendResult(carolSID, adc.SearchResult{
+		Token: req.Token, Path: "/Linux/Gentoo.iso", Size: 1000, Slots: 1,
+		Tiger: tiger.MustParseBase32(testTTH),
+	})
+	sr := carol.expect("SR").(*nmdc.SR)
+	exp := nmdc.SR{
+		From: "bob", Path: "Linux\\Gentoo.iso", Size: 1000, FreeSlots: 1,
+		TTH: tiger.MustParseBase32(testTTH), HubAddr: sr.HubAddr,
+	}
+	if *sr != exp {
+		t.Fatalf("unexpected result: %+v", sr)
+	}
+}
+
+func TestADCSearchNMDC(t *testing.T) {
+	h := newTestHub(t)
+	carol := loginNMDC(t, h, "carol")
+	bob := loginADC(t, h, "bob")
+
+	err := bob.conn.WriteBroadcast(bob.sid, &adc.SearchRequest{
+		Token: "42", And: []string{"gentoo", "2005"}, Le: 5000, Type: adc.FileTypeAny,
+	})
+	if err == nil {
+		err = bob.conn.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := carol.expect("Search").(*nmdc.Search)
+	exp := nmdc.Search{
+		Nick: "bob", SizeRestricted: true, IsMaxSize: true, Size: 5000,
+		DataType: nmdc.DataTypeAny, Pattern: "gentoo 2005",
+	}
+	if *s != exp {
+		t.Fatalf("unexpected search: %+v", s)
+	}
+
+	carol.write(&nmdc.SR{
+		From: "carol", Path: "Linux\\gentoo 2005.iso", Size: 4000, FreeSlots: 1, TotalSlots: 2,
+		HubName: "test", HubAddr: "127.0.0.1:411", To: "bob",
+	})
+	carol.write(&nmdc.SR{
+		From: "carol", Path: "Linux\\gentoo 2005", IsDir: true, FreeSlots: 1, TotalSlots: 2,
+		HubName: "test", HubAddr: "127.0.0.1:411", To: "bob",
+	})
+	// results are relayed concurrently, so the order may change
+	paths := map[string]bool{"/Linux/gentoo 2005.iso": true, "/Linux/gentoo 2005/": true}
+	for i := 0; i < 2; i++ {
+		d := bob.expectDirect("RES")
+		var res adc.SearchResult
+		if err := adc.Unmarshal(d.Data, &res); err != nil {
+			t.Fatal(err)
+		}
+		if d.ID != h.byName("carol").SID() || res.Token != "42" || !paths[res.Path] || res.Slots != 1 {
+			t.Fatalf("unexpected result: %+v", res)
+		}
+		delete(paths, res.Path)
+	}
+}
+
+func TestADCSearchNMDCTokens(t *testing.T) {
+	h := newTestHub(t)
+	carol := loginNMDC(t, h, "carol")
+	bob := loginADC(t, h, "bob")
+
+	// several searches are in flight, and results for older searches arrive last
+	for _, req := range []adc.SearchRequest{
+		{Token: "1", And: []string{"gentoo"}},
+		{Token: "2", Tiger: testTTH},
+		{Token: "3", And: []string{"ubuntu"}, Ge: 1000},
+	} {
+		err := bob.conn.WriteBroadcast(bob.sid, &req)
+		if err == nil {
+			err = bob.conn.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		carol.expect("Search")
+	}
+	exp := map[string]string{
+		"/Linux/Ubuntu 18.04.iso": "3",
+		"/Linux/Other.iso":        "2",
+		"/Linux/gentoo.iso":       "1",
+	}
+	for _, sr := range []nmdc.SR{
+		{Path: "Linux\\Ubuntu 18.04.iso", Size: 2000},
+		{Path: "Linux\\Other.iso", Size: 3000, TTH: tiger.MustParseBase32(testTTH)},
+		{Path: "Linux\\gentoo.iso", Size: 4000},
+	} {
+		sr.From, sr.To, sr.FreeSlots, sr.TotalSlots = "carol", "bob", 1, 2
+		sr.HubName, sr.HubAddr = "test", "127.0.0.1:411"
+		carol.write(&sr)
+	}
+	for i := 0; i < len(exp); i++ {
+		var res adc.SearchResult
+		if err := adc.Unmarshal(bob.expectDirect("RES").Data, &res); err != nil {
+			t.Fatal(err)
+		}
+		if tok, ok := exp[res.Path]; !ok || res.Token != tok {
+			t.Fatalf("unexpected token for %q: %q", res.Path, res.Token)
+		}
+		delete(exp, res.Path)
+	}
+}
@@ -0,0 +1,108 @@
+package hub
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+func (c *testADC) sendResult(to adc.SID, res adc.SearchResult) {
+	err := c.conn.WriteDirect(c.sid, to, &res)
+	if err == nil {
+		err = c.conn.Flush()
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expectResults receives n search results and a given chat message.
+// Results are relayed asynchronously, thus the message may arrive before the results.
+func (c *testADC) expectResults(n int, done string) []adc.SearchResult {
+	var (
+		out    []adc.SearchResult
+		isDone bool
+	)
+	for !isDone || len(out) < n {
+		p := c.next()
+		switch p.Message().Type.String() {
+		case "RES":
+			var res adc.SearchResult
+			if err := adc.Unmarshal(p.Message().Data, &res); err != nil {
+				c.t.Fatal(err)
+			}
+			out = append(out, res)
+			if len(out) > n {
+				c.t.Fatalf("unexpected result: %+v", res)
+			}
+		case "MSG":
+			var m adc.ChatMessage
+			if err := adc.Unmarshal(p.Message().Data, &m); err != nil {
+				c.t.Fatal(err)
+			}
+			if string(m.Text) == done {
+				isDone = true
+			}
+		}
+	}
+	return out
+}
+
+func TestSearchResultsCap(t *testing.T) {
+	h := New(Config{Name: "test", MaxSearchResults: 2})
+	alice := loginADC(t, h, "alice")
+	bob := loginADC(t, h, "bob")
+	carol := loginADC(t, h, "carol")
+
+	bob.sendResult(alice.sid, adc.SearchResult{Token: "1", Path: "/a", Size: 1})
+	// duplicates are dropped
+	bob.sendResult(alice.sid, adc.SearchResult{Token: "1", Path: "/a", Size: 1})
+	carol.sendResult(alice.sid, adc.SearchResult{Token: "1", Path: "/a", Size: 1})
+	carol.sendResult(alice.sid, adc.SearchResult{Token: "1", Path: "/b", Size: 1})
+	bob.sendResult(alice.sid, adc.SearchResult{Token: "1", Path: "/c", Size: 1})
+	// other searches are counted separately
+	bob.sendResult(alice.sid, adc.SearchResult{Token: "2", Path: "/c", Size: 1})
+	bob.sendChat("done")
+
+	res := alice.expectResults(3, "done")
+	var tokens string
+	for _, r := range res {
+		tokens += r.Token
+	}
+	if tokens != "112" && tokens != "121" && tokens != "211" {
+		t.Fatalf("unexpected results: %+v", res)
+	}
+}
+
+func TestSearchResultRate(t *testing.T) {
+	h := New(Config{Name: "test", SearchResultRate: 2})
+	alice := loginADC(t, h, "alice")
+	bob := loginADC(t, h, "bob")
+
+	for i := 0; i < 5; i++ {
+		bob.sendResult(alice.sid, adc.SearchResult{Token: "1", Path: "/" + strconv.Itoa(i), Size: 1})
+	}
+	bob.sendChat("done")
+	alice.expectResults(2, "done")
+}
+
+func TestSearchResultRateWindow(t *testing.T) {
+	clock := newTestClock()
+	h := newHub(Config{Name: "test", SearchResultRate: 2}, clock.Now)
+	alice := loginADC(t, h, "alice")
+	bob := loginADC(t, h, "bob")
+
+	// the clock is stopped, so all results fall into the same window
+	send := func(token string) {
+		for i := 0; i < 5; i++ {
+			bob.sendResult(alice.sid, adc.SearchResult{Token: token, Path: "/" + strconv.Itoa(i), Size: 1})
+		}
+		bob.sendChat("done " + token)
+		alice.expectResults(2, "done "+token)
+	}
+	send("1")
+	clock.Advance(time.Second)
+	send("2")
+}
@@ -0,0 +1,73 @@
+package hub
+
+import (
+	"fmt"
+	"net"
+)
+
+// parseIPNet parses a CIDR subnet, for example "10.0.0.0/24" or "2001:db8::/32".
+// A single IP address is treated as a subnet containing only that address.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return hostNet(ip), nil
+	}
+	_, sub, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q", s)
+	}
+	return sub, nil
+}
+
+// hostNet returns a subnet that contains only a given IP address.
+func hostNet(ip net.IP) *net.IPNet {
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// peersIn returns all users connected from the subnet. Virtual peers are never included.
+func (h *Hub) peersIn(sub *net.IPNet) []Peer {
+	var out []Peer
+	for _, p := range h.Peers() {
+		if isVirtual(p) {
+			continue
+		}
+		if ip := remoteIP(p.RemoteAddr()); ip != nil && sub.Contains(ip) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// SessionsByIP returns all users connected from a given IP address.
+func (h *Hub) SessionsByIP(ip net.IP) []Peer {
+	return h.peersIn(hostNet(ip))
+}
+
+// KickByIP disconnects all users connected from the subnet and returns the number of kicked users.
+// The subnet is either a CIDR, for example "10.0.0.0/24" or "2001:db8::/32", or a single IP address.
+// Nobody is kicked if the subnet is invalid.
+func (h *Hub) KickByIP(cidr string, reason string) int {
+	sub, err := parseIPNet(cidr)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, p := range h.peersIn(sub) {
+		if err := p.Kick(reason); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Redirect disconnects the peer and asks it to connect to the hub at a given address instead.
+// Only ADC clients support redirects, peers using other protocols are kicked with the reason.
+func (h *Hub) Redirect(peer Peer, addr, reason string) error {
+	if p, ok := peer.(*adcPeer); ok {
+		return p.Redirect(addr, reason)
+	}
+	return peer.Kick(reason)
+}
@@ -0,0 +1,65 @@
+package hub
+
+import (
+	"net"
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/nmdc"
+)
+
+func TestKickByIP(t *testing.T) {
+	h := newTestHub(t)
+	from := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000}
+	}
+	login := func(name, ip string) *testADC {
+		c := dialADCFrom(t, h, from(ip))
+		c.handshake()
+		c.identify(adc.User{Name: name})
+		c.expectUser(c.sid)
+		waitPeer(t, h, name)
+		return c
+	}
+	bob := login("bob", "10.0.0.1")
+	alice := login("alice", "10.0.0.200")
+	login("carol", "10.0.1.1")
+	dave := login("dave", "2001:db8::1")
+	loginNMDCFrom(t, h, from("10.0.0.3"), nmdc.MyInfo{Name: "eve"})
+
+	if list := h.SessionsByIP(net.ParseIP("10.0.0.200")); len(list) != 1 || list[0].Name() != "alice" {
+		t.Fatalf("unexpected sessions: %v", list)
+	}
+	if list := h.SessionsByIP(net.ParseIP("10.0.0.2")); len(list) != 0 {
+		t.Fatalf("unexpected sessions: %v", list)
+	}
+
+	if n := h.KickByIP("invalid", "attack"); n != 0 {
+		t.Fatalf("unexpected count: %d", n)
+	}
+	if n := h.KickByIP("10.0.0.0/24", "attack"); n != 3 {
+		t.Fatalf("unexpected count: %d", n)
+	}
+	if m := bob.expectQuit(bob.sid); m.Message != "attack" {
+		t.Fatalf("unexpected reason: %q", m.Message)
+	}
+	alice.expectQuit(alice.sid)
+	for _, name := range []string{"bob", "alice", "eve"} {
+		if h.byName(name) != nil {
+			t.Fatalf("%s is still on the hub", name)
+		}
+	}
+	for _, name := range []string{"carol", "dave"} {
+		if h.byName(name) == nil {
+			t.Fatalf("%s was kicked", name)
+		}
+	}
+
+	if n := h.KickByIP("2001:db8::/32", "attack"); n != 1 {
+		t.Fatalf("unexpected count: %d", n)
+	}
+	dave.expectQuit(dave.sid)
+	if h.byName("carol") == nil {
+		t.Fatal("carol was kicked")
+	}
+}
@@ -0,0 +1,99 @@
+package hub
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+var errViewerReadOnly = errors.New("read-only connection")
+
+// ServeViewer serves a read-only ADC connection, for example for a web chat widget.
+//
+// Viewers only send SUP and receive a SID, the user list and the main chat. They do not
+// identify themselves, are not visible to other users, do not count toward the user limit,
+// and any messages they send are rejected.
+func (h *Hub) ServeViewer(conn net.Conn) error {
+	log.Printf("%s: using ADC (viewer)", conn.RemoteAddr())
+	c, err := adc.NewConn(conn)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	peer, err := h.adcStageProtocol(c, h.config().loginDeadline())
+	if err != nil {
+		return err
+	}
+	if !peer.fea.IsSet(adc.FeaPING) {
+		// hub info was not sent yet
+		if err = peer.sendInfo(h.adcHubInfo()); err != nil {
+			return err
+		}
+	}
+
+	h.peers.Lock()
+	list := h.listVisible()
+	h.peers.viewers[peer.sid] = peer
+	stale := h.hubInfoChanged(&peer.BasePeer)
+	h.peers.Unlock()
+	defer func() {
+		h.peers.Lock()
+		delete(h.peers.viewers, peer.sid)
+		h.peers.Unlock()
+		_ = peer.Close()
+	}()
+
+	if stale {
+		if err = peer.sendHubInfo(); err != nil {
+			return err
+		}
+	}
+	if err = peer.PeersJoin(list); err != nil {
+		return err
+	}
+	if err = h.sendWelcome(peer); err != nil {
+		return err
+	}
+	return h.viewerServe(peer)
+}
+
+func (h *Hub) viewerServe(peer *adcPeer) error {
+	peer.conn.KeepAlive(time.Minute / 2)
+	for {
+		p, err := peer.conn.ReadPacket(time.Time{})
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hp, ok := p.(*adc.HubPacket); ok && hp.Name == (adc.Disconnect{}).Cmd() {
+			return nil
+		}
+		err = peer.sendError(adc.Recoverable, adc.CodeAccessDenied, errViewerReadOnly,
+			adc.StatusParam{Name: "FC", Value: adc.FourCC(p)})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// viewerList returns a snapshot of read-only peers.
+func (h *Hub) viewerList() []Peer {
+	h.peers.RLock()
+	defer h.peers.RUnlock()
+	list := make([]Peer, 0, len(h.peers.viewers))
+	for _, p := range h.peers.viewers {
+		list = append(list, p)
+	}
+	return list
+}
+
+// visibleToViewers checks if the broadcast message should be sent to read-only peers.
+func visibleToViewers(name adc.MsgType) bool {
+	return name == (adc.ChatMessage{}).Cmd() || name == (adc.User{}).Cmd()
+}
@@ -0,0 +1,105 @@
+package hub
+
+import (
+	"net"
+	"testing"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+// dialViewer connects to the hub as a read-only viewer.
+func dialViewer(t *testing.T, h *Hub) *testADC {
+	c1, c2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := h.ServeViewer(c2); err != nil {
+			t.Log(err)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = c1.Close()
+		<-done
+	})
+	c := newTestADC(t, c1)
+	c.handshake()
+	return c
+}
+
+func TestViewer(t *testing.T) {
+	h := newTestHub(t)
+	bob := loginADC(t, h, "bob")
+
+	v := dialViewer(t, h)
+	v.expectUser(bob.sid)
+
+	alice := loginADC(t, h, "alice")
+	v.expectUser(alice.sid)
+	if n := h.UserCount(); n != 2 {
+		t.Fatalf("viewer should not be counted: %d users", n)
+	}
+	for _, u := range h.ListUsers() {
+		if u.Name != "alice" && u.Name != "bob" {
+			t.Fatalf("unexpected user: %+v", u)
+		}
+	}
+
+	bob.sendChat("hi")
+	v.expectChat("hi")
+
+	// viewers cannot send messages
+	err := v.conn.WriteBroadcast(v.sid, &adc.ChatMessage{Text: "spam"})
+	if err == nil {
+		err = v.conn.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, ok := v.expectInfo().(adc.Status); !ok || st.Sev != adc.Recoverable || st.Code != 25 {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+	bob.sendChat("done")
+	for {
+		var m adc.ChatMessage
+		if err := adc.Unmarshal(alice.expect("MSG").Message().Data, &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Text == "spam" {
+			t.Fatal("message from the viewer was broadcasted")
+		} else if m.Text == "done" {
+			break
+		}
+	}
+
+	// viewers see users leaving
+	_ = h.byName("alice").Close()
+	var m adc.Disconnect
+	if err := adc.Unmarshal(v.expect("QUI").Message().Data, &m); err != nil {
+		t.Fatal(err)
+	} else if m.ID != alice.sid {
+		t.Fatalf("unexpected QUI: %+v", m)
+	}
+}
+
+func TestViewerRejectSearch(t *testing.T) {
+	h := newTestHub(t)
+	v := dialViewer(t, h)
+
+	err := v.conn.WriteBroadcast(v.sid, &adc.SearchRequest{And: []string{"some", "data"}, Token: "1"})
+	if err == nil {
+		err = v.conn.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st adc.Status
+	if err := adc.Unmarshal(v.expect("STA").Message().Data, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Sev != adc.Recoverable || st.Code != adc.CodeAccessDenied {
+		t.Fatalf("unexpected status: %#v", st)
+	}
+	if fc, _ := st.Param("FC"); fc != "BSCH" {
+		t.Fatalf("unexpected offending command: %q", fc)
+	}
+}
@@ -0,0 +1,55 @@
+package hub
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsConn adapts the WebSocket connection to net.Conn. Data is sent in text frames, one frame per write,
+// and received frames are read as a stream, so protocol messages may span frames.
+type wsConn struct {
+	*websocket.Conn
+	addr net.Addr
+}
+
+// RemoteAddr returns the address of the client. The WebSocket connection reports its origin instead.
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// isWebSocket checks if the HTTP request asks to upgrade the connection to WebSocket.
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// ServeWebSocket upgrades the HTTP request to WebSocket and serves ADC over it, for example for
+// browser-based clients. The handshake and the hub checks are the same as for other ADC connections.
+//
+// Clients should send ADC messages in text frames. The hub may put multiple messages into one frame,
+// so clients must split frames by newlines. Requests from any origin are accepted.
+func (h *Hub) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "invalid remote address", http.StatusBadRequest)
+		return
+	}
+	s := websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			conn := &wsConn{Conn: ws, addr: addr}
+			log.Printf("%s: using WebSocket", addr)
+			if err := h.admit(conn); err != nil {
+				log.Printf("%s: %v", addr, err)
+				return
+			}
+			err := h.serveCaptured(h.limitConn(conn), h.ServeADC)
+			if err != nil {
+				log.Printf("%s: %v", addr, err)
+			}
+		},
+	}
+	s.ServeHTTP(w, r)
+}
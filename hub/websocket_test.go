@@ -0,0 +1,39 @@
+package hub
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/direct-connect/go-dcpp/adc"
+)
+
+func TestWebSocket(t *testing.T) {
+	h := newTestHub(t)
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ws.Close()
+	})
+	bob := newTestADC(t, ws)
+	bob.handshake()
+	bob.identify(adc.User{Name: "bob"})
+	bob.expectUser(bob.sid)
+	p := waitPeer(t, h, "bob")
+	if ip := remoteIP(p.RemoteAddr()); ip == nil || !ip.IsLoopback() {
+		t.Fatalf("unexpected address: %v", p.RemoteAddr())
+	}
+
+	alice := loginADC(t, h, "alice")
+	bob.sendChat("hello")
+	alice.expectChat("hello")
+	alice.sendChat("hi")
+	bob.expectChat("hi")
+}
@@ -79,7 +79,8 @@ func Dial(addr string) (*Conn, error) {
 // NewConn runs an NMDC protocol over a specified connection.
 func NewConn(conn net.Conn) (*Conn, error) {
 	c := &Conn{
-		conn: conn,
+		conn:   conn,
+		closed: make(chan struct{}),
 	}
 	c.write.w = bufio.NewWriter(conn)
 	c.read.r = conn
@@ -89,7 +90,9 @@ func NewConn(conn net.Conn) (*Conn, error) {
 
 // Conn is a NMDC protocol connection.
 type Conn struct {
-	closed chan struct{}
+	closeOnce sync.Once
+	closed    chan struct{}
+	keepAlive sync.Once
 
 	// bin should be acquired as RLock on commands read/write
 	// and as Lock when switching to binary mode.
@@ -117,43 +120,65 @@ func (c *Conn) RemoteAddr() net.Addr {
 
 // Close closes the connection.
 func (c *Conn) Close() error {
-	if c.closed != nil {
-		select {
-		case <-c.closed:
-		default:
-			close(c.closed)
-		}
-	}
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
 	return c.conn.Close()
 }
 
 // KeepAlive starts sending keep-alive messages on the connection.
 func (c *Conn) KeepAlive(interval time.Duration) {
-	if c.closed != nil {
-		// already enabled
-		return
-	}
-	c.closed = make(chan struct{})
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-c.closed:
-				return
-			case <-ticker.C:
-			}
-			// empty message serves as keep-alive for NMDC
-			err := c.writeRaw([]byte("|"))
-			if err == nil {
-				err = c.Flush()
-			}
-			if err != nil {
-				_ = c.Close()
-				return
-			}
+	c.keepAlive.Do(func() {
+		go c.keepAliveLoop(interval)
+	})
+}
+
+func (c *Conn) keepAliveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		// empty message serves as keep-alive for NMDC
+		err := c.writeRaw([]byte("|"))
+		if err == nil {
+			err = c.Flush()
 		}
-	}()
+		if err != nil {
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+// Ping sends a keep-alive message and flushes the buffer. It fails if the write
+// is not completed within a given timeout, which usually means that the connection is dead.
+func (c *Conn) Ping(timeout time.Duration) error {
+	// make sure connection is not in binary mode
+	c.bin.RLock()
+	defer c.bin.RUnlock()
+
+	c.write.Lock()
+	defer c.write.Unlock()
+
+	if err := c.write.err; err != nil {
+		return err
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer c.conn.SetWriteDeadline(time.Time{})
+
+	// empty message serves as keep-alive for NMDC
+	_, err := c.write.w.Write([]byte("|"))
+	if err == nil {
+		err = c.write.w.Flush()
+	}
+	if err != nil {
+		c.write.err = err
+	}
+	return err
 }
 
 func (c *Conn) WriteMsg(m Message) error {
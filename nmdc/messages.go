@@ -7,6 +7,8 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+
+	"github.com/direct-connect/go-dcpp/tiger"
 )
 
 var (
@@ -21,11 +23,16 @@ func init() {
 	RegisterMessage(&MyNick{})
 	RegisterMessage(&ValidateNick{})
 	RegisterMessage(&ValidateDenide{})
+	RegisterMessage(&GetPass{})
+	RegisterMessage(&MyPass{})
+	RegisterMessage(&BadPass{})
+	RegisterMessage(&LogedIn{})
 	RegisterMessage(&Quit{})
 	RegisterMessage(&Lock{})
 	RegisterMessage(&Key{})
 	RegisterMessage(&Supports{})
 	RegisterMessage(&GetNickList{})
+	RegisterMessage(&HubIsFull{})
 	RegisterMessage(&HubINFO{})
 	RegisterMessage(&MyInfo{})
 	RegisterMessage(&OpList{})
@@ -37,6 +44,8 @@ func init() {
 	RegisterMessage(&Failed{})
 	RegisterMessage(&Error{})
 	RegisterMessage(&FailOver{})
+	RegisterMessage(&Search{})
+	RegisterMessage(&SR{})
 }
 
 type Message interface {
@@ -161,6 +170,50 @@ func (*ValidateDenide) Cmd() string {
 	return "ValidateDenide"
 }
 
+type GetPass struct{}
+
+func (*GetPass) Cmd() string {
+	return "GetPass"
+}
+
+func (m *GetPass) MarshalNMDC() ([]byte, error) {
+	return nil, nil
+}
+
+func (m *GetPass) UnmarshalNMDC(data []byte) error {
+	return nil
+}
+
+type MyPass struct {
+	String
+}
+
+func (*MyPass) Cmd() string {
+	return "MyPass"
+}
+
+type BadPass struct{}
+
+func (*BadPass) Cmd() string {
+	return "BadPass"
+}
+
+func (m *BadPass) MarshalNMDC() ([]byte, error) {
+	return nil, nil
+}
+
+func (m *BadPass) UnmarshalNMDC(data []byte) error {
+	return nil
+}
+
+type LogedIn struct {
+	Name
+}
+
+func (*LogedIn) Cmd() string {
+	return "LogedIn"
+}
+
 type Quit struct {
 	Name
 }
@@ -299,6 +352,20 @@ func (m *GetNickList) UnmarshalNMDC(data []byte) error {
 	return nil
 }
 
+type HubIsFull struct{}
+
+func (*HubIsFull) Cmd() string {
+	return "HubIsFull"
+}
+
+func (m *HubIsFull) MarshalNMDC() ([]byte, error) {
+	return nil, nil
+}
+
+func (m *HubIsFull) UnmarshalNMDC(data []byte) error {
+	return nil
+}
+
 type HubINFO struct {
 	Name     Name
 	Host     string
@@ -935,3 +1002,268 @@ func (m *FailOver) UnmarshalNMDC(data []byte) error {
 	}
 	return nil
 }
+
+// DataType is a file type filter of the search.
+type DataType int
+
+const (
+	DataTypeAny        = DataType(1)
+	DataTypeAudio      = DataType(2)
+	DataTypeCompressed = DataType(3)
+	DataTypeDocument   = DataType(4)
+	DataTypeExecutable = DataType(5)
+	DataTypePicture    = DataType(6)
+	DataTypeVideo      = DataType(7)
+	DataTypeFolder     = DataType(8)
+	DataTypeTTH        = DataType(9)
+)
+
+// tthPrefix is a prefix of TTH search patterns and of the hub name field in search results.
+const tthPrefix = "TTH:"
+
+// Search is a search request. Active users set the Address to receive the results over UDP.
+// Passive users set the Nick instead, and receive the results via the hub.
+type Search struct {
+	Address string
+	Nick    Name
+
+	SizeRestricted bool
+	IsMaxSize      bool
+	Size           uint64
+	DataType       DataType
+	// Pattern is a space-separated list of words. It is empty for TTH searches.
+	Pattern String
+	TTH     tiger.Hash
+}
+
+func (*Search) Cmd() string {
+	return "Search"
+}
+
+func (m *Search) MarshalNMDC() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if m.Address != "" {
+		buf.WriteString(m.Address)
+	} else {
+		nick, err := m.Nick.MarshalNMDC()
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("Hub:")
+		buf.Write(nick)
+	}
+	buf.WriteByte(' ')
+	for _, f := range []bool{m.SizeRestricted, m.IsMaxSize} {
+		if f {
+			buf.WriteString("T?")
+		} else {
+			buf.WriteString("F?")
+		}
+	}
+	buf.WriteString(strconv.FormatUint(m.Size, 10))
+	buf.WriteByte('?')
+	typ := m.DataType
+	if typ == 0 {
+		typ = DataTypeAny
+	}
+	buf.WriteString(strconv.Itoa(int(typ)))
+	buf.WriteByte('?')
+	if typ == DataTypeTTH {
+		buf.WriteString(tthPrefix + m.TTH.Base32())
+		return buf.Bytes(), nil
+	}
+	for i, w := range strings.Split(string(m.Pattern), " ") {
+		if i != 0 {
+			buf.WriteByte('$')
+		}
+		buf.WriteString(Escape(w))
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *Search) UnmarshalNMDC(data []byte) error {
+	i := bytes.IndexByte(data, ' ')
+	if i < 0 {
+		return errors.New("invalid search command")
+	}
+	if addr := data[:i]; bytes.HasPrefix(addr, []byte("Hub:")) {
+		if err := m.Nick.UnmarshalNMDC(addr[4:]); err != nil {
+			return err
+		}
+	} else {
+		m.Address = string(addr)
+	}
+	fields := bytes.SplitN(data[i+1:], []byte("?"), 5)
+	if len(fields) != 5 {
+		return errors.New("invalid search command")
+	}
+	for i, ptr := range []*bool{&m.SizeRestricted, &m.IsMaxSize} {
+		switch string(fields[i]) {
+		case "T":
+			*ptr = true
+		case "F":
+			*ptr = false
+		default:
+			return fmt.Errorf("invalid search flag: %q", fields[i])
+		}
+	}
+	var err error
+	m.Size, err = strconv.ParseUint(string(fields[2]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid search size: %v", err)
+	}
+	typ, err := strconv.Atoi(string(fields[3]))
+	if err != nil || typ < int(DataTypeAny) || typ > int(DataTypeTTH) {
+		return fmt.Errorf("invalid search type: %q", fields[3])
+	}
+	m.DataType = DataType(typ)
+	pattern := fields[4]
+	if m.DataType == DataTypeTTH {
+		if !bytes.HasPrefix(pattern, []byte(tthPrefix)) {
+			return fmt.Errorf("invalid TTH search: %q", pattern)
+		}
+		return m.TTH.FromBase32(string(pattern[len(tthPrefix):]))
+	}
+	words := bytes.Split(pattern, []byte("$"))
+	list := make([]string, 0, len(words))
+	for _, w := range words {
+		list = append(list, Unescape(string(w)))
+	}
+	m.Pattern = String(strings.Join(list, " "))
+	return nil
+}
+
+// SR is a search result. Passive results are sent to the hub with the nick of the searcher,
+// and the hub removes it before sending the result to the searcher.
+type SR struct {
+	From Name
+	// Path is a path of a file or a directory, separated with '\'.
+	Path       String
+	IsDir      bool
+	Size       uint64
+	FreeSlots  int
+	TotalSlots int
+	// TTH of the file is sent instead of the hub name, if set.
+	TTH     tiger.Hash
+	HubName String
+	HubAddr string
+	To      Name
+}
+
+func (*SR) Cmd() string {
+	return "SR"
+}
+
+func (m *SR) MarshalNMDC() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	from, err := m.From.MarshalNMDC()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(from)
+	buf.WriteByte(' ')
+	path, err := m.Path.MarshalNMDC()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(path)
+	if !m.IsDir {
+		buf.WriteByte(0x05)
+		buf.WriteString(strconv.FormatUint(m.Size, 10))
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Itoa(m.FreeSlots))
+	buf.WriteByte('/')
+	buf.WriteString(strconv.Itoa(m.TotalSlots))
+	buf.WriteByte(0x05)
+	if !m.TTH.IsZero() {
+		buf.WriteString(tthPrefix + m.TTH.Base32())
+	} else {
+		name, err := m.HubName.MarshalNMDC()
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+	}
+	buf.WriteString(" (")
+	buf.WriteString(m.HubAddr)
+	buf.WriteByte(')')
+	if m.To != "" {
+		to, err := m.To.MarshalNMDC()
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(0x05)
+		buf.Write(to)
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *SR) UnmarshalNMDC(data []byte) error {
+	fields := bytes.Split(data, []byte{0x05})
+	if last := fields[len(fields)-1]; len(fields) > 2 && !bytes.HasSuffix(last, []byte(")")) {
+		if err := m.To.UnmarshalNMDC(last); err != nil {
+			return err
+		}
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) != 2 && len(fields) != 3 {
+		return errors.New("invalid search result")
+	}
+	// hub name or TTH, followed by the hub address
+	hub := fields[len(fields)-1]
+	i := bytes.LastIndex(hub, []byte(" ("))
+	if i < 0 || !bytes.HasSuffix(hub, []byte(")")) {
+		return errors.New("invalid hub in search result")
+	}
+	m.HubAddr = string(hub[i+2 : len(hub)-1])
+	if name := hub[:i]; bytes.HasPrefix(name, []byte(tthPrefix)) {
+		if err := m.TTH.FromBase32(string(name[len(tthPrefix):])); err != nil {
+			return err
+		}
+	} else if err := m.HubName.UnmarshalNMDC(name); err != nil {
+		return err
+	}
+	// nick and path, followed by the size and slots for files, or only slots for directories
+	i = bytes.IndexByte(fields[0], ' ')
+	if i < 0 {
+		return errors.New("invalid search result")
+	}
+	if err := m.From.UnmarshalNMDC(fields[0][:i]); err != nil {
+		return err
+	}
+	path, slots := fields[0][i+1:], fields[1]
+	if len(fields) == 2 {
+		m.IsDir = true
+		i = bytes.LastIndexByte(path, ' ')
+		if i < 0 {
+			return errors.New("invalid search result")
+		}
+		path, slots = path[:i], path[i+1:]
+	} else {
+		i = bytes.IndexByte(slots, ' ')
+		if i < 0 {
+			return errors.New("invalid search result")
+		}
+		size, err := strconv.ParseUint(string(slots[:i]), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid size in search result: %v", err)
+		}
+		m.Size, slots = size, slots[i+1:]
+	}
+	if err := m.Path.UnmarshalNMDC(path); err != nil {
+		return err
+	}
+	i = bytes.IndexByte(slots, '/')
+	if i < 0 {
+		return errors.New("invalid slots in search result")
+	}
+	var err error
+	if m.FreeSlots, err = strconv.Atoi(string(slots[:i])); err != nil {
+		return fmt.Errorf("invalid slots in search result: %v", err)
+	}
+	if m.TotalSlots, err = strconv.Atoi(string(slots[i+1:])); err != nil {
+		return fmt.Errorf("invalid slots in search result: %v", err)
+	}
+	return nil
+}
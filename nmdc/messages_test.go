@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"reflect"
 	"testing"
+
+	"github.com/direct-connect/go-dcpp/tiger"
 )
 
 var casesUnmarshal = []struct {
@@ -224,6 +226,58 @@ var casesUnmarshal = []struct {
 			Text: "message",
 		},
 	},
+	{
+		typ:  "Search",
+		name: "active",
+		data: `192.168.1.5:412 T?T?500000?1?Gentoo$2005`,
+		msg: &Search{
+			Address:        "192.168.1.5:412",
+			SizeRestricted: true,
+			IsMaxSize:      true,
+			Size:           500000,
+			DataType:       DataTypeAny,
+			Pattern:        "Gentoo 2005",
+		},
+	},
+	{
+		typ:  "Search",
+		name: "passive TTH",
+		data: `Hub:john F?T?0?9?TTH:TO32WPD6AQE7VA7654HEAM5GKFQGIL7F2BEKFNA`,
+		msg: &Search{
+			Nick:      "john",
+			IsMaxSize: true,
+			DataType:  DataTypeTTH,
+			TTH:       tiger.MustParseBase32("TO32WPD6AQE7VA7654HEAM5GKFQGIL7F2BEKFNA"),
+		},
+	},
+	{
+		typ:  "SR",
+		name: "file",
+		data: "john Linux\\Gentoo 2005.iso\x05437331968 1/2\x05TTH:TO32WPD6AQE7VA7654HEAM5GKFQGIL7F2BEKFNA (192.168.1.1:411)\x05peter",
+		msg: &SR{
+			From:       "john",
+			Path:       "Linux\\Gentoo 2005.iso",
+			Size:       437331968,
+			FreeSlots:  1,
+			TotalSlots: 2,
+			TTH:        tiger.MustParseBase32("TO32WPD6AQE7VA7654HEAM5GKFQGIL7F2BEKFNA"),
+			HubAddr:    "192.168.1.1:411",
+			To:         "peter",
+		},
+	},
+	{
+		typ:  "SR",
+		name: "directory",
+		data: "john Linux\\Gentoo 0/2\x05Test hub (192.168.1.1:411)",
+		msg: &SR{
+			From:       "john",
+			Path:       "Linux\\Gentoo",
+			IsDir:      true,
+			TotalSlots: 2,
+			HubName:    "Test hub",
+			HubAddr:    "192.168.1.1:411",
+		},
+	},
 }
 
 func TestUnmarshal(t *testing.T) {
@@ -36,6 +36,7 @@ type timeoutErr interface {
 	Timeout() bool
 }
 
+// Ping fetches the information about the hub by logging in as a pinger.
 func Ping(ctx context.Context, addr string) (*HubInfo, error) {
 	addr, err := NormalizeAddr(addr)
 	if err != nil {
@@ -48,13 +49,19 @@ func Ping(ctx context.Context, addr string) (*HubInfo, error) {
 		return nil, err
 	}
 	defer c.Close()
+	return PingConn(ctx, c)
+}
 
+// PingConn is like Ping, but uses an existing connection. Nothing should be read from
+// the connection before the call. The connection is not closed.
+func PingConn(ctx context.Context, c *Conn) (*HubInfo, error) {
 	// set deadline once
 	deadline, ok := ctx.Deadline()
 	if !ok {
 		deadline = time.Now().Add(time.Second * 10)
 	}
-	if err = c.conn.SetDeadline(deadline); err != nil {
+	err := c.conn.SetDeadline(deadline)
+	if err != nil {
 		return nil, err
 	}
 
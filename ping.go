@@ -2,29 +2,122 @@ package dc
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/direct-connect/go-dcpp/adc"
 	"github.com/direct-connect/go-dcpp/nmdc"
 )
 
+// Error is returned by Ping if the hub was reached, but the ping failed. The kind of the failure
+// can be checked with errors.Is, while the underlying error is still available to errors.As.
+type Error struct {
+	Kind error // ErrPingTimeout or ErrProtocol
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// pingError classifies the error returned by the probe or the protocol-specific ping.
+// Network errors other than timeouts are returned as-is.
+func pingError(err error) error {
+	if err == nil || errors.Is(err, ErrUnsupportedProtocol) {
+		return err
+	}
+	var te timeoutErr
+	if errors.As(err, &te) && te.Timeout() {
+		return &Error{Kind: ErrPingTimeout, Err: err}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	return &Error{Kind: ErrProtocol, Err: err}
+}
+
 // Ping fetches the information about the specified hub.
+//
+// The address is either a host with an optional port, or a hub URI, for example "adc://example.com:411".
+// ADCS URIs may include the keyprint of the hub certificate: "adcs://example.com:411/?kp=SHA256/...".
+// The hub is only pinged if its certificate matches the keyprint.
+//
+// Errors can be checked with errors.Is against ErrUnsupportedProtocol, ErrPingTimeout, ErrProtocol
+// and ErrKeyprintMismatch. Other errors come from the network, for example if the connection was refused,
+// or report an invalid address.
 func Ping(ctx context.Context, addr string) (*HubInfo, error) {
+	addr, kp, err := parseHubURI(addr)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ping(ctx, addr, kp)
+	if err != nil {
+		return nil, pingError(err)
+	}
+	return info, nil
+}
+
+// parseHubURI parses the hub URI and returns it without ADC URI parameters, and the keyprint of the hub
+// certificate from the "kp" parameter. Other parameters are ignored. Addresses without a scheme
+// are returned as-is.
+func parseHubURI(addr string) (string, string, error) {
+	if !strings.Contains(addr, "://") {
+		return addr, "", nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid hub address: %v", err)
+	}
+	if u.Hostname() == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.Fragment != "" {
+		return "", "", fmt.Errorf("invalid hub address: %q", addr)
+	}
+	base := u.Scheme + "://" + u.Host
+	kp := u.Query().Get("kp")
+	if kp == "" {
+		return base, "", nil
+	}
+	if u.Scheme+"://" != adcsSchema {
+		return "", "", fmt.Errorf("invalid hub address: %q: keyprint requires %s", addr, adcsSchema)
+	}
+	if !strings.HasPrefix(kp, adc.KeyprintPrefix) {
+		return "", "", fmt.Errorf("invalid hub address: %q: unsupported keyprint", addr)
+	}
+	return base, kp, nil
+}
+
+func ping(ctx context.Context, addr, kp string) (*HubInfo, error) {
 	// probe first, if protocol is not specified
+	// and reuse the connection of the probe, if possible
+	var conn *probedConn
 	i := strings.Index(addr, "://")
 	if i < 0 {
-		s, err := Probe(ctx, addr)
+		s, c, err := probe(ctx, addr)
 		if err != nil {
 			return nil, err
 		}
-		addr = s
+		addr, conn = s, c
 		i = strings.Index(addr, "://")
 	}
 
 	switch addr[:i+3] {
 	case nmdcSchema, nmdcsSchema:
-		hub, err := nmdc.Ping(ctx, addr)
+		hub, err := pingNMDC(ctx, addr, conn)
 		if err != nil {
 			return nil, err
 		}
@@ -51,7 +144,9 @@ func Ping(ctx context.Context, addr string) (*HubInfo, error) {
 			}
 		}
 
+		info.UserCount = len(hub.Users)
 		for _, u := range hub.Users {
+			info.Share += u.ShareSize
 			info.Users = append(info.Users, HubUser{
 				Name:  string(u.Name),
 				Share: u.ShareSize,
@@ -63,10 +158,96 @@ func Ping(ctx context.Context, addr string) (*HubInfo, error) {
 			})
 		}
 		return info, nil
+	case adcSchema, adcsSchema:
+		hub, err := pingADC(ctx, addr, kp, conn)
+		if err != nil {
+			return nil, err
+		}
+		info := &HubInfo{
+			Name:   hub.Name,
+			Desc:   hub.Desc,
+			Addr:   []string{addr},
+			Server: &Software{Name: hub.Version, Ext: hub.Ext},
+			Uptime: time.Duration(hub.Uptime) * time.Second,
+
+			UserCount: hub.Users,
+			Share:     uint64(hub.Share),
+		}
+		if i := strings.LastIndex(hub.Version, " "); i > 0 {
+			info.Server.Name, info.Server.Vers = hub.Version[:i], hub.Version[i+1:]
+		}
+		return info, nil
 	default:
-		// FIXME: ADC
-		return nil, fmt.Errorf("unsupported protocol: %q", addr)
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedProtocol, addr)
+	}
+}
+
+// pingNMDC pings the NMDC hub. If the probe connection is set, it's used instead of dialing again.
+func pingNMDC(ctx context.Context, addr string, conn *probedConn) (*nmdc.HubInfo, error) {
+	if conn == nil {
+		return nmdc.Ping(ctx, addr)
+	}
+	c, err := nmdc.NewConn(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	defer c.Close()
+	return nmdc.PingConn(ctx, c)
+}
+
+// pingADC pings the ADC hub. If the probe connection is set, it's used instead of dialing again.
+// If the keyprint is set, the hub certificate must match it.
+func pingADC(ctx context.Context, addr, kp string, conn *probedConn) (*adc.PingInfo, error) {
+	if kp != "" {
+		return pingADCS(ctx, strings.TrimPrefix(addr, adcsSchema), kp)
+	}
+	if conn == nil {
+		return adc.Ping(ctx, addr)
+	}
+	c, err := adc.NewConn(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	defer c.Close()
+	if conn.adcSent {
+		return adc.PingReply(ctx, c)
+	}
+	return adc.PingConn(ctx, c)
+}
+
+// pingADCS pings the ADCS hub with a given address (host:port) after checking its certificate keyprint.
+func pingADCS(ctx context.Context, addr, kp string) (*adc.PingInfo, error) {
+	conn, err := dialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(conn, &tls.Config{
+		// self-signed certificates are common, the keyprint is checked instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(certs [][]byte, _ [][]*x509.Certificate) error {
+			if len(certs) == 0 || adc.Keyprint(certs[0]) != kp {
+				return ErrKeyprintMismatch
+			}
+			return nil
+		},
+	})
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = tc.SetDeadline(deadline)
+	}
+	if err = tc.Handshake(); err != nil {
+		_ = tc.Close()
+		return nil, err
+	}
+	_ = tc.SetDeadline(time.Time{})
+	c, err := adc.NewConn(tc)
+	if err != nil {
+		_ = tc.Close()
+		return nil, err
 	}
+	defer c.Close()
+	return adc.PingConn(ctx, c)
 }
 
 type HubInfo struct {
@@ -76,6 +257,10 @@ type HubInfo struct {
 	Addr   []string      `json:"addr"`
 	Uptime time.Duration `json:"uptime"`
 	Users  []HubUser     `json:"users"`
+	// UserCount and Share are the number of users and their total share size. ADC hubs report them
+	// without sending the user list, so Users is only set for NMDC hubs.
+	UserCount int    `json:"user_count"`
+	Share     uint64 `json:"share"`
 }
 
 type HubUser struct {
@@ -0,0 +1,260 @@
+package dc
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+// serveHub serves the hub on a local port and returns the address.
+func serveHub(t *testing.T, h *hub.Hub) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go h.Serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestPingADC(t *testing.T) {
+	addr := serveHub(t, hub.New(hub.Config{Name: "test", Desc: "test hub"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	info, err := Ping(ctx, adcSchema+addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "test" || info.Desc != "test hub" {
+		t.Fatalf("unexpected hub info: %+v", info)
+	}
+	if exp := []string{"BAS0", "BASE", "PING", "TIGR", "UCMD"}; !reflect.DeepEqual(info.Server.Ext, exp) {
+		t.Fatalf("unexpected extensions: %q", info.Server.Ext)
+	}
+	if info.Uptime < 0 || info.Uptime > time.Minute {
+		t.Fatalf("unexpected uptime: %v", info.Uptime)
+	}
+}
+
+func newTestCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestPingKeyprint(t *testing.T) {
+	cert := newTestCert(t)
+	addr := serveHub(t, hub.New(hub.Config{
+		Name: "test",
+		TLS:  &tls.Config{Certificates: []tls.Certificate{cert}},
+	}))
+	kp := adc.Keyprint(cert.Certificate[0])
+	ping := func(uri string) (*HubInfo, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return Ping(ctx, uri)
+	}
+
+	for _, uri := range []string{
+		adcsSchema + addr,
+		adcsSchema + addr + "/?kp=" + kp,
+		adcsSchema + addr + "?kp=" + kp + "&foo=bar",
+	} {
+		info, err := ping(uri)
+		if err != nil {
+			t.Fatalf("%s: %v", uri, err)
+		}
+		if info.Name != "test" || info.Addr[0] != adcsSchema+addr {
+			t.Fatalf("%s: unexpected hub info: %+v", uri, info)
+		}
+	}
+
+	other := adc.Keyprint(newTestCert(t).Certificate[0])
+	_, err := ping(adcsSchema + addr + "/?kp=" + other)
+	if !errors.Is(err, ErrKeyprintMismatch) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestPingInvalidAddr(t *testing.T) {
+	for _, uri := range []string{
+		"adc://",
+		"adc://:411",
+		"adc://exa mple.com:411",
+		"adc://example.com:abc",
+		"adc://example.com:411/path",
+		"adc://user@example.com:411",
+		"adc://example.com:411/?kp=SHA256/ABC",
+		"adcs://example.com:411/?kp=MD5/ABC",
+	} {
+		_, err := Ping(context.Background(), uri)
+		if err == nil {
+			t.Fatalf("%s: expected an error", uri)
+		}
+		var (
+			pe *Error
+			ne net.Error
+		)
+		if errors.As(err, &pe) || errors.As(err, &ne) || !strings.HasPrefix(err.Error(), "invalid hub address") {
+			t.Fatalf("%s: unexpected error: %v", uri, err)
+		}
+	}
+}
+
+// serveConns accepts connections on a local port and handles them with fnc.
+// It returns the address and the counter of accepted connections.
+func serveConns(t *testing.T, fnc func(c net.Conn)) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var cnt int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&cnt, 1)
+			go func() {
+				defer conn.Close()
+				fnc(conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), &cnt
+}
+
+func TestPingErrors(t *testing.T) {
+	serve := func(fnc func(c net.Conn)) string {
+		addr, _ := serveConns(t, fnc)
+		return addr
+	}
+	ping := func(addr string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := Ping(ctx, addr)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		return err
+	}
+
+	err := ping("foo://127.0.0.1:411")
+	if !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	silent := serve(func(c net.Conn) {
+		_, _ = io.Copy(ioutil.Discard, c)
+	})
+	err = ping(adcSchema + silent)
+	if !errors.Is(err, ErrPingTimeout) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("expected the cause to be kept: %#v", err)
+	}
+
+	bogus := serve(func(c net.Conn) {
+		_, _ = c.Write([]byte("ISTA 000 hello\n"))
+		_, _ = io.Copy(ioutil.Discard, c)
+	})
+	err = ping(adcSchema + bogus)
+	if !errors.Is(err, ErrProtocol) || errors.Is(err, ErrPingTimeout) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+	err = ping(adcSchema + closed)
+	var pe *Error
+	if errors.As(err, &pe) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !errors.As(err, &ne) {
+		t.Fatalf("expected a network error: %#v", err)
+	}
+}
+
+func TestPingReuseProbe(t *testing.T) {
+	nmdcAddr, nmdcConns := serveConns(t, func(c net.Conn) {
+		// fake NMDC hub that greets the user and quits right away
+		_, _ = c.Write([]byte("$Lock EXTENDEDPROTOCOL_fake Pk=fake|$HubName fake|$Quit fake|"))
+		_, _ = io.Copy(ioutil.Discard, c)
+	})
+	adcAddr, adcConns := serveConns(t, func(c net.Conn) {
+		// fake ADC hub that only supports pingers
+		r := bufio.NewReader(c)
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.Contains(line, "ADPING") {
+			return
+		}
+		_, _ = c.Write([]byte("ISUP ADBASE ADTIGR ADPING\nISID AAAB\nIINF NIfake\n"))
+		_, _ = io.Copy(ioutil.Discard, r)
+	})
+
+	for _, c := range []struct {
+		addr  string
+		conns *int32
+		name  string
+	}{
+		{nmdcAddr, nmdcConns, "fake"},
+		{adcAddr, adcConns, "fake"},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		info, err := Ping(ctx, c.addr)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != c.name {
+			t.Fatalf("unexpected hub info: %+v", info)
+		}
+		if n := atomic.LoadInt32(c.conns); n != 1 {
+			t.Fatalf("expected a single connection, got %d", n)
+		}
+	}
+}
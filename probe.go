@@ -1,9 +1,11 @@
 package dc
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
+	"io"
 	"log"
 	"net"
 	"strings"
@@ -15,6 +17,9 @@ import (
 
 var (
 	ErrUnsupportedProtocol = errors.New("unsupported protocol")
+	ErrPingTimeout         = errors.New("ping timeout")
+	ErrProtocol            = errors.New("protocol error")
+	ErrKeyprintMismatch    = errors.New("hub certificate doesn't match the keyprint")
 )
 
 type timeoutErr interface {
@@ -37,22 +42,73 @@ func dialContext(ctx context.Context, addr string) (net.Conn, error) {
 	return net.DialTimeout("tcp", addr, timeout)
 }
 
+// probedConn is a connection that was used to detect the protocol.
+// It replays the data read by the probe.
+type probedConn struct {
+	net.Conn
+	r io.Reader
+	// adcSent is set if the ADC pinger handshake was sent on the connection.
+	adcSent bool
+}
+
+func newProbedConn(c net.Conn, read []byte, adcSent bool) (*probedConn, error) {
+	// reset deadlines set by the probe
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	read = append([]byte{}, read...)
+	return &probedConn{
+		Conn:    c,
+		r:       io.MultiReader(bytes.NewReader(read), c),
+		adcSent: adcSent,
+	}, nil
+}
+
+func (c *probedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
 // Probe tries to detect the protocol on a specified host or host:port.
 // It returns a canonical address with an appropriate URI scheme.
 func Probe(ctx context.Context, addr string) (string, error) {
+	addr, c, err := probe(ctx, addr)
+	if c != nil {
+		_ = c.Close()
+	}
+	return addr, err
+}
+
+// probe is like Probe, but also returns the connection, if it can be used for the ping.
+// Otherwise, the returned connection is nil, and the caller should dial again.
+func probe(ctx context.Context, addr string) (string, *probedConn, error) {
 	if _, port, _ := net.SplitHostPort(addr); port == "" {
 		addr += ":411" // TODO: should also try 412, 413, etc
 	}
 
 	c, err := dialContext(ctx, addr)
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+	// the connection may be replaced by TLS below
+	keep := false
+	defer func() {
+		if !keep {
+			_ = c.Close()
+		}
+	}()
+	// reuse returns the connection to the caller instead of closing it
+	reuse := func(schema string, read []byte, adcSent bool) (string, *probedConn, error) {
+		pc, err := newProbedConn(c, read, adcSent)
+		if err != nil {
+			return "", nil, err
+		}
+		keep = true
+		return schema + addr, pc, nil
 	}
-	defer c.Close()
 
 	if strings.Contains(addr, "://") {
 		// only probe for open port
-		return addr, nil
+		return addr, nil, nil
 	}
 
 	now := time.Now()
@@ -61,7 +117,7 @@ func Probe(ctx context.Context, addr string) (string, error) {
 	if deadline, ok := ctx.Deadline(); ok {
 		sub := deadline.Sub(now)
 		if sub < 0 {
-			return "", context.DeadlineExceeded
+			return "", nil, context.DeadlineExceeded
 		}
 		if dt > sub/3 {
 			dt = sub / 3
@@ -69,7 +125,7 @@ func Probe(ctx context.Context, addr string) (string, error) {
 	}
 
 	if err = c.SetReadDeadline(now.Add(dt)); err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	buf := make([]byte, 6)
@@ -77,39 +133,39 @@ func Probe(ctx context.Context, addr string) (string, error) {
 	if err == nil {
 		// may be NMDC protocol where server speaks first
 		if string(buf[:n]) == "$Lock " {
-			return nmdcSchema + addr, nil
+			return reuse(nmdcSchema, buf[:n], false)
 		}
-		return "", ErrUnsupportedProtocol
+		return "", nil, ErrUnsupportedProtocol
 	}
 	te, ok := err.(timeoutErr)
 	if !ok || !te.Timeout() {
-		return "", err
+		return "", nil, err
 	}
 	// timeout, server expects that we speak first
 
 	now = time.Now()
 	curDeadline := now.Add(dt)
 
-	// pretend that we speak a base version of ADC
-	const adcHandshake = "HSUP ADBAS0 ADBASE ADTIGR\x0a"
+	// pretend that we are an ADC pinger, so the connection can be reused for the ping
+	const adcHandshake = "HSUP ADBAS0 ADBASE ADTIGR ADPING\x0a"
 	if err = c.SetWriteDeadline(curDeadline); err != nil {
-		return "", err
+		return "", nil, err
 	}
 	_, err = c.Write([]byte(adcHandshake))
 	if err != nil {
 		// FIXME: server may drop the connection earlier, since we waited too long
-		return "", err
+		return "", nil, err
 	}
 	if err = c.SetReadDeadline(curDeadline); err != nil {
-		return "", err
+		return "", nil, err
 	}
 	buf = buf[:5]
 	n, err = c.Read(buf)
 	if err == nil {
 		if string(buf[:n]) == "ISUP " {
-			return adcSchema + addr, nil
+			return reuse(adcSchema, buf[:n], true)
 		}
-		return "", ErrUnsupportedProtocol
+		return "", nil, ErrUnsupportedProtocol
 	}
 
 	// this may sill be ADCS (ADC over TLS), but we broke the connection already
@@ -118,24 +174,24 @@ func Probe(ctx context.Context, addr string) (string, error) {
 	// connect again, use (insecure) TLS this time
 	c, err = dialContext(ctx, addr)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	tc := tls.Client(c, &tls.Config{
 		InsecureSkipVerify: true,
 		NextProtos:         []string{"adc", "nmdc"},
 	})
-	defer tc.Close()
+	c = tc
 	if err = tc.Handshake(); err != nil {
-		return "", ErrUnsupportedProtocol
+		return "", nil, ErrUnsupportedProtocol
 	}
 
 	// first, check if ALPN handshake was successful
 	state := tc.ConnectionState()
 	switch state.NegotiatedProtocol {
 	case "adc":
-		return adcsSchema + addr, nil
+		return reuse(adcsSchema, nil, false)
 	case "nmdc":
-		return nmdcsSchema + addr, nil
+		return reuse(nmdcsSchema, nil, false)
 	}
 
 	now = time.Now()
@@ -143,20 +199,20 @@ func Probe(ctx context.Context, addr string) (string, error) {
 
 	// repeat ADC handshake over TLS this time
 	if err = tc.SetWriteDeadline(curDeadline); err != nil {
-		return "", err
+		return "", nil, err
 	}
 	_, err = tc.Write([]byte(adcHandshake))
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	if err = tc.SetReadDeadline(curDeadline); err != nil {
-		return "", err
+		return "", nil, err
 	}
 	buf = buf[:5]
 	n, err = tc.Read(buf)
 	if err == nil && string(buf[:n]) == "ISUP " {
-		return adcsSchema + addr, nil
+		return reuse(adcsSchema, buf[:n], true)
 	}
 	log.Println(err, string(buf))
-	return "", ErrUnsupportedProtocol
+	return "", nil, ErrUnsupportedProtocol
 }